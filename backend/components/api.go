@@ -0,0 +1,286 @@
+package components
+
+import (
+	"encoding/json"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	apigateway "github.com/aws/aws-cdk-go/awscdk/v2/awsapigatewayv2"
+	dynamodb "github.com/aws/aws-cdk-go/awscdk/v2/awsdynamodb"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
+	awslambdago "github.com/aws/aws-cdk-go/awscdklambdagoalpha/v2"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// The name of the global secondary index used to query the transactions.
+const fraudIndexName = "isFraud-transactionDateTime-index"
+
+// The authorization types of the routes. The routes changing the ingested
+// data require requests signed with AWS credentials allowed to call them.
+const (
+	authorizationNone = "NONE"
+	authorizationIAM  = "AWS_IAM"
+)
+
+// The route key of the upload route, and the requests per second it is
+// throttled to as the browsers call it without credentials.
+const (
+	uploadRouteKey        = "POST /uploads"
+	uploadThrottlingRate  = 5
+	uploadThrottlingBurst = 10
+)
+
+// TransactionsAPIProps are the settings of a TransactionsAPI.
+type TransactionsAPIProps struct {
+	// The prefix used to name the API.
+	ProjectPrefix string
+
+	// The table holding the transactions, the API adds the index it queries to it.
+	Table dynamodb.Table
+
+	// The tables of the ingestion rules keyed by name, which a request names
+	// with its table query parameter. The API adds the index it queries to
+	// each of them, and cannot reach the other tables of the account.
+	Tables map[string]dynamodb.Table
+
+	// The origins allowed to call the API from a browser. Defaults to any origin.
+	CorsOrigins []string
+
+	// The settings of the lambda functions.
+	Function FunctionOptions
+
+	// The lambda replaying archived files into the ingestion pipeline, if any.
+	ReplayFunction awslambda.IFunction
+
+	// The table recording the state of the ingestions, if any.
+	IngestionsTable dynamodb.Table
+
+	// The lambda signing the URLs the files are uploaded to, if any.
+	UploadFunction awslambda.IFunction
+
+	// Whether the API, its stage and its first routes keep the logical ids
+	// they had when they were defined in the stack itself, so the stacks
+	// deployed before the split keep the URL of their API.
+	LegacyLogicalIDs bool
+}
+
+// TransactionsAPI is the HTTP API used by the frontend to query and update
+// the transactions loaded into the table.
+type TransactionsAPI struct {
+	constructs.Construct
+
+	// The HTTP API.
+	API apigateway.CfnApi
+
+	// The stage the API is deployed to.
+	Stage apigateway.CfnStage
+
+	// The lambda that queries the transactions.
+	QueryFunction awslambdago.GoFunction
+
+	// The lambda that updates a transaction.
+	UpdateFunction awslambdago.GoFunction
+
+	// The lambda that lists or deletes the transactions of a source file.
+	SourceFunction awslambdago.GoFunction
+
+	// The lambda that returns the state of the ingestions, when the API is
+	// given their table.
+	StatusFunction awslambdago.GoFunction
+}
+
+// NewTransactionsAPI creates the API Gateway, its routes and the lambdas
+// backing them.
+func NewTransactionsAPI(scope constructs.Construct, id string, props *TransactionsAPIProps) *TransactionsAPI {
+	corsOrigins := props.CorsOrigins
+	if len(corsOrigins) == 0 {
+		corsOrigins = []string{"*"}
+	}
+
+	construct := constructs.NewConstruct(scope, &id)
+	this := &TransactionsAPI{Construct: construct}
+
+	// The tables the requests can name, sorted so the grants keep their order.
+	tables := map[string]dynamodb.Table{defaultName: props.Table}
+	for name, table := range props.Tables {
+		tables[name] = table
+	}
+	names := []string{}
+	for name := range tables {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	tableNames := map[string]*string{}
+	for _, name := range names {
+		tableNames[name] = tables[name].TableName()
+	}
+	tablesJSON, err := json.Marshal(tableNames)
+	if err != nil {
+		panic(err)
+	}
+
+	// Create a new lambda function to query the table.
+	this.QueryFunction = newGoFunction(construct, "QueryLambda", "lambdas/dynamo-query", props.Function, map[string]*string{
+		"TABLE_NAME": props.Table.TableName(),
+		"TABLES":     jsii.String(string(tablesJSON)),
+		"INDEX_NAME": jsii.String(fraudIndexName),
+	})
+
+	// Create a new lambda function to update the table.
+	this.UpdateFunction = newGoFunction(construct, "UpdateLambda", "lambdas/dynamo-update", props.Function, map[string]*string{
+		"TABLE_NAME": props.Table.TableName(),
+		"TABLES":     jsii.String(string(tablesJSON)),
+	})
+
+	// Create a new lambda function to list or delete the transactions of a
+	// file, found by the source index of the table.
+	this.SourceFunction = newGoFunction(construct, "SourceLambda", "lambdas/dynamo-source", props.Function, map[string]*string{
+		"TABLE_NAME": props.Table.TableName(),
+		"TABLES":     jsii.String(string(tablesJSON)),
+		"INDEX_NAME": jsii.String(sourceIndexName),
+	})
+
+	indexed := map[string]bool{}
+	for _, name := range names {
+		table := tables[name]
+		if indexed[*table.Node().Path()] {
+			continue
+		}
+		indexed[*table.Node().Path()] = true
+
+		// Add global secondary index to the table for transactionDateTime and isFraud.
+		// This is done so that we can query the table for all transactions that occurred
+		// on a specific date and whether or not the transaction was fraudulent.
+		table.AddGlobalSecondaryIndex(&dynamodb.GlobalSecondaryIndexProps{
+			IndexName: jsii.String(fraudIndexName),
+			PartitionKey: &dynamodb.Attribute{
+				Name: jsii.String("isFraud"),
+				Type: dynamodb.AttributeType_STRING,
+			},
+			SortKey: &dynamodb.Attribute{
+				Name: jsii.String("transactionDateTime"),
+				Type: dynamodb.AttributeType_STRING,
+			},
+			ProjectionType: dynamodb.ProjectionType_ALL,
+		})
+
+		// Grant the lambda functions read access to the table to query it, and
+		// read write access to update its transactions or delete those of a file.
+		table.GrantReadData(this.QueryFunction)
+		table.GrantReadWriteData(this.UpdateFunction)
+		table.GrantReadWriteData(this.SourceFunction)
+	}
+
+	// Create a new lambda function to return the state of the ingestions.
+	if props.IngestionsTable != nil {
+		this.StatusFunction = newGoFunction(construct, "StatusLambda", "lambdas/ingestion-status", props.Function, map[string]*string{
+			"TABLE_NAME": props.IngestionsTable.TableName(),
+		})
+
+		// Grant the lambda function read access to the table.
+		props.IngestionsTable.GrantReadData(this.StatusFunction)
+	}
+
+	// Create a new API Gateway.
+	this.API = apigateway.NewCfnApi(construct, jsii.String("API"), &apigateway.CfnApiProps{
+		CorsConfiguration: &apigateway.CfnApi_CorsProperty{
+			AllowHeaders:  jsii.Strings("*"),
+			AllowMethods:  jsii.Strings("GET", "POST", "PUT", "DELETE", "OPTIONS"),
+			AllowOrigins:  jsii.Strings(corsOrigins...),
+			ExposeHeaders: jsii.Strings("*"),
+		},
+		Name:         jsii.String(strings.Join([]string{props.ProjectPrefix, `api`}, `-`)),
+		ProtocolType: jsii.String("HTTP"),
+	})
+
+	// Get transactions route.
+	this.addRoute("GetAllTransactions", "GET /transactions", authorizationNone, this.QueryFunction)
+
+	// Update transaction route.
+	this.addRoute("UpdateTransaction", "PUT /transactions/{id}", authorizationNone, this.UpdateFunction)
+
+	// Source file transactions routes, signed as they delete transactions.
+	this.addRoute("GetSourceTransactions", "GET /sources/transactions", authorizationIAM, this.SourceFunction)
+	this.addRoute("DeleteSourceTransactions", "DELETE /sources/transactions", authorizationIAM, this.SourceFunction)
+
+	// Ingestion status routes.
+	if this.StatusFunction != nil {
+		this.addRoute("GetIngestions", "GET /ingestions", authorizationNone, this.StatusFunction)
+		this.addRoute("GetIngestion", "GET /ingestions/{id}", authorizationNone, this.StatusFunction)
+	}
+
+	// Upload route, called by the browsers without credentials. The lambda
+	// only signs URLs under the prefixes of the rules for the files their
+	// rule accepts, and the route is throttled.
+	if props.UploadFunction != nil {
+		this.addRoute("CreateUpload", uploadRouteKey, authorizationNone, props.UploadFunction)
+	}
+
+	// Replay ingestions route, signed as it loads files again.
+	if props.ReplayFunction != nil {
+		this.addRoute("ReplayIngestions", "POST /ingestions/replay", authorizationIAM, props.ReplayFunction)
+	}
+
+	// Create a new stage for the API Gateway. The route settings are passed
+	// to CloudFormation as is, with the names of its properties.
+	routeSettings := map[string]interface{}{}
+	if props.UploadFunction != nil {
+		routeSettings[uploadRouteKey] = map[string]interface{}{
+			"ThrottlingRateLimit":  uploadThrottlingRate,
+			"ThrottlingBurstLimit": uploadThrottlingBurst,
+		}
+	}
+	this.Stage = apigateway.NewCfnStage(construct, jsii.String("Stage"), &apigateway.CfnStageProps{
+		ApiId:         this.API.Ref(),
+		StageName:     jsii.String("v1"),
+		AutoDeploy:    jsii.Bool(true),
+		RouteSettings: routeSettings,
+	})
+
+	// Keep the logical ids the API had in the stack. The routes keep theirs
+	// too, as a route is created before the one it replaces is deleted and
+	// an API cannot have two routes with the same key.
+	if props.LegacyLogicalIDs {
+		overrideLogicalID(this.API, "API")
+		overrideLogicalID(this.Stage, "Stage")
+		overrideLogicalID(construct, "QueryIntegration", "GetAllTransactionsIntegration")
+		overrideLogicalID(construct, "GetAllTransactionsResource", "GetAllTransactionsRoute")
+		overrideLogicalID(construct, "UpdateIntegration", "UpdateTransactionIntegration")
+		overrideLogicalID(construct, "UpdateTransactionsResource", "UpdateTransactionRoute")
+	}
+
+	return this
+}
+
+// URL returns the URL of the deployed stage of the API.
+func (a *TransactionsAPI) URL() *string {
+	stack := awscdk.Stack_Of(a.Construct)
+	return jsii.String("https://" + *a.API.Ref() + ".execute-api." + *stack.Region() + ".amazonaws.com/" + *a.Stage.StageName())
+}
+
+// Adds a route to the API that is integrated with the given lambda function,
+// the name is used to name the resources created for the route.
+func (a *TransactionsAPI) addRoute(name string, routeKey string, authorizationType string, function awslambda.IFunction) {
+	stack := awscdk.Stack_Of(a.Construct)
+
+	integration := apigateway.NewCfnIntegration(a.Construct, jsii.String(name+"Integration"), &apigateway.CfnIntegrationProps{
+		ApiId:                a.API.Ref(),
+		IntegrationUri:       function.FunctionArn(),
+		IntegrationType:      jsii.String("AWS_PROXY"),
+		PayloadFormatVersion: jsii.String("1.0"),
+	})
+	apigateway.NewCfnRoute(a.Construct, jsii.String(name+"Route"), &apigateway.CfnRouteProps{
+		ApiId:             a.API.Ref(),
+		AuthorizationType: jsii.String(authorizationType),
+		Target:            jsii.String("integrations/" + *integration.Ref()),
+		RouteKey:          jsii.String(routeKey),
+	})
+	function.AddPermission(jsii.String(name+"Permission"), &awslambda.Permission{
+		Action:    jsii.String("lambda:InvokeFunction"),
+		Principal: awsiam.NewServicePrincipal(jsii.String("apigateway.amazonaws.com"), nil),
+		SourceArn: jsii.String("arn:aws:execute-api:" + *stack.Region() + ":" + *stack.Account() + ":" + *a.API.Ref() + "/*"),
+	})
+}
@@ -0,0 +1,97 @@
+package components
+
+import (
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
+	s3 "github.com/aws/aws-cdk-go/awscdk/v2/awss3"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// StaticFrontendProps are the settings of a StaticFrontend.
+type StaticFrontendProps struct {
+	// The document served for the root of the website and for unknown paths,
+	// which is needed for single page apps. Defaults to "index.html".
+	IndexDocument string
+
+	// What happens to the bucket when it is removed from the stack. Defaults
+	// to retaining it.
+	RemovalPolicy awscdk.RemovalPolicy
+
+	// Whether the objects of the bucket are deleted when it is destroyed, only
+	// allowed with the destroy removal policy.
+	AutoDeleteObjects bool
+
+	// Whether the bucket keeps the logical id it had when it was defined in
+	// the stack itself, so the stacks deployed before the split update it
+	// instead of replacing it.
+	LegacyLogicalIDs bool
+}
+
+// StaticFrontend is the public website bucket the frontend is deployed to.
+type StaticFrontend struct {
+	constructs.Construct
+
+	// The bucket hosting the website.
+	Bucket s3.Bucket
+}
+
+// NewStaticFrontend creates the bucket hosting the frontend and makes it
+// publicly readable.
+func NewStaticFrontend(scope constructs.Construct, id string, props *StaticFrontendProps) *StaticFrontend {
+	if props == nil {
+		props = &StaticFrontendProps{}
+	}
+	indexDocument := props.IndexDocument
+	if indexDocument == "" {
+		indexDocument = "index.html"
+	}
+	removalPolicy := props.RemovalPolicy
+	if removalPolicy == "" {
+		removalPolicy = awscdk.RemovalPolicy_RETAIN
+	}
+
+	construct := constructs.NewConstruct(scope, &id)
+	this := &StaticFrontend{Construct: construct}
+
+	// Create a new S3 bucket to store the frontend.
+	this.Bucket = s3.NewBucket(construct, jsii.String("FrontendBucket"), &s3.BucketProps{
+		Encryption:           s3.BucketEncryption_S3_MANAGED,
+		RemovalPolicy:        removalPolicy,
+		AutoDeleteObjects:    jsii.Bool(props.AutoDeleteObjects),
+		WebsiteIndexDocument: jsii.String(indexDocument),
+
+		// This is needed for single page apps.
+		WebsiteErrorDocument: jsii.String(indexDocument),
+
+		// Allow public access to the frontend.
+		BlockPublicAccess: s3.NewBlockPublicAccess(&s3.BlockPublicAccessOptions{
+			BlockPublicPolicy: jsii.Bool(false),
+		}),
+	})
+
+	// A bucket policy is needed to allow public access to the frontend.
+	// This is not recommended for production applications. Instead, you should
+	// use CloudFront to serve the frontend.
+	this.Bucket.AddToResourcePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Effect: awsiam.Effect_ALLOW,
+		Actions: jsii.Strings(
+			"s3:GetObject",
+		),
+		Principals: &[]awsiam.IPrincipal{
+			awsiam.NewAnyPrincipal(),
+		},
+		Resources: jsii.Strings(
+			*this.Bucket.BucketArn() + `/*`,
+		),
+	}))
+
+	// Keep the logical ids the bucket and its resources had in the stack.
+	if props.LegacyLogicalIDs {
+		overrideLogicalID(this.Bucket, "FrontendBucketEFE2E19C")
+		overrideLogicalID(this.Bucket, "FrontendBucketPolicy1DFF75D9", "Policy")
+		overrideLogicalID(this.Bucket, "FrontendBucketAutoDeleteObjectsCustomResourceDB860B32", "AutoDeleteObjectsCustomResource")
+	}
+
+	return this
+}
@@ -0,0 +1,804 @@
+package components
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+
+	"go-cdk-workshop/internal/rules"
+	"go-cdk-workshop/internal/schema"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	dynamodb "github.com/aws/aws-cdk-go/awscdk/v2/awsdynamodb"
+	events "github.com/aws/aws-cdk-go/awscdk/v2/awsevents"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awseventstargets"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslambdaeventsources"
+	s3 "github.com/aws/aws-cdk-go/awscdk/v2/awss3"
+	sns "github.com/aws/aws-cdk-go/awscdk/v2/awssns"
+	sqs "github.com/aws/aws-cdk-go/awscdk/v2/awssqs"
+	glue "github.com/aws/aws-cdk-go/awscdkgluealpha/v2"
+	awslambdago "github.com/aws/aws-cdk-go/awscdklambdagoalpha/v2"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+const (
+	// The prefix the Glue job writes the rows that fail validation to, per job run.
+	rejectedPrefix = "rejected/"
+
+	// The prefix the Glue job writes the accepted and rejected row counts of
+	// each job run to, read by the archive lambda.
+	statsPrefix = "stats/"
+
+	// The name of the job and table used by the rules that do not name one.
+	defaultName = "default"
+
+	// The number of times an upload event is received from the ingest queue
+	// before it is sent to the dead-letter queue, the uploads whose workflow
+	// could not be started are received again once their visibility timeout
+	// expires.
+	ingestMaxReceiveCount = 10
+)
+
+// IngestionPipelineProps are the settings of an IngestionPipeline.
+type IngestionPipelineProps struct {
+	// The prefix used to name the state machine of the ingestion workflow.
+	// Defaults to the name of the stack.
+	ProjectPrefix string
+
+	// How long the ingestion workflow waits between two checks of the job
+	// run. Defaults to 1 minute.
+	PollInterval awscdk.Duration
+
+	// The prefix uploaded files must be under to be processed. Defaults to "input/".
+	KeyPrefix string
+
+	// The number of parallel tasks the Glue job uses to write to the table. Defaults to 8.
+	Workers int
+
+	// What happens to the bucket and the table when they are removed from the
+	// stack. Defaults to retaining them.
+	RemovalPolicy awscdk.RemovalPolicy
+
+	// Whether the objects of the bucket are deleted when it is destroyed, only
+	// allowed with the destroy removal policy.
+	AutoDeleteObjects bool
+
+	// Whether point-in-time recovery is enabled on the table.
+	PointInTimeRecovery bool
+
+	// Whether the bucket keeps the previous versions of its objects.
+	Versioned bool
+
+	// How long the previous versions of the objects are kept for when the
+	// bucket is versioned. Defaults to keeping them forever.
+	NoncurrentVersionExpiration awscdk.Duration
+
+	// The settings of the lambda functions.
+	Function FunctionOptions
+
+	// The number of times the EventBridge rules retry an event the lambdas
+	// failed to process before sending it to their dead-letter queue.
+	// Defaults to 185, the default of EventBridge.
+	RetryAttempts *float64
+
+	// The maximum age of an event before the EventBridge rules stop retrying
+	// it and send it to the dead-letter queue. Defaults to 24 hours.
+	MaxEventAge awscdk.Duration
+
+	// The topic the outcome of each ingestion is published to, required by
+	// the "sns" notification channel.
+	NotificationTopic sns.ITopic
+
+	// The channels the outcome of each ingestion is published to: "sns",
+	// "webhook" and "log". Defaults to "sns" when there is a topic.
+	NotificationChannels []string
+
+	// The Slack-style incoming webhook used by the "webhook" channel.
+	NotificationWebhookURL string
+
+	// The template of the key a processed file is moved to. Defaults to
+	// "{folder}/{yyyy}/{mm}/{dd}/{runId}/{path}".
+	ArchiveKeyTemplate string
+
+	// The rules deciding which uploaded files are ingested and by which job
+	// and table. Defaults to the .csv files under the key prefix.
+	Rules []rules.Rule
+
+	// The origins allowed to upload files from a browser with the upload
+	// URLs. Uploads from a browser are not allowed when empty.
+	UploadCorsOrigins []string
+
+	// The maximum number of uploads loaded by a single job run. Defaults to 10.
+	BatchSize int
+
+	// How long the uploads are gathered for before a job run is started.
+	// Defaults to none, required when the batch size is over 10.
+	BatchWindow awscdk.Duration
+
+	// Whether the bucket and the table keep the logical ids they had when
+	// they were defined in the stack itself, so the stacks deployed before
+	// the split update them instead of replacing them. Only one pipeline of
+	// a stack can keep them.
+	LegacyLogicalIDs bool
+}
+
+// IngestionPipeline is the ETL pipeline that loads the CSV files uploaded to
+// the data bucket into the transactions table.
+//
+// A file uploaded under the key prefix is sent to the ingest queue, the
+// glue-trigger lambda receives the uploads in batches and starts an execution
+// of the ingestion workflow per batch, see IngestionWorkflow. Once the Glue
+// job run finishes the move-to-archive lambda moves its files to the
+// archive/ or failed/ folder of the bucket.
+type IngestionPipeline struct {
+	constructs.Construct
+
+	// The bucket the files are uploaded to.
+	Bucket s3.Bucket
+
+	// The table the transactions are loaded into.
+	Table dynamodb.Table
+
+	// The Glue job that transforms and loads the files.
+	Job glue.Job
+
+	// The jobs and tables used by the rules keyed by their name, the default
+	// job and table included.
+	Jobs   map[string]glue.Job
+	Tables map[string]dynamodb.Table
+
+	// The ARNs of the jobs, the default job included.
+	JobArns []*string
+
+	// The table recording how each file was loaded and whether it reconciles
+	// with the items written to its table.
+	Ledger dynamodb.Table
+
+	// The table recording the state of each ingestion, for the status API.
+	Ingestions dynamodb.Table
+
+	// The queue buffering the upload events, so the uploads are coalesced
+	// into job runs.
+	IngestQueue sqs.Queue
+
+	// The queue holding back the start steps of the ingestion workflow while
+	// Glue is busy, until the trigger lambda retries them.
+	DelayQueue sqs.Queue
+
+	// The lambda that starts the Glue job when files are uploaded.
+	TriggerFunction awslambdago.GoFunction
+
+	// The lambda that moves the processed files once the Glue job finishes.
+	ArchiveFunction awslambdago.GoFunction
+
+	// The queue receiving the upload events that could not be sent to the
+	// ingest queue, or that the trigger lambda failed to process.
+	TriggerDeadLetterQueue sqs.Queue
+
+	// The queue receiving the archive steps of the ingestion workflow that failed.
+	ArchiveDeadLetterQueue sqs.Queue
+
+	// The lambda that replays the dead-letter queues through the lambdas.
+	RedriveFunction awslambdago.GoFunction
+
+	// The lambda that removes the items of a bad load and moves its files
+	// back to the failed folder.
+	RollbackFunction awslambdago.GoFunction
+	// The lambda that copies archived or failed files back to the keys they
+	// were uploaded to, so they are ingested again.
+	ReplayFunction awslambdago.GoFunction
+	// The lambda that signs the URLs the files are uploaded to without AWS
+	// credentials.
+	UploadFunction awslambdago.GoFunction
+
+	// The state machine loading each batch of uploads, started by the
+	// trigger lambda.
+	Workflow *IngestionWorkflow
+}
+
+// NewIngestionPipeline creates the bucket, table, Glue job and lambdas of the
+// ingestion pipeline.
+func NewIngestionPipeline(scope constructs.Construct, id string, props *IngestionPipelineProps) *IngestionPipeline {
+	if props == nil {
+		props = &IngestionPipelineProps{}
+	}
+	keyPrefix := props.KeyPrefix
+	if keyPrefix == "" {
+		keyPrefix = "input/"
+	}
+	// Copy the rules as the names of their jobs and tables are filled in.
+	ingestionRules := append([]rules.Rule{}, props.Rules...)
+	if len(ingestionRules) == 0 {
+		ingestionRules = []rules.Rule{{Name: defaultName, Prefix: keyPrefix, Extensions: rules.DefaultExtensions}}
+	}
+	workers := props.Workers
+	if workers == 0 {
+		workers = 8
+	}
+	batchSize := props.BatchSize
+	if batchSize == 0 {
+		batchSize = 10
+	}
+	maxEventAge := props.MaxEventAge
+	if maxEventAge == nil {
+		maxEventAge = awscdk.Duration_Hours(jsii.Number(24))
+	}
+	notificationChannels := props.NotificationChannels
+	if notificationChannels == nil && props.NotificationTopic != nil {
+		notificationChannels = []string{"sns"}
+	}
+	removalPolicy := props.RemovalPolicy
+	if removalPolicy == "" {
+		removalPolicy = awscdk.RemovalPolicy_RETAIN
+	}
+
+	construct := constructs.NewConstruct(scope, &id)
+	this := &IngestionPipeline{Construct: construct}
+
+	// Clean up the parts of the multipart copies the archive lambda did not
+	// complete, e.g. when it timed out.
+	lifecycleRules := []*s3.LifecycleRule{
+		{AbortIncompleteMultipartUploadAfter: awscdk.Duration_Days(jsii.Number(1))},
+	}
+
+	// Expire the previous versions of the objects, if the bucket keeps them.
+	if props.Versioned && props.NoncurrentVersionExpiration != nil {
+		lifecycleRules = append(lifecycleRules, &s3.LifecycleRule{
+			NoncurrentVersionExpiration: props.NoncurrentVersionExpiration,
+		})
+	}
+
+	// Create a new S3 bucket
+	this.Bucket = s3.NewBucket(construct, jsii.String(`Bucket`), &s3.BucketProps{
+		Encryption:         s3.BucketEncryption_S3_MANAGED,
+		RemovalPolicy:      removalPolicy,
+		EventBridgeEnabled: jsii.Bool(true),
+		AutoDeleteObjects:  jsii.Bool(props.AutoDeleteObjects),
+		Versioned:          jsii.Bool(props.Versioned),
+		LifecycleRules:     &lifecycleRules,
+	})
+
+	// Allow the browsers to send the files to the upload URLs, the ETags of
+	// the parts are read to complete the uploads in parts and an upload in
+	// parts is aborted with a DELETE. CORS grants no access, the browsers
+	// only send the requests signed by the upload lambda, whose role can
+	// abort its uploads but not delete files.
+	if len(props.UploadCorsOrigins) > 0 {
+		this.Bucket.AddCorsRule(&s3.CorsRule{
+			AllowedMethods: &[]s3.HttpMethods{s3.HttpMethods_PUT, s3.HttpMethods_POST, s3.HttpMethods_DELETE},
+			AllowedOrigins: jsii.Strings(props.UploadCorsOrigins...),
+			AllowedHeaders: jsii.Strings("*"),
+			ExposedHeaders: jsii.Strings("ETag"),
+		})
+	}
+
+	// Create a new Glue job.
+	this.Job = this.newJob("PythonETLJob")
+
+	// Create a new DynamoDB table to store the results of the Glue job.
+	this.Table = newTransactionsTable(construct, "Table", removalPolicy, props.PointInTimeRecovery)
+
+	// Create the other jobs and tables the rules load their files with, and
+	// resolve the deployed names of the jobs and tables of each rule.
+	this.Jobs = map[string]glue.Job{defaultName: this.Job}
+	this.Tables = map[string]dynamodb.Table{defaultName: this.Table}
+	jobNames := []string{defaultName}
+	for i := range ingestionRules {
+		rule := &ingestionRules[i]
+		if rule.Job == "" {
+			rule.Job = defaultName
+		}
+		if rule.Table == "" {
+			rule.Table = defaultName
+		}
+
+		job, ok := this.Jobs[rule.Job]
+		if !ok {
+			job = this.newJob("PythonETLJob" + rule.Job)
+			this.Jobs[rule.Job] = job
+			jobNames = append(jobNames, rule.Job)
+		}
+		table, ok := this.Tables[rule.Table]
+		if !ok {
+			table = newTransactionsTable(construct, "Table"+rule.Table, removalPolicy, props.PointInTimeRecovery)
+			this.Tables[rule.Table] = table
+		}
+
+		// Give the glue job service role access to write to the table.
+		table.GrantWriteData(job.GrantPrincipal())
+
+		rule.JobName = *job.JobName()
+		rule.TableName = *table.TableName()
+	}
+	// Record how the files were loaded, keyed by the file and the job run.
+	this.Ledger = dynamodb.NewTable(construct, jsii.String("FileLedger"), &dynamodb.TableProps{
+		PartitionKey: &dynamodb.Attribute{
+			Name: jsii.String("key"),
+			Type: dynamodb.AttributeType_STRING,
+		},
+		SortKey: &dynamodb.Attribute{
+			Name: jsii.String("jobRunId"),
+			Type: dynamodb.AttributeType_STRING,
+		},
+		RemovalPolicy:       removalPolicy,
+		BillingMode:         dynamodb.BillingMode_PAY_PER_REQUEST,
+		PointInTimeRecovery: jsii.Bool(props.PointInTimeRecovery),
+	})
+	// Find the files loaded by a job run, to roll it back.
+	this.Ledger.AddGlobalSecondaryIndex(&dynamodb.GlobalSecondaryIndexProps{
+		IndexName: jsii.String("ByJobRun"),
+		PartitionKey: &dynamodb.Attribute{
+			Name: jsii.String("jobRunId"),
+			Type: dynamodb.AttributeType_STRING,
+		},
+		SortKey: &dynamodb.Attribute{
+			Name: jsii.String("key"),
+			Type: dynamodb.AttributeType_STRING,
+		},
+		ProjectionType: dynamodb.ProjectionType_ALL,
+	})
+
+	// Record the state of each batch of files, keyed by the id of its
+	// manifest, and list them by the day they were queued on.
+	this.Ingestions = dynamodb.NewTable(construct, jsii.String("Ingestions"), &dynamodb.TableProps{
+		PartitionKey: &dynamodb.Attribute{
+			Name: jsii.String("id"),
+			Type: dynamodb.AttributeType_STRING,
+		},
+		RemovalPolicy:       removalPolicy,
+		BillingMode:         dynamodb.BillingMode_PAY_PER_REQUEST,
+		PointInTimeRecovery: jsii.Bool(props.PointInTimeRecovery),
+	})
+	this.Ingestions.AddGlobalSecondaryIndex(&dynamodb.GlobalSecondaryIndexProps{
+		IndexName: jsii.String("ByDay"),
+		PartitionKey: &dynamodb.Attribute{
+			Name: jsii.String("day"),
+			Type: dynamodb.AttributeType_STRING,
+		},
+		SortKey: &dynamodb.Attribute{
+			Name: jsii.String("createdAt"),
+			Type: dynamodb.AttributeType_STRING,
+		},
+		ProjectionType: dynamodb.ProjectionType_ALL,
+	})
+
+	jobArns := []*string{}
+	for _, name := range jobNames {
+		jobArns = append(jobArns, this.Jobs[name].JobArn())
+	}
+	this.JobArns = jobArns
+
+	// Buffer the upload events in a queue, the trigger lambda receives them in
+	// batches so the files uploaded together are loaded by a single job run.
+	// The upload events that keep failing are sent to a dead-letter queue,
+	// whether EventBridge could not deliver them or the lambda failed to
+	// process them, so the files are not left in the input folder without
+	// anyone knowing.
+	this.TriggerDeadLetterQueue = newDeadLetterQueue(construct, "GlueJobTriggerDeadLetterQueue")
+	this.IngestQueue = sqs.NewQueue(construct, jsii.String("IngestQueue"), &sqs.QueueProps{
+		Encryption: sqs.QueueEncryption_SQS_MANAGED,
+		// Six times the timeout of the lambda, as advised for the queues
+		// invoking a lambda, so a batch is not received twice.
+		VisibilityTimeout: awscdk.Duration_Minutes(jsii.Number(30)),
+		DeadLetterQueue: &sqs.DeadLetterQueue{
+			Queue:           this.TriggerDeadLetterQueue,
+			MaxReceiveCount: jsii.Number(ingestMaxReceiveCount),
+		},
+	})
+
+	// Hold back the start steps of the workflow while the job is running as
+	// many times as it can. The steps are kept until the workflow gives up
+	// waiting for them.
+	this.DelayQueue = sqs.NewQueue(construct, jsii.String("DelayQueue"), &sqs.QueueProps{
+		Encryption:        sqs.QueueEncryption_SQS_MANAGED,
+		VisibilityTimeout: awscdk.Duration_Minutes(jsii.Number(30)),
+		RetentionPeriod:   awscdk.Duration_Hours(jsii.Number(startJobRunTimeoutHours)),
+	})
+
+	// Create a new lambda function to trigger glue job. It moves the files the
+	// rules do not accept, which are copied in parts when they are over 5 GB,
+	// so it gets a longer timeout.
+	moveOptions := FunctionOptions{
+		MemorySize:       props.Function.MemorySize,
+		Timeout:          awscdk.Duration_Minutes(jsii.Number(5)),
+		LogLevel:         props.Function.LogLevel,
+		MetricsNamespace: props.Function.MetricsNamespace,
+	}
+
+	// Both lambdas fail files, the trigger those whose header does not match
+	// their schema, so they lay out the failed keys and notify the same way.
+	failureEnvironment := map[string]*string{
+		"NOTIFY_CHANNELS": jsii.String(strings.Join(notificationChannels, ",")),
+	}
+	if props.ArchiveKeyTemplate != "" {
+		failureEnvironment["ARCHIVE_KEY_TEMPLATE"] = jsii.String(props.ArchiveKeyTemplate)
+	}
+	if props.NotificationTopic != nil {
+		failureEnvironment["SNS_TOPIC_ARN"] = props.NotificationTopic.TopicArn()
+	}
+	if props.NotificationWebhookURL != "" {
+		failureEnvironment["NOTIFY_WEBHOOK_URL"] = jsii.String(props.NotificationWebhookURL)
+	}
+
+	// A rule that cannot be passed to the lambdas fails the synth, rather
+	// than every upload once deployed.
+	rulesJSON, err := json.Marshal(ingestionRules)
+	if err != nil {
+		panic(err)
+	}
+	triggerEnvironment := map[string]*string{
+		"INGESTION_RULES":  jsii.String(string(rulesJSON)),
+		"WORKERS":          jsii.String(strconv.Itoa(workers)),
+		"DELAY_QUEUE_URL":  this.DelayQueue.QueueUrl(),
+		"DELAY_QUEUE_ARN":  this.DelayQueue.QueueArn(),
+		"INGESTIONS_TABLE": this.Ingestions.TableName(),
+	}
+	for name, value := range failureEnvironment {
+		triggerEnvironment[name] = value
+	}
+	this.TriggerFunction = newGoFunction(construct, "GlueJobTriggerLambda", "lambdas/glue-trigger", moveOptions, triggerEnvironment)
+	this.TriggerFunction.AddEventSource(awslambdaeventsources.NewSqsEventSource(this.IngestQueue, &awslambdaeventsources.SqsEventSourceProps{
+		BatchSize:               jsii.Number(float64(batchSize)),
+		MaxBatchingWindow:       props.BatchWindow,
+		ReportBatchItemFailures: jsii.Bool(true),
+	}))
+	this.TriggerFunction.AddEventSource(awslambdaeventsources.NewSqsEventSource(this.DelayQueue, &awslambdaeventsources.SqsEventSourceProps{
+		ReportBatchItemFailures: jsii.Bool(true),
+	}))
+	this.DelayQueue.GrantSendMessages(this.TriggerFunction)
+
+	// Create EventBridge rule to send the uploads to the ingest queue.
+	eventRule := events.NewRule(construct, jsii.String("S3ObjectCreated"), &events.RuleProps{
+		EventPattern: &events.EventPattern{
+			Source: &[]*string{jsii.String(`aws.s3`)},
+			DetailType: &[]*string{
+				jsii.String("Object Created"),
+			},
+			Detail: &map[string]interface{}{
+				"bucket": map[string]interface{}{
+					"name": &[]*string{this.Bucket.BucketName()},
+				},
+			},
+		},
+	})
+	eventRule.AddTarget(awseventstargets.NewSqsQueue(this.IngestQueue, &awseventstargets.SqsQueueProps{
+		DeadLetterQueue: this.TriggerDeadLetterQueue,
+		RetryAttempts:   props.RetryAttempts,
+		MaxEventAge:     maxEventAge,
+	}))
+
+	// Create IAM role for lambda to trigger glue job.
+	this.TriggerFunction.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Effect: awsiam.Effect_ALLOW,
+		Actions: jsii.Strings(
+			"glue:StartJobRun",
+		),
+		Resources: &jobArns,
+	}))
+
+	// Give the lambda access to move the files the rules do not accept to the
+	// ignored folder, and the files whose header does not match their schema
+	// to the failed folder.
+	this.TriggerFunction.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Effect: awsiam.Effect_ALLOW,
+		Actions: jsii.Strings(
+			"s3:ListBucket",
+			"s3:GetObject",
+			"s3:GetObjectTagging",
+			"s3:PutObject",
+			"s3:PutObjectTagging",
+			"s3:DeleteObject",
+			"s3:AbortMultipartUpload",
+		),
+		Resources: jsii.Strings(
+			*this.Bucket.BucketArn(),
+			*this.Bucket.BucketArn()+`/*`,
+		),
+	}))
+
+	// Create Lambda to move finished files to archive folder, it is run by the
+	// ingestion workflow. The archive steps the workflow could not run are
+	// sent to a dead-letter queue so they can be replayed.
+	this.ArchiveDeadLetterQueue = newDeadLetterQueue(construct, "MoveToArchiveDeadLetterQueue")
+	archiveEnvironment := map[string]*string{
+		"BUCKET_NAME":      this.Bucket.BucketName(),
+		"S3_KEY_PREFIX":    jsii.String(keyPrefix),
+		"STATS_PREFIX":     jsii.String(statsPrefix),
+		"LEDGER_TABLE":     this.Ledger.TableName(),
+		"INGESTIONS_TABLE": this.Ingestions.TableName(),
+	}
+	for name, value := range failureEnvironment {
+		archiveEnvironment[name] = value
+	}
+	// Files over 5 GB are copied in parts, so the lambda gets a longer timeout.
+	this.ArchiveFunction = newGoFunction(construct, "MoveToArchiveLambda", "lambdas/move-to-archive", moveOptions, archiveEnvironment)
+
+	// Give the archive lambda access to reconcile the files with the items
+	// loaded into the tables, and to record them in the ledger.
+	tableNames := []string{}
+	for name := range this.Tables {
+		tableNames = append(tableNames, name)
+	}
+	sort.Strings(tableNames)
+	for _, name := range tableNames {
+		this.Tables[name].GrantReadData(this.ArchiveFunction)
+	}
+	this.Ledger.GrantReadWriteData(this.ArchiveFunction)
+
+	// Give the lambdas access to record the state of the ingestions.
+	this.Ingestions.GrantReadWriteData(this.TriggerFunction)
+	this.Ingestions.GrantReadWriteData(this.ArchiveFunction)
+
+	// Give the lambdas access to publish the outcome of the ingestions.
+	if props.NotificationTopic != nil {
+		props.NotificationTopic.GrantPublish(this.TriggerFunction)
+		props.NotificationTopic.GrantPublish(this.ArchiveFunction)
+	}
+
+	// Create IAM role for lambda to move files to archive folder and give access to read from glue job.
+	archiveResources := append([]*string{
+		this.Bucket.BucketArn(),
+		jsii.String(*this.Bucket.BucketArn() + `/*`),
+	}, jobArns...)
+	this.ArchiveFunction.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Effect: awsiam.Effect_ALLOW,
+		Actions: jsii.Strings(
+			"s3:ListBucket",
+			"s3:GetObject",
+			"s3:GetObjectTagging",
+			"s3:PutObject",
+			"s3:PutObjectTagging",
+			"s3:DeleteObject",
+			"s3:AbortMultipartUpload",
+			"glue:GetJobRun",
+		),
+		Resources: &archiveResources,
+	}))
+
+	// Create a lambda to replay the events of the dead-letter queues through
+	// the same lambdas once the cause of the failures is fixed.
+	// The upload events are sent back to the ingest queue, so they are
+	// batched like the new uploads.
+	// The archive lambda is invoked synchronously, the redrive lambda only
+	// replays a message when it has the timeout of the archive lambda left.
+	redriveTargets, err := json.Marshal(map[string]map[string]interface{}{
+		"glue-trigger": {
+			"queueUrl":       this.TriggerDeadLetterQueue.QueueUrl(),
+			"destinationUrl": this.IngestQueue.QueueUrl(),
+		},
+		"move-to-archive": {
+			"queueUrl":               this.ArchiveDeadLetterQueue.QueueUrl(),
+			"functionName":           this.ArchiveFunction.FunctionName(),
+			"functionTimeoutSeconds": this.ArchiveFunction.Timeout().ToSeconds(nil),
+		},
+	})
+	if err != nil {
+		panic(err)
+	}
+	// It replays the messages one at a time, waiting for the archive lambda,
+	// so it gets the longest timeout.
+	redriveOptions := FunctionOptions{
+		MemorySize:       props.Function.MemorySize,
+		Timeout:          awscdk.Duration_Minutes(jsii.Number(15)),
+		LogLevel:         props.Function.LogLevel,
+		MetricsNamespace: props.Function.MetricsNamespace,
+	}
+	this.RedriveFunction = newGoFunction(construct, "DeadLetterRedriveLambda", "lambdas/dlq-redrive", redriveOptions, map[string]*string{
+		"REDRIVE_TARGETS": jsii.String(string(redriveTargets)),
+	})
+
+	// Give the redrive lambda access to the queues and the lambdas it replays them through.
+	this.TriggerDeadLetterQueue.GrantConsumeMessages(this.RedriveFunction)
+	this.ArchiveDeadLetterQueue.GrantConsumeMessages(this.RedriveFunction)
+	this.IngestQueue.GrantSendMessages(this.RedriveFunction)
+	this.ArchiveFunction.GrantInvoke(this.RedriveFunction)
+
+	// Create a lambda to roll back a bad load: it removes the items a job run
+	// wrote for its files and moves the files back to the failed folder. It
+	// removes the items in pages, so it gets the longest timeout.
+	rollbackOptions := FunctionOptions{
+		MemorySize:       props.Function.MemorySize,
+		Timeout:          awscdk.Duration_Minutes(jsii.Number(15)),
+		LogLevel:         props.Function.LogLevel,
+		MetricsNamespace: props.Function.MetricsNamespace,
+	}
+	this.RollbackFunction = newGoFunction(construct, "IngestionRollbackLambda", "lambdas/ingestion-rollback", rollbackOptions, map[string]*string{
+		"LEDGER_TABLE": this.Ledger.TableName(),
+	})
+
+	// Give the rollback lambda access to remove the items, to record the
+	// rollback in the ledger, and to move the files.
+	for _, name := range tableNames {
+		this.Tables[name].GrantReadWriteData(this.RollbackFunction)
+	}
+	this.Ledger.GrantReadWriteData(this.RollbackFunction)
+	this.RollbackFunction.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Effect: awsiam.Effect_ALLOW,
+		Actions: jsii.Strings(
+			"s3:ListBucket",
+			"s3:GetObject",
+			"s3:GetObjectTagging",
+			"s3:PutObject",
+			"s3:PutObjectTagging",
+			"s3:DeleteObject",
+			"s3:AbortMultipartUpload",
+		),
+		Resources: jsii.Strings(
+			*this.Bucket.BucketArn(),
+			*this.Bucket.BucketArn()+`/*`,
+		),
+	}))
+
+	// Create a lambda to replay archived or failed files, e.g. after a fix of
+	// the job. The copies are picked up by the ingest queue like new uploads,
+	// so they are batched and throttled the same way. It is called by the
+	// API, so its timeout stays under the timeout of the API.
+	replayOptions := FunctionOptions{
+		MemorySize:       props.Function.MemorySize,
+		Timeout:          awscdk.Duration_Seconds(jsii.Number(29)),
+		LogLevel:         props.Function.LogLevel,
+		MetricsNamespace: props.Function.MetricsNamespace,
+	}
+	this.ReplayFunction = newGoFunction(construct, "IngestionReplayLambda", "lambdas/ingestion-replay", replayOptions, map[string]*string{
+		"BUCKET_NAME":  this.Bucket.BucketName(),
+		"LEDGER_TABLE": this.Ledger.TableName(),
+	})
+
+	// Give the replay lambda access to find the keys the files were uploaded
+	// to, and to copy them back.
+	this.Ledger.GrantReadData(this.ReplayFunction)
+	this.ReplayFunction.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Effect: awsiam.Effect_ALLOW,
+		Actions: jsii.Strings(
+			"s3:ListBucket",
+			"s3:GetObject",
+			"s3:GetObjectTagging",
+			"s3:PutObject",
+			"s3:PutObjectTagging",
+			"s3:AbortMultipartUpload",
+		),
+		Resources: jsii.Strings(
+			*this.Bucket.BucketArn(),
+			*this.Bucket.BucketArn()+`/*`,
+		),
+	}))
+
+	// Create a lambda to sign the URLs the files are uploaded to, under the
+	// prefixes of the rules. The uploads are checked against their rule and
+	// recorded so their ingestion can be followed from the start.
+	this.UploadFunction = newGoFunction(construct, "IngestionUploadLambda", "lambdas/ingestion-upload", props.Function, map[string]*string{
+		"BUCKET_NAME":      this.Bucket.BucketName(),
+		"S3_KEY_PREFIX":    jsii.String(keyPrefix),
+		"INGESTION_RULES":  jsii.String(string(rulesJSON)),
+		"INGESTIONS_TABLE": this.Ingestions.TableName(),
+	})
+
+	// Give the upload lambda access to record the uploads, and to sign the
+	// uploads under the prefixes of the rules only. The URLs are signed with
+	// the credentials of the lambda.
+	this.Ingestions.GrantReadWriteData(this.UploadFunction)
+	uploadResources := []*string{}
+	for _, rule := range ingestionRules {
+		uploadResources = append(uploadResources, jsii.String(*this.Bucket.BucketArn()+`/`+rule.Prefix+`*`))
+	}
+	this.UploadFunction.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Effect: awsiam.Effect_ALLOW,
+		Actions: jsii.Strings(
+			"s3:PutObject",
+			"s3:AbortMultipartUpload",
+		),
+		Resources: &uploadResources,
+	}))
+
+	// Orchestrate the loading of each batch of uploads, the trigger lambda
+	// starts the workflow and the workflow feeds the archive dead-letter queue.
+	projectPrefix := props.ProjectPrefix
+	if projectPrefix == "" {
+		projectPrefix = *awscdk.Stack_Of(construct).StackName()
+	}
+	this.Workflow = NewIngestionWorkflow(construct, "Workflow", &IngestionWorkflowProps{
+		ProjectPrefix: projectPrefix,
+		Pipeline:      this,
+		PollInterval:  props.PollInterval,
+	})
+
+	// Keep the logical ids the bucket and the table had in the stack, along
+	// with those of the resources of the bucket whose removal would empty it
+	// or turn off its events.
+	if props.LegacyLogicalIDs {
+		overrideLogicalID(this.Bucket, "Bucket83908E77")
+		overrideLogicalID(this.Bucket, "BucketPolicyE9A3008A", "Policy")
+		overrideLogicalID(this.Bucket, "BucketAutoDeleteObjectsCustomResourceBAFD23C2", "AutoDeleteObjectsCustomResource")
+		overrideLogicalID(this.Bucket, "BucketNotifications8F2E257D", "Notifications")
+		overrideLogicalID(this.Table, "TableCD117FA1")
+	}
+
+	return this
+}
+
+// Creates a Glue job running the ETL script, with access to read the files
+// and to write the rejected rows and the row counts of each run.
+func (i *IngestionPipeline) newJob(id string) glue.Job {
+	// The runs started without a schema load the default one.
+	defaultSchema, err := schema.Lookup("")
+	if err != nil {
+		panic(err)
+	}
+	defaultSchemaJSON, err := defaultSchema.JSON()
+	if err != nil {
+		panic(err)
+	}
+
+	job := glue.NewJob(i.Construct, jsii.String(id), &glue.JobProps{
+		Executable: glue.JobExecutable_PythonEtl(&glue.PythonSparkJobExecutableProps{
+			GlueVersion:   glue.GlueVersion_V3_0(),
+			PythonVersion: glue.PythonVersion_THREE,
+			Script:        glue.Code_FromAsset(jsii.String("glue/etl.py"), nil),
+		}),
+		Description: jsii.String("A simple Python ETL job"),
+		DefaultArguments: &map[string]*string{
+			"--format":          jsii.String("csv"),
+			"--schema":          jsii.String(defaultSchemaJSON),
+			"--rejected_prefix": jsii.String(rejectedPrefix),
+			"--stats_prefix":    jsii.String(statsPrefix),
+		},
+	})
+
+	i.Bucket.GrantRead(job.GrantPrincipal(), nil)
+	i.Bucket.GrantPut(job.GrantPrincipal(), jsii.String(rejectedPrefix+"*"))
+	i.Bucket.GrantPut(job.GrantPrincipal(), jsii.String(statsPrefix+"*"))
+
+	return job
+}
+
+// The name of the global secondary index of the transactions tables finding
+// the items loaded from a file, and by which job run.
+const sourceIndexName = "sourceKey-jobRunId-index"
+
+// Creates a table the transactions are loaded into.
+func newTransactionsTable(scope constructs.Construct, id string, removalPolicy awscdk.RemovalPolicy, pointInTimeRecovery bool) dynamodb.Table {
+	table := dynamodb.NewTable(scope, jsii.String(id), &dynamodb.TableProps{
+		PartitionKey: &dynamodb.Attribute{
+			Name: jsii.String("id"),
+			Type: dynamodb.AttributeType_NUMBER,
+		},
+		SortKey: &dynamodb.Attribute{
+			Name: jsii.String("accountNumber"),
+			Type: dynamodb.AttributeType_STRING,
+		},
+		RemovalPolicy:       removalPolicy,
+		BillingMode:         dynamodb.BillingMode_PAY_PER_REQUEST,
+		PointInTimeRecovery: jsii.Bool(pointInTimeRecovery),
+	})
+
+	// Find the items loaded from a file, by every job run or by one of them,
+	// to list or delete them through the API, reconcile or roll back the
+	// file. A single index is added, DynamoDB creates one per update of the
+	// table. Every attribute is projected, so the amounts are read whatever
+	// the schema of the file.
+	table.AddGlobalSecondaryIndex(&dynamodb.GlobalSecondaryIndexProps{
+		IndexName: jsii.String(sourceIndexName),
+		PartitionKey: &dynamodb.Attribute{
+			Name: jsii.String("sourceKey"),
+			Type: dynamodb.AttributeType_STRING,
+		},
+		SortKey: &dynamodb.Attribute{
+			Name: jsii.String("jobRunId"),
+			Type: dynamodb.AttributeType_STRING,
+		},
+		ProjectionType: dynamodb.ProjectionType_ALL,
+	})
+	return table
+}
+
+// Creates a dead-letter queue that keeps the failed events for 14 days, the
+// maximum SQS allows.
+func newDeadLetterQueue(scope constructs.Construct, id string) sqs.Queue {
+	return sqs.NewQueue(scope, jsii.String(id), &sqs.QueueProps{
+		Encryption:      sqs.QueueEncryption_SQS_MANAGED,
+		RetentionPeriod: awscdk.Duration_Days(jsii.Number(14)),
+	})
+}
@@ -0,0 +1,77 @@
+package components
+
+import (
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awslambda"
+	awslambdago "github.com/aws/aws-cdk-go/awscdklambdagoalpha/v2"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// FunctionOptions are the settings shared by the lambda functions of a construct.
+type FunctionOptions struct {
+	// The memory size of the functions in MB. Defaults to 1024.
+	MemorySize int
+
+	// The timeout of the functions. Defaults to 15 seconds.
+	Timeout awscdk.Duration
+
+	// The lowest level of the logs written by the functions. Defaults to INFO.
+	LogLevel string
+
+	// The CloudWatch namespace of the metrics emitted by the functions.
+	// Defaults to the namespace of the metrics package.
+	MetricsNamespace string
+}
+
+// The bundling options shared by every Go lambda, strips the debug information
+// to keep the deployment packages small.
+var bundlingOptions = &awslambdago.BundlingOptions{
+	GoBuildFlags: &[]*string{jsii.String(`-ldflags "-s -w"`)},
+}
+
+// Creates a new Go lambda function from the given entry folder with the
+// settings shared by every lambda in the project.
+func newGoFunction(scope constructs.Construct, id string, entry string, options FunctionOptions, environment map[string]*string) awslambdago.GoFunction {
+	props := goFunctionProps(entry, options, environment)
+
+	// The metrics of the functions have the name of their stack as a dimension.
+	(*props.Environment)["STACK_NAME"] = awscdk.Stack_Of(scope).StackName()
+	return awslambdago.NewGoFunction(scope, jsii.String(id), props)
+}
+
+// Returns the props of a Go lambda function with the settings shared by every
+// lambda in the project, for the functions that need more settings than
+// newGoFunction allows.
+func goFunctionProps(entry string, options FunctionOptions, environment map[string]*string) *awslambdago.GoFunctionProps {
+	memorySize := options.MemorySize
+	if memorySize == 0 {
+		memorySize = 1024
+	}
+	timeout := options.Timeout
+	if timeout == nil {
+		timeout = awscdk.Duration_Millis(jsii.Number(15000))
+	}
+
+	// Every function gets the log level and metrics namespace, along with its
+	// own settings.
+	functionEnvironment := map[string]*string{}
+	if options.LogLevel != "" {
+		functionEnvironment["LOG_LEVEL"] = jsii.String(options.LogLevel)
+	}
+	if options.MetricsNamespace != "" {
+		functionEnvironment["METRICS_NAMESPACE"] = jsii.String(options.MetricsNamespace)
+	}
+	for name, value := range environment {
+		functionEnvironment[name] = value
+	}
+
+	return &awslambdago.GoFunctionProps{
+		Runtime:     awslambda.Runtime_GO_1_X(),
+		Entry:       jsii.String(entry),
+		Bundling:    bundlingOptions,
+		MemorySize:  jsii.Number(float64(memorySize)),
+		Timeout:     timeout,
+		Environment: &functionEnvironment,
+	}
+}
@@ -0,0 +1,30 @@
+package components
+
+import (
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// Overrides the logical id of the CloudFormation resource of a construct, or
+// of its child at the given path of ids, when there is one.
+//
+// The constructs use it to keep the logical ids their stateful resources had
+// when they were defined in the stack itself. CloudFormation would otherwise
+// replace the buckets, the table and the API of the stacks deployed before
+// the split, deleting their data.
+func overrideLogicalID(scope constructs.IConstruct, logicalID string, path ...string) {
+	for _, id := range path {
+		scope = scope.Node().TryFindChild(jsii.String(id))
+		if scope == nil {
+			return
+		}
+	}
+	if resource, ok := scope.(awscdk.CfnResource); ok {
+		resource.OverrideLogicalId(jsii.String(logicalID))
+		return
+	}
+	if resource, ok := scope.Node().DefaultChild().(awscdk.CfnResource); ok {
+		resource.OverrideLogicalId(jsii.String(logicalID))
+	}
+}
@@ -0,0 +1,171 @@
+package components
+
+import (
+	"go-cdk-workshop/internal/metrics"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	cloudwatch "github.com/aws/aws-cdk-go/awscdk/v2/awscloudwatch"
+	cloudwatchactions "github.com/aws/aws-cdk-go/awscdk/v2/awscloudwatchactions"
+	sns "github.com/aws/aws-cdk-go/awscdk/v2/awssns"
+	snssubscriptions "github.com/aws/aws-cdk-go/awscdk/v2/awssnssubscriptions"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// The period the metrics are summed over on the dashboard and by the alarms.
+const metricsPeriodMinutes = 5
+
+// IngestionMonitoringProps are the settings of an IngestionMonitoring.
+type IngestionMonitoringProps struct {
+	// The CloudWatch namespace the lambdas emit their metrics to. Defaults to
+	// the namespace of the metrics package.
+	Namespace string
+
+	// The prefixes of the ingestion rules, the dashboard shows the files of
+	// each of them.
+	Prefixes []string
+
+	// The alarms fire when at least this many files are failed, or rows
+	// rejected, within 5 minutes. Zero disables the alarm.
+	FailedFilesThreshold  int
+	RejectedRowsThreshold int
+
+	// The alarm fires when the 99th percentile of the query latency is over
+	// this many milliseconds for 15 minutes. Zero disables the alarm.
+	QueryLatencyMs int
+
+	// The email addresses subscribed to the alarms.
+	AlarmEmails []string
+}
+
+// IngestionMonitoring is the dashboard of the business metrics emitted by the
+// lambdas, and the alarms watching them.
+type IngestionMonitoring struct {
+	constructs.Construct
+
+	// The dashboard of the ingestions and the API.
+	Dashboard cloudwatch.Dashboard
+
+	// The topic the alarms are published to.
+	AlarmTopic sns.Topic
+
+	// The alarms of the stack.
+	Alarms []cloudwatch.Alarm
+}
+
+// NewIngestionMonitoring creates the dashboard and alarms of the metrics the
+// lambdas emit for the stack.
+func NewIngestionMonitoring(scope constructs.Construct, id string, props *IngestionMonitoringProps) *IngestionMonitoring {
+	if props == nil {
+		props = &IngestionMonitoringProps{}
+	}
+	namespace := props.Namespace
+	if namespace == "" {
+		namespace = metrics.DefaultNamespace
+	}
+
+	construct := constructs.NewConstruct(scope, &id)
+	this := &IngestionMonitoring{Construct: construct}
+	stackName := awscdk.Stack_Of(construct).StackName()
+
+	// Returns a metric of the stack, or of the files of a prefix.
+	metric := func(name string, statistic string, prefix string) cloudwatch.Metric {
+		dimensions := map[string]*string{metrics.StackDimension: stackName}
+		label := name
+		if prefix != "" {
+			dimensions[metrics.PrefixDimension] = jsii.String(prefix)
+			label = prefix
+		}
+		return cloudwatch.NewMetric(&cloudwatch.MetricProps{
+			Namespace:     jsii.String(namespace),
+			MetricName:    jsii.String(name),
+			DimensionsMap: &dimensions,
+			Statistic:     jsii.String(statistic),
+			Period:        awscdk.Duration_Minutes(jsii.Number(metricsPeriodMinutes)),
+			Label:         jsii.String(label),
+		})
+	}
+	sum := func(name string) cloudwatch.IMetric {
+		return metric(name, "Sum", "")
+	}
+
+	// Create the topic the alarms are published to, and subscribe the emails
+	// from the stage config to it.
+	this.AlarmTopic = sns.NewTopic(construct, jsii.String("AlarmTopic"), &sns.TopicProps{
+		DisplayName: jsii.String(*stackName + "-alarms"),
+	})
+	for _, email := range props.AlarmEmails {
+		this.AlarmTopic.AddSubscription(snssubscriptions.NewEmailSubscription(jsii.String(email), nil))
+	}
+
+	// Alarm on the files and rows that were not loaded, and on slow queries.
+	if props.FailedFilesThreshold > 0 {
+		this.addAlarm("FailedFilesAlarm", "Files were moved to the failed folder", sum(metrics.FilesFailed), props.FailedFilesThreshold, 1)
+	}
+	if props.RejectedRowsThreshold > 0 {
+		this.addAlarm("RejectedRowsAlarm", "Rows of the loaded files were rejected", sum(metrics.RowsRejected), props.RejectedRowsThreshold, 1)
+	}
+	if props.QueryLatencyMs > 0 {
+		this.addAlarm("QueryLatencyAlarm", "The queries of the API are slow", metric(metrics.QueryLatency, "p99", ""), props.QueryLatencyMs, 3)
+	}
+
+	// Show the files of each prefix next to the totals of the stack.
+	accepted := []cloudwatch.IMetric{}
+	for _, prefix := range props.Prefixes {
+		accepted = append(accepted, metric(metrics.FilesAccepted, "Sum", prefix))
+	}
+
+	this.Dashboard = cloudwatch.NewDashboard(construct, jsii.String("Dashboard"), &cloudwatch.DashboardProps{
+		DashboardName: jsii.String(*stackName + "-ingestion"),
+	})
+	this.Dashboard.AddWidgets(
+		graph("Uploaded files", sum(metrics.FilesAccepted), sum(metrics.FilesIgnored), sum(metrics.FilesRejected)),
+		graph("Job runs started", sum(metrics.JobRunsStarted)),
+		graph("Moved files", sum(metrics.FilesArchived), sum(metrics.FilesFailed)),
+	)
+	this.Dashboard.AddWidgets(
+		graph("Rows", sum(metrics.RowsLoaded), sum(metrics.RowsRejected)),
+		graph("Accepted files by prefix", accepted...),
+		graph("Fraud flag updates", sum(metrics.FraudFlagUpdates)),
+	)
+	alarms := []cloudwatch.IAlarm{}
+	for _, alarm := range this.Alarms {
+		alarms = append(alarms, alarm)
+	}
+	this.Dashboard.AddWidgets(
+		graph("Query latency", metric(metrics.QueryLatency, "p50", ""), metric(metrics.QueryLatency, "p99", "")),
+		graph("Query results", sum(metrics.QueryResults)),
+		cloudwatch.NewAlarmStatusWidget(&cloudwatch.AlarmStatusWidgetProps{
+			Title:  jsii.String("Alarms"),
+			Alarms: &alarms,
+			Width:  jsii.Number(8),
+		}),
+	)
+
+	return this
+}
+
+// Creates an alarm firing when the metric reaches the threshold for the
+// given number of periods, published to the alarm topic.
+func (m *IngestionMonitoring) addAlarm(id string, description string, metric cloudwatch.IMetric, threshold int, periods int) {
+	alarm := cloudwatch.NewAlarm(m.Construct, jsii.String(id), &cloudwatch.AlarmProps{
+		AlarmDescription:   jsii.String(description),
+		Metric:             metric,
+		Threshold:          jsii.Number(float64(threshold)),
+		EvaluationPeriods:  jsii.Number(float64(periods)),
+		ComparisonOperator: cloudwatch.ComparisonOperator_GREATER_THAN_OR_EQUAL_TO_THRESHOLD,
+		// No metric means no file failed and no query ran.
+		TreatMissingData: cloudwatch.TreatMissingData_NOT_BREACHING,
+	})
+	alarm.AddAlarmAction(cloudwatchactions.NewSnsAction(m.AlarmTopic))
+	m.Alarms = append(m.Alarms, alarm)
+}
+
+// Returns a graph of the metrics, a third of the width of the dashboard.
+func graph(title string, left ...cloudwatch.IMetric) cloudwatch.GraphWidget {
+	return cloudwatch.NewGraphWidget(&cloudwatch.GraphWidgetProps{
+		Title: jsii.String(title),
+		Left:  &left,
+		Width: jsii.Number(8),
+	})
+}
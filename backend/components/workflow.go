@@ -0,0 +1,319 @@
+package components
+
+import (
+	"strings"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/aws-cdk-go/awscdk/v2/awsiam"
+	sfn "github.com/aws/aws-cdk-go/awscdk/v2/awsstepfunctions"
+	tasks "github.com/aws/aws-cdk-go/awscdk/v2/awsstepfunctionstasks"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+)
+
+// How long the workflow waits for the job run to start, the trigger lambda
+// holds the start step back in the delay queue while Glue is busy.
+const startJobRunTimeoutHours = 3
+
+// IngestionWorkflowProps are the settings of an IngestionWorkflow.
+type IngestionWorkflowProps struct {
+	// The prefix used to name the state machine.
+	ProjectPrefix string
+
+	// The pipeline whose lambdas run the steps of the workflow.
+	Pipeline *IngestionPipeline
+
+	// How long the workflow waits between two checks of the job run.
+	// Defaults to 1 minute.
+	PollInterval awscdk.Duration
+}
+
+// IngestionWorkflow is the state machine loading a manifest of uploaded
+// files: it validates the files, starts the Glue job run loading them, waits
+// for the run to finish, reconciles its row counts, then archives the files
+// and notifies the outcome. Each execution shows the progress of its files
+// in the Step Functions console.
+type IngestionWorkflow struct {
+	constructs.Construct
+
+	// The state machine, its executions are started by the trigger lambda.
+	StateMachine sfn.StateMachine
+}
+
+// NewIngestionWorkflow creates the state machine and lets the trigger lambda
+// of the pipeline start its executions. It is called by NewIngestionPipeline,
+// a pipeline has a single workflow.
+func NewIngestionWorkflow(scope constructs.Construct, id string, props *IngestionWorkflowProps) *IngestionWorkflow {
+	pollInterval := props.PollInterval
+	if pollInterval == nil {
+		pollInterval = awscdk.Duration_Minutes(jsii.Number(1))
+	}
+	pipeline := props.Pipeline
+
+	construct := constructs.NewConstruct(scope, &id)
+	this := &IngestionWorkflow{Construct: construct}
+
+	// The input of the execution passed to the lambda steps.
+	workflowInput := func(action string) sfn.TaskInput {
+		return sfn.TaskInput_FromObject(&map[string]interface{}{
+			"action":    action,
+			"bucket":    sfn.JsonPath_StringAt(jsii.String("$.bucket")),
+			"manifest":  sfn.JsonPath_StringAt(jsii.String("$.manifest")),
+			"jobName":   sfn.JsonPath_StringAt(jsii.String("$.jobName")),
+			"arguments": sfn.JsonPath_ObjectAt(jsii.String("$.arguments")),
+			"jobRunId":  sfn.JsonPath_StringAt(jsii.String("$.jobRun.id")),
+		})
+	}
+
+	// There is no job run until the start step succeeds.
+	prepare := sfn.NewPass(construct, jsii.String("Prepare"), &sfn.PassProps{
+		Result:     sfn.Result_FromObject(&map[string]interface{}{"id": ""}),
+		ResultPath: jsii.String("$.jobRun"),
+	})
+
+	// Drop the files moved or replaced since they were uploaded.
+	validate := tasks.NewLambdaInvoke(construct, jsii.String("ValidateFiles"), &tasks.LambdaInvokeProps{
+		LambdaFunction:           pipeline.TriggerFunction,
+		RetryOnServiceExceptions: jsii.Bool(false),
+		Payload:                  workflowInput("validate"),
+		ResultSelector: &map[string]interface{}{
+			"files": sfn.JsonPath_NumberAt(jsii.String("$.Payload.files")),
+		},
+		ResultPath: jsii.String("$.validation"),
+	})
+
+	// Start the job run. The trigger lambda completes the step with the id of
+	// the run, it retries the errors Glue may recover from and holds the step
+	// back in the delay queue while the job is running as many times as it can.
+	startInput := map[string]interface{}{
+		"action":    "start",
+		"bucket":    sfn.JsonPath_StringAt(jsii.String("$.bucket")),
+		"manifest":  sfn.JsonPath_StringAt(jsii.String("$.manifest")),
+		"jobName":   sfn.JsonPath_StringAt(jsii.String("$.jobName")),
+		"arguments": sfn.JsonPath_ObjectAt(jsii.String("$.arguments")),
+		"taskToken": sfn.JsonPath_TaskToken(),
+	}
+	startJob := tasks.NewLambdaInvoke(construct, jsii.String("StartJobRun"), &tasks.LambdaInvokeProps{
+		LambdaFunction:           pipeline.TriggerFunction,
+		RetryOnServiceExceptions: jsii.Bool(false),
+		IntegrationPattern:       sfn.IntegrationPattern_WAIT_FOR_TASK_TOKEN,
+		Payload:                  sfn.TaskInput_FromObject(&startInput),
+		Timeout:                  awscdk.Duration_Hours(jsii.Number(startJobRunTimeoutHours)),
+		ResultSelector: &map[string]interface{}{
+			"id": sfn.JsonPath_StringAt(jsii.String("$.jobRunId")),
+		},
+		ResultPath: jsii.String("$.jobRun"),
+	})
+
+	// Carry on with the job run recorded by the trigger lambda when the start
+	// step timed out, the run may have started without completing the step.
+	recoverJob := tasks.NewLambdaInvoke(construct, jsii.String("RecoverJobRun"), &tasks.LambdaInvokeProps{
+		LambdaFunction:           pipeline.TriggerFunction,
+		RetryOnServiceExceptions: jsii.Bool(false),
+		Payload:                  workflowInput("recover"),
+		ResultSelector: &map[string]interface{}{
+			"id": sfn.JsonPath_StringAt(jsii.String("$.Payload.jobRunId")),
+		},
+		ResultPath: jsii.String("$.jobRun"),
+	})
+	startJob.AddCatch(recoverJob, &sfn.CatchProps{
+		Errors:     jsii.Strings("States.Timeout"),
+		ResultPath: jsii.String("$.error"),
+	})
+
+	// Check the job run until it finishes.
+	waitForJobRun := sfn.NewWait(construct, jsii.String("WaitForJobRun"), &sfn.WaitProps{
+		Time: sfn.WaitTime_Duration(pollInterval),
+	})
+	getJobRun := tasks.NewCallAwsService(construct, jsii.String("GetJobRun"), &tasks.CallAwsServiceProps{
+		Service: jsii.String("glue"),
+		Action:  jsii.String("getJobRun"),
+		Parameters: &map[string]interface{}{
+			"JobName": sfn.JsonPath_StringAt(jsii.String("$.jobName")),
+			"RunId":   sfn.JsonPath_StringAt(jsii.String("$.jobRun.id")),
+		},
+		IamResources: &pipeline.JobArns,
+		ResultSelector: &map[string]interface{}{
+			"state": sfn.JsonPath_StringAt(jsii.String("$.JobRun.JobRunState")),
+		},
+		ResultPath: jsii.String("$.status"),
+	})
+	getJobRun.AddRetry(&sfn.RetryProps{
+		Interval:    awscdk.Duration_Seconds(jsii.Number(10)),
+		BackoffRate: jsii.Number(2),
+		MaxAttempts: jsii.Number(3),
+	})
+
+	// Check the job run loaded every file of the manifest.
+	reconcile := tasks.NewLambdaInvoke(construct, jsii.String("ReconcileJobRun"), &tasks.LambdaInvokeProps{
+		LambdaFunction:           pipeline.ArchiveFunction,
+		RetryOnServiceExceptions: jsii.Bool(false),
+		Payload:                  workflowInput("reconcile"),
+		ResultSelector: &map[string]interface{}{
+			"state":   sfn.JsonPath_StringAt(jsii.String("$.Payload.state")),
+			"message": sfn.JsonPath_StringAt(jsii.String("$.Payload.message")),
+		},
+		ResultPath: jsii.String("$.outcome"),
+	})
+
+	// The outcome of the job runs that did not succeed.
+	jobRunFailed := sfn.NewPass(construct, jsii.String("JobRunFailed"), &sfn.PassProps{
+		Parameters: &map[string]interface{}{
+			"state":   sfn.JsonPath_StringAt(jsii.String("$.status.state")),
+			"message": "",
+		},
+		ResultPath: jsii.String("$.outcome"),
+	})
+
+	// The outcome of the steps that failed, their files are failed too.
+	stepFailed := sfn.NewPass(construct, jsii.String("StepFailed"), &sfn.PassProps{
+		Parameters: &map[string]interface{}{
+			"state":   "FAILED",
+			"message": sfn.JsonPath_StringAt(jsii.String("$.error.Cause")),
+		},
+		ResultPath: jsii.String("$.outcome"),
+	})
+	// Retry the lambda steps the Lambda service failed or throttled, and the
+	// invocations that timed out. The start step is not retried on its
+	// timeout, the job run may have started by then, it is recovered instead.
+	for _, step := range []sfn.TaskStateBase{validate, recoverJob, reconcile} {
+		addLambdaRetry(step, "States.Timeout")
+	}
+	addLambdaRetry(startJob)
+	for _, step := range []sfn.TaskStateBase{validate, startJob, recoverJob, getJobRun, reconcile} {
+		step.AddCatch(stepFailed, &sfn.CatchProps{ResultPath: jsii.String("$.error")})
+	}
+
+	// Move the files to the archive or failed folder. The archive steps that
+	// keep failing are sent to the dead-letter queue so they can be replayed,
+	// they then notify the outcome themselves.
+	archiveInput := map[string]interface{}{
+		"bucket":       sfn.JsonPath_StringAt(jsii.String("$.bucket")),
+		"manifest":     sfn.JsonPath_StringAt(jsii.String("$.manifest")),
+		"jobName":      sfn.JsonPath_StringAt(jsii.String("$.jobName")),
+		"jobRunId":     sfn.JsonPath_StringAt(jsii.String("$.jobRun.id")),
+		"state":        sfn.JsonPath_StringAt(jsii.String("$.outcome.state")),
+		"errorMessage": sfn.JsonPath_StringAt(jsii.String("$.outcome.message")),
+	}
+	archive := tasks.NewLambdaInvoke(construct, jsii.String("ArchiveFiles"), &tasks.LambdaInvokeProps{
+		LambdaFunction: pipeline.ArchiveFunction,
+		Payload:        sfn.TaskInput_FromObject(withFields(archiveInput, map[string]interface{}{"action": "archive"})),
+		ResultSelector: &map[string]interface{}{
+			"events": sfn.JsonPath_ListAt(jsii.String("$.Payload.events")),
+		},
+		ResultPath: jsii.String("$.archive"),
+	})
+	archive.AddRetry(&sfn.RetryProps{
+		Interval:    awscdk.Duration_Seconds(jsii.Number(30)),
+		BackoffRate: jsii.Number(2),
+		MaxAttempts: jsii.Number(3),
+	})
+	sendToDeadLetterQueue := tasks.NewSqsSendMessage(construct, jsii.String("SendToDeadLetterQueue"), &tasks.SqsSendMessageProps{
+		Queue:       pipeline.ArchiveDeadLetterQueue,
+		MessageBody: sfn.TaskInput_FromObject(withFields(archiveInput, map[string]interface{}{"action": "archive", "notify": true})),
+		ResultPath:  sfn.JsonPath_DISCARD(),
+	})
+	archive.AddCatch(sendToDeadLetterQueue, &sfn.CatchProps{ResultPath: jsii.String("$.error")})
+	sendToDeadLetterQueue.Next(sfn.NewFail(construct, jsii.String("ArchiveFailed"), &sfn.FailProps{
+		Error: jsii.String("ArchiveFailed"),
+		Cause: jsii.String("The files could not be archived, the archive step was sent to the dead-letter queue"),
+	}))
+
+	// Notify the outcome, the files have been moved already, so a failed
+	// notification does not fail the execution.
+	notifyOutcome := tasks.NewLambdaInvoke(construct, jsii.String("NotifyOutcome"), &tasks.LambdaInvokeProps{
+		LambdaFunction: pipeline.ArchiveFunction,
+		Payload: sfn.TaskInput_FromObject(&map[string]interface{}{
+			"action": "notify",
+			"events": sfn.JsonPath_ListAt(jsii.String("$.archive.events")),
+		}),
+		ResultPath: sfn.JsonPath_DISCARD(),
+	})
+	loaded := sfn.NewChoice(construct, jsii.String("Loaded"), nil).
+		When(sfn.Condition_StringEquals(jsii.String("$.outcome.state"), jsii.String("SUCCEEDED")), sfn.NewSucceed(construct, jsii.String("Succeeded"), nil)).
+		Otherwise(sfn.NewFail(construct, jsii.String("Failed"), &sfn.FailProps{
+			Error: jsii.String("IngestionFailed"),
+			Cause: jsii.String("The files were moved to the failed folder"),
+		}))
+	notifyOutcome.AddCatch(loaded, &sfn.CatchProps{ResultPath: jsii.String("$.notifyError")})
+
+	// Link the steps.
+	prepare.Next(validate)
+	validate.Next(sfn.NewChoice(construct, jsii.String("HasFiles"), nil).
+		When(sfn.Condition_NumberEquals(jsii.String("$.validation.files"), jsii.Number(0)), sfn.NewSucceed(construct, jsii.String("NothingToLoad"), nil)).
+		Otherwise(startJob))
+	startJob.Next(waitForJobRun)
+	recoverJob.Next(waitForJobRun)
+	waitForJobRun.Next(getJobRun)
+	getJobRun.Next(sfn.NewChoice(construct, jsii.String("JobRunFinished"), nil).
+		When(sfn.Condition_Or(
+			sfn.Condition_StringEquals(jsii.String("$.status.state"), jsii.String("STARTING")),
+			sfn.Condition_StringEquals(jsii.String("$.status.state"), jsii.String("RUNNING")),
+			sfn.Condition_StringEquals(jsii.String("$.status.state"), jsii.String("STOPPING")),
+			sfn.Condition_StringEquals(jsii.String("$.status.state"), jsii.String("WAITING")),
+		), waitForJobRun).
+		When(sfn.Condition_StringEquals(jsii.String("$.status.state"), jsii.String("SUCCEEDED")), reconcile).
+		Otherwise(jobRunFailed))
+	reconcile.Next(archive)
+	jobRunFailed.Next(archive)
+	stepFailed.Next(archive)
+	archive.Next(notifyOutcome)
+	notifyOutcome.Next(loaded)
+
+	// The state machine is named, so the trigger lambda gets its ARN without
+	// depending on it, the state machine depending on the lambda already.
+	stateMachineName := strings.Join([]string{props.ProjectPrefix, "ingestion"}, "-")
+	this.StateMachine = sfn.NewStateMachine(construct, jsii.String("StateMachine"), &sfn.StateMachineProps{
+		StateMachineName: jsii.String(stateMachineName),
+		Definition:       prepare,
+	})
+	stateMachineArn := awscdk.Stack_Of(construct).FormatArn(&awscdk.ArnComponents{
+		Service:      jsii.String("states"),
+		Resource:     jsii.String("stateMachine"),
+		ResourceName: jsii.String(stateMachineName),
+		ArnFormat:    awscdk.ArnFormat_COLON_RESOURCE_NAME,
+	})
+
+	// Let the trigger lambda start the executions and complete their start steps.
+	pipeline.TriggerFunction.AddEnvironment(jsii.String("STATE_MACHINE_ARN"), stateMachineArn, nil)
+	pipeline.TriggerFunction.AddToRolePolicy(awsiam.NewPolicyStatement(&awsiam.PolicyStatementProps{
+		Effect: awsiam.Effect_ALLOW,
+		Actions: jsii.Strings(
+			"states:StartExecution",
+			"states:SendTaskSuccess",
+			"states:SendTaskFailure",
+		),
+		Resources: &[]*string{stateMachineArn},
+	}))
+
+	return this
+}
+
+// Retries a lambda step on the errors of the Lambda service and its
+// throttling, along with the extra errors. It replaces the retry of the
+// service errors LambdaInvoke adds, with the same delays.
+func addLambdaRetry(step sfn.TaskStateBase, errors ...string) {
+	step.AddRetry(&sfn.RetryProps{
+		Errors: jsii.Strings(append([]string{
+			"Lambda.ServiceException",
+			"Lambda.AWSLambdaException",
+			"Lambda.SdkClientException",
+			"Lambda.TooManyRequestsException",
+		}, errors...)...),
+		Interval:    awscdk.Duration_Seconds(jsii.Number(2)),
+		BackoffRate: jsii.Number(2),
+		MaxAttempts: jsii.Number(6),
+	})
+}
+
+// Returns a copy of the fields with the extra fields added.
+func withFields(fields map[string]interface{}, extra map[string]interface{}) *map[string]interface{} {
+	merged := map[string]interface{}{}
+	for name, value := range fields {
+		merged[name] = value
+	}
+	for name, value := range extra {
+		merged[name] = value
+	}
+	return &merged
+}
@@ -0,0 +1,420 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"go-cdk-workshop/internal/logging"
+	"go-cdk-workshop/internal/metrics"
+	"go-cdk-workshop/internal/rules"
+
+	"github.com/aws/aws-cdk-go/awscdk/v2"
+	"github.com/aws/constructs-go/constructs/v10"
+	"github.com/aws/jsii-runtime-go"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// The stage deployed when none is given with `-c stage=<name>`.
+	DefaultStage = "dev"
+
+	// The file the stages are read from when none is given with `-c config=<path>`.
+	DefaultFile = "config.yaml"
+
+	// The name of the production stage, it defaults to retaining its data.
+	ProductionStage = "prod"
+)
+
+// Environment holds the settings of a single deployment stage.
+type Environment struct {
+	// The name of the stage, e.g. dev, staging or prod.
+	Stage string `yaml:"-"`
+
+	// What happens to the buckets and the table when they are removed from the
+	// stack, either "destroy" or "retain".
+	RemovalPolicy string `yaml:"removalPolicy"`
+
+	// Whether the objects of the buckets are deleted when the buckets are
+	// destroyed, only allowed with the "destroy" removal policy.
+	AutoDeleteObjects bool `yaml:"autoDeleteObjects"`
+
+	Retention     RetentionConfig     `yaml:"retention"`
+	Ingestion     IngestionConfig     `yaml:"ingestion"`
+	Events        EventsConfig        `yaml:"events"`
+	Notifications NotificationsConfig `yaml:"notifications"`
+	Archive       ArchiveConfig       `yaml:"archive"`
+	Lambda        LambdaConfig        `yaml:"lambda"`
+	Glue          GlueConfig          `yaml:"glue"`
+	API           APIConfig           `yaml:"api"`
+	Monitoring    MonitoringConfig    `yaml:"monitoring"`
+}
+
+// RetentionConfig holds the settings protecting the banking data from being
+// lost along with the stack.
+type RetentionConfig struct {
+	// Whether point-in-time recovery is enabled on the transactions table.
+	PointInTimeRecovery bool `yaml:"pointInTimeRecovery"`
+
+	// Whether the data bucket keeps the previous versions of its objects.
+	Versioning bool `yaml:"versioning"`
+
+	// The number of days the previous versions of the objects are kept for,
+	// zero keeps them forever.
+	NoncurrentVersionDays int `yaml:"noncurrentVersionDays"`
+
+	// Whether the stack has termination protection enabled, so it cannot be
+	// deleted until the protection is turned off.
+	DeletionProtection bool `yaml:"deletionProtection"`
+}
+
+// IngestionConfig holds the rules deciding which uploaded files are ingested.
+type IngestionConfig struct {
+	// The rules of the prefixes watched, the files under none of them are
+	// skipped and the files their rule does not accept are moved to ignored/.
+	Rules []rules.Rule `yaml:"rules"`
+
+	// How the uploads are coalesced into job runs.
+	Batch BatchConfig `yaml:"batch"`
+}
+
+// BatchConfig holds how the uploads are buffered before a job run is started,
+// the files uploaded within the window are loaded by the same run.
+type BatchConfig struct {
+	// The maximum number of files loaded by a single job run.
+	MaxFiles int `yaml:"maxFiles"`
+
+	// How long the uploads are gathered for before a job run is started.
+	WindowSeconds int `yaml:"windowSeconds"`
+}
+
+// EventsConfig holds the retry policy of the EventBridge rules invoking the
+// lambdas, the events that are still failing afterwards are sent to a
+// dead-letter queue.
+type EventsConfig struct {
+	// The number of times a failed event is retried.
+	RetryAttempts int `yaml:"retryAttempts"`
+
+	// The maximum age of an event before it is no longer retried.
+	MaxEventAgeSeconds int `yaml:"maxEventAgeSeconds"`
+}
+
+// NotificationsConfig holds the channels the outcome of each ingestion is
+// published to.
+type NotificationsConfig struct {
+	// The channels the events are published to: "sns", "webhook" and "log".
+	Channels []string `yaml:"channels"`
+
+	// The email addresses subscribed to the SNS topic.
+	Emails []string `yaml:"emails"`
+
+	// Whether the emails are only sent for the failed ingestions.
+	EmailFailuresOnly bool `yaml:"emailFailuresOnly"`
+
+	// The Slack-style incoming webhook the events are posted to.
+	WebhookURL string `yaml:"webhookUrl"`
+}
+
+// ArchiveConfig holds the layout of the folders the processed files are moved to.
+type ArchiveConfig struct {
+	// The template of the key a processed file is moved to, see the
+	// move-to-archive lambda for the placeholders.
+	KeyTemplate string `yaml:"keyTemplate"`
+}
+
+// LambdaConfig holds the settings shared by every lambda function.
+type LambdaConfig struct {
+	MemorySize     int `yaml:"memorySize"`
+	TimeoutSeconds int `yaml:"timeoutSeconds"`
+
+	// The lowest level of the logs written: DEBUG, INFO, WARN or ERROR. The
+	// events received are only logged at DEBUG.
+	LogLevel string `yaml:"logLevel"`
+}
+
+// GlueConfig holds the settings of the Glue job.
+type GlueConfig struct {
+	// The number of parallel tasks used to write to the table.
+	Workers int `yaml:"workers"`
+}
+
+// APIConfig holds the settings of the API Gateway.
+type APIConfig struct {
+	// The origins allowed to call the API from a browser.
+	CorsOrigins []string `yaml:"corsOrigins"`
+}
+
+// MonitoringConfig holds the dashboard and alarms of the business metrics
+// emitted by the lambdas.
+type MonitoringConfig struct {
+	// The CloudWatch namespace of the metrics.
+	Namespace string `yaml:"namespace"`
+
+	// The alarms fire when at least this many files are moved to the failed
+	// folder, or rows rejected, within 5 minutes. Zero disables the alarm.
+	FailedFilesThreshold  int `yaml:"failedFilesThreshold"`
+	RejectedRowsThreshold int `yaml:"rejectedRowsThreshold"`
+
+	// The alarm fires when the 99th percentile of the query latency is over
+	// this many milliseconds for 15 minutes. Zero disables the alarm.
+	QueryLatencyMs int `yaml:"queryLatencyMs"`
+
+	// The email addresses the alarms are sent to.
+	AlarmEmails []string `yaml:"alarmEmails"`
+}
+
+// The layout of the configuration file, the stages keyed by their name.
+type file struct {
+	Stages map[string]yaml.Node `yaml:"stages"`
+}
+
+// Defaults returns the settings used for a stage before the configuration
+// file and context are applied. The production stage retains and protects
+// its data, every other stage is destroyed along with the stack.
+func Defaults(stage string) Environment {
+	env := Environment{
+		Stage:             stage,
+		RemovalPolicy:     "destroy",
+		AutoDeleteObjects: true,
+		Ingestion: IngestionConfig{
+			Rules: []rules.Rule{
+				{Name: "default", Prefix: "input/"},
+			},
+			Batch: BatchConfig{
+				MaxFiles:      100,
+				WindowSeconds: 30,
+			},
+		},
+		Events: EventsConfig{
+			RetryAttempts:      2,
+			MaxEventAgeSeconds: 3600,
+		},
+		Notifications: NotificationsConfig{
+			Channels:          []string{"sns"},
+			EmailFailuresOnly: true,
+		},
+		Archive: ArchiveConfig{
+			KeyTemplate: "{folder}/{yyyy}/{mm}/{dd}/{runId}/{path}",
+		},
+		Lambda: LambdaConfig{
+			MemorySize:     1024,
+			TimeoutSeconds: 15,
+			LogLevel:       "INFO",
+		},
+		Glue: GlueConfig{
+			Workers: 8,
+		},
+		API: APIConfig{
+			CorsOrigins: []string{"*"},
+		},
+		Monitoring: MonitoringConfig{
+			Namespace:             metrics.DefaultNamespace,
+			FailedFilesThreshold:  1,
+			RejectedRowsThreshold: 1000,
+			QueryLatencyMs:        3000,
+		},
+	}
+
+	if stage == ProductionStage {
+		env.RemovalPolicy = "retain"
+		env.AutoDeleteObjects = false
+		env.Retention = RetentionConfig{
+			PointInTimeRecovery:   true,
+			Versioning:            true,
+			NoncurrentVersionDays: 90,
+			DeletionProtection:    true,
+		}
+	}
+
+	return env
+}
+
+// Load returns the settings of the stage selected by the `stage` context
+// value. The defaults of the stage are overridden by its section in the
+// configuration file, then by the `environments.<stage>` context value, so
+// a single setting can be changed from cdk.json or the command line.
+func Load(node constructs.Node) (*Environment, error) {
+	stage := contextString(node, "stage", DefaultStage)
+	env := Defaults(stage)
+
+	// Apply the stage section of the configuration file, if there is one.
+	path := contextString(node, "config", DefaultFile)
+	content, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("reading config file %s: %w", path, err)
+	}
+	if err == nil {
+		var f file
+		if err := yaml.Unmarshal(content, &f); err != nil {
+			return nil, fmt.Errorf("parsing config file %s: %w", path, err)
+		}
+		if section, ok := f.Stages[stage]; ok {
+			if err := section.Decode(&env); err != nil {
+				return nil, fmt.Errorf("parsing stage %s of config file %s: %w", stage, path, err)
+			}
+		}
+	}
+
+	// Apply the stage section of the context, JSON being valid YAML the same
+	// decoder is used for both.
+	if environments, ok := node.TryGetContext(jsii.String("environments")).(map[string]interface{}); ok {
+		if section, ok := environments[stage]; ok {
+			content, err := json.Marshal(section)
+			if err != nil {
+				return nil, fmt.Errorf("reading stage %s of the context: %w", stage, err)
+			}
+			if err := yaml.Unmarshal(content, &env); err != nil {
+				return nil, fmt.Errorf("parsing stage %s of the context: %w", stage, err)
+			}
+		}
+	}
+
+	// The rules that do not list their extensions accept the formats the
+	// pipeline loads, an empty list accepting every extension.
+	for i := range env.Ingestion.Rules {
+		if env.Ingestion.Rules[i].Extensions == nil {
+			env.Ingestion.Rules[i].Extensions = rules.DefaultExtensions
+		}
+	}
+
+	if err := env.Validate(); err != nil {
+		return nil, err
+	}
+
+	return &env, nil
+}
+
+// Validate checks the settings can be deployed.
+func (e *Environment) Validate() error {
+	switch e.RemovalPolicy {
+	case "destroy", "retain":
+	default:
+		return fmt.Errorf("stage %s: unknown removal policy %q", e.Stage, e.RemovalPolicy)
+	}
+
+	if e.AutoDeleteObjects && e.RemovalPolicy != "destroy" {
+		return fmt.Errorf("stage %s: autoDeleteObjects requires the destroy removal policy", e.Stage)
+	}
+
+	if e.Retention.NoncurrentVersionDays < 0 {
+		return fmt.Errorf("stage %s: noncurrentVersionDays cannot be negative", e.Stage)
+	}
+
+	if e.Retention.NoncurrentVersionDays > 0 && !e.Retention.Versioning {
+		return fmt.Errorf("stage %s: noncurrentVersionDays requires versioning", e.Stage)
+	}
+
+	if err := rules.Validate(e.Ingestion.Rules); err != nil {
+		return fmt.Errorf("stage %s: %w", e.Stage, err)
+	}
+
+	if e.Ingestion.Batch.MaxFiles < 1 || e.Ingestion.Batch.MaxFiles > 10000 {
+		return fmt.Errorf("stage %s: the batch max files must be between 1 and 10000", e.Stage)
+	}
+
+	if e.Ingestion.Batch.WindowSeconds < 0 || e.Ingestion.Batch.WindowSeconds > 300 {
+		return fmt.Errorf("stage %s: the batch window must be between 0 and 300 seconds", e.Stage)
+	}
+
+	if e.Ingestion.Batch.MaxFiles > 10 && e.Ingestion.Batch.WindowSeconds == 0 {
+		return fmt.Errorf("stage %s: a batch of more than 10 files requires a batch window", e.Stage)
+	}
+
+	if e.Events.RetryAttempts < 0 || e.Events.RetryAttempts > 185 {
+		return fmt.Errorf("stage %s: event retry attempts must be between 0 and 185", e.Stage)
+	}
+
+	if e.Events.MaxEventAgeSeconds < 60 || e.Events.MaxEventAgeSeconds > 86400 {
+		return fmt.Errorf("stage %s: max event age must be between 60 and 86400 seconds", e.Stage)
+	}
+
+	for _, channel := range e.Notifications.Channels {
+		switch channel {
+		case "sns", "log":
+		case "webhook":
+			if e.Notifications.WebhookURL == "" {
+				return fmt.Errorf("stage %s: the webhook notification channel requires a webhookUrl", e.Stage)
+			}
+		default:
+			return fmt.Errorf("stage %s: unknown notification channel %q", e.Stage, channel)
+		}
+	}
+
+	if !strings.Contains(e.Archive.KeyTemplate, "{path}") && !strings.Contains(e.Archive.KeyTemplate, "{file}") {
+		return fmt.Errorf("stage %s: the archive key template must contain {path} or {file}", e.Stage)
+	}
+
+	if e.Lambda.MemorySize < 128 || e.Lambda.MemorySize > 10240 {
+		return fmt.Errorf("stage %s: lambda memory size must be between 128 and 10240 MB", e.Stage)
+	}
+
+	if e.Lambda.TimeoutSeconds < 1 || e.Lambda.TimeoutSeconds > 900 {
+		return fmt.Errorf("stage %s: lambda timeout must be between 1 and 900 seconds", e.Stage)
+	}
+
+	if _, err := logging.ParseLevel(e.Lambda.LogLevel); err != nil {
+		return fmt.Errorf("stage %s: %w", e.Stage, err)
+	}
+
+	if e.Glue.Workers < 1 {
+		return fmt.Errorf("stage %s: glue workers must be at least 1", e.Stage)
+	}
+
+	if e.Monitoring.Namespace == "" {
+		return fmt.Errorf("stage %s: the metrics namespace is required", e.Stage)
+	}
+
+	if e.Monitoring.FailedFilesThreshold < 0 || e.Monitoring.RejectedRowsThreshold < 0 || e.Monitoring.QueryLatencyMs < 0 {
+		return fmt.Errorf("stage %s: the alarm thresholds cannot be negative", e.Stage)
+	}
+
+	if len(e.API.CorsOrigins) == 0 {
+		return fmt.Errorf("stage %s: at least one CORS origin is required", e.Stage)
+	}
+
+	return nil
+}
+
+// Removal returns the CDK removal policy of the stateful resources.
+func (e *Environment) Removal() awscdk.RemovalPolicy {
+	switch e.RemovalPolicy {
+	case "retain":
+		return awscdk.RemovalPolicy_RETAIN
+	default:
+		return awscdk.RemovalPolicy_DESTROY
+	}
+}
+
+// NoncurrentVersionExpiration returns how long the previous versions of the
+// objects are kept for, nil when they are kept forever.
+func (r RetentionConfig) NoncurrentVersionExpiration() awscdk.Duration {
+	if r.NoncurrentVersionDays == 0 {
+		return nil
+	}
+	return awscdk.Duration_Days(jsii.Number(float64(r.NoncurrentVersionDays)))
+}
+
+// MaxEventAge returns the maximum age of an event before it is no longer retried.
+func (e EventsConfig) MaxEventAge() awscdk.Duration {
+	return awscdk.Duration_Seconds(jsii.Number(float64(e.MaxEventAgeSeconds)))
+}
+
+// Window returns how long the uploads are gathered for before a job run is started.
+func (b BatchConfig) Window() awscdk.Duration {
+	return awscdk.Duration_Seconds(jsii.Number(float64(b.WindowSeconds)))
+}
+
+// Timeout returns the timeout of the lambda functions.
+func (l LambdaConfig) Timeout() awscdk.Duration {
+	return awscdk.Duration_Seconds(jsii.Number(float64(l.TimeoutSeconds)))
+}
+
+// Reads a string context value, returning the fallback when it is not set.
+func contextString(node constructs.Node, key string, fallback string) string {
+	if value, ok := node.TryGetContext(jsii.String(key)).(string); ok && value != "" {
+		return value
+	}
+	return fallback
+}
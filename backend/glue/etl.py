@@ -1,14 +1,35 @@
 import sys
+import json
+import boto3
+from urllib.parse import unquote
+from datetime import datetime, timezone
 from awsglue.transforms import *
 from awsglue.utils import getResolvedOptions
 from pyspark.context import SparkContext
 from pyspark.sql import functions as F
+from pyspark.sql.window import Window
 from awsglue.context import GlueContext
 from awsglue.job import Job
 from awsglue.dynamicframe import DynamicFrame
 
-## @params: [JOB_NAME, s3_bucket, s3_key, table, workers]
-args = getResolvedOptions(sys.argv, ['JOB_NAME', 's3_bucket', 's3_key', 'table', 'workers'])
+## @params: [JOB_NAME, JOB_RUN_ID, s3_bucket, s3_key, format, schema, table, workers, rejected_prefix, stats_prefix, manifest (optional), correlation_id (optional)]
+optional_params = [name for name in ['manifest', 'correlation_id'] if f'--{name}' in sys.argv]
+args = getResolvedOptions(sys.argv, ['JOB_NAME', 'JOB_RUN_ID', 's3_bucket', 's3_key', 'format', 'schema', 'table', 'workers', 'rejected_prefix', 'stats_prefix'] + optional_params)
+
+# Logs a JSON line with the job run and correlation id, like the logs of the lambdas, so a file
+# is followed from its upload through the job to its archive
+def log(message, level="INFO", **fields):
+    entry = {
+        "time": datetime.now(timezone.utc).isoformat(),
+        "level": level,
+        "message": message,
+        "correlationId": fields.pop("correlationId", None) or args.get("correlation_id"),
+        "jobRunId": args["JOB_RUN_ID"],
+    }
+    if args.get("manifest"):
+        entry["ingestionId"] = args["manifest"].split("/")[-1].rsplit(".json", 1)[0]
+    entry.update(fields)
+    print(json.dumps(entry))
 
 #Create spark context
 sc = SparkContext()
@@ -17,66 +38,232 @@ spark = glueContext.spark_session
 job = Job(glueContext)
 job.init(args['JOB_NAME'], args)
 
-# Gets the s3 file source
-s3_file_source = f's3://{args["s3_bucket"]}/{args["s3_key"]}'
+# Unparseable dates become null instead of failing the run, so the rows can be rejected
+spark.conf.set("spark.sql.legacy.timeParserPolicy", "CORRECTED")
+
+# Gets the s3 file sources, the files of the manifest written by glue-trigger when the uploads
+# were coalesced into a single run, or the s3_key file
+s3_keys = [args["s3_key"]]
+if args.get("manifest"):
+    manifest = json.loads(boto3.client("s3").get_object(Bucket=args["s3_bucket"], Key=args["manifest"])["Body"].read())
+    s3_keys = [file["key"] for file in manifest["files"]]
+    log("Loading the files of the manifest", manifest=args["manifest"], files=len(s3_keys))
+    for file in manifest["files"]:
+        log("Loading the file", key=file["key"], correlationId=file.get("correlationId"))
+s3_file_sources = [f's3://{args["s3_bucket"]}/{key}' for key in s3_keys]
+
+# The column the path of the file of each row is added to, so the rows are counted per file
+source_file_column = "_sourceFile"
+bucket_path = f's3://{args["s3_bucket"]}/'
 
-# Extract s3 file longo dynamic frame
+# Count the rows of each file with the Spark readers, apart from the Glue reader loading them, so
+# the rows the load drops are found when the files are reconciled
+readers = {
+    "csv": spark.read.option("header", True).option("multiLine", True).csv,
+    "parquet": spark.read.parquet,
+    "json": spark.read.json,
+}
+# input_file_name() returns the URI of the file, whose key is URL-encoded, e.g. a space is %20
+source_rows = {key: 0 for key in s3_keys}
+for row in readers[args["format"]](s3_file_sources).groupBy(F.input_file_name().alias("path")).count().collect():
+    source_rows[unquote(row["path"])[len(bucket_path):]] = row["count"]
+
+# Extract s3 file longo dynamic frame, the format is csv, parquet or json (JSON Lines) and
+# .gz and .bz2 files are decompressed based on their extension. attachFilename is an option of
+# the S3 connection, it is ignored in the format options
+format_options = {}
+if args["format"] == "csv":
+    format_options["withHeader"] = True
 inputGDF = glueContext.create_dynamic_frame_from_options(
     connection_type="s3", 
-    format="csv", 
-    format_options={"withHeader":True},
-    connection_options={"paths": [s3_file_source], 
-    "recurse": True}
+    format=args["format"], 
+    format_options=format_options,
+    connection_options={"paths": s3_file_sources, 
+    "recurse": True,
+    "attachFilename": source_file_column}
 )
 
-# Apply mapping
+# The schema of the file, its columns, their aliases and types, see backend/internal/schema
+schema = json.loads(args["schema"])
+schema_ref = f'{schema["name"]}@v{schema["version"]}'
+log("Loading the files with the schema", schema=schema_ref)
+
+# The columns of the file and the types they are loaded as, the timestamps are converted once loaded
+mappings = [
+    (column["name"], "string", column["name"], "string" if column["type"] == "timestamp" else column["type"])
+    for column in schema["columns"]
+]
+
+# The columns a row cannot be loaded without
+required_columns = [column["name"] for column in schema["columns"] if column.get("required")]
+
+# The timestamp columns and their formats
+date_formats = {column["name"]: column["format"] for column in schema["columns"] if column["type"] == "timestamp"}
+
+# Convert dynamic frame to data frame
+rawDF = inputGDF.toDF()
+
+# Name the columns as in the schema, matching their names and aliases ignoring the case. The other
+# columns are not loaded, e.g. the unnamed index column, and only the first of the columns with the
+# same name is, e.g. the second CountryCode column of the sample file
+schema_names = {}
+ignored_names = [name.lower() for name in schema.get("ignored", [])]
+for column in schema["columns"]:
+    for name in [column["name"]] + column.get("aliases", []):
+        schema_names[name.lower()] = column["name"]
+file_columns = rawDF.columns
+rawDF = rawDF.toDF(*[f"_column{index}" for index in range(len(file_columns))])
+selected, unexpected_columns = [], []
+for index, name in enumerate(file_columns):
+    if name == source_file_column:
+        selected.append((f"_column{index}", source_file_column))
+        continue
+    target = schema_names.get(name.strip().lower())
+    if target is None:
+        if name.strip() and name.strip().lower() not in ignored_names:
+            unexpected_columns.append(name)
+        continue
+    if target in [column for _, column in selected]:
+        continue
+    selected.append((f"_column{index}", target))
+rawDF = rawDF.select(*[F.col(source).alias(target) for source, target in selected])
+if unexpected_columns:
+    log("Columns not in the schema, not loaded", level="WARN", columns=unexpected_columns)
+
+# Parquet and JSON files have typed columns, turn them into the strings a CSV file would have
+# so every format is validated and mapped the same way
+if args["format"] != "csv":
+    columns = []
+    for field in rawDF.schema.fields:
+        value = F.col(field.name)
+        if field.name == source_file_column:
+            columns.append(value)
+            continue
+        type_name = field.dataType.typeName()
+        if type_name in ("timestamp", "date") and field.name in date_formats:
+            value = F.date_format(value, date_formats[field.name])
+        elif type_name == "boolean":
+            value = F.upper(value.cast("string"))
+        columns.append(value.cast("string").alias(field.name))
+    rawDF = rawDF.select(*columns)
+
+# Validate each row against the schema, the reason codes of a row are separated by ";"
+checks = []
+for column in required_columns:
+    value = F.col(column) if column in rawDF.columns else F.lit(None)
+    checks.append(F.when(value.isNull() | (F.trim(value) == ""), F.lit(f"MISSING_VALUE:{column}")))
+for source, _, _, target_type in mappings:
+    if source not in rawDF.columns:
+        continue
+    value = F.col(source)
+    present = value.isNotNull() & (F.trim(value) != "")
+    if target_type in ("double", "long"):
+        checks.append(F.when(present & value.cast(target_type).isNull(), F.lit(f"INVALID_NUMBER:{source}")))
+    if target_type == "boolean":
+        checks.append(F.when(present & value.cast("boolean").isNull(), F.lit(f"INVALID_BOOLEAN:{source}")))
+    if source in date_formats:
+        checks.append(F.when(present & F.to_timestamp(value, date_formats[source]).isNull(), F.lit(f"INVALID_DATE:{source}")))
+rawDF = rawDF.withColumn("rejectReasons", F.concat_ws(";", *checks))
+
+# Key the rows by their file, without the bucket. The column is missing when no row was read, and
+# the rows of several files cannot be told apart without it, so the run fails instead of loading
+# them under the wrong file
+if source_file_column in rawDF.columns:
+    rawDF = rawDF.withColumn(source_file_column, F.expr(f"substring({source_file_column}, {len(bucket_path) + 1})"))
+elif len(s3_keys) == 1 or rawDF.rdd.isEmpty():
+    rawDF = rawDF.withColumn(source_file_column, F.lit(s3_keys[0]))
+else:
+    log("The rows were read without the key of their file", level="ERROR", files=len(s3_keys))
+    raise Exception(f"The rows of the {len(s3_keys)} files were read without the {source_file_column} column")
+
+# Number the rows of each file in the order they were read, the header excluded, so a loaded or
+# rejected row can be traced back to its line
+row_number_column = "_rowNumber"
+rawDF = rawDF.withColumn(row_number_column, F.row_number().over(
+    Window.partitionBy(source_file_column).orderBy(F.monotonically_increasing_id())
+))
+rawDF = rawDF.cache()
+
+acceptedDF = rawDF.filter(F.col("rejectReasons") == "").drop("rejectReasons")
+rejectedDF = rawDF.filter(F.col("rejectReasons") != "")
+
+# Count the accepted and rejected rows of each file
+file_counts = {key: {"sourceRows": source_rows.get(key, 0), "acceptedRows": 0, "rejectedRows": 0} for key in s3_keys}
+counts = rawDF.groupBy(source_file_column).agg(
+    F.sum(F.when(F.col("rejectReasons") == "", 1).otherwise(0)).alias("acceptedRows"),
+    F.sum(F.when(F.col("rejectReasons") != "", 1).otherwise(0)).alias("rejectedRows"),
+).collect()
+for row in counts:
+    file_counts.setdefault(row[source_file_column], {"sourceRows": source_rows.get(row[source_file_column], 0)})
+    file_counts[row[source_file_column]].update({"acceptedRows": row["acceptedRows"], "rejectedRows": row["rejectedRows"]})
+accepted_rows = sum(count["acceptedRows"] for count in file_counts.values())
+rejected_rows = sum(count["rejectedRows"] for count in file_counts.values())
+
+# Write the rejected rows as JSON lines with their reason codes, so they can be fixed and uploaded again
+rejected_path = f's3://{args["s3_bucket"]}/{args["rejected_prefix"]}{args["JOB_RUN_ID"]}/'
+reason_counts = {}
+if rejected_rows > 0:
+    rejectedDF \
+        .withColumnRenamed(source_file_column, "sourceKey") \
+        .withColumnRenamed(row_number_column, "rowNumber") \
+        .withColumn("rejectReasons", F.split(F.col("rejectReasons"), ";")) \
+        .write.mode("overwrite").json(rejected_path)
+    for row in rejectedDF.select(F.explode(F.split(F.col("rejectReasons"), ";")).alias("reason")).groupBy("reason").count().collect():
+        reason_counts[row["reason"]] = row["count"]
+
+# Apply mapping to the accepted rows, each item keeps the key of its file and its row number so it
+# can be reconciled and traced back to its source
 inputGDF = ApplyMapping.apply(
-    frame = inputGDF, 
-    mappings = [
-        ("accountNumber", "string", "accountNumber", "string"),
-        ("customerId", "string", "customerId", "string"),
-        ("creditLimit", "string", "creditLimit", "double"),
-        ("availableMoney", "string", "availableMoney", "double"),
-        ("transactionDateTime", "string", "transactionDateTime", "string"),
-        ("transactionAmount", "string", "transactionAmount", "double"),
-        ("merchantName", "string", "merchantName", "string"),
-        ("acqCountry", "string", "acqCountry", "string"),
-        ("merchantCountryCode", "string", "merchantCountryCode", "string"),
-        ("posEntryMode", "string", "posEntryMode", "long"),
-        ("posConditionCode", "string", "posConditionCode", "long"),
-        ("merchantCategoryCode", "string", "merchantCategoryCode", "string"),
-        ("currentExpDate", "string", "currentExpDate", "string"),
-        ("accountOpenDate", "string", "accountOpenDate", "string"),
-        ("dateOfLastAddressChange", "string", "dateOfLastAddressChange", "string"),
-        ("cardCVV", "string", "cardCVV", "long"),
-        ("enteredCVV", "string", "enteredCVV", "long"),
-        ("cardLast4Digits", "string", "cardLast4Digits", "long"),
-        ("transactionType", "string", "transactionType", "string"),
-        ("currentBalance", "string", "currentBalance", "double"),
-        ("cardPresent", "string", "cardPresent", "string"),
-        ("isFraud", "string", "isFraud", "string"),
-        ("CountryCode", "string", "CountryCode", "string"),
+    frame = DynamicFrame.fromDF(acceptedDF, glueContext, "acceptedGDF"),
+    mappings = [m for m in mappings if m[0] in acceptedDF.columns] + [
+        (source_file_column, "string", "sourceKey", "string"),
+        (row_number_column, "int", "rowNumber", "long"),
     ]
 )
 
 # Convert dynamic frame to data frame
 inputDF = inputGDF.toDF()
 
-# Create a UUID column to be used as a primary key
-inputDF = inputDF.withColumn("id", F.monotonically_increasing_id())
+# Record the lineage of each item: its bucket, the job run that loaded it and when, along with
+# the key and row number of its file
+inputDF = inputDF \
+    .withColumn("sourceBucket", F.lit(args["s3_bucket"])) \
+    .withColumn("jobRunId", F.lit(args["JOB_RUN_ID"])) \
+    .withColumn("ingestedAt", F.lit(datetime.now(timezone.utc).strftime("%Y-%m-%dT%H:%M:%SZ")))
+
+# Derive the primary key from the lineage of the row, so the items of other runs are never
+# overwritten and a run loading the same rows again writes the same ids. The hash is cut to 53
+# bits so the ids survive the float64 of the API and the numbers of the frontend, their sums wrap
+# around as they do in the archive lambda
+inputDF = inputDF.withColumn("id", F.xxhash64("sourceKey", "jobRunId", "rowNumber").bitwiseAND(F.lit((1 << 53) - 1)))
+inputDF = inputDF.cache()
 
 # Remove everything past hyphen in CountryCode column
-inputDF = inputDF.withColumn("CountryCode", inputDF["CountryCode"].substr(0, 2))
+if "CountryCode" in inputDF.columns:
+    inputDF = inputDF.withColumn("CountryCode", inputDF["CountryCode"].substr(0, 2))
 
 # If isFraud is "FALSE", set to "TRUE"
-inputDF = inputDF.withColumn("isFraud", F.when(inputDF["isFraud"] == "FALSE", "TRUE").otherwise(inputDF["isFraud"]))
+if "isFraud" in inputDF.columns:
+    inputDF = inputDF.withColumn("isFraud", F.when(inputDF["isFraud"] == "FALSE", "TRUE").otherwise(inputDF["isFraud"]))
 
-# Convert transactionDateTime yyyy-mm-ddThh:mm:ss to a timestamp
-inputDF = inputDF.withColumn("transactionDateTime", F.unix_timestamp(inputDF["transactionDateTime"], "yyyy-MM-dd'T'HH:mm:ss").cast("timestamp"))
+# Convert the timestamp columns, e.g. transactionDateTime yyyy-mm-ddThh:mm:ss, with their format
+for name, date_format in date_formats.items():
+    if name in inputDF.columns:
+        inputDF = inputDF.withColumn(name, F.unix_timestamp(inputDF[name], date_format).cast("timestamp"))
 
-# Convert accountOpenDate, dateOfLastAddressChange mm/dd/yy to a timestamp
-inputDF = inputDF.withColumn("accountOpenDate", F.unix_timestamp(inputDF["accountOpenDate"], "M/d/yy").cast("timestamp"))
-inputDF = inputDF.withColumn("dateOfLastAddressChange", F.unix_timestamp(inputDF["dateOfLastAddressChange"], "M/d/yy").cast("timestamp"))
+# Sum the ids and the amounts in cents of the rows of each file, the archive lambda compares them
+# with the items found in the table
+amount_column = schema.get("amount")
+checksums = [F.sum("id").alias("idChecksum")]
+if amount_column:
+    for counts in file_counts.values():
+        counts["amountChecksum"] = 0
+    if amount_column in inputDF.columns:
+        checksums.append(F.coalesce(F.sum(F.round(F.col(amount_column) * 100).cast("long")), F.lit(0)).alias("amountChecksum"))
+for counts in file_counts.values():
+    counts["idChecksum"] = 0
+for row in inputDF.groupBy("sourceKey").agg(*checksums).collect():
+    file_counts[row["sourceKey"]].update({name: row[name] for name in row.asDict() if name != "sourceKey"})
 
 # Convert dateframe to dynamic frame
 inputGDF = DynamicFrame.fromDF(inputDF, glueContext, "inputGDF")
@@ -90,4 +277,28 @@ Datasink1 = glueContext.write_dynamic_frame_from_options(
         "dynamodb.throughput.write.percent": "1.0",
         "dynamodb.output.numParallelTasks": args["workers"]
     },
-)
\ No newline at end of file
+)
+
+# Record how many rows were loaded and rejected, the archive lambda adds them to the archived file
+stats = {
+    "jobRunId": args["JOB_RUN_ID"],
+    "sourceBucket": args["s3_bucket"],
+    "sourceKey": args["s3_key"],
+    "manifest": args.get("manifest"),
+    "schema": schema_ref,
+    "unexpectedColumns": unexpected_columns,
+    "acceptedRows": accepted_rows,
+    "rejectedRows": rejected_rows,
+    "rejectReasons": reason_counts,
+    "files": file_counts,
+}
+if rejected_rows > 0:
+    stats["rejectedPath"] = rejected_path
+boto3.client("s3").put_object(
+    Bucket=args["s3_bucket"],
+    Key=f'{args["stats_prefix"]}{args["JOB_RUN_ID"]}.json',
+    Body=json.dumps(stats, indent=2).encode("utf-8"),
+    ContentType="application/json",
+)
+
+job.commit()
@@ -4,17 +4,18 @@ go 1.18
 
 require (
 	github.com/aws/aws-cdk-go/awscdk/v2 v2.47.0
+	github.com/aws/aws-cdk-go/awscdkgluealpha/v2 v2.47.0-alpha.0
+	github.com/aws/aws-cdk-go/awscdklambdagoalpha/v2 v2.46.0-alpha.0
+	github.com/aws/aws-lambda-go v1.34.1
+	github.com/aws/aws-sdk-go v1.44.118
 	github.com/aws/constructs-go/constructs/v10 v10.1.133
 	github.com/aws/jsii-runtime-go v1.69.0
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
 	github.com/Masterminds/semver/v3 v3.1.1 // indirect
 	github.com/aws/aws-cdk-go/awscdk v1.177.0-devpreview // indirect
-	github.com/aws/aws-cdk-go/awscdkgluealpha/v2 v2.47.0-alpha.0 // indirect
-	github.com/aws/aws-cdk-go/awscdklambdagoalpha/v2 v2.46.0-alpha.0 // indirect
-	github.com/aws/aws-lambda-go v1.34.1 // indirect
-	github.com/aws/aws-sdk-go v1.44.118 // indirect
 	github.com/aws/constructs-go/constructs/v3 v3.4.121 // indirect
 	github.com/jmespath/go-jmespath v0.4.0 // indirect
 )
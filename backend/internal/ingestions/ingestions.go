@@ -0,0 +1,394 @@
+// Package ingestions records the state of each ingestion in the ingestions
+// table, one item per batch of files loaded by a job run, keyed by the id of
+// its manifest. The glue-trigger lambda records the batches it queues and
+// starts, the move-to-archive lambda the outcome of their files, and the
+// ingestion-status lambda serves them to the frontend.
+package ingestions
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// The states of an ingestion and of its files. A file the workflow dropped
+// because it was moved or replaced before it was loaded is skipped, a file
+// whose upload URL was issued is pending until it is queued.
+const (
+	StatePending = "PENDING"
+	StateQueued  = "QUEUED"
+	StateRunning = "RUNNING"
+	StateLoaded  = "LOADED"
+	StatePartial = "PARTIALLY_LOADED"
+	StateFailed  = "FAILED"
+	StateSkipped = "SKIPPED"
+)
+
+// DayIndex is the index of the ingestions by the day they were queued on.
+const DayIndex = "ByDay"
+
+// Ingestion is the record of a batch of files loaded by a job run.
+type Ingestion struct {
+	ID       string `json:"id"`
+	Bucket   string `json:"bucket"`
+	Manifest string `json:"manifest"`
+	Rule     string `json:"rule,omitempty"`
+	Schema   string `json:"schema,omitempty"`
+	Format   string `json:"format,omitempty"`
+	State    string `json:"state"`
+	JobName  string `json:"jobName,omitempty"`
+	JobRunID string `json:"jobRunId,omitempty"`
+
+	// The keys of the files, and their outcome by key.
+	Keys  []string         `json:"keys"`
+	Files map[string]*File `json:"files"`
+
+	// The rows loaded and rejected over every file.
+	AcceptedRows int64 `json:"acceptedRows"`
+	RejectedRows int64 `json:"rejectedRows"`
+
+	// Why the ingestion failed, the message of the first failed file.
+	ErrorMessage string `json:"errorMessage,omitempty"`
+
+	// For an upload, the ingestion loading its file once it is queued, and
+	// when its upload URL expires.
+	IngestionID string     `json:"ingestionId,omitempty"`
+	ExpiresAt   *time.Time `json:"expiresAt,omitempty"`
+
+	// The day the ingestion was queued on, 2006-01-02, and when it was
+	// queued, started and finished. The uploads have no day, so they are
+	// not listed.
+	Day        string     `json:"day,omitempty"`
+	CreatedAt  time.Time  `json:"createdAt"`
+	StartedAt  *time.Time `json:"startedAt,omitempty"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	UpdatedAt  time.Time  `json:"updatedAt"`
+}
+
+// File is the outcome of a file of an ingestion.
+type File struct {
+	Key            string     `json:"key"`
+	Size           int64      `json:"size"`
+	State          string     `json:"state"`
+	DestinationKey string     `json:"destinationKey,omitempty"`
+	AcceptedRows   *int64     `json:"acceptedRows,omitempty"`
+	RejectedRows   *int64     `json:"rejectedRows,omitempty"`
+	ErrorMessage   string     `json:"errorMessage,omitempty"`
+	DiagnosticsKey string     `json:"diagnosticsKey,omitempty"`
+	FinishedAt     *time.Time `json:"finishedAt,omitempty"`
+}
+
+// Queue records a new ingestion with its files queued. An ingestion already
+// recorded, e.g. when the upload event is delivered twice, is left as is.
+func Queue(ctx context.Context, client dynamodbiface.DynamoDBAPI, table string, ingestion *Ingestion) error {
+	now := time.Now().UTC()
+	ingestion.State = StateQueued
+	ingestion.CreatedAt = now
+	ingestion.UpdatedAt = now
+	ingestion.Day = now.Format("2006-01-02")
+
+	item, err := dynamodbattribute.MarshalMap(ingestion)
+	if err != nil {
+		return err
+	}
+	_, err = client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:                aws.String(table),
+		Item:                     item,
+		ConditionExpression:      aws.String("attribute_not_exists(#id)"),
+		ExpressionAttributeNames: map[string]*string{"#id": aws.String("id")},
+	})
+	if isConditionFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// Start records the job run loading the files of the ingestion.
+func Start(ctx context.Context, client dynamodbiface.DynamoDBAPI, table string, id string, jobName string, jobRunID string) error {
+	now, err := dynamodbattribute.Marshal(time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	_, err = client.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:        aws.String(table),
+		Key:              map[string]*dynamodb.AttributeValue{"id": {S: aws.String(id)}},
+		UpdateExpression: aws.String("SET #state = :state, #jobName = :jobName, #jobRunId = :jobRunId, #startedAt = :now, #updatedAt = :now"),
+		// An ingestion finished in the meantime keeps its outcome.
+		ConditionExpression: aws.String("attribute_exists(#id) AND #state = :queued"),
+		ExpressionAttributeNames: map[string]*string{
+			"#id":        aws.String("id"),
+			"#state":     aws.String("state"),
+			"#jobName":   aws.String("jobName"),
+			"#jobRunId":  aws.String("jobRunId"),
+			"#startedAt": aws.String("startedAt"),
+			"#updatedAt": aws.String("updatedAt"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":state":    {S: aws.String(StateRunning)},
+			":queued":   {S: aws.String(StateQueued)},
+			":jobName":  {S: aws.String(jobName)},
+			":jobRunId": {S: aws.String(jobRunID)},
+			":now":      now,
+		},
+	})
+	if isConditionFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// SetFile records the outcome of a file of the ingestion.
+func SetFile(ctx context.Context, client dynamodbiface.DynamoDBAPI, table string, id string, file *File) error {
+	value, err := dynamodbattribute.Marshal(file)
+	if err != nil {
+		return err
+	}
+	now, err := dynamodbattribute.Marshal(time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	_, err = client.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:           aws.String(table),
+		Key:                 map[string]*dynamodb.AttributeValue{"id": {S: aws.String(id)}},
+		UpdateExpression:    aws.String("SET #files.#key = :file, #updatedAt = :now"),
+		ConditionExpression: aws.String("attribute_exists(#id)"),
+		ExpressionAttributeNames: map[string]*string{
+			"#id":        aws.String("id"),
+			"#files":     aws.String("files"),
+			"#key":       aws.String(file.Key),
+			"#updatedAt": aws.String("updatedAt"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":file": value,
+			":now":  now,
+		},
+	})
+	if isConditionFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// Finish records the outcome of the ingestion once its files are archived or
+// failed, the files without an outcome were skipped by the workflow.
+func Finish(ctx context.Context, client dynamodbiface.DynamoDBAPI, table string, id string) error {
+	ingestion, err := Get(ctx, client, table, id)
+	if err != nil || ingestion == nil {
+		return err
+	}
+
+	now := time.Now().UTC()
+	ingestion.AcceptedRows, ingestion.RejectedRows = 0, 0
+	loaded, failed := 0, 0
+	for _, key := range ingestion.Keys {
+		file := ingestion.Files[key]
+		switch {
+		case file == nil:
+			continue
+		case file.State == StateLoaded:
+			loaded++
+		case file.State == StateFailed:
+			failed++
+			if ingestion.ErrorMessage == "" {
+				ingestion.ErrorMessage = file.ErrorMessage
+			}
+		case file.State != StateSkipped:
+			file.State = StateSkipped
+			file.FinishedAt = &now
+		}
+		ingestion.AcceptedRows += aws.Int64Value(file.AcceptedRows)
+		ingestion.RejectedRows += aws.Int64Value(file.RejectedRows)
+	}
+
+	switch {
+	case failed == 0 && loaded > 0:
+		ingestion.State = StateLoaded
+	case loaded == 0:
+		ingestion.State = StateFailed
+	default:
+		ingestion.State = StatePartial
+	}
+	ingestion.FinishedAt = &now
+	ingestion.UpdatedAt = now
+
+	item, err := dynamodbattribute.MarshalMap(ingestion)
+	if err != nil {
+		return err
+	}
+	_, err = client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(table),
+		Item:      item,
+	})
+	return err
+}
+
+// CreateUpload records the upload of a file whose upload URL was issued, its
+// id is the id of the upload.
+func CreateUpload(ctx context.Context, client dynamodbiface.DynamoDBAPI, table string, upload *Ingestion) error {
+	now := time.Now().UTC()
+	upload.State = StatePending
+	upload.CreatedAt = now
+	upload.UpdatedAt = now
+
+	item, err := dynamodbattribute.MarshalMap(upload)
+	if err != nil {
+		return err
+	}
+	_, err = client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName:                aws.String(table),
+		Item:                     item,
+		ConditionExpression:      aws.String("attribute_not_exists(#id)"),
+		ExpressionAttributeNames: map[string]*string{"#id": aws.String("id")},
+	})
+	return err
+}
+
+// LinkUpload records the ingestion loading the file of an upload.
+func LinkUpload(ctx context.Context, client dynamodbiface.DynamoDBAPI, table string, uploadID string, ingestionID string) error {
+	return updateUpload(ctx, client, table, uploadID, "SET #ingestionId = :ingestionId, #state = :state, #updatedAt = :now",
+		map[string]*string{"#ingestionId": aws.String("ingestionId"), "#state": aws.String("state")},
+		map[string]*dynamodb.AttributeValue{
+			":ingestionId": {S: aws.String(ingestionID)},
+			":state":       {S: aws.String(StateQueued)},
+		})
+}
+
+// FailUpload records why the file of an upload was not queued, e.g. it was
+// ignored by its rule or rejected by the preflight checks.
+func FailUpload(ctx context.Context, client dynamodbiface.DynamoDBAPI, table string, uploadID string, key string, message string) error {
+	return updateUpload(ctx, client, table, uploadID, "SET #state = :state, #errorMessage = :message, #files.#key.#state = :state, #files.#key.#errorMessage = :message, #finishedAt = :now, #updatedAt = :now",
+		map[string]*string{
+			"#state":        aws.String("state"),
+			"#errorMessage": aws.String("errorMessage"),
+			"#files":        aws.String("files"),
+			"#key":          aws.String(key),
+			"#finishedAt":   aws.String("finishedAt"),
+		},
+		map[string]*dynamodb.AttributeValue{
+			":state":   {S: aws.String(StateFailed)},
+			":message": {S: aws.String(message)},
+		})
+}
+
+// Updates an upload, the uploads that were not recorded are left out.
+func updateUpload(ctx context.Context, client dynamodbiface.DynamoDBAPI, table string, uploadID string, expression string, names map[string]*string, values map[string]*dynamodb.AttributeValue) error {
+	now, err := dynamodbattribute.Marshal(time.Now().UTC())
+	if err != nil {
+		return err
+	}
+	names["#id"] = aws.String("id")
+	names["#updatedAt"] = aws.String("updatedAt")
+	values[":now"] = now
+
+	_, err = client.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName:                 aws.String(table),
+		Key:                       map[string]*dynamodb.AttributeValue{"id": {S: aws.String(uploadID)}},
+		UpdateExpression:          aws.String(expression),
+		ConditionExpression:       aws.String("attribute_exists(#id)"),
+		ExpressionAttributeNames:  names,
+		ExpressionAttributeValues: values,
+	})
+	if isConditionFailed(err) {
+		return nil
+	}
+	return err
+}
+
+// Get returns an ingestion, or nil when it was not recorded.
+func Get(ctx context.Context, client dynamodbiface.DynamoDBAPI, table string, id string) (*Ingestion, error) {
+	output, err := client.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(table),
+		Key:            map[string]*dynamodb.AttributeValue{"id": {S: aws.String(id)}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(output.Item) == 0 {
+		return nil, nil
+	}
+
+	ingestion := &Ingestion{}
+	if err := dynamodbattribute.UnmarshalMap(output.Item, ingestion); err != nil {
+		return nil, err
+	}
+	return ingestion, nil
+}
+
+// ListInput selects the ingestions of a day, the latest first.
+type ListInput struct {
+	Day string
+
+	// Only the ingestions in the state, or loading the file, when set.
+	State string
+	Key   string
+
+	Limit             int64
+	ExclusiveStartKey map[string]*dynamodb.AttributeValue
+}
+
+// List returns a page of the ingestions of a day, and the key the next page
+// starts after.
+func List(ctx context.Context, client dynamodbiface.DynamoDBAPI, table string, input ListInput) ([]*Ingestion, map[string]*dynamodb.AttributeValue, error) {
+	query := &dynamodb.QueryInput{
+		TableName:                aws.String(table),
+		IndexName:                aws.String(DayIndex),
+		KeyConditionExpression:   aws.String("#day = :day"),
+		ExpressionAttributeNames: map[string]*string{"#day": aws.String("day")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":day": {S: aws.String(input.Day)},
+		},
+		ScanIndexForward:  aws.Bool(false),
+		Limit:             aws.Int64(input.Limit),
+		ExclusiveStartKey: input.ExclusiveStartKey,
+	}
+
+	filters := []string{}
+	if input.State != "" {
+		filters = append(filters, "#state = :state")
+		query.ExpressionAttributeNames["#state"] = aws.String("state")
+		query.ExpressionAttributeValues[":state"] = &dynamodb.AttributeValue{S: aws.String(input.State)}
+	}
+	if input.Key != "" {
+		filters = append(filters, "contains(#keys, :key)")
+		query.ExpressionAttributeNames["#keys"] = aws.String("keys")
+		query.ExpressionAttributeValues[":key"] = &dynamodb.AttributeValue{S: aws.String(input.Key)}
+	}
+	if len(filters) > 0 {
+		query.FilterExpression = aws.String(strings.Join(filters, " AND "))
+	}
+
+	output, err := client.QueryWithContext(ctx, query)
+	if err != nil {
+		return nil, nil, err
+	}
+	ingestions := []*Ingestion{}
+	if err := dynamodbattribute.UnmarshalListOfMaps(output.Items, &ingestions); err != nil {
+		return nil, nil, err
+	}
+	return ingestions, output.LastEvaluatedKey, nil
+}
+
+// SortedFiles returns the files of the ingestion in the order of their keys.
+func (i *Ingestion) SortedFiles() []*File {
+	files := []*File{}
+	for _, file := range i.Files {
+		files = append(files, file)
+	}
+	sort.Slice(files, func(a, b int) bool { return files[a].Key < files[b].Key })
+	return files
+}
+
+// Whether the error is DynamoDB saying the condition of a write failed.
+func isConditionFailed(err error) bool {
+	var awsErr awserr.Error
+	return errors.As(err, &awsErr) && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException
+}
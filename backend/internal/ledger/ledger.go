@@ -0,0 +1,197 @@
+// Package ledger records how each file was loaded in the file ledger table,
+// one item per file and job run. The move-to-archive lambda reconciles the
+// rows read from a file with the items the job run wrote for it, records the
+// outcome, and moves the files that do not reconcile to the failed folder.
+// The ingestion-rollback lambda finds the items and the archived file of a
+// bad load through the ledger.
+package ledger
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// The outcomes of the reconciliation of a file, and the status of a file
+// whose items were removed by a rollback.
+const (
+	StatusReconciled = "RECONCILED"
+	StatusMismatched = "MISMATCHED"
+	StatusRolledBack = "ROLLED_BACK"
+)
+
+// RunIndex is the index of the entries by their job run.
+const RunIndex = "ByJobRun"
+
+// Entry is the record of a file loaded by a job run.
+type Entry struct {
+	Key      string `json:"key"`
+	JobRunID string `json:"jobRunId"`
+	Bucket   string `json:"bucket"`
+	Manifest string `json:"manifest,omitempty"`
+	Status   string `json:"status"`
+
+	// The table the items of the file were written to, and the key the file
+	// was moved to once loaded.
+	Table       string `json:"table,omitempty"`
+	ArchivedKey string `json:"archivedKey,omitempty"`
+
+	// The rows read from the file, the rows accepted and rejected by the job,
+	// and the items the job wrote to the table for the file.
+	SourceRows   int64 `json:"sourceRows"`
+	AcceptedRows int64 `json:"acceptedRows"`
+	RejectedRows int64 `json:"rejectedRows"`
+	LoadedItems  int64 `json:"loadedItems"`
+
+	// The checksums of the accepted rows as computed by the job, and of the
+	// items found in the table: the sum of the ids, and the sum of the
+	// amounts in cents when the schema has an amount column.
+	ExpectedIDChecksum     int64  `json:"expectedIdChecksum"`
+	LoadedIDChecksum       int64  `json:"loadedIdChecksum"`
+	ExpectedAmountChecksum *int64 `json:"expectedAmountChecksum,omitempty"`
+	LoadedAmountChecksum   *int64 `json:"loadedAmountChecksum,omitempty"`
+
+	// Why the file does not reconcile.
+	Mismatches []string `json:"mismatches,omitempty"`
+
+	ReconciledAt time.Time `json:"reconciledAt"`
+
+	// When the items of the file were removed, and how many.
+	RolledBackAt    *time.Time `json:"rolledBackAt,omitempty"`
+	RolledBackItems int64      `json:"rolledBackItems,omitempty"`
+}
+
+// Reconcile compares the counts and checksums of the entry, and sets its
+// status and mismatches.
+func (e *Entry) Reconcile() {
+	e.Mismatches = nil
+	if e.SourceRows != e.AcceptedRows+e.RejectedRows {
+		e.Mismatches = append(e.Mismatches, fmt.Sprintf("%d rows read, %d accepted and %d rejected", e.SourceRows, e.AcceptedRows, e.RejectedRows))
+	}
+	if e.LoadedItems != e.AcceptedRows {
+		e.Mismatches = append(e.Mismatches, fmt.Sprintf("%d rows accepted, %d items loaded", e.AcceptedRows, e.LoadedItems))
+	}
+	if e.LoadedIDChecksum != e.ExpectedIDChecksum {
+		e.Mismatches = append(e.Mismatches, fmt.Sprintf("id checksum %d, %d loaded", e.ExpectedIDChecksum, e.LoadedIDChecksum))
+	}
+	if e.ExpectedAmountChecksum != nil && aws.Int64Value(e.LoadedAmountChecksum) != *e.ExpectedAmountChecksum {
+		e.Mismatches = append(e.Mismatches, fmt.Sprintf("amount checksum %d, %d loaded", *e.ExpectedAmountChecksum, aws.Int64Value(e.LoadedAmountChecksum)))
+	}
+
+	e.Status = StatusReconciled
+	if len(e.Mismatches) > 0 {
+		e.Status = StatusMismatched
+	}
+	e.ReconciledAt = time.Now().UTC()
+}
+
+// Reconciled reports whether the file was loaded as a whole.
+func (e *Entry) Reconciled() bool {
+	return e.Status == StatusReconciled
+}
+
+// Put records the entry, replacing the entry of a previous attempt.
+func Put(ctx context.Context, client dynamodbiface.DynamoDBAPI, table string, e *Entry) error {
+	item, err := dynamodbattribute.MarshalMap(e)
+	if err != nil {
+		return err
+	}
+	_, err = client.PutItemWithContext(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(table),
+		Item:      item,
+	})
+	return err
+}
+
+// Get returns the entry of a file loaded by a job run, or nil when the file
+// was not reconciled.
+func Get(ctx context.Context, client dynamodbiface.DynamoDBAPI, table string, key string, jobRunID string) (*Entry, error) {
+	output, err := client.GetItemWithContext(ctx, &dynamodb.GetItemInput{
+		TableName: aws.String(table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"key":      {S: aws.String(key)},
+			"jobRunId": {S: aws.String(jobRunID)},
+		},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(output.Item) == 0 {
+		return nil, nil
+	}
+
+	e := &Entry{}
+	if err := dynamodbattribute.UnmarshalMap(output.Item, e); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// List returns the entries of a file, one per job run that loaded it.
+func List(ctx context.Context, client dynamodbiface.DynamoDBAPI, table string, key string) ([]*Entry, error) {
+	return query(ctx, client, &dynamodb.QueryInput{
+		TableName:                aws.String(table),
+		KeyConditionExpression:   aws.String("#key = :key"),
+		ExpressionAttributeNames: map[string]*string{"#key": aws.String("key")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":key": {S: aws.String(key)},
+		},
+	})
+}
+
+// ListRun returns the entries of the files loaded by a job run.
+func ListRun(ctx context.Context, client dynamodbiface.DynamoDBAPI, table string, jobRunID string) ([]*Entry, error) {
+	return query(ctx, client, &dynamodb.QueryInput{
+		TableName:                aws.String(table),
+		IndexName:                aws.String(RunIndex),
+		KeyConditionExpression:   aws.String("#run = :run"),
+		ExpressionAttributeNames: map[string]*string{"#run": aws.String("jobRunId")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":run": {S: aws.String(jobRunID)},
+		},
+	})
+}
+
+// SetArchivedKey records the key the file was moved to once loaded.
+func SetArchivedKey(ctx context.Context, client dynamodbiface.DynamoDBAPI, table string, key string, jobRunID string, archivedKey string) error {
+	_, err := client.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+		TableName: aws.String(table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"key":      {S: aws.String(key)},
+			"jobRunId": {S: aws.String(jobRunID)},
+		},
+		UpdateExpression:         aws.String("SET #archivedKey = :archivedKey"),
+		ConditionExpression:      aws.String("attribute_exists(#key)"),
+		ExpressionAttributeNames: map[string]*string{"#archivedKey": aws.String("archivedKey"), "#key": aws.String("key")},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":archivedKey": {S: aws.String(archivedKey)},
+		},
+	})
+	return err
+}
+
+// Returns the entries matching the query, every page of them.
+func query(ctx context.Context, client dynamodbiface.DynamoDBAPI, input *dynamodb.QueryInput) ([]*Entry, error) {
+	entries := []*Entry{}
+	var unmarshalErr error
+	err := client.QueryPagesWithContext(ctx, input, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			e := &Entry{}
+			if unmarshalErr = dynamodbattribute.UnmarshalMap(item, e); unmarshalErr != nil {
+				return false
+			}
+			entries = append(entries, e)
+		}
+		return true
+	})
+	if err == nil {
+		err = unmarshalErr
+	}
+	return entries, err
+}
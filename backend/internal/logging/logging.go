@@ -0,0 +1,357 @@
+// Package logging writes the logs of the lambdas as JSON lines, so they can
+// be searched with CloudWatch Logs Insights. Each line carries the context
+// of the invocation: its request id, the correlation id following a file
+// from its upload through the Glue job to its archive, and the job run and
+// S3 key it is about. The fields holding banking data are redacted.
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambdacontext"
+)
+
+// The fields of the context of an invocation.
+const (
+	RequestID     = "requestId"
+	CorrelationID = "correlationId"
+	IngestionID   = "ingestionId"
+	JobRunID      = "jobRunId"
+	Bucket        = "bucket"
+	Key           = "key"
+)
+
+// The header of the API requests carrying the correlation id of the client,
+// lower case as HTTP APIs pass the headers.
+const CorrelationHeader = "x-correlation-id"
+
+// The order the fields of the context are written in, after the level and
+// the message.
+var contextFields = []string{"function", RequestID, CorrelationID, IngestionID, JobRunID, Bucket, Key}
+
+// Level is the severity of a log entry.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = map[Level]string{
+	LevelDebug: "DEBUG",
+	LevelInfo:  "INFO",
+	LevelWarn:  "WARN",
+	LevelError: "ERROR",
+}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+// ParseLevel returns the level of its name, e.g. "debug" or "WARN".
+func ParseLevel(name string) (Level, error) {
+	for level, levelName := range levelNames {
+		if strings.EqualFold(name, levelName) {
+			return level, nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level %q", name)
+}
+
+// The value the redacted fields are replaced with.
+const Redacted = "[REDACTED]"
+
+// The fields holding banking data, never written to the logs. More fields
+// are redacted with the comma separated LOG_REDACT_FIELDS environment
+// variable. The names are compared ignoring their case, dashes and
+// underscores, so account_number and --account-number are redacted too.
+var DefaultRedactedFields = []string{
+	"accountNumber",
+	"customerId",
+	"creditLimit",
+	"availableMoney",
+	"currentBalance",
+	"transactionAmount",
+	"cardCVV",
+	"cardLast4Digits",
+	"cardNumber",
+	"currentExpDate",
+	"authorization",
+	"cookie",
+	"x-amz-security-token",
+}
+
+var (
+	mutex   sync.Mutex
+	output  io.Writer = os.Stdout
+	level             = levelFromEnv()
+	redact            = redactedFields()
+	current           = map[string]string{}
+)
+
+// Returns the level set by the LOG_LEVEL environment variable, INFO when it
+// is not set or unknown.
+func levelFromEnv() Level {
+	level, _ := ParseLevel(os.Getenv("LOG_LEVEL"))
+	return level
+}
+
+func redactedFields() map[string]bool {
+	fields := map[string]bool{}
+	names := append([]string{}, DefaultRedactedFields...)
+	names = append(names, strings.Split(os.Getenv("LOG_REDACT_FIELDS"), ",")...)
+	for _, name := range names {
+		if name = normalize(name); name != "" {
+			fields[name] = true
+		}
+	}
+	return fields
+}
+
+func normalize(name string) string {
+	return strings.ToLower(strings.NewReplacer("-", "", "_", "", " ", "").Replace(name))
+}
+
+// Start resets the context of the logs at the start of an invocation, with
+// the request id of the invocation and the name of the function. A lambda
+// handles one invocation at a time, so the context is shared by the whole
+// process.
+func Start(ctx context.Context) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	current = map[string]string{"function": lambdacontext.FunctionName}
+	if lc, ok := lambdacontext.FromContext(ctx); ok {
+		current[RequestID] = lc.AwsRequestID
+	}
+}
+
+// StartRequest resets the context of the logs at the start of an API
+// request. Its correlation id is the X-Correlation-Id header sent by the
+// client, or the id API Gateway gave the request.
+func StartRequest(ctx context.Context, request events.APIGatewayV2HTTPRequest) {
+	Start(ctx)
+
+	correlationID := request.Headers[CorrelationHeader]
+	if correlationID == "" {
+		correlationID = request.RequestContext.RequestID
+	}
+	Set(CorrelationID, correlationID)
+}
+
+// Set adds a field to the context of the logs, an empty value removes it.
+func Set(field string, value string) {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	if value == "" {
+		delete(current, field)
+		return
+	}
+	current[field] = value
+}
+
+// Get returns a field of the context of the logs.
+func Get(field string) string {
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	return current[field]
+}
+
+// Enabled returns whether the entries of the level are written.
+func Enabled(l Level) bool {
+	return l >= level
+}
+
+// Debug writes a debug entry, the fields are pairs of names and values.
+func Debug(message string, fields ...interface{}) {
+	write(LevelDebug, message, fields)
+}
+
+// Info writes an info entry, the fields are pairs of names and values.
+func Info(message string, fields ...interface{}) {
+	write(LevelInfo, message, fields)
+}
+
+// Warn writes a warning entry, the fields are pairs of names and values.
+func Warn(message string, fields ...interface{}) {
+	write(LevelWarn, message, fields)
+}
+
+// Error writes an error entry with the error, the fields are pairs of names
+// and values.
+func Error(message string, err error, fields ...interface{}) {
+	if err != nil {
+		fields = append(fields, "error", err.Error())
+	}
+	write(LevelError, message, fields)
+}
+
+func write(l Level, message string, fields []interface{}) {
+	if !Enabled(l) {
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+
+	var line bytes.Buffer
+	line.WriteString("{")
+	writeField(&line, "time", time.Now().UTC().Format(time.RFC3339Nano), true)
+	writeField(&line, "level", l.String(), false)
+	writeField(&line, "message", message, false)
+	// The fields of the entry take over the fields of the context.
+	names := map[string]bool{}
+	for i := 0; i < len(fields); i += 2 {
+		names[fmt.Sprint(fields[i])] = true
+	}
+	for _, field := range contextFields {
+		if value, ok := current[field]; ok && value != "" && !names[field] {
+			writeField(&line, field, value, false)
+		}
+	}
+	for i := 0; i < len(fields); i += 2 {
+		name := fmt.Sprint(fields[i])
+		var value interface{}
+		if i+1 < len(fields) {
+			value = fields[i+1]
+		}
+		if redact[normalize(name)] {
+			value = Redacted
+		}
+		writeField(&line, name, Redact(value), false)
+	}
+	line.WriteString("}\n")
+
+	output.Write(line.Bytes())
+}
+
+func writeField(line *bytes.Buffer, name string, value interface{}, first bool) {
+	encoded, err := marshal(value)
+	if err != nil {
+		encoded, _ = marshal(fmt.Sprint(value))
+	}
+	if !first {
+		line.WriteString(",")
+	}
+	key, _ := marshal(name)
+	line.Write(key)
+	line.WriteString(":")
+	line.Write(encoded)
+}
+
+// Returns the value as JSON, leaving the characters HTML escapes as they are
+// so the keys and query strings stay readable.
+func marshal(value interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	encoder := json.NewEncoder(&buffer)
+	encoder.SetEscapeHTML(false)
+	if err := encoder.Encode(value); err != nil {
+		return nil, err
+	}
+	return bytes.TrimSuffix(buffer.Bytes(), []byte("\n")), nil
+}
+
+// Redact returns the value as JSON values, with the redacted fields of its
+// objects replaced, including those of the strings holding a JSON document
+// such as the body of an API request.
+func Redact(value interface{}) interface{} {
+	switch value := value.(type) {
+	case nil:
+		return nil
+	case error:
+		return value.Error()
+	case string:
+		return redactString(value)
+	case time.Duration:
+		return value.String()
+	case bool, int, int32, int64, float64, time.Time:
+		return value
+	}
+
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	var decoded interface{}
+	if err := json.Unmarshal(encoded, &decoded); err != nil {
+		return string(encoded)
+	}
+	return redactValue(decoded)
+}
+
+// Redacts a string holding a JSON object or array, or a query string, the
+// other strings are returned as they are.
+func redactString(value string) interface{} {
+	trimmed := strings.TrimSpace(value)
+	if strings.Contains(trimmed, "=") && !strings.ContainsAny(trimmed, " {[") {
+		return redactQuery(value)
+	}
+	if !strings.HasPrefix(trimmed, "{") && !strings.HasPrefix(trimmed, "[") {
+		return value
+	}
+	var decoded interface{}
+	if err := json.Unmarshal([]byte(trimmed), &decoded); err != nil {
+		return value
+	}
+	encoded, err := marshal(redactValue(decoded))
+	if err != nil {
+		return value
+	}
+	return string(encoded)
+}
+
+// Redacts the parameters of a query string, e.g. the raw query string of an
+// API request.
+func redactQuery(value string) string {
+	query, err := url.ParseQuery(value)
+	if err != nil {
+		return value
+	}
+	redacted := false
+	for name := range query {
+		if redact[normalize(name)] {
+			query[name] = []string{Redacted}
+			redacted = true
+		}
+	}
+	if !redacted {
+		return value
+	}
+	return strings.ReplaceAll(query.Encode(), url.QueryEscape(Redacted), Redacted)
+}
+
+func redactValue(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for name, field := range value {
+			if redact[normalize(name)] {
+				value[name] = Redacted
+			} else {
+				value[name] = redactValue(field)
+			}
+		}
+		return value
+	case []interface{}:
+		for i, item := range value {
+			value[i] = redactValue(item)
+		}
+		return value
+	case string:
+		return redactString(value)
+	}
+	return value
+}
@@ -0,0 +1,112 @@
+package logging
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+func TestRedact(t *testing.T) {
+	tests := []struct {
+		name  string
+		value interface{}
+		want  string
+	}{
+		{
+			name:  "plain string",
+			value: "input/bank_data.csv",
+			want:  `"input/bank_data.csv"`,
+		},
+		{
+			name:  "error",
+			value: errors.New("accountNumber=123"),
+			want:  `"accountNumber=123"`,
+		},
+		{
+			name:  "JSON body",
+			value: `{"accountNumber": "733493772", "isFraud": "TRUE", "card": {"cardCVV": 123}}`,
+			want:  `"{\"accountNumber\":\"[REDACTED]\",\"card\":{\"cardCVV\":\"[REDACTED]\"},\"isFraud\":\"TRUE\"}"`,
+		},
+		{
+			name:  "JSON array body",
+			value: `[{"account_number": "733493772"}, {"merchantName": "Uber"}]`,
+			want:  `"[{\"account_number\":\"[REDACTED]\"},{\"merchantName\":\"Uber\"}]"`,
+		},
+		{
+			name:  "invalid JSON body",
+			value: `{"accountNumber": `,
+			want:  `"{\"accountNumber\": "`,
+		},
+		{
+			name:  "query string",
+			value: "accountNumber=733493772&isFraud=TRUE",
+			want:  `"accountNumber=[REDACTED]&isFraud=TRUE"`,
+		},
+		{
+			name:  "query string without redacted fields",
+			value: "isFraud=TRUE&pageSize=10",
+			want:  `"isFraud=TRUE&pageSize=10"`,
+		},
+		{
+			name: "nested map",
+			value: map[string]interface{}{
+				"headers": map[string]string{"Authorization": "Bearer token", "X-Correlation-Id": "abc"},
+				"items":   []map[string]string{{"customer-id": "42", "merchantName": "Uber"}},
+			},
+			want: `{"headers":{"Authorization":"[REDACTED]","X-Correlation-Id":"abc"},"items":[{"customer-id":"[REDACTED]","merchantName":"Uber"}]}`,
+		},
+		{
+			name: "DynamoDB attribute map",
+			value: map[string]*dynamodb.AttributeValue{
+				"id":            {N: aws.String("1")},
+				"accountNumber": {S: aws.String("733493772")},
+				"card": {M: map[string]*dynamodb.AttributeValue{
+					"cardCVV":      {N: aws.String("123")},
+					"merchantName": {S: aws.String("Uber")},
+				}},
+				"history": {L: []*dynamodb.AttributeValue{
+					{M: map[string]*dynamodb.AttributeValue{"currentBalance": {N: aws.String("10.5")}}},
+				}},
+			},
+			want: `{"accountNumber":"[REDACTED]","card":{"M":{"cardCVV":"[REDACTED]","merchantName":{"S":"Uber"}}},"history":{"L":[{"M":{"currentBalance":"[REDACTED]"}}]},"id":{"N":"1"}}`,
+		},
+		{
+			name:  "number",
+			value: 42,
+			want:  `42`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := marshal(withoutNulls(Redact(test.value)))
+			if err != nil {
+				t.Fatalf("Redact() returned a value that cannot be marshalled: %v", err)
+			}
+			if string(got) != test.want {
+				t.Errorf("Redact() = %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+// Returns the JSON value without the null fields of its objects, e.g. the
+// unset fields of the DynamoDB attribute values.
+func withoutNulls(value interface{}) interface{} {
+	switch value := value.(type) {
+	case map[string]interface{}:
+		for name, field := range value {
+			if field == nil {
+				delete(value, name)
+			} else {
+				value[name] = withoutNulls(field)
+			}
+		}
+	case []interface{}:
+		for i, item := range value {
+			value[i] = withoutNulls(item)
+		}
+	}
+	return value
+}
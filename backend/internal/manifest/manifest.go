@@ -0,0 +1,159 @@
+// Package manifest lists the files loaded by a single Glue job run. The
+// glue-trigger lambda coalesces the files uploaded together into one run and
+// writes their manifest to the bucket, the job loads every file it lists and
+// the move-to-archive lambda archives them once the run finishes.
+package manifest
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// Prefix is the folder of the bucket the manifests are written to.
+const Prefix = "manifests/"
+
+// Manifest is the list of files loaded by a job run, with the settings they
+// share.
+type Manifest struct {
+	ID        string    `json:"id"`
+	Bucket    string    `json:"bucket"`
+	Rule      string    `json:"rule"`
+	Prefix    string    `json:"prefix"`
+	Schema    string    `json:"schema"`
+	Format    string    `json:"format"`
+	CreatedAt time.Time `json:"createdAt"`
+	Files     []File    `json:"files"`
+}
+
+// File is a file listed in a manifest.
+type File struct {
+	Key          string    `json:"key"`
+	Size         int64     `json:"size"`
+	ETag         string    `json:"etag,omitempty"`
+	LastModified time.Time `json:"lastModified"`
+
+	// The correlation id of the file, the id of its upload, followed through
+	// the logs of its ingestion.
+	CorrelationID string `json:"correlationId,omitempty"`
+}
+
+// New returns the manifest of the files accepted by a rule, sorted by their
+// key. Its id is derived from the files and their versions, so the manifest
+// of a batch retried after a failure replaces the manifest of the previous
+// attempt, while a file uploaded again gets a new one.
+func New(bucket string, rule string, prefix string, schemaRef string, format string, files []File) *Manifest {
+	sorted := append([]File{}, files...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Key < sorted[j].Key })
+
+	hash := sha256.New()
+	for _, file := range append([]File{{Key: bucket}}, sorted...) {
+		hash.Write([]byte(file.Key + "\n" + file.ETag + "\n" + file.LastModified.UTC().Format(time.RFC3339Nano) + "\n"))
+	}
+
+	return &Manifest{
+		ID:        hex.EncodeToString(hash.Sum(nil))[:32],
+		Bucket:    bucket,
+		Rule:      rule,
+		Prefix:    prefix,
+		Schema:    schemaRef,
+		Format:    format,
+		CreatedAt: time.Now().UTC(),
+		Files:     sorted,
+	}
+}
+
+// Key returns the key of the manifest in the bucket.
+func (m *Manifest) Key() string {
+	return Prefix + m.ID + ".json"
+}
+
+// CorrelationID returns the correlation id of the job run: the correlation
+// id of its files when they share one, e.g. when it loads a single upload,
+// else the id of the manifest.
+func (m *Manifest) CorrelationID() string {
+	correlationID := ""
+	for i, file := range m.Files {
+		if file.CorrelationID == "" || (i > 0 && file.CorrelationID != correlationID) {
+			return m.ID
+		}
+		correlationID = file.CorrelationID
+	}
+	if correlationID == "" {
+		return m.ID
+	}
+	return correlationID
+}
+
+// CorrelationIDOf returns the correlation id of a file of the manifest, the
+// correlation id of the job run when the file has none.
+func (m *Manifest) CorrelationIDOf(key string) string {
+	for _, file := range m.Files {
+		if file.Key == key && file.CorrelationID != "" {
+			return file.CorrelationID
+		}
+	}
+	return m.CorrelationID()
+}
+
+// IDOf returns the id of the manifest written to the key.
+func IDOf(key string) string {
+	return strings.TrimSuffix(strings.TrimPrefix(key, Prefix), ".json")
+}
+
+// Keys returns the keys of the files of the manifest.
+func (m *Manifest) Keys() []string {
+	keys := make([]string, 0, len(m.Files))
+	for _, file := range m.Files {
+		keys = append(keys, file.Key)
+	}
+	return keys
+}
+
+// Write writes the manifest to its key in its bucket.
+func Write(ctx context.Context, client s3iface.S3API, m *Manifest) error {
+	content, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = client.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(m.Bucket),
+		Key:         aws.String(m.Key()),
+		Body:        bytes.NewReader(content),
+		ContentType: aws.String("application/json"),
+	})
+	return err
+}
+
+// Read reads the manifest written to the key.
+func Read(ctx context.Context, client s3iface.S3API, bucket string, key string) (*Manifest, error) {
+	object, err := client.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer object.Body.Close()
+
+	content, err := io.ReadAll(object.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &Manifest{}
+	if err := json.Unmarshal(content, m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
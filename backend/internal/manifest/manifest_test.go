@@ -0,0 +1,79 @@
+package manifest
+
+import (
+	"testing"
+	"time"
+)
+
+func TestNewID(t *testing.T) {
+	uploaded := time.Date(2026, 10, 18, 9, 30, 0, 0, time.UTC)
+	august := File{Key: "input/august.csv", Size: 100, ETag: `"a1"`, LastModified: uploaded}
+	september := File{Key: "input/september.csv", Size: 200, ETag: `"b2"`, LastModified: uploaded}
+	id := New("bucket", "default", "input/", "transactions@v1", "csv", []File{august, september}).ID
+
+	tests := []struct {
+		name   string
+		bucket string
+		files  []File
+		same   bool
+	}{
+		{
+			name:   "same files",
+			bucket: "bucket",
+			files:  []File{august, september},
+			same:   true,
+		},
+		{
+			name:   "files in another order",
+			bucket: "bucket",
+			files:  []File{september, august},
+			same:   true,
+		},
+		{
+			name:   "same time in another zone",
+			bucket: "bucket",
+			files:  []File{{Key: august.Key, Size: august.Size, ETag: august.ETag, LastModified: uploaded.In(time.FixedZone("CEST", 2*60*60))}, september},
+			same:   true,
+		},
+		{
+			name:   "correlation id and size are not part of the id",
+			bucket: "bucket",
+			files:  []File{{Key: august.Key, Size: 1, ETag: august.ETag, LastModified: uploaded, CorrelationID: "upload"}, september},
+			same:   true,
+		},
+		{
+			name:   "file uploaded again",
+			bucket: "bucket",
+			files:  []File{{Key: august.Key, Size: august.Size, ETag: august.ETag, LastModified: uploaded.Add(time.Second)}, september},
+		},
+		{
+			name:   "file replaced",
+			bucket: "bucket",
+			files:  []File{{Key: august.Key, Size: august.Size, ETag: `"c3"`, LastModified: uploaded}, september},
+		},
+		{
+			name:   "file missing",
+			bucket: "bucket",
+			files:  []File{august},
+		},
+		{
+			name:   "other bucket",
+			bucket: "other",
+			files:  []File{august, september},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := New(test.bucket, "default", "input/", "transactions@v1", "csv", test.files).ID
+			if (got == id) != test.same {
+				t.Errorf("New() id = %s, first id %s, want same %v", got, id, test.same)
+			}
+			if len(got) != 32 {
+				t.Errorf("New() id = %s, want 32 characters", got)
+			}
+			if IDOf(Prefix+got+".json") != got {
+				t.Errorf("IDOf() = %s, want %s", IDOf(Prefix+got+".json"), got)
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+// Package metrics writes the business metrics of the lambdas in the CloudWatch
+// Embedded Metric Format: a JSON line of the logs that CloudWatch turns into
+// metrics, without calling the CloudWatch API. The metrics have the name of
+// the stack as a dimension, and the prefix of the ingestion rule of the files
+// they count when there is one.
+package metrics
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// The namespace of the metrics when METRICS_NAMESPACE is not set.
+const DefaultNamespace = "GoCdkWorkshop"
+
+// The dimensions of the metrics.
+const (
+	StackDimension  = "Stack"
+	PrefixDimension = "Prefix"
+)
+
+// The names of the metrics.
+const (
+	// The uploaded files queued for a job run, moved to the ignored folder
+	// because their rule does not accept them, or failed before the job run
+	// because their header does not match their schema.
+	FilesAccepted = "FilesAccepted"
+	FilesIgnored  = "FilesIgnored"
+	FilesRejected = "FilesRejected"
+
+	// The job runs started by the ingestion workflow.
+	JobRunsStarted = "JobRunsStarted"
+
+	// The rows of the files loaded into the table, and rejected by the job.
+	RowsLoaded   = "RowsLoaded"
+	RowsRejected = "RowsRejected"
+
+	// The files moved to the archive folder, and to the failed folder.
+	FilesArchived = "FilesArchived"
+	FilesFailed   = "FilesFailed"
+
+	// How long the query route took to query the table, and how many
+	// transactions it returned.
+	QueryLatency = "QueryLatency"
+	QueryResults = "QueryResults"
+
+	// The transactions whose fraud flag was changed by the update route.
+	FraudFlagUpdates = "FraudFlagUpdates"
+)
+
+// The units of the metrics.
+const (
+	UnitCount        = "Count"
+	UnitMilliseconds = "Milliseconds"
+)
+
+// Metric is a value of a metric.
+type Metric struct {
+	Name  string
+	Value float64
+	Unit  string
+}
+
+// Count returns a count metric.
+func Count(name string, value int64) Metric {
+	return Metric{Name: name, Value: float64(value), Unit: UnitCount}
+}
+
+// Duration returns a metric of a duration, in milliseconds.
+func Duration(name string, value time.Duration) Metric {
+	return Metric{Name: name, Value: float64(value) / float64(time.Millisecond), Unit: UnitMilliseconds}
+}
+
+var (
+	mutex  sync.Mutex
+	output io.Writer = os.Stdout
+)
+
+// The metadata telling CloudWatch which fields of the line are metrics.
+type metadata struct {
+	Timestamp         int64              `json:"Timestamp"`
+	CloudWatchMetrics []metricsDirective `json:"CloudWatchMetrics"`
+}
+
+type metricsDirective struct {
+	Namespace  string             `json:"Namespace"`
+	Dimensions [][]string         `json:"Dimensions"`
+	Metrics    []metricDefinition `json:"Metrics"`
+}
+
+type metricDefinition struct {
+	Name string `json:"Name"`
+	Unit string `json:"Unit"`
+}
+
+// Emit writes the metrics as one line of the logs. They are recorded for the
+// stack as a whole, and for the prefix of their ingestion rule when it is
+// not empty. A metric whose value is zero is still written, so the alarms
+// see the periods without failures.
+func Emit(prefix string, values ...Metric) {
+	if len(values) == 0 {
+		return
+	}
+
+	dimensions := [][]string{{StackDimension}}
+	line := map[string]interface{}{
+		StackDimension: os.Getenv("STACK_NAME"),
+	}
+	if prefix != "" {
+		dimensions = append(dimensions, []string{StackDimension, PrefixDimension})
+		line[PrefixDimension] = prefix
+	}
+
+	namespace := os.Getenv("METRICS_NAMESPACE")
+	if namespace == "" {
+		namespace = DefaultNamespace
+	}
+	directive := metricsDirective{Namespace: namespace, Dimensions: dimensions, Metrics: []metricDefinition{}}
+	for _, value := range values {
+		directive.Metrics = append(directive.Metrics, metricDefinition{Name: value.Name, Unit: value.Unit})
+		line[value.Name] = value.Value
+	}
+	line["_aws"] = metadata{
+		Timestamp:         time.Now().UnixNano() / int64(time.Millisecond),
+		CloudWatchMetrics: []metricsDirective{directive},
+	}
+
+	encoded, err := json.Marshal(line)
+	if err != nil {
+		return
+	}
+
+	mutex.Lock()
+	defer mutex.Unlock()
+	output.Write(append(encoded, '\n'))
+}
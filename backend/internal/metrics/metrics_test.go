@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// The line written by Emit, with its metadata.
+type emitted struct {
+	Stack  string `json:"Stack"`
+	Prefix string `json:"Prefix"`
+	AWS    struct {
+		Timestamp         int64              `json:"Timestamp"`
+		CloudWatchMetrics []metricsDirective `json:"CloudWatchMetrics"`
+	} `json:"_aws"`
+}
+
+func TestEmit(t *testing.T) {
+	tests := []struct {
+		name           string
+		namespace      string
+		prefix         string
+		values         []Metric
+		wantNamespace  string
+		wantDimensions [][]string
+		wantMetrics    []metricDefinition
+		wantValues     map[string]float64
+	}{
+		{
+			name:           "stack only",
+			values:         []Metric{Count(FilesArchived, 2)},
+			wantNamespace:  DefaultNamespace,
+			wantDimensions: [][]string{{StackDimension}},
+			wantMetrics:    []metricDefinition{{Name: FilesArchived, Unit: UnitCount}},
+			wantValues:     map[string]float64{FilesArchived: 2},
+		},
+		{
+			name:           "prefix",
+			namespace:      "Ingestion",
+			prefix:         "input/bank/",
+			values:         []Metric{Count(FilesAccepted, 3), Count(FilesIgnored, 0)},
+			wantNamespace:  "Ingestion",
+			wantDimensions: [][]string{{StackDimension}, {StackDimension, PrefixDimension}},
+			wantMetrics:    []metricDefinition{{Name: FilesAccepted, Unit: UnitCount}, {Name: FilesIgnored, Unit: UnitCount}},
+			wantValues:     map[string]float64{FilesAccepted: 3, FilesIgnored: 0},
+		},
+		{
+			name:           "duration",
+			values:         []Metric{Duration(QueryLatency, 1500*time.Microsecond)},
+			wantNamespace:  DefaultNamespace,
+			wantDimensions: [][]string{{StackDimension}},
+			wantMetrics:    []metricDefinition{{Name: QueryLatency, Unit: UnitMilliseconds}},
+			wantValues:     map[string]float64{QueryLatency: 1.5},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("STACK_NAME", "etl-test")
+			t.Setenv("METRICS_NAMESPACE", test.namespace)
+			var buffer bytes.Buffer
+			defer swapOutput(&buffer)()
+
+			Emit(test.prefix, test.values...)
+
+			var line emitted
+			if err := json.Unmarshal(buffer.Bytes(), &line); err != nil {
+				t.Fatalf("Emit() wrote %q: %v", buffer.String(), err)
+			}
+			if line.Stack != "etl-test" || line.Prefix != test.prefix {
+				t.Errorf("Emit() dimensions Stack = %q, Prefix = %q", line.Stack, line.Prefix)
+			}
+			if len(line.AWS.CloudWatchMetrics) != 1 {
+				t.Fatalf("Emit() wrote %d directives, want 1", len(line.AWS.CloudWatchMetrics))
+			}
+			directive := line.AWS.CloudWatchMetrics[0]
+			if directive.Namespace != test.wantNamespace {
+				t.Errorf("Emit() namespace = %q, want %q", directive.Namespace, test.wantNamespace)
+			}
+			if !reflect.DeepEqual(directive.Dimensions, test.wantDimensions) {
+				t.Errorf("Emit() dimensions = %v, want %v", directive.Dimensions, test.wantDimensions)
+			}
+			if !reflect.DeepEqual(directive.Metrics, test.wantMetrics) {
+				t.Errorf("Emit() metrics = %v, want %v", directive.Metrics, test.wantMetrics)
+			}
+
+			values := map[string]interface{}{}
+			json.Unmarshal(buffer.Bytes(), &values)
+			for name, want := range test.wantValues {
+				if values[name] != want {
+					t.Errorf("Emit() %s = %v, want %v", name, values[name], want)
+				}
+			}
+		})
+	}
+}
+
+func TestEmitNothing(t *testing.T) {
+	var buffer bytes.Buffer
+	defer swapOutput(&buffer)()
+
+	Emit("input/")
+	if buffer.Len() != 0 {
+		t.Errorf("Emit() without metrics wrote %q", buffer.String())
+	}
+}
+
+// Writes the metrics to the writer, until the returned function is called.
+func swapOutput(writer io.Writer) func() {
+	previous := output
+	output = writer
+	return func() { output = previous }
+}
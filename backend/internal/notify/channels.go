@@ -0,0 +1,152 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+)
+
+// SNSNotifier publishes the events as JSON to an SNS topic. The type and
+// state of the event are set as message attributes, so subscriptions can
+// filter on them, e.g. to only email the failures.
+type SNSNotifier struct {
+	Client   snsiface.SNSAPI
+	TopicArn string
+}
+
+func (n *SNSNotifier) Notify(ctx context.Context, event Event) error {
+	// The message carries the full summary, the subject may be cut short.
+	message, err := json.Marshal(struct {
+		Event
+		Summary string `json:"summary"`
+	}{event, event.Summary()})
+	if err != nil {
+		return err
+	}
+
+	_, err = n.Client.PublishWithContext(ctx, &sns.PublishInput{
+		TopicArn: aws.String(n.TopicArn),
+		Subject:  aws.String(subject(event)),
+		Message:  aws.String(string(message)),
+		MessageAttributes: map[string]*sns.MessageAttributeValue{
+			"type":  {DataType: aws.String("String"), StringValue: aws.String(event.Type)},
+			"state": {DataType: aws.String("String"), StringValue: aws.String(event.State)},
+		},
+	})
+	if err != nil {
+		return fmt.Errorf("publishing to %s: %w", n.TopicArn, err)
+	}
+	return nil
+}
+
+// The maximum length of an SNS subject.
+const maxSubjectLength = 100
+
+// Returns the summary of the event as an SNS subject: SNS rejects the
+// subjects that are not printable ASCII on a single line, e.g. with the
+// accented name of a file or a multi-line error, so the other characters are
+// replaced and the subject is cut to its maximum length.
+func subject(event Event) string {
+	runes := []rune{}
+	for _, r := range event.Summary() {
+		switch {
+		case r >= ' ' && r <= '~':
+			runes = append(runes, r)
+		case unicode.IsSpace(r):
+			if len(runes) > 0 && runes[len(runes)-1] != ' ' {
+				runes = append(runes, ' ')
+			}
+		default:
+			runes = append(runes, '?')
+		}
+	}
+	if len(runes) > maxSubjectLength {
+		runes = append(runes[:maxSubjectLength-3], '.', '.', '.')
+	}
+	return strings.TrimSpace(string(runes))
+}
+
+// WebhookNotifier posts the events to a Slack-style incoming webhook, the
+// summary is sent as the text of the message and the event as a field.
+type WebhookNotifier struct {
+	URL    string
+	Client *http.Client
+}
+
+// NewWebhookNotifier returns a notifier posting to the given webhook URL.
+func NewWebhookNotifier(url string) *WebhookNotifier {
+	return &WebhookNotifier{URL: url, Client: &http.Client{Timeout: 5 * time.Second}}
+}
+
+func (n *WebhookNotifier) Notify(ctx context.Context, event Event) error {
+	body, err := json.Marshal(map[string]interface{}{
+		"text":  event.Summary(),
+		"event": event,
+	})
+	if err != nil {
+		return err
+	}
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, n.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	request.Header.Set("Content-Type", "application/json")
+
+	response, err := n.Client.Do(request)
+	if err != nil {
+		return fmt.Errorf("posting to the webhook: %w", err)
+	}
+	defer response.Body.Close()
+
+	if response.StatusCode >= 300 {
+		return fmt.Errorf("posting to the webhook: unexpected status %s", response.Status)
+	}
+	return nil
+}
+
+// LogNotifier writes the events as JSON lines and keeps them in memory, it
+// is used to see the events locally and to check them in tests.
+type LogNotifier struct {
+	mu     sync.Mutex
+	writer io.Writer
+	events []Event
+}
+
+// NewLogNotifier returns a notifier writing to the given writer.
+func NewLogNotifier(writer io.Writer) *LogNotifier {
+	return &LogNotifier{writer: writer}
+}
+
+func (n *LogNotifier) Notify(ctx context.Context, event Event) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	n.events = append(n.events, event)
+
+	line, err := json.Marshal(map[string]interface{}{"notification": event})
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintln(n.writer, string(line))
+	return err
+}
+
+// Events returns the events notified so far.
+func (n *LogNotifier) Events() []Event {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return append([]Event{}, n.events...)
+}
@@ -0,0 +1,131 @@
+package notify
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/sns"
+	"github.com/aws/aws-sdk-go/service/sns/snsiface"
+)
+
+// fakeSNS records the messages published to it.
+type fakeSNS struct {
+	snsiface.SNSAPI
+	published []*sns.PublishInput
+}
+
+func (f *fakeSNS) PublishWithContext(ctx aws.Context, input *sns.PublishInput, options ...request.Option) (*sns.PublishOutput, error) {
+	f.published = append(f.published, input)
+	return &sns.PublishOutput{}, nil
+}
+
+func TestSNSNotifier(t *testing.T) {
+	tests := []struct {
+		name        string
+		event       Event
+		wantSubject string
+	}{
+		{
+			name:        "ASCII summary",
+			event:       Event{Type: "ingestion.archived", State: "ARCHIVED", Bucket: "bucket", Key: "input/bank.csv"},
+			wantSubject: "Ingestion of s3://bucket/input/bank.csv archived",
+		},
+		{
+			name:        "non-ASCII key",
+			event:       Event{Type: "ingestion.failed", State: "FAILED", Bucket: "bucket", Key: "input/relevé-août.csv"},
+			wantSubject: "Ingestion of s3://bucket/input/relev?-ao?t.csv failed",
+		},
+		{
+			name:        "multi-line error",
+			event:       Event{Type: "ingestion.failed", State: "FAILED", Bucket: "bucket", Key: "input/bank.csv", ErrorMessage: "Traceback:\n\tline 1\r\n\x00done"},
+			wantSubject: "Ingestion of s3://bucket/input/bank.csv failed: Traceback: line 1 ?done",
+		},
+		{
+			name:        "long non-ASCII summary cut by runes",
+			event:       Event{Type: "ingestion.failed", State: "FAILED", Bucket: "bucket", Key: "input/" + strings.Repeat("é", 120) + ".csv"},
+			wantSubject: "Ingestion of s3://bucket/input/" + strings.Repeat("?", 66) + "...",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &fakeSNS{}
+			notifier := &SNSNotifier{Client: client, TopicArn: "arn:aws:sns:eu-west-1:123456789012:alarms"}
+			if err := notifier.Notify(context.Background(), test.event); err != nil {
+				t.Fatalf("Notify() error = %v", err)
+			}
+			if len(client.published) != 1 {
+				t.Fatalf("Notify() published %d messages, want 1", len(client.published))
+			}
+			input := client.published[0]
+
+			subject := aws.StringValue(input.Subject)
+			if subject != test.wantSubject {
+				t.Errorf("Notify() subject = %q, want %q", subject, test.wantSubject)
+			}
+			if utf8.RuneCountInString(subject) > maxSubjectLength {
+				t.Errorf("Notify() subject has %d characters", utf8.RuneCountInString(subject))
+			}
+
+			var message map[string]interface{}
+			if err := json.Unmarshal([]byte(aws.StringValue(input.Message)), &message); err != nil {
+				t.Fatalf("Notify() message is not JSON: %v", err)
+			}
+			if message["summary"] != test.event.Summary() || message["key"] != test.event.Key {
+				t.Errorf("Notify() message = %v, want the event and its full summary", message)
+			}
+			if aws.StringValue(input.MessageAttributes["state"].StringValue) != test.event.State {
+				t.Errorf("Notify() state attribute = %v", input.MessageAttributes["state"])
+			}
+		})
+	}
+}
+
+func TestLogNotifier(t *testing.T) {
+	tests := []struct {
+		name   string
+		events []Event
+	}{
+		{name: "no events"},
+		{
+			name: "events kept in order",
+			events: []Event{
+				{Type: "ingestion.archived", State: "ARCHIVED", Bucket: "bucket", Key: "input/a.csv"},
+				{Type: "ingestion.failed", State: "FAILED", Bucket: "bucket", Key: "input/b.csv", ErrorMessage: "bad header"},
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var buffer bytes.Buffer
+			notifier := NewLogNotifier(&buffer)
+			for _, event := range test.events {
+				if err := notifier.Notify(context.Background(), event); err != nil {
+					t.Fatalf("Notify() error = %v", err)
+				}
+			}
+
+			events := notifier.Events()
+			if len(events) != len(test.events) {
+				t.Fatalf("Events() = %v, want %v", events, test.events)
+			}
+			lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+			for i, event := range test.events {
+				if events[i] != event {
+					t.Errorf("Events()[%d] = %v, want %v", i, events[i], event)
+				}
+				var line struct {
+					Notification Event `json:"notification"`
+				}
+				if err := json.Unmarshal([]byte(lines[i]), &line); err != nil || line.Notification != event {
+					t.Errorf("line %d = %s, want the event %v", i, lines[i], event)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,110 @@
+// Package notify publishes the outcome of the ingestion of a file to the
+// channels configured for the stack, so operators learn about failed files
+// without looking in the failed/ folder.
+package notify
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/sns"
+)
+
+// The types of the events published.
+const (
+	IngestionSucceeded = "ingestion.succeeded"
+	IngestionFailed    = "ingestion.failed"
+)
+
+// Event is the outcome of the ingestion of a file.
+type Event struct {
+	Type           string    `json:"type"`
+	Time           time.Time `json:"time"`
+	JobName        string    `json:"jobName,omitempty"`
+	JobRunID       string    `json:"jobRunId,omitempty"`
+	State          string    `json:"state"`
+	Bucket         string    `json:"bucket"`
+	Key            string    `json:"key"`
+	DestinationKey string    `json:"destinationKey,omitempty"`
+	SourceArchive  string    `json:"sourceArchive,omitempty"`
+	ErrorMessage   string    `json:"errorMessage,omitempty"`
+	DiagnosticsKey string    `json:"diagnosticsKey,omitempty"`
+	Rows           *Rows     `json:"rows,omitempty"`
+}
+
+// Rows are how many rows of the file were loaded and rejected, the rejected
+// rows are written with their reasons under RejectedPath.
+type Rows struct {
+	Accepted     int64  `json:"accepted"`
+	Rejected     int64  `json:"rejected"`
+	RejectedPath string `json:"rejectedPath,omitempty"`
+}
+
+// Summary returns a one line, human readable description of the event.
+func (e Event) Summary() string {
+	summary := fmt.Sprintf("Ingestion of s3://%s/%s %s", e.Bucket, e.Key, strings.ToLower(e.State))
+	if e.SourceArchive != "" {
+		summary += fmt.Sprintf(" (extracted from %s)", e.SourceArchive)
+	}
+	if e.JobRunID != "" {
+		summary += fmt.Sprintf(" (job run %s)", e.JobRunID)
+	}
+	if e.Rows != nil {
+		summary += fmt.Sprintf(", %d rows loaded, %d rejected", e.Rows.Accepted, e.Rows.Rejected)
+	}
+	if e.ErrorMessage != "" {
+		summary += ": " + e.ErrorMessage
+	}
+	return summary
+}
+
+// Notifier publishes events to a channel.
+type Notifier interface {
+	Notify(ctx context.Context, event Event) error
+}
+
+// Multi publishes the events to every notifier, it returns an error if any
+// of them failed but still tries all of them.
+type Multi []Notifier
+
+func (m Multi) Notify(ctx context.Context, event Event) error {
+	failures := []string{}
+	for _, notifier := range m {
+		if err := notifier.Notify(ctx, event); err != nil {
+			failures = append(failures, err.Error())
+		}
+	}
+	if len(failures) > 0 {
+		return fmt.Errorf("notifying: %s", strings.Join(failures, "; "))
+	}
+	return nil
+}
+
+// FromEnv returns the notifiers of the channels listed in the NOTIFY_CHANNELS
+// environment variable, a comma separated list of:
+//
+//   - sns: publishes to the topic in SNS_TOPIC_ARN, the topic delivers the
+//     events to its email subscriptions.
+//   - webhook: posts Slack-style messages to NOTIFY_WEBHOOK_URL.
+//   - log: writes the events to the standard output.
+func FromEnv(sess *session.Session) (Notifier, error) {
+	notifiers := Multi{}
+	for _, channel := range strings.Split(os.Getenv("NOTIFY_CHANNELS"), ",") {
+		switch strings.TrimSpace(channel) {
+		case "":
+		case "sns":
+			notifiers = append(notifiers, &SNSNotifier{Client: sns.New(sess), TopicArn: os.Getenv("SNS_TOPIC_ARN")})
+		case "webhook":
+			notifiers = append(notifiers, NewWebhookNotifier(os.Getenv("NOTIFY_WEBHOOK_URL")))
+		case "log":
+			notifiers = append(notifiers, NewLogNotifier(os.Stdout))
+		default:
+			return nil, fmt.Errorf("unknown notification channel: %s", channel)
+		}
+	}
+	return notifiers, nil
+}
@@ -0,0 +1,89 @@
+package objects
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// The maximum number of suffixes tried when the key is already taken.
+const maxCollisionSuffix = 100
+
+// AvailableKey returns a key the file can be moved to without overwriting
+// another file. The key is used as is when it is free, or when it already
+// holds a copy of the same file, e.g. when a previous attempt copied the file
+// but failed to delete it. Otherwise a numbered suffix is added before the
+// extension.
+func AvailableKey(ctx context.Context, client s3iface.S3API, bucket string, key string, source *s3.HeadObjectOutput) (string, error) {
+	for i := 0; i < maxCollisionSuffix; i++ {
+		candidate := key
+		if i > 0 {
+			candidate = withSuffix(key, i)
+		}
+
+		existing, err := client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(candidate),
+		})
+		if IsNotFound(err) {
+			return candidate, nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if sameObject(source, existing) {
+			return candidate, nil
+		}
+	}
+
+	return "", fmt.Errorf("no free key found for %s after %d attempts", key, maxCollisionSuffix)
+}
+
+// Adds a numbered suffix to the name of the file, before its extensions, so
+// the extensions used to detect the format of the file are kept.
+func withSuffix(key string, i int) string {
+	dir, file := path.Split(key)
+	name, extension := file, ""
+	if index := strings.Index(file, "."); index > 0 {
+		name, extension = file[:index], file[index:]
+	}
+	return fmt.Sprintf("%s%s-%d%s", dir, name, i, extension)
+}
+
+// Whether both objects have the same size and content hash.
+func sameObject(a *s3.HeadObjectOutput, b *s3.HeadObjectOutput) bool {
+	return aws.Int64Value(a.ContentLength) == aws.Int64Value(b.ContentLength) &&
+		aws.StringValue(a.ETag) == aws.StringValue(b.ETag)
+}
+
+// IsNotFound reports whether the error is S3 saying the object does not exist.
+func IsNotFound(err error) bool {
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		return awsErr.Code() == "NotFound" || awsErr.Code() == s3.ErrCodeNoSuchKey
+	}
+	return false
+}
+
+// The metadata added to the files extracted from a zip file, so the archived
+// files can be traced back to the zip file they came from.
+const SourceArchiveMetadata = "source-archive"
+
+// MetadataKey returns the key of user metadata as returned by HeadObject,
+// which capitalizes it, e.g. source-archive becomes Source-Archive.
+func MetadataKey(name string) string {
+	segments := strings.Split(name, "-")
+	for i, segment := range segments {
+		if segment != "" {
+			segments[i] = strings.ToUpper(segment[:1]) + segment[1:]
+		}
+	}
+	return strings.Join(segments, "-")
+}
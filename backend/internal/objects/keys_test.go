@@ -0,0 +1,45 @@
+package objects
+
+import "testing"
+
+func TestMetadataKey(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{name: "schema", want: "Schema"},
+		{name: SourceArchiveMetadata, want: "Source-Archive"},
+		{name: "upload-id", want: "Upload-Id"},
+		{name: "Already-Capitalized", want: "Already-Capitalized"},
+		{name: "double--dash", want: "Double--Dash"},
+		{name: "", want: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := MetadataKey(test.name); got != test.want {
+				t.Errorf("MetadataKey(%q) = %q, want %q", test.name, got, test.want)
+			}
+		})
+	}
+}
+
+func TestWithSuffix(t *testing.T) {
+	tests := []struct {
+		key  string
+		i    int
+		want string
+	}{
+		{key: "archive/august.csv", i: 1, want: "archive/august-1.csv"},
+		{key: "archive/august.csv.gz", i: 2, want: "archive/august-2.csv.gz"},
+		{key: "archive/august", i: 3, want: "archive/august-3"},
+		{key: "archive/.hidden", i: 1, want: "archive/.hidden-1"},
+		{key: "august.csv", i: 10, want: "august-10.csv"},
+	}
+	for _, test := range tests {
+		t.Run(test.key, func(t *testing.T) {
+			if got := withSuffix(test.key, test.i); got != test.want {
+				t.Errorf("withSuffix(%q, %d) = %q, want %q", test.key, test.i, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,63 @@
+package objects
+
+import (
+	"fmt"
+	"path"
+	"strings"
+	"time"
+)
+
+// DefaultKeyTemplate is the layout of the archived and failed keys when
+// ARCHIVE_KEY_TEMPLATE is not set.
+const DefaultKeyTemplate = "{folder}/{yyyy}/{mm}/{dd}/{runId}/{path}"
+
+// RenderKey renders the key a file is moved to from the template. The
+// placeholders are:
+//
+//   - {folder}: archive or failed.
+//   - {yyyy}, {mm}, {dd}: the date of the job run, or of the rejection of a
+//     file that failed before a job was started.
+//   - {runId}: the id of the job run.
+//   - {path}: the key of the file without the input prefix, sub folders included.
+//   - {file}: the name of the file.
+//
+// Empty segments, e.g. when there is no run id, are removed from the key.
+func RenderKey(template string, folder string, prefix string, key string, runID string, runDate time.Time) (string, error) {
+	if !strings.Contains(template, "{path}") && !strings.Contains(template, "{file}") {
+		return "", fmt.Errorf("the key template must contain {path} or {file}: %s", template)
+	}
+
+	relative := key
+	if prefix != "" && strings.HasPrefix(key, prefix) {
+		relative = strings.TrimPrefix(key, prefix)
+	}
+	relative = strings.TrimPrefix(relative, "/")
+
+	runDate = runDate.UTC()
+	rendered := strings.NewReplacer(
+		"{folder}", folder,
+		"{yyyy}", runDate.Format("2006"),
+		"{mm}", runDate.Format("01"),
+		"{dd}", runDate.Format("02"),
+		"{runId}", runID,
+		"{path}", relative,
+		"{file}", path.Base(key),
+	).Replace(template)
+
+	segments := []string{}
+	for _, segment := range strings.Split(rendered, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	return strings.Join(segments, "/"), nil
+}
+
+// The suffix of the diagnostics file written next to a failed file.
+const diagnosticsSuffix = ".error.json"
+
+// DiagnosticsKey returns the key of the diagnostics file written next to a
+// failed file.
+func DiagnosticsKey(failedKey string) string {
+	return failedKey + diagnosticsSuffix
+}
@@ -0,0 +1,81 @@
+package objects
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRenderKey(t *testing.T) {
+	runDate := time.Date(2026, 10, 2, 23, 30, 0, 0, time.FixedZone("CEST", 2*60*60))
+
+	tests := []struct {
+		name     string
+		template string
+		folder   string
+		prefix   string
+		key      string
+		runID    string
+		want     string
+		wantErr  bool
+	}{
+		{
+			name:     "default template",
+			template: DefaultKeyTemplate,
+			folder:   "archive",
+			prefix:   "input/",
+			key:      "input/bank/august.csv",
+			runID:    "jr_0123",
+			want:     "archive/2026/10/02/jr_0123/bank/august.csv",
+		},
+		{
+			name:     "no run id",
+			template: DefaultKeyTemplate,
+			folder:   "failed",
+			prefix:   "input/",
+			key:      "input/august.csv",
+			want:     "failed/2026/10/02/august.csv",
+		},
+		{
+			name:     "file name only",
+			template: "{folder}/{runId}/{file}",
+			folder:   "archive",
+			prefix:   "input/",
+			key:      "input/bank/august.csv",
+			runID:    "jr_0123",
+			want:     "archive/jr_0123/august.csv",
+		},
+		{
+			name:     "key outside the prefix",
+			template: "{folder}/{path}",
+			folder:   "archive",
+			prefix:   "input/",
+			key:      "cards/august.csv",
+			want:     "archive/cards/august.csv",
+		},
+		{
+			name:     "no prefix",
+			template: "{folder}/{yyyy}-{mm}-{dd}/{path}",
+			folder:   "archive",
+			key:      "/input/august.csv",
+			want:     "archive/2026-10-02/input/august.csv",
+		},
+		{
+			name:     "no path nor file",
+			template: "{folder}/{runId}",
+			folder:   "archive",
+			key:      "input/august.csv",
+			wantErr:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := RenderKey(test.template, test.folder, test.prefix, test.key, test.runID, runDate)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("RenderKey() error = %v, want error %v", err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("RenderKey() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,343 @@
+// Package objects moves files between the folders of the data bucket. S3 has
+// no move, so a file is copied, the copy is verified and only then is the
+// original deleted.
+package objects
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+const (
+	// The largest object CopyObject can copy, larger objects are copied in parts.
+	maxCopyObjectSize = 5 * 1024 * 1024 * 1024
+
+	// The size of the parts of a multipart copy, raised for objects that
+	// would need more than maxParts parts.
+	minPartSize = 512 * 1024 * 1024
+
+	// The maximum number of parts of a multipart upload.
+	maxParts = 10000
+
+	// The number of parts copied at the same time.
+	partConcurrency = 8
+
+	// The maximum number of tags on an S3 object.
+	maxTags = 10
+)
+
+// MoveInput describes a file to move within a bucket.
+type MoveInput struct {
+	Bucket         string
+	SourceKey      string
+	DestinationKey string
+
+	// Tags added to the moved file, they are merged with the tags of the
+	// source and win on conflicts.
+	Tags map[string]string
+
+	// Whether the tags of the source are dropped, the file only gets the
+	// added tags.
+	ReplaceTags bool
+}
+
+// MoveOutput describes the moved file.
+type MoveOutput struct {
+	// The ETag of the moved file.
+	ETag string
+
+	// The size of the moved file in bytes.
+	Size int64
+
+	// Whether the file was copied in parts.
+	Multipart bool
+
+	// The tags of the source, or added tags, that were dropped because S3
+	// allows 10 tags per object.
+	DroppedTags []string
+}
+
+// Move copies a file to its destination key with its metadata and tags,
+// verifies the copy and deletes the source.
+func Move(ctx context.Context, client s3iface.S3API, input MoveInput) (MoveOutput, error) {
+	output, err := Copy(ctx, client, input)
+	if err != nil {
+		return output, err
+	}
+
+	_, err = client.DeleteObjectWithContext(ctx, &s3.DeleteObjectInput{
+		Bucket: aws.String(input.Bucket),
+		Key:    aws.String(input.SourceKey),
+	})
+	if err != nil {
+		return output, fmt.Errorf("deleting %s: %w", input.SourceKey, err)
+	}
+
+	return output, nil
+}
+
+// Copy copies a file to its destination key with its metadata and tags, and
+// verifies the copy. Files over 5 GB are copied in parts. The copy is
+// verified by its size, and by its ETag when both files were written in a
+// single part, as the ETag of a multipart object depends on the size of its
+// parts.
+func Copy(ctx context.Context, client s3iface.S3API, input MoveInput) (MoveOutput, error) {
+	output := MoveOutput{}
+
+	source, err := client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(input.Bucket),
+		Key:    aws.String(input.SourceKey),
+	})
+	if err != nil {
+		return output, fmt.Errorf("getting %s: %w", input.SourceKey, err)
+	}
+
+	// Keep the tags of the source along with the added tags.
+	tagging, err := client.GetObjectTaggingWithContext(ctx, &s3.GetObjectTaggingInput{
+		Bucket: aws.String(input.Bucket),
+		Key:    aws.String(input.SourceKey),
+	})
+	if err != nil {
+		return output, fmt.Errorf("getting the tags of %s: %w", input.SourceKey, err)
+	}
+	sourceTags := map[string]string{}
+	for _, tag := range tagging.TagSet {
+		if !input.ReplaceTags {
+			sourceTags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+		}
+	}
+	tags, dropped := mergeTags(sourceTags, input.Tags)
+	output.DroppedTags = dropped
+
+	size := aws.Int64Value(source.ContentLength)
+	if size > maxCopyObjectSize {
+		output.Multipart = true
+		output.ETag, err = multipartCopy(ctx, client, input, source, tags)
+	} else {
+		output.ETag, err = singleCopy(ctx, client, input, tags)
+	}
+	if err != nil {
+		return output, err
+	}
+
+	// Verify the copy, so a moved file is only deleted once it is safe.
+	copied, err := client.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(input.Bucket),
+		Key:    aws.String(input.DestinationKey),
+	})
+	if err != nil {
+		return output, fmt.Errorf("getting the copy %s: %w", input.DestinationKey, err)
+	}
+	if err := verifyCopy(source, copied, output.Multipart); err != nil {
+		return output, fmt.Errorf("verifying the copy of %s to %s: %w", input.SourceKey, input.DestinationKey, err)
+	}
+	output.Size = aws.Int64Value(copied.ContentLength)
+
+	return output, nil
+}
+
+// Copies a file with a single CopyObject call, the metadata is copied from
+// the source and the tags are replaced with the merged tags.
+func singleCopy(ctx context.Context, client s3iface.S3API, input MoveInput, tags string) (string, error) {
+	copied, err := client.CopyObjectWithContext(ctx, &s3.CopyObjectInput{
+		Bucket:            aws.String(input.Bucket),
+		CopySource:        aws.String(copySource(input.Bucket, input.SourceKey)),
+		Key:               aws.String(input.DestinationKey),
+		MetadataDirective: aws.String(s3.MetadataDirectiveCopy),
+		TaggingDirective:  aws.String(s3.TaggingDirectiveReplace),
+		Tagging:           aws.String(tags),
+	})
+	if err != nil {
+		return "", fmt.Errorf("copying %s to %s: %w", input.SourceKey, input.DestinationKey, err)
+	}
+	return aws.StringValue(copied.CopyObjectResult.ETag), nil
+}
+
+// Copies a file in parts, for the files CopyObject cannot copy. The metadata
+// of the source is set on the upload as it is not copied by UploadPartCopy.
+// The upload is aborted if any part fails so no parts are left behind.
+func multipartCopy(ctx context.Context, client s3iface.S3API, input MoveInput, source *s3.HeadObjectOutput, tags string) (string, error) {
+	upload, err := client.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:             aws.String(input.Bucket),
+		Key:                aws.String(input.DestinationKey),
+		Metadata:           source.Metadata,
+		ContentType:        source.ContentType,
+		ContentEncoding:    source.ContentEncoding,
+		ContentDisposition: source.ContentDisposition,
+		ContentLanguage:    source.ContentLanguage,
+		CacheControl:       source.CacheControl,
+		StorageClass:       source.StorageClass,
+		Tagging:            aws.String(tags),
+	})
+	if err != nil {
+		return "", fmt.Errorf("starting the copy of %s to %s: %w", input.SourceKey, input.DestinationKey, err)
+	}
+
+	parts, err := copyParts(ctx, client, input, upload.UploadId, aws.Int64Value(source.ContentLength))
+	if err != nil {
+		_, abortErr := client.AbortMultipartUploadWithContext(ctx, &s3.AbortMultipartUploadInput{
+			Bucket:   aws.String(input.Bucket),
+			Key:      aws.String(input.DestinationKey),
+			UploadId: upload.UploadId,
+		})
+		if abortErr != nil {
+			return "", fmt.Errorf("%v, and aborting the copy: %v", err, abortErr)
+		}
+		return "", err
+	}
+
+	completed, err := client.CompleteMultipartUploadWithContext(ctx, &s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(input.Bucket),
+		Key:             aws.String(input.DestinationKey),
+		UploadId:        upload.UploadId,
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: parts},
+	})
+	if err != nil {
+		return "", fmt.Errorf("completing the copy of %s to %s: %w", input.SourceKey, input.DestinationKey, err)
+	}
+	return aws.StringValue(completed.ETag), nil
+}
+
+// Copies the parts of a file concurrently and returns them in order.
+func copyParts(ctx context.Context, client s3iface.S3API, input MoveInput, uploadID *string, size int64) ([]*s3.CompletedPart, error) {
+	partSize := int64(minPartSize)
+	if size/partSize >= maxParts {
+		partSize = size/maxParts + 1
+	}
+	count := int((size + partSize - 1) / partSize)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		part *s3.CompletedPart
+		err  error
+	}
+	results := make(chan result, count)
+	limit := make(chan struct{}, partConcurrency)
+
+	for i := 0; i < count; i++ {
+		number := int64(i + 1)
+		first := int64(i) * partSize
+		last := first + partSize - 1
+		if last >= size {
+			last = size - 1
+		}
+
+		go func() {
+			limit <- struct{}{}
+			defer func() { <-limit }()
+
+			copied, err := client.UploadPartCopyWithContext(ctx, &s3.UploadPartCopyInput{
+				Bucket:          aws.String(input.Bucket),
+				Key:             aws.String(input.DestinationKey),
+				CopySource:      aws.String(copySource(input.Bucket, input.SourceKey)),
+				CopySourceRange: aws.String(fmt.Sprintf("bytes=%d-%d", first, last)),
+				PartNumber:      aws.Int64(number),
+				UploadId:        uploadID,
+			})
+			if err != nil {
+				results <- result{err: fmt.Errorf("copying part %d of %s: %w", number, input.SourceKey, err)}
+				return
+			}
+			results <- result{part: &s3.CompletedPart{ETag: copied.CopyPartResult.ETag, PartNumber: aws.Int64(number)}}
+		}()
+	}
+
+	parts := make([]*s3.CompletedPart, 0, count)
+	var firstErr error
+	for i := 0; i < count; i++ {
+		r := <-results
+		if r.err != nil {
+			if firstErr == nil {
+				firstErr = r.err
+				cancel()
+			}
+			continue
+		}
+		parts = append(parts, r.part)
+	}
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	sort.Slice(parts, func(i, j int) bool {
+		return aws.Int64Value(parts[i].PartNumber) < aws.Int64Value(parts[j].PartNumber)
+	})
+	return parts, nil
+}
+
+// Checks the copy has the size of the source and, when both were written in
+// a single part, the same ETag.
+func verifyCopy(source *s3.HeadObjectOutput, copied *s3.HeadObjectOutput, multipart bool) error {
+	if aws.Int64Value(source.ContentLength) != aws.Int64Value(copied.ContentLength) {
+		return fmt.Errorf("size mismatch: source is %d bytes, copy is %d bytes", aws.Int64Value(source.ContentLength), aws.Int64Value(copied.ContentLength))
+	}
+
+	sourceETag := aws.StringValue(source.ETag)
+	if !multipart && !isMultipartETag(sourceETag) && sourceETag != aws.StringValue(copied.ETag) {
+		return fmt.Errorf("ETag mismatch: source is %s, copy is %s", sourceETag, aws.StringValue(copied.ETag))
+	}
+
+	return nil
+}
+
+// Whether the ETag is the one of an object uploaded in parts, e.g. "abc-3".
+func isMultipartETag(etag string) bool {
+	return strings.Contains(etag, "-")
+}
+
+// Returns the URL encoded CopySource of a file.
+func copySource(bucket string, key string) string {
+	segments := strings.Split(key, "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return bucket + "/" + strings.Join(segments, "/")
+}
+
+// Merges the tags of the source file with the given tags, which win on
+// conflicts, and encodes them for the Tagging field of a copy. S3 allows 10
+// tags per object: the source tags that do not fit are dropped, and so are
+// the given tags past the first 10 by key, as S3 would reject the copy.
+func mergeTags(source map[string]string, tags map[string]string) (string, []string) {
+	values := url.Values{}
+	dropped := []string{}
+	for _, key := range sortedKeys(tags) {
+		if len(values) >= maxTags {
+			dropped = append(dropped, fmt.Sprintf("%s=%s", key, tags[key]))
+			continue
+		}
+		values.Set(key, tags[key])
+	}
+
+	for _, key := range sortedKeys(source) {
+		if _, ok := tags[key]; ok {
+			continue
+		}
+		if len(values) >= maxTags {
+			dropped = append(dropped, fmt.Sprintf("%s=%s", key, source[key]))
+			continue
+		}
+		values.Set(key, source[key])
+	}
+
+	return values.Encode(), dropped
+}
+
+// Returns the keys of the tags, sorted.
+func sortedKeys(tags map[string]string) []string {
+	keys := make([]string, 0, len(tags))
+	for key := range tags {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
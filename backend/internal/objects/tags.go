@@ -0,0 +1,63 @@
+package objects
+
+import (
+	"context"
+	"net/url"
+	"regexp"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// The maximum length of an S3 tag value.
+const maxTagValueLength = 256
+
+// The characters S3 does not allow in tag values.
+var invalidTagCharacters = regexp.MustCompile(`[^\pL\pN +\-=._:/@]+`)
+
+// TagValue makes a string safe to use as an S3 tag value, replacing the
+// characters S3 does not allow and truncating it to the maximum length.
+func TagValue(value string) string {
+	value = strings.TrimSpace(invalidTagCharacters.ReplaceAllString(value, " "))
+	runes := []rune(value)
+	if len(runes) > maxTagValueLength {
+		value = string(runes[:maxTagValueLength])
+	}
+	return value
+}
+
+// AddTags adds the tags to a file, keeping its other tags. The tags win on
+// conflicts, and the tags that no longer fit, the tags of the file first,
+// are dropped and returned.
+func AddTags(ctx context.Context, client s3iface.S3API, bucket string, key string, tags map[string]string) ([]string, error) {
+	tagging, err := client.GetObjectTaggingWithContext(ctx, &s3.GetObjectTaggingInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return nil, err
+	}
+	current := map[string]string{}
+	for _, tag := range tagging.TagSet {
+		current[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+
+	encoded, dropped := mergeTags(current, tags)
+	values, err := url.ParseQuery(encoded)
+	if err != nil {
+		return dropped, err
+	}
+	tagSet := []*s3.Tag{}
+	for name := range values {
+		tagSet = append(tagSet, &s3.Tag{Key: aws.String(name), Value: aws.String(values.Get(name))})
+	}
+
+	_, err = client.PutObjectTaggingWithContext(ctx, &s3.PutObjectTaggingInput{
+		Bucket:  aws.String(bucket),
+		Key:     aws.String(key),
+		Tagging: &s3.Tagging{TagSet: tagSet},
+	})
+	return dropped, err
+}
@@ -0,0 +1,93 @@
+package objects
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"testing"
+)
+
+func TestMergeTags(t *testing.T) {
+	// Returns n tags named prefix0, prefix1, ...
+	numbered := func(prefix string, n int) map[string]string {
+		tags := map[string]string{}
+		for i := 0; i < n; i++ {
+			tags[fmt.Sprintf("%s%d", prefix, i)] = "v"
+		}
+		return tags
+	}
+
+	tests := []struct {
+		name        string
+		source      map[string]string
+		tags        map[string]string
+		want        map[string]string
+		wantDropped []string
+	}{
+		{
+			name:   "merged",
+			source: map[string]string{"bank": "acme"},
+			tags:   map[string]string{"rule": "default"},
+			want:   map[string]string{"bank": "acme", "rule": "default"},
+		},
+		{
+			name:   "tags win on conflicts",
+			source: map[string]string{"state": "queued", "bank": "acme"},
+			tags:   map[string]string{"state": "archived"},
+			want:   map[string]string{"state": "archived", "bank": "acme"},
+		},
+		{
+			name:        "source tags dropped first",
+			source:      map[string]string{"a": "1", "b": "2"},
+			tags:        numbered("t", 9),
+			want:        withTags(numbered("t", 9), map[string]string{"a": "1"}),
+			wantDropped: []string{"b=2"},
+		},
+		{
+			name:        "tags past the limit dropped by key",
+			source:      map[string]string{"a": "1"},
+			tags:        numbered("t", 11),
+			want:        withTags(numbered("t", 10), map[string]string{"t10": "v"}, "t9"),
+			wantDropped: []string{"t9=v", "a=1"},
+		},
+		{
+			name: "no tags",
+			want: map[string]string{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			encoded, dropped := mergeTags(test.source, test.tags)
+			values, err := url.ParseQuery(encoded)
+			if err != nil {
+				t.Fatalf("mergeTags() encoded invalid tags %q: %v", encoded, err)
+			}
+			got := map[string]string{}
+			for key := range values {
+				got[key] = values.Get(key)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("mergeTags() tags = %v, want %v", got, test.want)
+			}
+			if len(dropped) != len(test.wantDropped) || (len(dropped) > 0 && !reflect.DeepEqual(dropped, test.wantDropped)) {
+				t.Errorf("mergeTags() dropped = %v, want %v", dropped, test.wantDropped)
+			}
+		})
+	}
+}
+
+// Returns a copy of the tags with the extra tags added and the given keys
+// removed.
+func withTags(tags map[string]string, extra map[string]string, removed ...string) map[string]string {
+	merged := map[string]string{}
+	for key, value := range tags {
+		merged[key] = value
+	}
+	for key, value := range extra {
+		merged[key] = value
+	}
+	for _, key := range removed {
+		delete(merged, key)
+	}
+	return merged
+}
@@ -0,0 +1,228 @@
+// Package rules decides which uploaded files are ingested and by which Glue
+// job and table. The rules are read from the stage config and passed to the
+// glue-trigger lambda as JSON.
+package rules
+
+import (
+	"fmt"
+	"mime"
+	"path"
+	"regexp"
+	"strings"
+
+	"go-cdk-workshop/internal/schema"
+)
+
+// The reasons a file is not accepted by the rule of its prefix.
+const (
+	ExtensionNotAllowed   = "EXTENSION_NOT_ALLOWED"
+	PatternNotMatched     = "PATTERN_NOT_MATCHED"
+	TooSmall              = "TOO_SMALL"
+	TooLarge              = "TOO_LARGE"
+	ContentTypeNotAllowed = "CONTENT_TYPE_NOT_ALLOWED"
+
+	// The file is not in a format the Glue job reads, detected by glue-trigger.
+	UnsupportedFormat = "UNSUPPORTED_FORMAT"
+
+	// The file names a schema that does not exist, detected by glue-trigger.
+	UnknownSchema = "UNKNOWN_SCHEMA"
+
+	// The zip file has more files than are extracted, detected by glue-trigger.
+	TooManyFiles = "TOO_MANY_FILES"
+)
+
+// The folders the pipeline writes to, which a rule cannot watch as the files
+// moved there would be ingested again.
+var ReservedPrefixes = []string{"archive/", "failed/", "ignored/", "expanded/", "rejected/", "stats/", "manifests/"}
+
+// The extensions of the formats the pipeline loads, accepted by the rules of
+// the stage config that do not list their own.
+var DefaultExtensions = []string{".csv", ".csv.gz", ".csv.bz2", ".zip", ".parquet", ".jsonl", ".ndjson", ".jsonl.gz"}
+
+// The names of the jobs and tables must be usable in construct ids.
+var validName = regexp.MustCompile(`^[A-Za-z][A-Za-z0-9]*$`)
+
+// Rule describes the files accepted under a prefix of the data bucket.
+type Rule struct {
+	// The name of the rule, it is added to the files it ignores.
+	Name string `yaml:"name" json:"name"`
+
+	// The prefix the rule watches, ending with a slash. A file is handled by
+	// the rule with the longest prefix it is under.
+	Prefix string `yaml:"prefix" json:"prefix"`
+
+	// Glob patterns, e.g. "bank-*/*.csv", matched against the key without the
+	// prefix. A pattern without a slash is matched against the file name.
+	// Every file is accepted when there are none.
+	Patterns []string `yaml:"patterns" json:"patterns,omitempty"`
+
+	// The extensions accepted, e.g. ".csv". Every extension is accepted when
+	// there are none.
+	Extensions []string `yaml:"extensions" json:"extensions,omitempty"`
+
+	// The size limits of the files in bytes, zero means no limit.
+	MinSizeBytes int64 `yaml:"minSizeBytes" json:"minSizeBytes,omitempty"`
+	MaxSizeBytes int64 `yaml:"maxSizeBytes" json:"maxSizeBytes,omitempty"`
+
+	// The content types accepted, e.g. "text/csv". Every content type is
+	// accepted when there are none.
+	ContentTypes []string `yaml:"contentTypes" json:"contentTypes,omitempty"`
+
+	// The schema of the files, e.g. "transactions" for its latest version or
+	// "transactions@v1", the latest version of the default schema when empty.
+	// A file can name its own in its "schema" metadata.
+	Schema string `yaml:"schema" json:"schema,omitempty"`
+
+	// The names of the Glue job and table the files are loaded with, the
+	// default job and table of the pipeline when empty. The stack creates a
+	// job and a table for every name used.
+	Job   string `yaml:"job" json:"job,omitempty"`
+	Table string `yaml:"table" json:"table,omitempty"`
+
+	// The deployed names of the job and table, set by the stack.
+	JobName   string `yaml:"-" json:"jobName,omitempty"`
+	TableName string `yaml:"-" json:"tableName,omitempty"`
+}
+
+// Object is the uploaded file a rule is checked against.
+type Object struct {
+	Key         string
+	Size        int64
+	ContentType string
+}
+
+// Validate checks the rules can be deployed.
+func Validate(rules []Rule) error {
+	if len(rules) == 0 {
+		return fmt.Errorf("at least one ingestion rule is required")
+	}
+
+	names := map[string]bool{}
+	prefixes := map[string]bool{}
+	for _, rule := range rules {
+		if rule.Name == "" {
+			return fmt.Errorf("ingestion rule %q: a name is required", rule.Prefix)
+		}
+		if names[rule.Name] {
+			return fmt.Errorf("ingestion rule %s: the name is used twice", rule.Name)
+		}
+		names[rule.Name] = true
+
+		if rule.Prefix == "" || !strings.HasSuffix(rule.Prefix, "/") {
+			return fmt.Errorf("ingestion rule %s: the prefix must end with a slash", rule.Name)
+		}
+		if prefixes[rule.Prefix] {
+			return fmt.Errorf("ingestion rule %s: the prefix %s is used twice", rule.Name, rule.Prefix)
+		}
+		prefixes[rule.Prefix] = true
+		for _, reserved := range ReservedPrefixes {
+			if strings.HasPrefix(rule.Prefix, reserved) || strings.HasPrefix(reserved, rule.Prefix) {
+				return fmt.Errorf("ingestion rule %s: the prefix cannot overlap the %s folder", rule.Name, reserved)
+			}
+		}
+
+		for _, pattern := range rule.Patterns {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("ingestion rule %s: invalid pattern %q", rule.Name, pattern)
+			}
+		}
+
+		if rule.MinSizeBytes < 0 || rule.MaxSizeBytes < 0 {
+			return fmt.Errorf("ingestion rule %s: the size limits cannot be negative", rule.Name)
+		}
+		if rule.MaxSizeBytes > 0 && rule.MinSizeBytes > rule.MaxSizeBytes {
+			return fmt.Errorf("ingestion rule %s: the minimum size is above the maximum size", rule.Name)
+		}
+
+		if _, err := schema.Lookup(rule.Schema); err != nil {
+			return fmt.Errorf("ingestion rule %s: %w", rule.Name, err)
+		}
+
+		if rule.Job != "" && !validName.MatchString(rule.Job) {
+			return fmt.Errorf("ingestion rule %s: the job name %q must be alphanumeric", rule.Name, rule.Job)
+		}
+		if rule.Table != "" && !validName.MatchString(rule.Table) {
+			return fmt.Errorf("ingestion rule %s: the table name %q must be alphanumeric", rule.Name, rule.Table)
+		}
+	}
+
+	return nil
+}
+
+// Match returns the rule with the longest prefix the key is under, nil when
+// the key is not under any of them.
+func Match(rules []Rule, key string) *Rule {
+	var match *Rule
+	for i := range rules {
+		if strings.HasPrefix(key, rules[i].Prefix) && (match == nil || len(rules[i].Prefix) > len(match.Prefix)) {
+			match = &rules[i]
+		}
+	}
+	return match
+}
+
+// Check returns why the rule does not accept the file, or an empty string
+// when it does.
+func (r Rule) Check(object Object) string {
+	if len(r.Extensions) > 0 && !r.hasExtension(object.Key) {
+		return ExtensionNotAllowed
+	}
+
+	if len(r.Patterns) > 0 && !r.matchesPattern(object.Key) {
+		return PatternNotMatched
+	}
+
+	if r.MinSizeBytes > 0 && object.Size < r.MinSizeBytes {
+		return TooSmall
+	}
+	if r.MaxSizeBytes > 0 && object.Size > r.MaxSizeBytes {
+		return TooLarge
+	}
+
+	if len(r.ContentTypes) > 0 && !r.hasContentType(object.ContentType) {
+		return ContentTypeNotAllowed
+	}
+
+	return ""
+}
+
+// Whether the key ends with one of the extensions, ignoring the case.
+func (r Rule) hasExtension(key string) bool {
+	key = strings.ToLower(key)
+	for _, extension := range r.Extensions {
+		if strings.HasSuffix(key, strings.ToLower(extension)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the key, without the prefix, matches one of the patterns.
+func (r Rule) matchesPattern(key string) bool {
+	relative := strings.TrimPrefix(key, r.Prefix)
+	for _, pattern := range r.Patterns {
+		name := relative
+		if !strings.Contains(pattern, "/") {
+			name = path.Base(relative)
+		}
+		if ok, _ := path.Match(pattern, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Whether the media type of the content type is one of the content types,
+// ignoring its parameters, e.g. "text/csv; charset=utf-8".
+func (r Rule) hasContentType(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return false
+	}
+	for _, allowed := range r.ContentTypes {
+		if strings.EqualFold(mediaType, allowed) {
+			return true
+		}
+	}
+	return false
+}
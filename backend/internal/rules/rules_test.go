@@ -0,0 +1,140 @@
+package rules
+
+import "testing"
+
+func TestMatch(t *testing.T) {
+	rules := []Rule{
+		{Name: "default", Prefix: "input/"},
+		{Name: "bank", Prefix: "input/bank/"},
+		{Name: "cards", Prefix: "cards/"},
+	}
+
+	tests := []struct {
+		name string
+		key  string
+		want string
+	}{
+		{name: "single prefix", key: "cards/august.csv", want: "cards"},
+		{name: "longest prefix", key: "input/bank/august.csv", want: "bank"},
+		{name: "shorter prefix", key: "input/august.csv", want: "default"},
+		{name: "prefix of a folder name", key: "input/banking/august.csv", want: "default"},
+		{name: "no prefix", key: "archive/input/august.csv", want: ""},
+		{name: "prefix without slash", key: "input", want: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := ""
+			if rule := Match(rules, test.key); rule != nil {
+				got = rule.Name
+			}
+			if got != test.want {
+				t.Errorf("Match(%q) = %q, want %q", test.key, got, test.want)
+			}
+		})
+	}
+}
+
+func TestCheck(t *testing.T) {
+	rule := Rule{
+		Name:         "bank",
+		Prefix:       "input/",
+		Patterns:     []string{"bank-*", "exports/*/*.parquet"},
+		Extensions:   []string{".csv", ".csv.gz", ".parquet"},
+		MinSizeBytes: 10,
+		MaxSizeBytes: 1000,
+		ContentTypes: []string{"text/csv", "application/gzip", "application/octet-stream"},
+	}
+
+	tests := []struct {
+		name   string
+		rule   Rule
+		object Object
+		want   string
+	}{
+		{
+			name:   "accepted",
+			rule:   rule,
+			object: Object{Key: "input/bank-august.csv", Size: 100, ContentType: "text/csv"},
+		},
+		{
+			name:   "extension ignoring the case",
+			rule:   rule,
+			object: Object{Key: "input/bank-august.CSV.GZ", Size: 100, ContentType: "application/gzip"},
+		},
+		{
+			name:   "pattern without slash matches the file name",
+			rule:   rule,
+			object: Object{Key: "input/2026/bank-august.csv", Size: 100, ContentType: "text/csv"},
+		},
+		{
+			name:   "pattern with slash matches the relative key",
+			rule:   rule,
+			object: Object{Key: "input/exports/august/cards.parquet", Size: 100, ContentType: "application/octet-stream"},
+		},
+		{
+			name:   "content type parameters",
+			rule:   rule,
+			object: Object{Key: "input/bank-august.csv", Size: 100, ContentType: "text/csv; charset=utf-8"},
+		},
+		{
+			name:   "extension not allowed",
+			rule:   rule,
+			object: Object{Key: "input/bank-august.json", Size: 100, ContentType: "text/csv"},
+			want:   ExtensionNotAllowed,
+		},
+		{
+			name:   "pattern not matched",
+			rule:   rule,
+			object: Object{Key: "input/cards-august.csv", Size: 100, ContentType: "text/csv"},
+			want:   PatternNotMatched,
+		},
+		{
+			name:   "pattern does not cross folders",
+			rule:   rule,
+			object: Object{Key: "input/exports/2026/august/cards.parquet", Size: 100, ContentType: "application/octet-stream"},
+			want:   PatternNotMatched,
+		},
+		{
+			name:   "too small",
+			rule:   rule,
+			object: Object{Key: "input/bank-august.csv", Size: 9, ContentType: "text/csv"},
+			want:   TooSmall,
+		},
+		{
+			name:   "too large",
+			rule:   rule,
+			object: Object{Key: "input/bank-august.csv", Size: 1001, ContentType: "text/csv"},
+			want:   TooLarge,
+		},
+		{
+			name:   "content type not allowed",
+			rule:   rule,
+			object: Object{Key: "input/bank-august.csv", Size: 100, ContentType: "application/json"},
+			want:   ContentTypeNotAllowed,
+		},
+		{
+			name:   "invalid content type",
+			rule:   rule,
+			object: Object{Key: "input/bank-august.csv", Size: 100, ContentType: ";"},
+			want:   ContentTypeNotAllowed,
+		},
+		{
+			name:   "extension checked first",
+			rule:   rule,
+			object: Object{Key: "input/cards.json", Size: 0, ContentType: "application/json"},
+			want:   ExtensionNotAllowed,
+		},
+		{
+			name:   "no limits",
+			rule:   Rule{Name: "default", Prefix: "input/"},
+			object: Object{Key: "input/anything.bin"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.rule.Check(test.object); got != test.want {
+				t.Errorf("Check(%+v) = %q, want %q", test.object, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,259 @@
+// Package schema holds the versioned definitions of the files the pipeline
+// ingests: their columns, the aliases the banks use for them, their types and
+// whether they are required. The definitions are JSON files embedded in the
+// lambdas, so a schema is validated before a Glue job is started, and passed
+// to the job as the --schema argument.
+package schema
+
+import (
+	"embed"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// The schema used by the rules and files that do not name one.
+const DefaultName = "transactions"
+
+// The types of the columns, as loaded into the table. Timestamps are parsed
+// with the format of their column.
+const (
+	TypeString    = "string"
+	TypeDouble    = "double"
+	TypeLong      = "long"
+	TypeBoolean   = "boolean"
+	TypeTimestamp = "timestamp"
+)
+
+//go:embed schemas/*.json
+var files embed.FS
+
+// Schema describes the columns of a file.
+type Schema struct {
+	Name        string   `json:"name"`
+	Version     int      `json:"version"`
+	Description string   `json:"description,omitempty"`
+	Columns     []Column `json:"columns"`
+
+	// The columns some files have that are known and not loaded, e.g.
+	// expirationDateKeyInMatch. Any other column is not loaded either, but
+	// is reported as unexpected.
+	Ignored []string `json:"ignored,omitempty"`
+
+	// The double or long column whose sum is checked once the rows are
+	// loaded, e.g. transactionAmount. The files are only reconciled by their
+	// row counts and ids without it.
+	Amount string `json:"amount,omitempty"`
+}
+
+// Column describes a column of a file.
+type Column struct {
+	// The name of the column in the table.
+	Name string `json:"name"`
+
+	// The type of the column, one of the Type constants.
+	Type string `json:"type"`
+
+	// The format of a timestamp column, in the Spark datetime pattern syntax.
+	Format string `json:"format,omitempty"`
+
+	// Whether a row without a value in the column is rejected, and a file
+	// without the column is failed.
+	Required bool `json:"required,omitempty"`
+
+	// The other names of the column in the files, matched ignoring the case.
+	Aliases []string `json:"aliases,omitempty"`
+}
+
+var (
+	loadOnce sync.Once
+	registry map[string][]*Schema
+	loadErr  error
+)
+
+// Ref returns the reference of the schema, e.g. "transactions@v1".
+func (s *Schema) Ref() string {
+	return fmt.Sprintf("%s@v%d", s.Name, s.Version)
+}
+
+// JSON returns the schema as compact JSON, as passed to the Glue job.
+func (s *Schema) JSON() (string, error) {
+	content, err := json.Marshal(s)
+	return string(content), err
+}
+
+// Validate checks the schema can be used by the Glue job.
+func (s *Schema) Validate() error {
+	if s.Name == "" || s.Version < 1 {
+		return fmt.Errorf("a schema needs a name and a version of at least 1")
+	}
+	if len(s.Columns) == 0 {
+		return fmt.Errorf("schema %s: at least one column is required", s.Ref())
+	}
+
+	names := map[string]string{}
+	for _, column := range s.Columns {
+		switch column.Type {
+		case TypeString, TypeDouble, TypeLong, TypeBoolean:
+		case TypeTimestamp:
+			if column.Format == "" {
+				return fmt.Errorf("schema %s: the timestamp column %s needs a format", s.Ref(), column.Name)
+			}
+		default:
+			return fmt.Errorf("schema %s: unknown type %q of column %s", s.Ref(), column.Type, column.Name)
+		}
+
+		for _, name := range append([]string{column.Name}, column.Aliases...) {
+			key := strings.ToLower(name)
+			if name == "" {
+				return fmt.Errorf("schema %s: the column names and aliases cannot be empty", s.Ref())
+			}
+			if other, ok := names[key]; ok {
+				return fmt.Errorf("schema %s: %s is used by both %s and %s", s.Ref(), name, other, column.Name)
+			}
+			names[key] = column.Name
+		}
+	}
+
+	if s.Amount != "" {
+		column := s.Column(s.Amount)
+		if column == nil || (column.Type != TypeDouble && column.Type != TypeLong) {
+			return fmt.Errorf("schema %s: the amount column %s needs to be a double or long column", s.Ref(), s.Amount)
+		}
+	}
+
+	return nil
+}
+
+// Column returns the column of the schema with the name, or nil.
+func (s *Schema) Column(name string) *Column {
+	for i := range s.Columns {
+		if s.Columns[i].Name == name {
+			return &s.Columns[i]
+		}
+	}
+	return nil
+}
+
+// Lookup returns the schema of a reference: "<name>" for the latest version
+// of the schema, or "<name>@v<version>" for a given version. An empty
+// reference is the latest version of the default schema.
+func Lookup(ref string) (*Schema, error) {
+	loadOnce.Do(func() { registry, loadErr = load() })
+	if loadErr != nil {
+		return nil, loadErr
+	}
+
+	name, version := strings.TrimSpace(ref), 0
+	if name == "" {
+		name = DefaultName
+	}
+	if index := strings.Index(name, "@"); index >= 0 {
+		number, err := strconv.Atoi(strings.TrimPrefix(name[index+1:], "v"))
+		if err != nil || number < 1 {
+			return nil, fmt.Errorf("invalid schema version in %q", ref)
+		}
+		name, version = name[:index], number
+	}
+
+	versions, ok := registry[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown schema %q", name)
+	}
+	if version == 0 {
+		return versions[len(versions)-1], nil
+	}
+	for _, schema := range versions {
+		if schema.Version == version {
+			return schema, nil
+		}
+	}
+	return nil, fmt.Errorf("unknown version %d of schema %q", version, name)
+}
+
+// Reads and validates the embedded schemas, keyed by their name and sorted
+// by their version. The files are named <name>.v<version>.json.
+func load() (map[string][]*Schema, error) {
+	entries, err := files.ReadDir("schemas")
+	if err != nil {
+		return nil, err
+	}
+
+	schemas := map[string][]*Schema{}
+	for _, entry := range entries {
+		content, err := files.ReadFile(path.Join("schemas", entry.Name()))
+		if err != nil {
+			return nil, err
+		}
+
+		schema := &Schema{}
+		if err := json.Unmarshal(content, schema); err != nil {
+			return nil, fmt.Errorf("parsing schema %s: %w", entry.Name(), err)
+		}
+		if err := schema.Validate(); err != nil {
+			return nil, err
+		}
+		if expected := fmt.Sprintf("%s.v%d.json", schema.Name, schema.Version); entry.Name() != expected {
+			return nil, fmt.Errorf("schema %s: the file should be named %s", schema.Ref(), expected)
+		}
+
+		schemas[schema.Name] = append(schemas[schema.Name], schema)
+	}
+
+	for _, versions := range schemas {
+		sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	}
+	return schemas, nil
+}
+
+// HeaderCheck is the result of checking the columns of a file against a schema.
+type HeaderCheck struct {
+	// The required columns of the schema the file does not have.
+	Missing []string `json:"missingColumns,omitempty"`
+
+	// The columns of the file that are neither in the schema nor ignored by it.
+	Unexpected []string `json:"unexpectedColumns,omitempty"`
+}
+
+// OK reports whether the file has every required column of the schema.
+func (c HeaderCheck) OK() bool {
+	return len(c.Missing) == 0
+}
+
+// CheckHeader checks the columns of a file against the schema, matching the
+// names and aliases of the columns ignoring the case, as the Glue job does.
+// The unnamed columns, e.g. an index column, are not reported.
+func (s *Schema) CheckHeader(header []string) HeaderCheck {
+	names := map[string]string{}
+	for _, column := range s.Columns {
+		for _, name := range append([]string{column.Name}, column.Aliases...) {
+			names[strings.ToLower(name)] = column.Name
+		}
+	}
+	ignored := map[string]bool{}
+	for _, name := range s.Ignored {
+		ignored[strings.ToLower(name)] = true
+	}
+
+	check := HeaderCheck{}
+	found := map[string]bool{}
+	for _, name := range header {
+		key := strings.ToLower(strings.TrimSpace(name))
+		if column, ok := names[key]; ok {
+			found[column] = true
+		} else if key != "" && !ignored[key] {
+			check.Unexpected = append(check.Unexpected, name)
+		}
+	}
+
+	for _, column := range s.Columns {
+		if column.Required && !found[column.Name] {
+			check.Missing = append(check.Missing, column.Name)
+		}
+	}
+	return check
+}
@@ -0,0 +1,68 @@
+package schema
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestCheckHeader(t *testing.T) {
+	schema := &Schema{
+		Name:    "transactions",
+		Version: 1,
+		Columns: []Column{
+			{Name: "accountNumber", Type: TypeString, Required: true, Aliases: []string{"account_number"}},
+			{Name: "transactionAmount", Type: TypeDouble, Required: true, Aliases: []string{"amount"}},
+			{Name: "merchantName", Type: TypeString},
+		},
+		Ignored: []string{"expirationDateKeyInMatch"},
+	}
+
+	tests := []struct {
+		name   string
+		header []string
+		want   HeaderCheck
+	}{
+		{
+			name:   "every column",
+			header: []string{"accountNumber", "transactionAmount", "merchantName"},
+		},
+		{
+			name:   "optional column missing",
+			header: []string{"accountNumber", "transactionAmount"},
+		},
+		{
+			name:   "aliases ignoring the case and spaces",
+			header: []string{" ACCOUNT_NUMBER ", "Amount"},
+		},
+		{
+			name:   "unnamed and ignored columns",
+			header: []string{"", "accountNumber", "transactionAmount", "ExpirationDateKeyInMatch"},
+		},
+		{
+			name:   "required columns missing",
+			header: []string{"merchantName"},
+			want:   HeaderCheck{Missing: []string{"accountNumber", "transactionAmount"}},
+		},
+		{
+			name:   "unexpected columns",
+			header: []string{"accountNumber", "transactionAmount", "cardCVV", "isFraud"},
+			want:   HeaderCheck{Unexpected: []string{"cardCVV", "isFraud"}},
+		},
+		{
+			name:   "empty header",
+			header: nil,
+			want:   HeaderCheck{Missing: []string{"accountNumber", "transactionAmount"}},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := schema.CheckHeader(test.header)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("CheckHeader(%q) = %+v, want %+v", test.header, got, test.want)
+			}
+			if got.OK() != (len(test.want.Missing) == 0) {
+				t.Errorf("CheckHeader(%q).OK() = %v", test.header, got.OK())
+			}
+		})
+	}
+}
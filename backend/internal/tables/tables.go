@@ -0,0 +1,40 @@
+// Package tables resolves the transactions table an API request is served
+// from. The default table is given by the TABLE_NAME variable, and the tables
+// of the ingestion rules by the TABLES variable, a JSON object of their
+// deployed names keyed by the names the rules give them. A request names the
+// table of a rule with the table query parameter.
+package tables
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+)
+
+// Parameter is the query parameter naming the table of a request.
+const Parameter = "table"
+
+// ErrUnknownTable is returned when a request names a table the API is not
+// given, the requests cannot reach the other tables of the account.
+var ErrUnknownTable = errors.New("unknown table")
+
+// Lookup returns the deployed name of the table named by a request, or of the
+// default table when the request names none.
+func Lookup(name string) (string, error) {
+	if name == "" {
+		return os.Getenv("TABLE_NAME"), nil
+	}
+
+	tables := map[string]string{}
+	if value := os.Getenv("TABLES"); value != "" {
+		if err := json.Unmarshal([]byte(value), &tables); err != nil {
+			return "", fmt.Errorf("error parsing TABLES: %w", err)
+		}
+	}
+	table, ok := tables[name]
+	if !ok {
+		return "", fmt.Errorf("%w %q", ErrUnknownTable, name)
+	}
+	return table, nil
+}
@@ -0,0 +1,65 @@
+package tables
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestLookup(t *testing.T) {
+	tests := []struct {
+		name        string
+		tables      string
+		table       string
+		want        string
+		wantUnknown bool
+		wantErr     bool
+	}{
+		{
+			name:   "default table",
+			tables: `{"default": "etl-test-Table", "cards": "etl-test-TableCards"}`,
+			want:   "etl-test-Table",
+		},
+		{
+			name:   "table of a rule",
+			tables: `{"default": "etl-test-Table", "cards": "etl-test-TableCards"}`,
+			table:  "cards",
+			want:   "etl-test-TableCards",
+		},
+		{
+			name:        "table not given to the API",
+			tables:      `{"default": "etl-test-Table"}`,
+			table:       "etl-test-Ledger",
+			wantUnknown: true,
+			wantErr:     true,
+		},
+		{
+			name:        "no tables of rules",
+			table:       "cards",
+			wantUnknown: true,
+			wantErr:     true,
+		},
+		{
+			name:    "invalid tables",
+			tables:  `["cards"]`,
+			table:   "cards",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("TABLE_NAME", "etl-test-Table")
+			t.Setenv("TABLES", test.tables)
+
+			got, err := Lookup(test.table)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("Lookup() error = %v, want error %v", err, test.wantErr)
+			}
+			if errors.Is(err, ErrUnknownTable) != test.wantUnknown {
+				t.Errorf("Lookup() error = %v, want unknown table %v", err, test.wantUnknown)
+			}
+			if got != test.want {
+				t.Errorf("Lookup() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
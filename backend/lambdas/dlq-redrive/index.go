@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"go-cdk-workshop/internal/logging"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	lambdasvc "github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+const (
+	// The number of messages replayed per target when the request does not say.
+	defaultMaxMessages = 100
+
+	// Stop replaying messages when less than this, along with the timeout of
+	// the lambda they are replayed through, is left before the lambda times
+	// out, so the replayed messages can still be deleted.
+	deadlineMargin = 5 * time.Second
+
+	// How long the received messages are hidden from the queue, the longest
+	// a lambda can run, so a message that failed again is not received twice
+	// by the same run.
+	visibilityTimeout = 15 * time.Minute
+)
+
+// Event handler, replays the messages of the dead-letter queues through the
+// lambdas that failed to process them.
+func HandleInfoEvent(ctx context.Context, request Request) (Response, error) {
+	// Log the event
+	logging.Start(ctx)
+	logging.Debug("Received event", "event", request)
+
+	// The dead-letter queue and lambda of each target, keyed by the target name.
+	var targets map[string]Target
+	if err := json.Unmarshal([]byte(os.Getenv("REDRIVE_TARGETS")), &targets); err != nil {
+		logging.Error("Error parsing the redrive targets", err)
+		return Response{}, err
+	}
+
+	// Replay every target unless one was asked for.
+	names := []string{}
+	if request.Target != "" {
+		if _, ok := targets[request.Target]; !ok {
+			return Response{}, fmt.Errorf("unknown redrive target: %s", request.Target)
+		}
+		names = append(names, request.Target)
+	} else {
+		for name := range targets {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+	}
+
+	maxMessages := request.MaxMessages
+	if maxMessages <= 0 {
+		maxMessages = defaultMaxMessages
+	}
+
+	// Create a new SQS and Lambda client to interact with AWS
+	logging.Debug("Creating a new SQS and Lambda client")
+	mySession := session.Must(session.NewSession())
+	sqsSvc := sqs.New(mySession)
+	lambdaSvc := lambdasvc.New(mySession)
+
+	response := Response{Results: map[string]Result{}}
+	for _, name := range names {
+		result, err := redrive(ctx, sqsSvc, lambdaSvc, targets[name], maxMessages)
+		response.Results[name] = result
+		if err != nil {
+			logging.Error("Error redriving the dead-letter queue", err, "queue", name)
+			return response, err
+		}
+		logging.Info("Redrove the dead-letter queue", "queue", name, "result", result)
+	}
+
+	return response, nil
+}
+
+// Replays up to maxMessages messages of the target's dead-letter queue. A
+// message is deleted once the lambda has processed it, or once it has been
+// sent back to the queue the lambda receives its events from. The messages
+// that fail again are not deleted: they stay hidden for the visibility
+// timeout, so the run counts them once, then become visible for the next run.
+func redrive(ctx context.Context, sqsSvc sqsiface.SQSAPI, lambdaSvc lambdaiface.LambdaAPI, target Target, maxMessages int) (Result, error) {
+	result := Result{}
+
+	for result.Replayed+result.Failed < maxMessages {
+		if !hasTimeFor(ctx, target) {
+			logging.Info("Stopping the redrive before the lambda times out")
+			break
+		}
+
+		batchSize := maxMessages - result.Replayed - result.Failed
+		if batchSize > 10 {
+			batchSize = 10
+		}
+
+		received, err := sqsSvc.ReceiveMessageWithContext(ctx, &sqs.ReceiveMessageInput{
+			QueueUrl:            aws.String(target.QueueURL),
+			MaxNumberOfMessages: aws.Int64(int64(batchSize)),
+			VisibilityTimeout:   aws.Int64(int64(visibilityTimeout.Seconds())),
+			WaitTimeSeconds:     aws.Int64(1),
+		})
+		if err != nil {
+			return result, err
+		}
+
+		// The queue is drained.
+		if len(received.Messages) == 0 {
+			break
+		}
+
+		for i, message := range received.Messages {
+			// Make the messages there is no time left for visible again, so
+			// the next run receives them straight away.
+			if !hasTimeFor(ctx, target) {
+				logging.Info("Stopping the redrive before the lambda times out")
+				release(ctx, sqsSvc, target, received.Messages[i:])
+				return result, nil
+			}
+
+			err := replay(ctx, sqsSvc, lambdaSvc, target, message)
+			if err != nil {
+				logging.Error("Error replaying message", err, "messageId", aws.StringValue(message.MessageId))
+				result.Failed++
+				continue
+			}
+
+			_, err = sqsSvc.DeleteMessageWithContext(ctx, &sqs.DeleteMessageInput{
+				QueueUrl:      aws.String(target.QueueURL),
+				ReceiptHandle: message.ReceiptHandle,
+			})
+			if err != nil {
+				return result, err
+			}
+			result.Replayed++
+		}
+	}
+
+	return result, nil
+}
+
+// Whether the lambda has time left to replay a message of the target, the
+// replay waiting for the lambda of the target.
+func hasTimeFor(ctx context.Context, target Target) bool {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return true
+	}
+	return time.Until(deadline) >= deadlineMargin+time.Duration(target.FunctionTimeout)*time.Second
+}
+
+// Makes the received messages visible in the queue again, a failure is only
+// logged as the messages become visible once their visibility timeout ends.
+func release(ctx context.Context, sqsSvc sqsiface.SQSAPI, target Target, messages []*sqs.Message) {
+	for _, message := range messages {
+		_, err := sqsSvc.ChangeMessageVisibilityWithContext(ctx, &sqs.ChangeMessageVisibilityInput{
+			QueueUrl:          aws.String(target.QueueURL),
+			ReceiptHandle:     message.ReceiptHandle,
+			VisibilityTimeout: aws.Int64(0),
+		})
+		if err != nil {
+			logging.Error("Error releasing the message", err, "messageId", aws.StringValue(message.MessageId))
+		}
+	}
+}
+
+// Replays a message through the lambda of the target, or sends it back to
+// the queue the lambda receives its events from.
+func replay(ctx context.Context, sqsSvc sqsiface.SQSAPI, lambdaSvc lambdaiface.LambdaAPI, target Target, message *sqs.Message) error {
+	if target.DestinationURL != "" {
+		_, err := sqsSvc.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+			QueueUrl:    aws.String(target.DestinationURL),
+			MessageBody: message.Body,
+		})
+		return err
+	}
+
+	// The body of the message is the original event, so the lambda is
+	// invoked exactly as the EventBridge rule would have.
+	output, err := lambdaSvc.InvokeWithContext(ctx, &lambdasvc.InvokeInput{
+		FunctionName:   aws.String(target.FunctionName),
+		InvocationType: aws.String(lambdasvc.InvocationTypeRequestResponse),
+		Payload:        []byte(aws.StringValue(message.Body)),
+	})
+	if err == nil && output.FunctionError != nil {
+		err = fmt.Errorf("%s: %s", aws.StringValue(output.FunctionError), string(output.Payload))
+	}
+	return err
+}
+
+func main() {
+	lambda.Start(HandleInfoEvent)
+}
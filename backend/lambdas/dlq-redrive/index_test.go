@@ -0,0 +1,205 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	lambdasvc "github.com/aws/aws-sdk-go/service/lambda"
+	"github.com/aws/aws-sdk-go/service/lambda/lambdaiface"
+	"github.com/aws/aws-sdk-go/service/sqs"
+	"github.com/aws/aws-sdk-go/service/sqs/sqsiface"
+)
+
+// fakeQueue is a dead-letter queue holding messages, it records what the
+// redrive does with them by their receipt handle.
+type fakeQueue struct {
+	sqsiface.SQSAPI
+	messages []*sqs.Message
+	deleted  []string
+	released []string
+	sent     []string
+}
+
+func (q *fakeQueue) ReceiveMessageWithContext(ctx aws.Context, input *sqs.ReceiveMessageInput, options ...request.Option) (*sqs.ReceiveMessageOutput, error) {
+	count := int(aws.Int64Value(input.MaxNumberOfMessages))
+	if count > len(q.messages) {
+		count = len(q.messages)
+	}
+	received := q.messages[:count]
+	q.messages = q.messages[count:]
+	return &sqs.ReceiveMessageOutput{Messages: received}, nil
+}
+
+func (q *fakeQueue) DeleteMessageWithContext(ctx aws.Context, input *sqs.DeleteMessageInput, options ...request.Option) (*sqs.DeleteMessageOutput, error) {
+	q.deleted = append(q.deleted, aws.StringValue(input.ReceiptHandle))
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func (q *fakeQueue) ChangeMessageVisibilityWithContext(ctx aws.Context, input *sqs.ChangeMessageVisibilityInput, options ...request.Option) (*sqs.ChangeMessageVisibilityOutput, error) {
+	q.released = append(q.released, aws.StringValue(input.ReceiptHandle))
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+func (q *fakeQueue) SendMessageWithContext(ctx aws.Context, input *sqs.SendMessageInput, options ...request.Option) (*sqs.SendMessageOutput, error) {
+	q.sent = append(q.sent, aws.StringValue(input.QueueUrl)+" "+aws.StringValue(input.MessageBody))
+	return &sqs.SendMessageOutput{}, nil
+}
+
+// fakeLambda fails the events whose body contains "fail", after taking the
+// given time to process each event.
+type fakeLambda struct {
+	lambdaiface.LambdaAPI
+	duration time.Duration
+	invoked  []string
+}
+
+func (l *fakeLambda) InvokeWithContext(ctx aws.Context, input *lambdasvc.InvokeInput, options ...request.Option) (*lambdasvc.InvokeOutput, error) {
+	time.Sleep(l.duration)
+	l.invoked = append(l.invoked, string(input.Payload))
+	if strings.Contains(string(input.Payload), "fail") {
+		return &lambdasvc.InvokeOutput{FunctionError: aws.String("Unhandled"), Payload: []byte(`{"errorMessage":"failed"}`)}, nil
+	}
+	return &lambdasvc.InvokeOutput{}, nil
+}
+
+func TestRedrive(t *testing.T) {
+	tests := []struct {
+		name         string
+		bodies       []string
+		target       Target
+		maxMessages  int
+		timeLeft     time.Duration
+		duration     time.Duration
+		want         Result
+		wantDeleted  []string
+		wantReleased []string
+		wantSent     []string
+		wantLeft     int
+	}{
+		{
+			name:        "replayed through the lambda",
+			bodies:      []string{"a", "b", "c"},
+			target:      Target{QueueURL: "dlq", FunctionName: "archive"},
+			maxMessages: 100,
+			want:        Result{Replayed: 3},
+			wantDeleted: []string{"0", "1", "2"},
+		},
+		{
+			name:        "failed again and kept",
+			bodies:      []string{"a", "fail", "c"},
+			target:      Target{QueueURL: "dlq", FunctionName: "archive"},
+			maxMessages: 100,
+			want:        Result{Replayed: 2, Failed: 1},
+			wantDeleted: []string{"0", "2"},
+		},
+		{
+			name:        "sent back to the queue",
+			bodies:      []string{"a", "fail"},
+			target:      Target{QueueURL: "dlq", DestinationURL: "ingest"},
+			maxMessages: 100,
+			want:        Result{Replayed: 2},
+			wantDeleted: []string{"0", "1"},
+			wantSent:    []string{"ingest a", "ingest fail"},
+		},
+		{
+			name:        "at most the maximum messages",
+			bodies:      []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k", "l"},
+			target:      Target{QueueURL: "dlq", FunctionName: "archive"},
+			maxMessages: 11,
+			want:        Result{Replayed: 11},
+			wantDeleted: []string{"0", "1", "2", "3", "4", "5", "6", "7", "8", "9", "10"},
+			wantLeft:    1,
+		},
+		{
+			name:        "no time for the lambda of the target",
+			bodies:      []string{"a", "b"},
+			target:      Target{QueueURL: "dlq", FunctionName: "archive", FunctionTimeout: 300},
+			maxMessages: 100,
+			timeLeft:    time.Minute,
+			wantLeft:    2,
+		},
+		{
+			name:         "time running out during a batch",
+			bodies:       []string{"a", "b", "c"},
+			target:       Target{QueueURL: "dlq", FunctionName: "archive"},
+			maxMessages:  100,
+			timeLeft:     deadlineMargin + 100*time.Millisecond,
+			duration:     200 * time.Millisecond,
+			want:         Result{Replayed: 1},
+			wantDeleted:  []string{"0"},
+			wantReleased: []string{"1", "2"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			queue := &fakeQueue{}
+			for i, body := range test.bodies {
+				queue.messages = append(queue.messages, &sqs.Message{
+					MessageId:     aws.String(fmt.Sprintf("m%d", i)),
+					ReceiptHandle: aws.String(fmt.Sprint(i)),
+					Body:          aws.String(body),
+				})
+			}
+			ctx := context.Background()
+			if test.timeLeft > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, test.timeLeft)
+				defer cancel()
+			}
+
+			got, err := redrive(ctx, queue, &fakeLambda{duration: test.duration}, test.target, test.maxMessages)
+			if err != nil {
+				t.Fatalf("redrive() error = %v", err)
+			}
+			if got != test.want {
+				t.Errorf("redrive() = %+v, want %+v", got, test.want)
+			}
+			if !reflect.DeepEqual(queue.deleted, test.wantDeleted) {
+				t.Errorf("redrive() deleted %v, want %v", queue.deleted, test.wantDeleted)
+			}
+			if !reflect.DeepEqual(queue.released, test.wantReleased) {
+				t.Errorf("redrive() released %v, want %v", queue.released, test.wantReleased)
+			}
+			if !reflect.DeepEqual(queue.sent, test.wantSent) {
+				t.Errorf("redrive() sent %v, want %v", queue.sent, test.wantSent)
+			}
+			if len(queue.messages) != test.wantLeft {
+				t.Errorf("redrive() left %d messages, want %d", len(queue.messages), test.wantLeft)
+			}
+		})
+	}
+}
+
+func TestHasTimeFor(t *testing.T) {
+	tests := []struct {
+		name     string
+		timeLeft time.Duration
+		timeout  int
+		want     bool
+	}{
+		{name: "no deadline", want: true},
+		{name: "time for the margin", timeLeft: time.Minute, want: true},
+		{name: "less than the margin", timeLeft: deadlineMargin / 2},
+		{name: "time for the lambda", timeLeft: 10 * time.Minute, timeout: 300, want: true},
+		{name: "less than the lambda timeout", timeLeft: 5 * time.Minute, timeout: 300},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx := context.Background()
+			if test.timeLeft > 0 {
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, test.timeLeft)
+				defer cancel()
+			}
+			if got := hasTimeFor(ctx, Target{FunctionTimeout: test.timeout}); got != test.want {
+				t.Errorf("hasTimeFor() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,31 @@
+package main
+
+// The request the lambda is invoked with, both fields are optional.
+type Request struct {
+	// The name of the target to replay, every target is replayed when empty.
+	Target string `json:"target"`
+
+	// The maximum number of messages replayed per target.
+	MaxMessages int `json:"maxMessages"`
+}
+
+// A dead-letter queue and the lambda its messages are replayed through, or
+// the queue they are sent back to.
+type Target struct {
+	QueueURL       string `json:"queueUrl"`
+	FunctionName   string `json:"functionName,omitempty"`
+	DestinationURL string `json:"destinationUrl,omitempty"`
+
+	// The timeout of the lambda in seconds, a message is only replayed
+	// through it when the redrive has that long left.
+	FunctionTimeout int `json:"functionTimeoutSeconds,omitempty"`
+}
+
+type Response struct {
+	Results map[string]Result `json:"results"`
+}
+
+type Result struct {
+	Replayed int `json:"replayed"`
+	Failed   int `json:"failed"`
+}
@@ -1,13 +1,19 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"strconv"
+	"time"
 
 	"encoding/json"
 
+	"go-cdk-workshop/internal/logging"
+	"go-cdk-workshop/internal/metrics"
+	"go-cdk-workshop/internal/tables"
+
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
@@ -21,14 +27,15 @@ const (
 )
 
 // Event handler, this function handles requests from clients
-func HandleInfoEvent(request events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+func HandleInfoEvent(ctx context.Context, request events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
 	ApiResponse := events.APIGatewayV2HTTPResponse{
 		Headers: map[string]string{
 			"Content-Type": "application/json",
 		},
 	}
 
-	log.Println("Received event: ", request)
+	logging.StartRequest(ctx, request)
+	logging.Debug("Received event", "event", request)
 
 	// Query parameters
 	day := request.QueryStringParameters["day"]
@@ -67,21 +74,39 @@ func HandleInfoEvent(request events.APIGatewayV2HTTPRequest) (events.APIGatewayV
 		limit = maxPageSize
 	}
 
+	// The table of the rule the transactions were loaded by, if not the default one.
+	table, err := tables.Lookup(request.QueryStringParameters[tables.Parameter])
+	if errors.Is(err, tables.ErrUnknownTable) {
+		ApiResponse.Body = "Error: unknown table"
+		ApiResponse.StatusCode = 400
+		return ApiResponse, nil
+	}
+	if err != nil {
+		logging.Error("Error finding the table", err)
+		ApiResponse.Body = fmt.Sprintf("Error finding the table: %s", err)
+		ApiResponse.StatusCode = 500
+		return ApiResponse, nil
+	}
+
 	// Create a new DynamoDB client
-	log.Println("Creating a new DynamoDB client")
+	logging.Debug("Creating a new DynamoDB client")
 	mySession := session.Must(session.NewSession())
 	svc := dynamodb.New(mySession)
 
 	// Create a new DynamoDB query using global secondary index
-	log.Println("Creating a new DynamoDB query")
+	logging.Debug("Creating a new DynamoDB query")
+	queryStart := time.Now()
 	dynamoQuery, err := svc.Query(&dynamodb.QueryInput{
-		TableName:              aws.String(os.Getenv("TABLE_NAME")),
+		TableName:              aws.String(table),
 		IndexName:              aws.String(os.Getenv("INDEX_NAME")),
 		ConsistentRead:         aws.Bool(false),
 		KeyConditionExpression: aws.String("#isFraud = :isFraud AND begins_with(#transactionDateTime, :transactionDateTime)"),
+		// Hide the transactions soft-deleted by a rollback
+		FilterExpression: aws.String("attribute_not_exists(#deletedAt)"),
 		ExpressionAttributeNames: map[string]*string{
 			"#isFraud":             aws.String("isFraud"),
 			"#transactionDateTime": aws.String("transactionDateTime"),
+			"#deletedAt":           aws.String("deletedAt"),
 		},
 		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
 			":isFraud":             {S: aws.String(isFraudString)},
@@ -91,8 +116,9 @@ func HandleInfoEvent(request events.APIGatewayV2HTTPRequest) (events.APIGatewayV
 		ExclusiveStartKey: paginationToken,
 	})
 
+	queryLatency := time.Since(queryStart)
 	if err != nil {
-		log.Println("Error querying DynamoDB: ", err)
+		logging.Error("Error querying DynamoDB", err)
 		body := fmt.Sprintf("Error querying DynamoDB: %s", err)
 		ApiResponse.Body = body
 		ApiResponse.StatusCode = 500
@@ -101,21 +127,30 @@ func HandleInfoEvent(request events.APIGatewayV2HTTPRequest) (events.APIGatewayV
 
 	// Unmarshall the response into a slice of Item structs
 	// This removes the types from the DynamoDB response
-	log.Println("Unmarshalling the response into a slice of Item structs")
+	logging.Debug("Unmarshalling the response into a slice of Item structs")
 	var items []Item
 	err = dynamodbattribute.UnmarshalListOfMaps(dynamoQuery.Items, &items)
 
 	if err != nil {
-		log.Println("Error formatting DynamoDB response: ", err)
+		logging.Error("Error formatting DynamoDB response", err)
 		body := fmt.Sprintf("Error formatting DynamoDB response: %s", err)
 		ApiResponse.Body = body
 		ApiResponse.StatusCode = 500
 		return ApiResponse, nil
 	}
 
+	metrics.Emit("", metrics.Duration(metrics.QueryLatency, queryLatency), metrics.Count(metrics.QueryResults, int64(len(items))))
+
+	// Only return where the transactions come from when asked for
+	if request.QueryStringParameters["lineage"] != "true" {
+		for i := range items {
+			items[i].Lineage = Lineage{}
+		}
+	}
+
 	// Converts the lastKeyEvaluated into a base64 encoded string
 	// This is used for pagination
-	log.Println("Converting the lastKeyEvaluated into a base64 encoded string")
+	logging.Debug("Converting the lastKeyEvaluated into a base64 encoded string")
 	lastEvaluatedKeyString := ""
 	if dynamoQuery.LastEvaluatedKey != nil {
 		lastEvaluatedKeyString = convertToBase64String(dynamoQuery.LastEvaluatedKey)
@@ -124,7 +159,7 @@ func HandleInfoEvent(request events.APIGatewayV2HTTPRequest) (events.APIGatewayV
 	// Marshall the slice of Item structs into a JSON string
 	// This adds the field names back into the response and makes it easier to read
 	// for the client.
-	log.Println("Marshalling the slice of Item structs into a JSON string")
+	logging.Debug("Marshalling the slice of Item structs into a JSON string")
 	body := &map[string]interface{}{
 		"items":           items,
 		"count":           len(items),
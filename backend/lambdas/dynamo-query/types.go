@@ -24,4 +24,17 @@ type Item struct {
 	CardPresent             string  `json:"cardPresent"`
 	IsFraud                 string  `json:"isFraud"`
 	CountryCode             string  `json:"countryCode"`
+
+	// Where the transaction was loaded from, only returned with lineage=true.
+	Lineage
+}
+
+// Lineage describes the file row a transaction was loaded from, and the job
+// run that loaded it.
+type Lineage struct {
+	SourceBucket string `json:"sourceBucket,omitempty"`
+	SourceKey    string `json:"sourceKey,omitempty"`
+	RowNumber    int64  `json:"rowNumber,omitempty"`
+	JobRunID     string `json:"jobRunId,omitempty"`
+	IngestedAt   string `json:"ingestedAt,omitempty"`
 }
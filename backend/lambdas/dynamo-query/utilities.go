@@ -3,7 +3,8 @@ package main
 import (
 	"encoding/base64"
 	"encoding/json"
-	"log"
+
+	"go-cdk-workshop/internal/logging"
 
 	"github.com/aws/aws-sdk-go/service/dynamodb"
 )
@@ -12,11 +13,11 @@ import (
 func convertToBase64String(input map[string]*dynamodb.AttributeValue) string {
 	jsonString, err := json.Marshal(input)
 	if err != nil {
-		log.Println("Error converting map to JSON string: ", err)
+		logging.Error("Error converting map to JSON string", err)
 		return ""
 	}
 	base64String := base64.StdEncoding.EncodeToString(jsonString)
-	log.Println("Base64 encoded string: ", base64String)
+	logging.Debug("Base64 encoded string", "value", base64String)
 	return base64String
 }
 
@@ -24,11 +25,11 @@ func convertToBase64String(input map[string]*dynamodb.AttributeValue) string {
 func parseBase64String(input string) map[string]*dynamodb.AttributeValue {
 	jsonString, err := base64.StdEncoding.DecodeString(input)
 	if err != nil {
-		log.Println("Error decoding base64 string: ", err)
+		logging.Error("Error decoding base64 string", err)
 		return nil
 	}
 	var output map[string]*dynamodb.AttributeValue
 	json.Unmarshal(jsonString, &output)
-	log.Println("Parsed base64 string: ", output)
+	logging.Debug("Parsed base64 string", "value", output)
 	return output
 }
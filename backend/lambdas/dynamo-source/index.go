@@ -0,0 +1,245 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"encoding/json"
+
+	"go-cdk-workshop/internal/logging"
+	"go-cdk-workshop/internal/tables"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+)
+
+const (
+	maxPageSize = 250
+
+	// The number of items deleted per request, the client calls again while
+	// there are more so a request does not outlast the API timeout.
+	maxDeletes = 1000
+
+	// The number of items per BatchWriteItem call, the maximum DynamoDB allows.
+	batchWriteSize = 25
+)
+
+// Event handler, this function lists or deletes the transactions loaded from
+// a source file, given by the key query parameter, in the table of the table
+// query parameter or the default table.
+func HandleInfoEvent(ctx context.Context, request events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	ApiResponse := events.APIGatewayV2HTTPResponse{
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}
+
+	logging.StartRequest(ctx, request)
+	logging.Debug("Received event", "event", request)
+
+	// The key of the file in the bucket, e.g. input/bank_data.csv, and
+	// optionally its bucket.
+	key := request.QueryStringParameters["key"]
+	bucket := request.QueryStringParameters["bucket"]
+	if key == "" {
+		ApiResponse.StatusCode = 400
+		body, _ := json.Marshal(&Body{Message: "Error: key is required"})
+		ApiResponse.Body = string(body)
+		return ApiResponse, nil
+	}
+
+	// The table of the rule the file was loaded by, if not the default one.
+	table, err := tables.Lookup(request.QueryStringParameters[tables.Parameter])
+	if errors.Is(err, tables.ErrUnknownTable) {
+		ApiResponse.StatusCode = 400
+		body, _ := json.Marshal(&Body{Message: "Error: unknown table"})
+		ApiResponse.Body = string(body)
+		return ApiResponse, nil
+	}
+	if err != nil {
+		logging.Error("Error finding the table", err)
+		ApiResponse.Body = fmt.Sprintf("Error finding the table: %s", err)
+		ApiResponse.StatusCode = 500
+		return ApiResponse, nil
+	}
+
+	// Create a new DynamoDB client
+	logging.Debug("Creating a new DynamoDB client")
+	mySession := session.Must(session.NewSession())
+	svc := dynamodb.New(mySession)
+
+	var body interface{}
+	switch request.RequestContext.HTTP.Method {
+	case "GET":
+		body, err = listItems(svc, request, table, bucket, key)
+	case "DELETE":
+		body, err = deleteItems(svc, table, bucket, key)
+	default:
+		ApiResponse.StatusCode = 405
+		body, _ := json.Marshal(&Body{Message: "Error: method not allowed"})
+		ApiResponse.Body = string(body)
+		return ApiResponse, nil
+	}
+
+	if err != nil {
+		logging.Error("Error querying DynamoDB", err)
+		ApiResponse.Body = fmt.Sprintf("Error querying DynamoDB: %s", err)
+		ApiResponse.StatusCode = 500
+		return ApiResponse, nil
+	}
+
+	// Return the response to the client
+	json, _ := json.Marshal(body)
+	ApiResponse.Body = string(json)
+	ApiResponse.StatusCode = 200
+	return ApiResponse, nil
+}
+
+// Returns the query of the items loaded from the file, grouped by the job
+// run that loaded them.
+func sourceQuery(table string, bucket string, key string) *dynamodb.QueryInput {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(table),
+		IndexName:              aws.String(os.Getenv("INDEX_NAME")),
+		KeyConditionExpression: aws.String("#sourceKey = :sourceKey"),
+		ExpressionAttributeNames: map[string]*string{
+			"#sourceKey": aws.String("sourceKey"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":sourceKey": {S: aws.String(key)},
+		},
+	}
+
+	// The same key may have been uploaded to another bucket.
+	if bucket != "" {
+		input.FilterExpression = aws.String("#sourceBucket = :sourceBucket")
+		input.ExpressionAttributeNames["#sourceBucket"] = aws.String("sourceBucket")
+		input.ExpressionAttributeValues[":sourceBucket"] = &dynamodb.AttributeValue{S: aws.String(bucket)}
+	}
+	return input
+}
+
+// Lists a page of the items loaded from the file.
+func listItems(svc *dynamodb.DynamoDB, request events.APIGatewayV2HTTPRequest, table string, bucket string, key string) (interface{}, error) {
+	// Set default page size
+	pageSize := int64(maxPageSize)
+	if value, err := strconv.ParseInt(request.QueryStringParameters["pageSize"], 10, 64); err == nil && value > 0 && value < maxPageSize {
+		pageSize = value
+	}
+
+	input := sourceQuery(table, bucket, key)
+	input.Limit = aws.Int64(pageSize)
+
+	// Hide the transactions soft-deleted by a rollback, as the query route does.
+	filter := "attribute_not_exists(#deletedAt)"
+	if input.FilterExpression != nil {
+		filter = *input.FilterExpression + " AND " + filter
+	}
+	input.FilterExpression = aws.String(filter)
+	input.ExpressionAttributeNames["#deletedAt"] = aws.String("deletedAt")
+	input.ExclusiveStartKey = parseBase64String(request.QueryStringParameters["paginationToken"])
+
+	logging.Info("Querying the items of the file", logging.Key, key)
+	dynamoQuery, err := svc.Query(input)
+	if err != nil {
+		return nil, err
+	}
+
+	var items []Item
+	if err := dynamodbattribute.UnmarshalListOfMaps(dynamoQuery.Items, &items); err != nil {
+		return nil, err
+	}
+
+	// Converts the lastKeyEvaluated into a base64 encoded string
+	// This is used for pagination
+	lastEvaluatedKeyString := ""
+	if dynamoQuery.LastEvaluatedKey != nil {
+		lastEvaluatedKeyString = convertToBase64String(dynamoQuery.LastEvaluatedKey)
+	}
+
+	return &map[string]interface{}{
+		"items":           items,
+		"count":           len(items),
+		"paginationToken": lastEvaluatedKeyString,
+	}, nil
+}
+
+// Deletes up to maxDeletes of the items loaded from the file, soft-deleted
+// or not, and reports whether there are more to delete. The deletion bypasses
+// the file ledger: the entries of the file are left as they were loaded and
+// its archived copy is not moved, unlike with the rollback lambda.
+func deleteItems(svc *dynamodb.DynamoDB, table string, bucket string, key string) (interface{}, error) {
+	input := sourceQuery(table, bucket, key)
+	input.ProjectionExpression = aws.String("#id, #accountNumber")
+	input.ExpressionAttributeNames["#id"] = aws.String("id")
+	input.ExpressionAttributeNames["#accountNumber"] = aws.String("accountNumber")
+
+	deleted, more := 0, false
+	for {
+		logging.Info("Querying the items of the file to delete", logging.Key, key)
+		input.Limit = aws.Int64(int64(maxDeletes - deleted))
+		dynamoQuery, err := svc.Query(input)
+		if err != nil {
+			return nil, err
+		}
+
+		for start := 0; start < len(dynamoQuery.Items); start += batchWriteSize {
+			end := start + batchWriteSize
+			if end > len(dynamoQuery.Items) {
+				end = len(dynamoQuery.Items)
+			}
+			if err := deleteBatch(svc, table, dynamoQuery.Items[start:end]); err != nil {
+				return nil, err
+			}
+			deleted += end - start
+		}
+
+		input.ExclusiveStartKey = dynamoQuery.LastEvaluatedKey
+		more = dynamoQuery.LastEvaluatedKey != nil
+		if !more || deleted >= maxDeletes {
+			break
+		}
+	}
+
+	logging.Info("Deleted the items of the file", logging.Key, key, "items", deleted)
+	return &map[string]interface{}{
+		"deleted": deleted,
+		"more":    more,
+	}, nil
+}
+
+// Deletes a batch of items by their keys, the items DynamoDB did not process
+// are sent again after a short wait.
+func deleteBatch(svc *dynamodb.DynamoDB, table string, keys []map[string]*dynamodb.AttributeValue) error {
+	requests := []*dynamodb.WriteRequest{}
+	for _, key := range keys {
+		requests = append(requests, &dynamodb.WriteRequest{DeleteRequest: &dynamodb.DeleteRequest{Key: key}})
+	}
+
+	for attempt := 0; len(requests) > 0; attempt++ {
+		if attempt == 5 {
+			return fmt.Errorf("%d items could not be deleted", len(requests))
+		}
+		time.Sleep(time.Duration(attempt) * 200 * time.Millisecond)
+		output, err := svc.BatchWriteItem(&dynamodb.BatchWriteItemInput{
+			RequestItems: map[string][]*dynamodb.WriteRequest{table: requests},
+		})
+		if err != nil {
+			return err
+		}
+		requests = output.UnprocessedItems[table]
+	}
+	return nil
+}
+
+func main() {
+	lambda.Start(HandleInfoEvent)
+}
@@ -1,12 +1,16 @@
 package main
 
 import (
-	"log"
-	"os"
+	"context"
+	"errors"
 	"strconv"
 
 	"encoding/json"
 
+	"go-cdk-workshop/internal/logging"
+	"go-cdk-workshop/internal/metrics"
+	"go-cdk-workshop/internal/tables"
+
 	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
@@ -16,17 +20,18 @@ import (
 )
 
 // Event handler, this function handles requests from clients
-func HandleInfoEvent(request events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+func HandleInfoEvent(ctx context.Context, request events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
 	ApiResponse := events.APIGatewayV2HTTPResponse{
 		Headers: map[string]string{
 			"Content-Type": "application/json",
 		},
 	}
 
-	log.Println("Received event: ", request)
+	logging.StartRequest(ctx, request)
+	logging.Debug("Received event", "event", request)
 
 	// Create a new DynamoDB client
-	log.Println("Creating a new DynamoDB client")
+	logging.Debug("Creating a new DynamoDB client")
 	mySession := session.Must(session.NewSession())
 	svc := dynamodb.New(mySession)
 
@@ -40,15 +45,31 @@ func HandleInfoEvent(request events.APIGatewayV2HTTPRequest) (events.APIGatewayV
 		return ApiResponse, nil
 	}
 
+	// The table of the rule the transaction was loaded by, if not the default one.
+	table, err := tables.Lookup(request.QueryStringParameters[tables.Parameter])
+	if errors.Is(err, tables.ErrUnknownTable) {
+		ApiResponse.StatusCode = 400
+		body, _ := json.Marshal(&Body{Message: "Error: unknown table"})
+		ApiResponse.Body = string(body)
+		return ApiResponse, nil
+	}
+	if err != nil {
+		logging.Error("Error finding the table", err)
+		body, _ := json.Marshal(&Body{Message: "Error: finding the table"})
+		ApiResponse.Body = string(body)
+		ApiResponse.StatusCode = 500
+		return ApiResponse, nil
+	}
+
 	// Convert to float64 to match the type of the Id field in the Item struct
 	idFloat, err := strconv.ParseFloat(id, 64)
 
 	// Parse the body of the request into a Item struct
-	log.Println("Parsing the body of the request into a Item struct")
+	logging.Debug("Parsing the body of the request into a Item struct")
 	var item Item
 	err = json.Unmarshal([]byte(request.Body), &item)
 	if err != nil {
-		log.Println("Error parsing request body", err)
+		logging.Error("Error parsing request body", err)
 		ApiResponse.StatusCode = 400
 		body, _ := json.Marshal(&Body{Message: "Error: parsing request body"})
 		ApiResponse.Body = string(body)
@@ -57,7 +78,7 @@ func HandleInfoEvent(request events.APIGatewayV2HTTPRequest) (events.APIGatewayV
 
 	// If body has an id, check if it matches the id in the path
 	if item.Id != 0 && item.Id != idFloat {
-		log.Println("Error: id in path does not match id in body")
+		logging.Warn("The id in the path does not match the id in the body")
 		ApiResponse.StatusCode = 400
 		body, _ := json.Marshal(&Body{Message: "Error: id in path does not match id in body"})
 		ApiResponse.Body = string(body)
@@ -66,35 +87,52 @@ func HandleInfoEvent(request events.APIGatewayV2HTTPRequest) (events.APIGatewayV
 		item.Id = idFloat
 	}
 
+	// Keep where the transaction was loaded from, the clients cannot change it
+	logging.Debug("Reading the lineage of the item")
+	stored, err := readStored(svc, table, item)
+	item.Lineage = stored.Lineage
+	if err != nil {
+		logging.Error("Error reading the lineage of the item", err)
+		body, _ := json.Marshal(&Body{Message: "Error: reading item from DynamoDB"})
+		ApiResponse.Body = string(body)
+		ApiResponse.StatusCode = 500
+		return ApiResponse, nil
+	}
+
 	// Convert the Item struct into a DynamoDB AttributeValue map
-	log.Println("Converting the Item struct into a DynamoDB AttributeValue map")
+	logging.Debug("Converting the Item struct into a DynamoDB AttributeValue map")
 	av, err := dynamodbattribute.MarshalMap(item)
 	if err != nil {
-		log.Println("Error marshalling item", err)
+		logging.Error("Error marshalling item", err)
 		ApiResponse.Body = err.Error()
 		ApiResponse.StatusCode = 500
 		return ApiResponse, nil
 	}
 
 	// Create the DynamoDB PutItemInput object
-	log.Println("Creating the DynamoDB PutItemInput object")
+	logging.Debug("Creating the DynamoDB PutItemInput object")
 	input := &dynamodb.PutItemInput{
 		Item:                av,
-		TableName:           aws.String(os.Getenv("TABLE_NAME")),
+		TableName:           aws.String(table),
 		ConditionExpression: aws.String("attribute_exists(id)"),
 	}
 
 	// Write the item to DynamoDB
-	log.Println("Writing the item to DynamoDB")
+	logging.Debug("Writing the item to DynamoDB")
 	_, err = svc.PutItem(input)
 	if err != nil {
-		log.Println("Error writing item to DynamoDB", err)
+		logging.Error("Error writing item to DynamoDB", err)
 		body, _ := json.Marshal(&Body{Message: "Error: writing item to DynamoDB"})
 		ApiResponse.Body = string(body)
 		ApiResponse.StatusCode = 500
 		return ApiResponse, nil
 	}
 
+	// Count the transactions flagged or cleared as fraud.
+	if stored.IsFraud != "" && stored.IsFraud != item.IsFraud {
+		metrics.Emit("", metrics.Count(metrics.FraudFlagUpdates, 1))
+	}
+
 	// Return the response to the client
 	ApiResponse.StatusCode = 200
 	body, _ := json.Marshal(&Body{Message: "Success"})
@@ -102,6 +140,26 @@ func HandleInfoEvent(request events.APIGatewayV2HTTPRequest) (events.APIGatewayV
 	return ApiResponse, nil
 }
 
+// Reads the lineage and fraud flag of the stored item, the lineage is empty
+// when the item does not exist or was loaded before the items had one.
+func readStored(svc *dynamodb.DynamoDB, table string, item Item) (storedItem, error) {
+	output, err := svc.GetItem(&dynamodb.GetItemInput{
+		TableName: aws.String(table),
+		Key: map[string]*dynamodb.AttributeValue{
+			"id":            {N: aws.String(strconv.FormatFloat(item.Id, 'f', -1, 64))},
+			"accountNumber": {S: aws.String(item.AccountNumber)},
+		},
+		ProjectionExpression: aws.String("sourceBucket, sourceKey, rowNumber, jobRunId, ingestedAt, isFraud"),
+	})
+	if err != nil {
+		return storedItem{}, err
+	}
+
+	var stored storedItem
+	err = dynamodbattribute.UnmarshalMap(output.Item, &stored)
+	return stored, err
+}
+
 func main() {
 	lambda.Start(HandleInfoEvent)
 }
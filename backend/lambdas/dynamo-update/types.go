@@ -24,6 +24,25 @@ type Item struct {
 	CardPresent             string  `json:"cardPresent"`
 	IsFraud                 string  `json:"isFraud"`
 	CountryCode             string  `json:"countryCode"`
+
+	// Where the transaction was loaded from, kept as loaded on update.
+	Lineage
+}
+
+// Lineage describes the file row a transaction was loaded from, and the job
+// run that loaded it.
+type Lineage struct {
+	SourceBucket string `json:"sourceBucket,omitempty"`
+	SourceKey    string `json:"sourceKey,omitempty"`
+	RowNumber    int64  `json:"rowNumber,omitempty"`
+	JobRunID     string `json:"jobRunId,omitempty"`
+	IngestedAt   string `json:"ingestedAt,omitempty"`
+}
+
+// The parts of the stored item read before it is replaced.
+type storedItem struct {
+	Lineage
+	IsFraud string `json:"isFraud"`
 }
 
 type Body struct {
@@ -0,0 +1,39 @@
+package main
+
+import (
+	"go-cdk-workshop/internal/manifest"
+	"go-cdk-workshop/internal/rules"
+	"go-cdk-workshop/internal/schema"
+)
+
+// BatchResponse lists the messages of the batch that failed, the other
+// messages are deleted from the ingest queue.
+type BatchResponse struct {
+	BatchItemFailures []BatchItemFailure `json:"batchItemFailures"`
+}
+
+type BatchItemFailure struct {
+	ItemIdentifier string `json:"itemIdentifier"`
+}
+
+// Reports the message as failed, it is received again once its visibility
+// timeout expires, or sent to the dead-letter queue once it was received too
+// many times.
+func (r *BatchResponse) fail(messageID string) {
+	r.BatchItemFailures = append(r.BatchItemFailures, BatchItemFailure{ItemIdentifier: messageID})
+}
+
+// An uploaded file accepted by its rule, waiting for the job run loading it.
+type upload struct {
+	messageID string
+
+	bucket     string
+	object     manifest.File
+	rule       *rules.Rule
+	schema     *schema.Schema
+	schemaJSON string
+	format     string
+
+	// The id of the upload, for the files uploaded through the upload API.
+	uploadID string
+}
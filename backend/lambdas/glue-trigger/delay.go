@@ -0,0 +1,86 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"math/rand"
+	"os"
+	"time"
+
+	"go-cdk-workshop/internal/logging"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sfn"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const (
+	// The number of times the start step is handed off to the delay queue
+	// before its files are failed. The delays double from a minute up to the
+	// 15 minutes SQS allows, so the files wait for over an hour.
+	delayMaxAttempts = 10
+
+	delayBase = time.Minute
+	delayMax  = 15 * time.Minute
+)
+
+// Hands the start step off to the delay queue, it is received again by the
+// lambda once the delay expires.
+func delayStart(ctx context.Context, sqsSvc *sqs.SQS, event Event) error {
+	event.Attempt++
+	delay := startDelay(event.Attempt)
+	body, err := json.Marshal(event)
+	if err != nil {
+		return err
+	}
+
+	logging.Info("Delaying the start of the job run", "delay", delay)
+	_, err = sqsSvc.SendMessageWithContext(ctx, &sqs.SendMessageInput{
+		QueueUrl:     aws.String(os.Getenv("DELAY_QUEUE_URL")),
+		MessageBody:  aws.String(string(body)),
+		DelaySeconds: aws.Int64(int64(delay.Seconds())),
+	})
+	if err != nil {
+		logging.Error("Error delaying the start of the job run", err)
+	}
+	return err
+}
+
+// Returns how long the start step waits before its attempt, between half and
+// all of the doubled delay so the steps delayed together are spread out.
+func startDelay(attempt int) time.Duration {
+	delay := delayMax
+	if attempt < 5 {
+		delay = delayBase << (attempt - 1)
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)))
+}
+
+// Handles a batch of start steps received from the delay queue. A step that
+// could be neither completed nor delayed again is failed on its own, it is
+// received again once its visibility timeout expires.
+func handleDelayed(ctx context.Context, s3Svc *s3.S3, svc *glue.Glue, sfnSvc *sfn.SFN, sqsSvc *sqs.SQS, dynamoSvc *dynamodb.DynamoDB, records []events.SQSMessage) (BatchResponse, error) {
+	logging.Info("Received delayed start steps", "count", len(records))
+
+	response := BatchResponse{}
+	for _, record := range records {
+		var event Event
+		if err := json.Unmarshal([]byte(record.Body), &event); err != nil {
+			logging.Error("Error parsing the delayed start step", err)
+			response.fail(record.MessageId)
+			continue
+		}
+
+		logWorkflow(event.WorkflowInput)
+		logging.Info("Starting the job run of the manifest", "manifest", event.Manifest, "attempt", event.Attempt)
+		if err := start(ctx, s3Svc, svc, sfnSvc, sqsSvc, dynamoSvc, event); err != nil {
+			response.fail(record.MessageId)
+		}
+	}
+
+	return response, nil
+}
@@ -0,0 +1,31 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestStartDelay(t *testing.T) {
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{attempt: 1, max: time.Minute},
+		{attempt: 2, max: 2 * time.Minute},
+		{attempt: 3, max: 4 * time.Minute},
+		{attempt: 4, max: 8 * time.Minute},
+		{attempt: 5, max: delayMax},
+		{attempt: delayMaxAttempts, max: delayMax},
+	}
+	for _, test := range tests {
+		t.Run(fmt.Sprint(test.attempt), func(t *testing.T) {
+			// The delay is random, so it is drawn a few times.
+			for i := 0; i < 100; i++ {
+				if got := startDelay(test.attempt); got < test.max/2 || got >= test.max {
+					t.Fatalf("startDelay(%d) = %v, want between %v and %v", test.attempt, got, test.max/2, test.max)
+				}
+			}
+		})
+	}
+}
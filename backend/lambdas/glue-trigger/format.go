@@ -0,0 +1,134 @@
+package main
+
+import (
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// The formats the Glue job reads, passed to it as the --format argument.
+const (
+	formatCSV     = "csv"
+	formatParquet = "parquet"
+	formatJSON    = "json"
+)
+
+// The error returned when the file is not in a format the Glue job reads.
+var errUnsupportedFormat = errors.New("unsupported format")
+
+// The number of bytes read from the start of a file to detect its format
+// and check its header.
+const headLength = 8192
+
+// The formats of the file extensions, the compression extensions are removed first.
+var extensionFormats = map[string]string{
+	".csv":     formatCSV,
+	".parquet": formatParquet,
+	".pq":      formatParquet,
+	".jsonl":   formatJSON,
+	".ndjson":  formatJSON,
+}
+
+// The magic bytes at the start of a Parquet file.
+var parquetMagic = []byte("PAR1")
+
+// The magic bytes at the start of a gzip and a bzip2 file.
+var (
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+)
+
+// Reads the first bytes of a file with a ranged GET, decompressed when the
+// file is a gzip or bzip2 file. Only the start of the file is read, so the
+// decompressed data is cut short and the error of the reader is expected.
+func readHead(ctx context.Context, s3Svc s3iface.S3API, bucket string, key string) ([]byte, error) {
+	object, err := s3Svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+		Range:  aws.String(fmt.Sprintf("bytes=0-%d", headLength-1)),
+	})
+	// S3 refuses ranges of empty files.
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == "InvalidRange" {
+		return []byte{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer object.Body.Close()
+
+	head, err := io.ReadAll(object.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	var decompressed io.Reader
+	switch {
+	case bytes.HasPrefix(head, gzipMagic):
+		reader, err := gzip.NewReader(bytes.NewReader(head))
+		if err != nil {
+			return nil, fmt.Errorf("%w: reading the gzip file: %v", errUnsupportedFormat, err)
+		}
+		decompressed = reader
+	case bytes.HasPrefix(head, bzip2Magic):
+		decompressed = bzip2.NewReader(bytes.NewReader(head))
+	}
+	if decompressed != nil {
+		head, _ = io.ReadAll(io.LimitReader(decompressed, headLength))
+	}
+	return head, nil
+}
+
+// Returns the format of a file from its extension, or from its first bytes
+// when the extension is not a known one, e.g. data.json or data.txt. It
+// returns an error when the format is not one the Glue job reads.
+func detectFormat(key string, head []byte) (string, error) {
+	if format, ok := extensionFormats[dataExtension(key)]; ok {
+		return format, nil
+	}
+
+	if bytes.HasPrefix(head, parquetMagic) {
+		return formatParquet, nil
+	}
+
+	text := headText(head)
+	switch {
+	case text == "":
+		return "", fmt.Errorf("%w: the file is empty", errUnsupportedFormat)
+	case strings.HasPrefix(text, "{"):
+		return formatJSON, nil
+	case strings.HasPrefix(text, "["):
+		return "", fmt.Errorf("%w: JSON arrays are not supported, use JSON Lines", errUnsupportedFormat)
+	default:
+		return formatCSV, nil
+	}
+}
+
+// Returns the first bytes of a file as text, without the byte order mark and
+// the leading blank lines.
+func headText(head []byte) string {
+	return strings.TrimLeft(strings.TrimPrefix(string(head), "\ufeff"), " \t\r\n")
+}
+
+// Returns the extension of the data of a file, without its compression
+// extension, e.g. ".csv" for august.csv.gz.
+func dataExtension(key string) string {
+	name := strings.ToLower(key[strings.LastIndex(key, "/")+1:])
+	for _, compression := range []string{".gz", ".bz2"} {
+		name = strings.TrimSuffix(name, compression)
+	}
+	if index := strings.LastIndex(name, "."); index >= 0 {
+		return name[index:]
+	}
+	return ""
+}
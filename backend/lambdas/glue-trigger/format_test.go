@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestDetectFormat(t *testing.T) {
+	tests := []struct {
+		name    string
+		key     string
+		head    string
+		want    string
+		wantErr bool
+	}{
+		{name: "CSV extension", key: "input/august.csv", head: `{"not": "read"}`, want: formatCSV},
+		{name: "compressed CSV extension", key: "input/august.CSV.gz", want: formatCSV},
+		{name: "Parquet extension", key: "input/august.parquet", want: formatParquet},
+		{name: "short Parquet extension", key: "input/august.pq", want: formatParquet},
+		{name: "compressed JSON Lines extension", key: "input/august.jsonl.bz2", want: formatJSON},
+		{name: "NDJSON extension", key: "input/august.ndjson", want: formatJSON},
+		{name: "Parquet magic bytes", key: "input/august.data", head: "PAR1\x15\x04", want: formatParquet},
+		{name: "JSON object", key: "input/august.json", head: `{"accountNumber": "1"}` + "\n", want: formatJSON},
+		{name: "JSON object after a byte order mark and blank lines", key: "input/august.txt", head: "\ufeff\r\n  {\"a\": 1}", want: formatJSON},
+		{name: "JSON array", key: "input/august.json", head: `[{"accountNumber": "1"}]`, wantErr: true},
+		{name: "empty file", key: "input/august.txt", head: "\ufeff\n\n", wantErr: true},
+		{name: "text without extension", key: "input/august", head: "accountNumber,isFraud\n1,TRUE\n", want: formatCSV},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := detectFormat(test.key, []byte(test.head))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("detectFormat() error = %v, want error %v", err, test.wantErr)
+			}
+			if err != nil && !errors.Is(err, errUnsupportedFormat) {
+				t.Errorf("detectFormat() error = %v, want an unsupported format", err)
+			}
+			if got != test.want {
+				t.Errorf("detectFormat() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestDataExtension(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{key: "input/august.csv", want: ".csv"},
+		{key: "input/August.CSV.GZ", want: ".csv"},
+		{key: "input/august.jsonl.bz2", want: ".jsonl"},
+		{key: "input/bank.v2/august", want: ""},
+		{key: "input/august.gz", want: ""},
+		{key: "input/august.tar.gz", want: ".tar"},
+	}
+	for _, test := range tests {
+		t.Run(test.key, func(t *testing.T) {
+			if got := dataExtension(test.key); got != test.want {
+				t.Errorf("dataExtension(%q) = %q, want %q", test.key, got, test.want)
+			}
+		})
+	}
+}
+
+// Returns the gzip compression of the text.
+func gzipOf(t *testing.T, text string) []byte {
+	var buffer bytes.Buffer
+	writer := gzip.NewWriter(&buffer)
+	if _, err := writer.Write([]byte(text)); err != nil {
+		t.Fatal(err)
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestReadHead(t *testing.T) {
+	// Random-looking lines compress poorly, so the compressed file is longer
+	// than the bytes read.
+	var long strings.Builder
+	for i := 0; long.Len() < 4*headLength; i++ {
+		long.WriteString(strings.Repeat(string(rune('a'+i*7%26)), i%13+1) + ",1\n")
+	}
+
+	tests := []struct {
+		name    string
+		data    []byte
+		want    string
+		cut     bool
+		wantErr error
+	}{
+		{name: "CSV file", data: []byte("accountNumber,isFraud\n1,TRUE\n"), want: "accountNumber,isFraud\n1,TRUE\n"},
+		{name: "long CSV file", data: []byte(long.String()), want: long.String()[:headLength]},
+		{name: "gzip file", data: gzipOf(t, "accountNumber,isFraud\n"), want: "accountNumber,isFraud\n"},
+		{name: "long gzip file cut short", data: gzipOf(t, long.String()), want: long.String()[:headLength], cut: true},
+		{name: "empty file", data: []byte{}, want: ""},
+		{name: "corrupt gzip file", data: []byte{0x1f, 0x8b, 0x00}, wantErr: errUnsupportedFormat},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &fakeS3{objects: map[string][]byte{"input/august.csv": test.data}}
+			got, err := readHead(context.Background(), client, "bucket", "input/august.csv")
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("readHead() error = %v, want %v", err, test.wantErr)
+			}
+			// A compressed file cut short decompresses to the start of the data.
+			if test.cut && len(got) > 0 && strings.HasPrefix(test.want, string(got)) {
+				return
+			}
+			if string(got) != test.want {
+				t.Errorf("readHead() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
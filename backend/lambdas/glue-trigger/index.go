@@ -1,18 +1,43 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"fmt"
-	"log"
 	"os"
 	"strings"
+	"time"
 
+	"go-cdk-workshop/internal/logging"
+	"go-cdk-workshop/internal/manifest"
+	"go-cdk-workshop/internal/metrics"
+	"go-cdk-workshop/internal/objects"
+	"go-cdk-workshop/internal/rules"
+	"go-cdk-workshop/internal/schema"
+
+	"github.com/aws/aws-lambda-go/events"
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sfn"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+const (
+	// The folder the files the rules do not accept are moved to.
+	ignoredPrefix = "ignored/"
+
+	// The metadata naming the schema of a file, e.g. "transactions@v1".
+	schemaMetadata = "schema"
 )
 
+// The upload event, as sent by EventBridge to the ingest queue.
 type Request struct {
+	ID     string                 `json:"id"`
 	Detail GlueTriggerEventDetail `json:"detail"`
 }
 
@@ -26,50 +51,299 @@ type S3Bucket struct {
 }
 
 type S3Object struct {
-	Key string `json:"key"`
+	Key  string `json:"key"`
+	Size int64  `json:"size"`
+}
+
+// Event is either a batch of upload events received from the ingest queue,
+// or a step of the ingestion workflow run by this lambda.
+type Event struct {
+	Records []events.SQSMessage `json:"Records"`
+
+	// The step of the workflow, "validate", "start" or "recover", along with
+	// the input of the execution.
+	Action string `json:"action"`
+	WorkflowInput
+
+	// The token completing the start step, and the number of times the step
+	// was handed off to the delay queue.
+	TaskToken string `json:"taskToken,omitempty"`
+	Attempt   int    `json:"attempt,omitempty"`
 }
 
-// Event handler, this function handles requests from clients
-func HandleInfoEvent(request Request) (string, error) {
+// Event handler, this function handles the upload events buffered by the
+// ingest queue, the start steps held back by the delay queue, and the steps
+// of the ingestion workflow.
+func HandleInfoEvent(ctx context.Context, event Event) (interface{}, error) {
+	logging.Start(ctx)
+	mySession := session.Must(session.NewSession())
+	s3Svc := s3.New(mySession)
+
+	switch event.Action {
+	case "":
+		if len(event.Records) > 0 && event.Records[0].EventSourceARN == os.Getenv("DELAY_QUEUE_ARN") {
+			return handleDelayed(ctx, s3Svc, glue.New(mySession), sfn.New(mySession), sqs.New(mySession), dynamodb.New(mySession), event.Records)
+		}
+		return handleUploads(ctx, mySession, s3Svc, event.Records)
+	case actionValidate:
+		logWorkflow(event.WorkflowInput)
+		logging.Info("Validating the manifest", "manifest", event.Manifest)
+		return validate(ctx, s3Svc, event.WorkflowInput)
+	case actionStart:
+		logWorkflow(event.WorkflowInput)
+		logging.Info("Starting the job run of the manifest", "manifest", event.Manifest)
+		return nil, start(ctx, s3Svc, glue.New(mySession), sfn.New(mySession), sqs.New(mySession), dynamodb.New(mySession), event)
+	case actionRecover:
+		logWorkflow(event.WorkflowInput)
+		logging.Info("Recovering the job run of the manifest", "manifest", event.Manifest)
+		return recoverJobRun(ctx, dynamodb.New(mySession), event.WorkflowInput)
+	default:
+		return nil, fmt.Errorf("unknown workflow step: %s", event.Action)
+	}
+}
+
+// Handles a batch of upload events. The files accepted by their rule are
+// coalesced into one execution of the ingestion workflow per rule, schema and
+// format, so a bank dropping hundreds of small files at once starts a
+// handful of job runs instead of one per file.
+func handleUploads(ctx context.Context, mySession *session.Session, s3Svc *s3.S3, records []events.SQSMessage) (BatchResponse, error) {
 	// Log the event
-	log.Println("Received event: ", fmt.Sprintf("%+v", request))
+	logging.Info("Received upload events", "count", len(records))
+
+	// The rules deciding which files are ingested, and by which job and table.
+	var ingestionRules []rules.Rule
+	if err := json.Unmarshal([]byte(os.Getenv("INGESTION_RULES")), &ingestionRules); err != nil {
+		logging.Error("Error parsing the ingestion rules", err)
+		return BatchResponse{}, err
+	}
 
-	// Check to see if the S3 key prefix is correct
-	if !strings.HasPrefix(request.Detail.Object.Key, os.Getenv("S3_KEY_PREFIX")) {
-		log.Println(fmt.Sprintf("S3 key prefix does not match the desired prefix: %s", os.Getenv("S3_KEY_PREFIX")))
-		return "", nil
+	// Check each file and group the accepted ones by the job run they are
+	// loaded with. A message whose file could not be checked is failed on its
+	// own, so it is received again without holding back the rest of the batch.
+	response := BatchResponse{}
+	batches := map[string][]*upload{}
+	batchKeys := []string{}
+	for _, record := range records {
+		var request Request
+		if err := json.Unmarshal([]byte(record.Body), &request); err != nil {
+			logging.Error("Error parsing the upload event", err)
+			response.fail(record.MessageId)
+			continue
+		}
+		// The files not uploaded through the upload API are followed by the
+		// id of their upload event.
+		logging.Set(logging.CorrelationID, request.ID)
+		logging.Set(logging.Bucket, request.Detail.Bucket.Name)
+		logging.Set(logging.Key, request.Detail.Object.Key)
+		logging.Debug("Received event", "event", request)
+
+		upload, err := prepare(ctx, mySession, s3Svc, ingestionRules, request)
+		if err != nil {
+			logging.Error("Error checking the file", err)
+			response.fail(record.MessageId)
+			continue
+		}
+		if upload == nil {
+			continue
+		}
+		upload.messageID = record.MessageId
+
+		batchKey := strings.Join([]string{upload.bucket, upload.rule.Name, upload.schema.Ref(), upload.format}, "|")
+		if _, ok := batches[batchKey]; !ok {
+			batchKeys = append(batchKeys, batchKey)
+		}
+		batches[batchKey] = append(batches[batchKey], upload)
 	}
 
-	// Check the file is a .csv file, we don't want to process any other files
-	if !strings.HasSuffix(request.Detail.Object.Key, ".csv") {
-		log.Println(fmt.Sprintf("S3 key does not match the desired file type: %s", ".csv"))
-		return "", nil
+	// Start a workflow per group of files.
+	sfnSvc := sfn.New(mySession)
+	dynamoSvc := dynamodb.New(mySession)
+	for _, batchKey := range batchKeys {
+		uploads := batches[batchKey]
+		execution, err := startWorkflow(ctx, s3Svc, sfnSvc, dynamoSvc, uploads)
+		if err != nil {
+			logging.Error("Error starting the ingestion workflow", err)
+			for _, upload := range uploads {
+				response.fail(upload.messageID)
+			}
+			continue
+		}
+		logging.Info("Started the ingestion workflow", "files", len(uploads), "execution", execution)
+		metrics.Emit(uploads[0].rule.Prefix, metrics.Count(metrics.FilesAccepted, int64(len(uploads))))
 	}
 
-	// Create a new Glue client
-	log.Println("Creating a new Glue client...")
-	mySession := session.Must(session.NewSession())
-	svc := glue.New(mySession)
-
-	// Create a new Glue job
-	log.Println("Creating a new Glue job: ", os.Getenv("JOB_NAME"))
-	glueJob, err := svc.StartJobRun(&glue.StartJobRunInput{
-		JobName: aws.String(os.Getenv("JOB_NAME")),
-		Arguments: map[string]*string{
-			"--s3_bucket": aws.String(request.Detail.Bucket.Name),
-			"--s3_key":    aws.String(request.Detail.Object.Key),
-			"--table":     aws.String(os.Getenv("TABLE_NAME")),
-			"--workers":   aws.String(os.Getenv("WORKERS")),
+	return response, nil
+}
+
+// Checks an uploaded file against the rule of its prefix and its schema. It
+// returns nil when the file is not ingested: it is under none of the
+// prefixes, or it was moved to the ignored/, expanded/ or failed/ folder.
+func prepare(ctx context.Context, mySession *session.Session, s3Svc *s3.S3, ingestionRules []rules.Rule, request Request) (*upload, error) {
+	// Skip the files that are not under a prefix we watch, e.g. the files
+	// moved to the archive folder.
+	rule := rules.Match(ingestionRules, request.Detail.Object.Key)
+	if rule == nil {
+		logging.Info("S3 key is not under any of the ingestion prefixes")
+		return nil, nil
+	}
+
+	// Get the file, its content type and metadata are not part of the event.
+	head, err := s3Svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(request.Detail.Bucket.Name),
+		Key:    aws.String(request.Detail.Object.Key),
+	})
+	// The event was delivered again after the file was moved, e.g. to the
+	// ignored folder.
+	if objects.IsNotFound(err) {
+		logging.Info("The file is no longer in the bucket")
+		return nil, nil
+	}
+	if err != nil {
+		logging.Error("Error getting the file", err)
+		return nil, err
+	}
+
+	// The files uploaded through the upload API record why they are not loaded.
+	uploadID := aws.StringValue(head.Metadata[objects.MetadataKey(uploadMetadata)])
+	correlationID := correlationOf(head.Metadata, request.ID)
+	logging.Set(logging.CorrelationID, correlationID)
+
+	// Check the file against the rule of its prefix.
+	object := rules.Object{
+		Key:         request.Detail.Object.Key,
+		Size:        aws.Int64Value(head.ContentLength),
+		ContentType: aws.StringValue(head.ContentType),
+	}
+
+	// Move the files the rule does not accept out of the way, tagged with the
+	// reason, so they are not silently left behind.
+	if reason := rule.Check(object); reason != "" {
+		logging.Warn("The ingestion rule does not accept the file", "rule", rule.Name, "reason", reason)
+		return nil, failUpload(ctx, mySession, uploadID, object.Key, reason, ignore(ctx, s3Svc, request.Detail.Bucket.Name, object.Key, rule, reason))
+	}
+
+	// Extract the files of the zip files, each of them is then ingested on its own.
+	if isZip(object.Key) {
+		logging.Info("Extracting the files of the zip file")
+		reason, err := expand(ctx, s3Svc, request.Detail.Bucket.Name, object.Key, rule, correlationID)
+		if reason != "" {
+			return nil, failUpload(ctx, mySession, uploadID, object.Key, reason, ignore(ctx, s3Svc, request.Detail.Bucket.Name, object.Key, rule, reason))
+		}
+		return nil, err
+	}
+
+	// Get the schema of the file, named by its metadata or by its rule.
+	schemaRef := rule.Schema
+	if ref, ok := head.Metadata[objects.MetadataKey(schemaMetadata)]; ok {
+		schemaRef = aws.StringValue(ref)
+	}
+	fileSchema, err := schema.Lookup(schemaRef)
+	if err != nil {
+		logging.Error("Error getting the schema of the file", err)
+		return nil, failUpload(ctx, mySession, uploadID, object.Key, rules.UnknownSchema, ignore(ctx, s3Svc, request.Detail.Bucket.Name, object.Key, rule, rules.UnknownSchema))
+	}
+	schemaJSON, err := fileSchema.JSON()
+	if err != nil {
+		logging.Error("Error formatting the schema of the file", err)
+		return nil, err
+	}
+	logging.Info("Loading the file with the schema", "schema", fileSchema.Ref())
+
+	// Read the start of the file to detect its format and check its header.
+	fileHead, err := readHead(ctx, s3Svc, request.Detail.Bucket.Name, object.Key)
+	if errors.Is(err, errUnsupportedFormat) {
+		logging.Warn("The file is not in a supported format", "error", err)
+		return nil, failUpload(ctx, mySession, uploadID, object.Key, rules.UnsupportedFormat, ignore(ctx, s3Svc, request.Detail.Bucket.Name, object.Key, rule, rules.UnsupportedFormat))
+	}
+	if err != nil {
+		logging.Error("Error reading the start of the file", err)
+		return nil, err
+	}
+
+	// Detect the format of the file, the files the job cannot read are moved
+	// out of the way like the files the rule does not accept.
+	format, err := detectFormat(object.Key, fileHead)
+	if errors.Is(err, errUnsupportedFormat) {
+		logging.Warn("The file is not in a supported format", "error", err)
+		return nil, failUpload(ctx, mySession, uploadID, object.Key, rules.UnsupportedFormat, ignore(ctx, s3Svc, request.Detail.Bucket.Name, object.Key, rule, rules.UnsupportedFormat))
+	}
+	if err != nil {
+		logging.Error("Error detecting the format of the file", err)
+		return nil, err
+	}
+	logging.Info("Detected the format of the file", "format", format)
+
+	// Check the header of the file against its schema before starting the
+	// job, the files without the required columns are failed right away.
+	if reason, message, header, check := checkHeader(fileSchema, format, fileHead); reason != "" {
+		logging.Warn("The header of the file does not match its schema", "reason", message)
+		return nil, failUpload(ctx, mySession, uploadID, object.Key, message, reject(ctx, mySession, s3Svc, PreflightDiagnostics{
+			Stage:        "preflight",
+			Reason:       reason,
+			ErrorMessage: message,
+			Rule:         rule.Name,
+			Schema:       fileSchema.Ref(),
+			Format:       format,
+			Header:       header,
+			HeaderCheck:  check,
+			SourceBucket: request.Detail.Bucket.Name,
+			SourceKey:    object.Key,
+			CheckedAt:    time.Now().UTC(),
+		}, rule.Prefix))
+	}
+
+	return &upload{
+		bucket: request.Detail.Bucket.Name,
+		object: manifest.File{
+			Key:           object.Key,
+			Size:          object.Size,
+			ETag:          aws.StringValue(head.ETag),
+			LastModified:  aws.TimeValue(head.LastModified),
+			CorrelationID: correlationID,
 		},
+		rule:       rule,
+		schema:     fileSchema,
+		schemaJSON: schemaJSON,
+		format:     format,
+		uploadID:   uploadID,
+	}, nil
+}
+
+// Moves a file the rules do not accept to the ignored folder, keeping its key
+// so it can be uploaded again once fixed.
+func ignore(ctx context.Context, s3Svc *s3.S3, bucket string, key string, rule *rules.Rule, reason string) error {
+	source, err := s3Svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
 	})
+	if err != nil {
+		logging.Error("Error getting the file", err)
+		return err
+	}
 
+	ignoredKey, err := objects.AvailableKey(ctx, s3Svc, bucket, ignoredPrefix+key, source)
+	if err != nil {
+		logging.Error("Error finding a free key for the file", err)
+		return err
+	}
+
+	logging.Info("Moving the file to the ignored folder", "destinationKey", ignoredKey)
+	_, err = objects.Move(ctx, s3Svc, objects.MoveInput{
+		Bucket:         bucket,
+		SourceKey:      key,
+		DestinationKey: ignoredKey,
+		Tags: map[string]string{
+			"ignored-reason": reason,
+			"ingestion-rule": rule.Name,
+		},
+	})
 	if err != nil {
-		log.Println("Error starting Glue job: ", err)
-		return "", err
+		logging.Error("Error moving the file to the ignored folder", err)
+		return err
 	}
+	metrics.Emit(rule.Prefix, metrics.Count(metrics.FilesIgnored, 1))
 
-	// Return the response to the client
-	return aws.StringValue(glueJob.JobRunId), nil
+	return nil
 }
 
 func main() {
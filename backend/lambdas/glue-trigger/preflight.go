@@ -0,0 +1,192 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"time"
+
+	"go-cdk-workshop/internal/logging"
+	"go-cdk-workshop/internal/metrics"
+	"go-cdk-workshop/internal/notify"
+	"go-cdk-workshop/internal/objects"
+	"go-cdk-workshop/internal/schema"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// The reasons a file fails the header check.
+const (
+	// The file has no header, e.g. it is empty or its first line is blank.
+	noHeader = "NO_HEADER"
+
+	// The header does not have every required column of the schema.
+	missingColumns = "MISSING_COLUMNS"
+)
+
+// PreflightDiagnostics describe why a file failed the header check, they are
+// written as JSON next to the failed file like the diagnostics of the failed
+// job runs.
+type PreflightDiagnostics struct {
+	Stage        string   `json:"stage"`
+	Reason       string   `json:"reason"`
+	ErrorMessage string   `json:"errorMessage"`
+	Rule         string   `json:"rule"`
+	Schema       string   `json:"schema"`
+	Format       string   `json:"format"`
+	Header       []string `json:"header"`
+	schema.HeaderCheck
+	SourceBucket string    `json:"sourceBucket"`
+	SourceKey    string    `json:"sourceKey"`
+	FailedKey    string    `json:"failedKey"`
+	CheckedAt    time.Time `json:"checkedAt"`
+}
+
+// Returns the columns of a CSV file from its first bytes. It returns nil when
+// the first line is longer than the bytes read, so a header cut short is not
+// mistaken for a header without the required columns.
+func parseHeader(head []byte) ([]string, error) {
+	text := headText(head)
+	if len(head) >= headLength && !strings.Contains(text, "\n") {
+		return nil, nil
+	}
+
+	reader := csv.NewReader(strings.NewReader(text))
+	reader.LazyQuotes = true
+	reader.FieldsPerRecord = -1
+	record, err := reader.Read()
+	if err == io.EOF {
+		return []string{}, nil
+	}
+	return record, err
+}
+
+// Checks the header of the file against its schema, and returns why the file
+// is rejected, or an empty string when the job can be started. Only the CSV
+// files have a header: the columns of Parquet files are in their footer, and
+// each line of a JSON Lines file names its own fields.
+func checkHeader(fileSchema *schema.Schema, format string, head []byte) (reason string, message string, header []string, check schema.HeaderCheck) {
+	if format != formatCSV {
+		return "", "", nil, check
+	}
+
+	header, err := parseHeader(head)
+	if err != nil {
+		return noHeader, fmt.Sprintf("the header of the file cannot be read: %v", err), nil, check
+	}
+	if header == nil {
+		logging.Info("The header of the file is longer than the bytes read, skipping the header check")
+		return "", "", nil, check
+	}
+	if len(header) == 0 || (len(header) == 1 && strings.TrimSpace(header[0]) == "") {
+		return noHeader, "the file has no header", header, check
+	}
+
+	check = fileSchema.CheckHeader(header)
+	if !check.OK() {
+		return missingColumns, fmt.Sprintf("the file does not have the required columns of %s: %s", fileSchema.Ref(), strings.Join(check.Missing, ", ")), header, check
+	}
+	return "", "", header, check
+}
+
+// Moves a file whose header does not match its schema to the failed folder,
+// next to a diagnostics file, and notifies the failure, so the file is failed
+// in seconds instead of after a job run.
+func reject(ctx context.Context, sess *session.Session, s3Svc *s3.S3, diagnostics PreflightDiagnostics, prefix string) error {
+	source, err := s3Svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(diagnostics.SourceBucket),
+		Key:    aws.String(diagnostics.SourceKey),
+	})
+	if err != nil {
+		logging.Error("Error getting the file", err)
+		return err
+	}
+
+	// The failed key is laid out like the keys of the failed job runs, without
+	// a run id as no job was started.
+	keyTemplate := os.Getenv("ARCHIVE_KEY_TEMPLATE")
+	if keyTemplate == "" {
+		keyTemplate = objects.DefaultKeyTemplate
+	}
+	failedKey, err := objects.RenderKey(keyTemplate, "failed", prefix, diagnostics.SourceKey, "", diagnostics.CheckedAt)
+	if err != nil {
+		logging.Error("Error rendering the failed key", err)
+		return err
+	}
+	failedKey, err = objects.AvailableKey(ctx, s3Svc, diagnostics.SourceBucket, failedKey, source)
+	if err != nil {
+		logging.Error("Error finding a free key for the file", err)
+		return err
+	}
+	diagnostics.FailedKey = failedKey
+
+	content, err := json.MarshalIndent(diagnostics, "", "  ")
+	if err != nil {
+		logging.Error("Error formatting the diagnostics", err)
+		return err
+	}
+	diagnosticsKey := objects.DiagnosticsKey(failedKey)
+	logging.Info("Writing the diagnostics of the file", "diagnosticsKey", diagnosticsKey)
+	_, err = s3Svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(diagnostics.SourceBucket),
+		Key:         aws.String(diagnosticsKey),
+		Body:        bytes.NewReader(content),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		logging.Error("Error writing the diagnostics", err)
+		return err
+	}
+
+	tags := map[string]string{
+		"preflight-error": diagnostics.Reason,
+		"ingestion-rule":  diagnostics.Rule,
+		"schema":          diagnostics.Schema,
+	}
+	if len(diagnostics.Missing) > 0 {
+		tags["missing-columns"] = objects.TagValue(strings.Join(diagnostics.Missing, " "))
+	}
+
+	logging.Info("Moving the file to the failed folder", "destinationKey", failedKey)
+	_, err = objects.Move(ctx, s3Svc, objects.MoveInput{
+		Bucket:         diagnostics.SourceBucket,
+		SourceKey:      diagnostics.SourceKey,
+		DestinationKey: failedKey,
+		Tags:           tags,
+	})
+	if err != nil {
+		logging.Error("Error moving the file to the failed folder", err)
+		return err
+	}
+	metrics.Emit(prefix, metrics.Count(metrics.FilesRejected, 1))
+
+	// Let the operators know the file was rejected. The file has been moved
+	// already, so a failed notification is logged rather than retried.
+	event := notify.Event{
+		Type:           notify.IngestionFailed,
+		Time:           diagnostics.CheckedAt,
+		State:          "REJECTED",
+		Bucket:         diagnostics.SourceBucket,
+		Key:            diagnostics.SourceKey,
+		DestinationKey: failedKey,
+		SourceArchive:  aws.StringValue(source.Metadata[objects.MetadataKey(objects.SourceArchiveMetadata)]),
+		ErrorMessage:   diagnostics.ErrorMessage,
+		DiagnosticsKey: diagnosticsKey,
+	}
+	notifier, err := notify.FromEnv(sess)
+	if err == nil {
+		err = notifier.Notify(ctx, event)
+	}
+	if err != nil {
+		logging.Error("Error sending the ingestion notification", err)
+	}
+
+	return nil
+}
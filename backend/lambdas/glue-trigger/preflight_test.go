@@ -0,0 +1,146 @@
+package main
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"go-cdk-workshop/internal/schema"
+)
+
+func TestParseHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		head    string
+		want    []string
+		wantErr bool
+	}{
+		{
+			name: "header and rows",
+			head: "accountNumber,isFraud\n1,TRUE\n",
+			want: []string{"accountNumber", "isFraud"},
+		},
+		{
+			name: "quoted columns after a byte order mark",
+			head: "\ufeff\"account,Number\",\"isFraud\"\r\n1,TRUE\r\n",
+			want: []string{"account,Number", "isFraud"},
+		},
+		{
+			name: "header without a new line",
+			head: "accountNumber,isFraud",
+			want: []string{"accountNumber", "isFraud"},
+		},
+		{
+			name: "empty file",
+			head: "",
+			want: []string{},
+		},
+		{
+			name: "header longer than the bytes read",
+			head: strings.Repeat("column,", headLength/7+1),
+		},
+		{
+			name: "quote inside a column",
+			head: "account\"Number,isFraud\n",
+			want: []string{"account\"Number", "isFraud"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseHeader([]byte(test.head))
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseHeader() error = %v, want error %v", err, test.wantErr)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseHeader() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckHeader(t *testing.T) {
+	fileSchema := &schema.Schema{
+		Name:    "transactions",
+		Version: 1,
+		Columns: []schema.Column{
+			{Name: "accountNumber", Type: schema.TypeString, Required: true},
+			{Name: "transactionAmount", Type: schema.TypeDouble, Required: true, Aliases: []string{"amount"}},
+			{Name: "merchantName", Type: schema.TypeString},
+		},
+	}
+
+	tests := []struct {
+		name        string
+		format      string
+		head        string
+		wantReason  string
+		wantHeader  []string
+		wantMissing []string
+	}{
+		{
+			name:       "every required column",
+			format:     formatCSV,
+			head:       "accountNumber,amount,merchantName\n1,2.5,Uber\n",
+			wantHeader: []string{"accountNumber", "amount", "merchantName"},
+		},
+		{
+			name:        "required column missing",
+			format:      formatCSV,
+			head:        "accountNumber,merchantName\n1,Uber\n",
+			wantReason:  missingColumns,
+			wantHeader:  []string{"accountNumber", "merchantName"},
+			wantMissing: []string{"transactionAmount"},
+		},
+		{
+			name:       "empty file",
+			format:     formatCSV,
+			wantReason: noHeader,
+			wantHeader: []string{},
+		},
+		{
+			name:       "empty lines before the header",
+			format:     formatCSV,
+			head:       "\n\naccountNumber,amount\n",
+			wantHeader: []string{"accountNumber", "amount"},
+		},
+		{
+			name:       "only blank lines",
+			format:     formatCSV,
+			head:       "\ufeff\r\n   \n",
+			wantReason: noHeader,
+			wantHeader: []string{},
+		},
+		{
+			name:   "header longer than the bytes read",
+			format: formatCSV,
+			head:   strings.Repeat("column,", headLength/7+1),
+		},
+		{
+			name:   "Parquet file",
+			format: formatParquet,
+			head:   "PAR1",
+		},
+		{
+			name:   "JSON Lines file",
+			format: formatJSON,
+			head:   `{"merchantName": "Uber"}`,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reason, message, header, check := checkHeader(fileSchema, test.format, []byte(test.head))
+			if reason != test.wantReason {
+				t.Errorf("checkHeader() reason = %q (%s), want %q", reason, message, test.wantReason)
+			}
+			if (reason == "") != (message == "") {
+				t.Errorf("checkHeader() message = %q with reason %q", message, reason)
+			}
+			if !reflect.DeepEqual(header, test.wantHeader) {
+				t.Errorf("checkHeader() header = %q, want %q", header, test.wantHeader)
+			}
+			if !reflect.DeepEqual(check.Missing, test.wantMissing) {
+				t.Errorf("checkHeader() missing = %v, want %v", check.Missing, test.wantMissing)
+			}
+		})
+	}
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand"
+	"time"
+
+	"go-cdk-workshop/internal/logging"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/glue"
+)
+
+const (
+	// The first and longest wait between two attempts at starting a job run
+	// within an invocation of the lambda.
+	retryBaseDelay = time.Second
+	retryMaxDelay  = 30 * time.Second
+
+	// Stop retrying when less than this is left before the lambda times out,
+	// so the start step can still be handed off to the delay queue.
+	retryDeadlineMargin = 15 * time.Second
+)
+
+// Whether starting the job run failed because Glue is busy or throttling the
+// requests, so it may succeed later. The other errors, e.g. a job that does
+// not exist, fail the files straight away.
+func isRetryable(err error) bool {
+	var awsErr awserr.Error
+	if !errors.As(err, &awsErr) {
+		return false
+	}
+
+	switch awsErr.Code() {
+	case glue.ErrCodeConcurrentRunsExceededException,
+		glue.ErrCodeResourceNumberLimitExceededException,
+		glue.ErrCodeInternalServiceException,
+		glue.ErrCodeOperationTimeoutException:
+		return true
+	}
+	return request.IsErrorThrottle(err) || request.IsErrorRetryable(err)
+}
+
+// Calls attempt until it succeeds, fails with an error that is not retryable,
+// or the time left before the lambda times out runs out. The attempts are
+// spaced by an exponential backoff with full jitter, so the runs held back at
+// the same time do not all hit Glue again together. It returns the last error.
+func withBackoff(ctx context.Context, attempt func() error) error {
+	delay := retryBaseDelay
+	for {
+		err := attempt()
+		if err == nil || !isRetryable(err) {
+			return err
+		}
+
+		wait := time.Duration(rand.Int63n(int64(delay)))
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline)-wait < retryDeadlineMargin {
+			logging.Error("No time left to retry starting the job run", err)
+			return err
+		}
+		logging.Warn("Retrying starting the job run", "wait", wait, "error", err)
+
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(wait):
+		}
+
+		delay *= 2
+		if delay > retryMaxDelay {
+			delay = retryMaxDelay
+		}
+	}
+}
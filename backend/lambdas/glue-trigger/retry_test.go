@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/glue"
+)
+
+func TestIsRetryable(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{name: "too many concurrent runs", err: awserr.New(glue.ErrCodeConcurrentRunsExceededException, "Concurrent runs exceeded", nil), want: true},
+		{name: "resource limit", err: awserr.New(glue.ErrCodeResourceNumberLimitExceededException, "Limit exceeded", nil), want: true},
+		{name: "internal error", err: awserr.New(glue.ErrCodeInternalServiceException, "Internal error", nil), want: true},
+		{name: "throttled", err: awserr.New("ThrottlingException", "Rate exceeded", nil), want: true},
+		{name: "wrapped", err: fmt.Errorf("starting the job run: %w", awserr.New(glue.ErrCodeOperationTimeoutException, "Timeout", nil)), want: true},
+		{name: "job not found", err: awserr.New(glue.ErrCodeEntityNotFoundException, "Job not found", nil)},
+		{name: "invalid input", err: awserr.New(glue.ErrCodeInvalidInputException, "Invalid input", nil)},
+		{name: "not an AWS error", err: errors.New("the manifest is empty")},
+		{name: "no error"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isRetryable(test.err); got != test.want {
+				t.Errorf("isRetryable(%v) = %v, want %v", test.err, got, test.want)
+			}
+		})
+	}
+}
+
+func TestWithBackoff(t *testing.T) {
+	busy := awserr.New(glue.ErrCodeConcurrentRunsExceededException, "Concurrent runs exceeded", nil)
+	notFound := awserr.New(glue.ErrCodeEntityNotFoundException, "Job not found", nil)
+
+	tests := []struct {
+		name         string
+		errs         []error
+		timeLeft     time.Duration
+		canceled     bool
+		want         error
+		wantAttempts int
+	}{
+		{
+			name:         "first attempt succeeds",
+			errs:         []error{nil},
+			wantAttempts: 1,
+		},
+		{
+			name:         "succeeds once Glue is not busy",
+			errs:         []error{busy, nil},
+			wantAttempts: 2,
+		},
+		{
+			name:         "error not retryable",
+			errs:         []error{notFound, nil},
+			want:         notFound,
+			wantAttempts: 1,
+		},
+		{
+			name:         "no time left to retry",
+			errs:         []error{busy, nil},
+			timeLeft:     retryDeadlineMargin / 2,
+			want:         busy,
+			wantAttempts: 1,
+		},
+		{
+			name:         "context canceled while waiting",
+			errs:         []error{busy, nil},
+			canceled:     true,
+			want:         busy,
+			wantAttempts: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			if test.timeLeft > 0 {
+				ctx, cancel = context.WithTimeout(ctx, test.timeLeft)
+				defer cancel()
+			}
+			if test.canceled {
+				cancel()
+			}
+
+			attempts := 0
+			err := withBackoff(ctx, func() error {
+				attempts++
+				return test.errs[attempts-1]
+			})
+			if err != test.want {
+				t.Errorf("withBackoff() error = %v, want %v", err, test.want)
+			}
+			if attempts != test.wantAttempts {
+				t.Errorf("withBackoff() made %d attempts, want %d", attempts, test.wantAttempts)
+			}
+		})
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"archive/zip"
+	"context"
+	"fmt"
+	"io"
+	"path"
+	"strconv"
+	"strings"
+
+	"go-cdk-workshop/internal/logging"
+	"go-cdk-workshop/internal/objects"
+	"go-cdk-workshop/internal/rules"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+const (
+	// The folder the zip files are moved to once their files are extracted.
+	expandedPrefix = "expanded/"
+
+	// The maximum number of files extracted from a zip file.
+	maxZipEntries = 1000
+
+	// The maximum total size of the files extracted from a zip file, so a
+	// zip bomb does not fill the bucket.
+	maxZipExpandedBytes = 50 * 1024 * 1024 * 1024
+
+	// The size of the ranges read from S3 when reading a zip file, so the
+	// zip file is never held in memory as a whole.
+	zipReadWindow = 8 * 1024 * 1024
+
+	// The metadata added to the extracted files next to the zip file they
+	// came from, with the name of their entry in it.
+	sourceEntryMetadata = "source-entry"
+)
+
+// Whether the file is a zip file whose files are ingested separately.
+func isZip(key string) bool {
+	return strings.HasSuffix(strings.ToLower(key), ".zip")
+}
+
+// Extracts the files of a zip file next to it, e.g. input/bank/august.zip is
+// extracted to input/bank/august/<file>, so each of them triggers its own
+// ingestion and is archived or failed on its own. The zip file is then moved
+// to the expanded folder.
+//
+// Nothing is extracted from a zip file with too many files, a file over the
+// maximum size of the rule or too large a total size, the reason is returned
+// instead. The sizes are the ones declared by the zip file, the zip reader
+// fails the files whose content is larger than declared.
+func expand(ctx context.Context, s3Svc s3iface.S3API, bucket string, key string, rule *rules.Rule, correlationID string) (string, error) {
+	source, err := s3Svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		logging.Error("Error getting the zip file", err)
+		return "", err
+	}
+	size := aws.Int64Value(source.ContentLength)
+
+	reader, err := zip.NewReader(&objectReaderAt{ctx: ctx, client: s3Svc, bucket: bucket, key: key, size: size}, size)
+	if err != nil {
+		logging.Error("Error reading the zip file", err)
+		return "", err
+	}
+
+	entries := []*zip.File{}
+	var expandedBytes uint64
+	for _, entry := range reader.File {
+		if entry.FileInfo().IsDir() || isHidden(entry.Name) {
+			continue
+		}
+		if rule.MaxSizeBytes > 0 && entry.UncompressedSize64 > uint64(rule.MaxSizeBytes) {
+			logging.Warn("The zip file has a file over the maximum size", "entry", entry.Name, "size", entry.UncompressedSize64)
+			return rules.TooLarge, nil
+		}
+		expandedBytes += entry.UncompressedSize64
+		entries = append(entries, entry)
+	}
+	if len(entries) > maxZipEntries {
+		logging.Warn("The zip file has too many files", "files", len(entries), "maxFiles", maxZipEntries)
+		return rules.TooManyFiles, nil
+	}
+	if expandedBytes > maxZipExpandedBytes {
+		logging.Warn("The files of the zip file are too large", "size", expandedBytes, "maxSize", uint64(maxZipExpandedBytes))
+		return rules.TooLarge, nil
+	}
+
+	folder := strings.TrimSuffix(key, path.Ext(key)) + "/"
+	uploader := s3manager.NewUploaderWithClient(s3Svc)
+	for _, entry := range entries {
+		entryKey := folder + strings.TrimPrefix(path.Clean("/"+entry.Name), "/")
+
+		// Skip the files extracted by a previous attempt that have not been
+		// ingested yet, so they are not ingested twice.
+		extracted, err := s3Svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(bucket),
+			Key:    aws.String(entryKey),
+		})
+		if err != nil && !objects.IsNotFound(err) {
+			logging.Error("Error getting the extracted file", err)
+			return "", err
+		}
+		if err == nil && aws.StringValue(extracted.Metadata[objects.MetadataKey(objects.SourceArchiveMetadata)]) == key {
+			logging.Info("Skipping the file already extracted", "entryKey", entryKey)
+			continue
+		}
+
+		logging.Info("Extracting the file from the zip file", "entryKey", entryKey)
+		body, err := entry.Open()
+		if err != nil {
+			logging.Error("Error reading the file from the zip file", err)
+			return "", err
+		}
+		metadata := map[string]*string{
+			objects.SourceArchiveMetadata: aws.String(key),
+			sourceEntryMetadata:           aws.String(entry.Name),
+		}
+		// The extracted files are followed with the correlation id of the zip file.
+		if correlationID != "" {
+			metadata[correlationMetadata] = aws.String(correlationID)
+		}
+		// The files are loaded with the schema named by the zip file, if any.
+		if ref, ok := source.Metadata[objects.MetadataKey(schemaMetadata)]; ok {
+			metadata[schemaMetadata] = ref
+		}
+		_, err = uploader.UploadWithContext(ctx, &s3manager.UploadInput{
+			Bucket:   aws.String(bucket),
+			Key:      aws.String(entryKey),
+			Body:     body,
+			Metadata: metadata,
+		})
+		body.Close()
+		if err != nil {
+			logging.Error("Error writing the extracted file", err)
+			return "", err
+		}
+	}
+
+	// Move the zip file out of the input folder, it is only kept for reference.
+	expandedKey, err := objects.AvailableKey(ctx, s3Svc, bucket, expandedPrefix+key, source)
+	if err != nil {
+		logging.Error("Error finding a free key for the zip file", err)
+		return "", err
+	}
+
+	logging.Info("Moving the zip file to the expanded folder", "destinationKey", expandedKey)
+	_, err = objects.Move(ctx, s3Svc, objects.MoveInput{
+		Bucket:         bucket,
+		SourceKey:      key,
+		DestinationKey: expandedKey,
+		Tags: map[string]string{
+			"expanded-files":  strconv.Itoa(len(entries)),
+			"expanded-folder": objects.TagValue(folder),
+		},
+	})
+	if err != nil {
+		logging.Error("Error moving the zip file to the expanded folder", err)
+		return "", err
+	}
+
+	return "", nil
+}
+
+// Whether the file is one of the hidden files added by archivers, e.g. the
+// __MACOSX folder or .DS_Store.
+func isHidden(name string) bool {
+	for _, segment := range strings.Split(name, "/") {
+		if strings.HasPrefix(segment, ".") || segment == "__MACOSX" {
+			return true
+		}
+	}
+	return false
+}
+
+// objectReaderAt reads an S3 object with ranged GETs, keeping the last range
+// read so the small sequential reads of the zip reader are served from memory.
+type objectReaderAt struct {
+	ctx    context.Context
+	client s3iface.S3API
+	bucket string
+	key    string
+	size   int64
+
+	window       []byte
+	windowOffset int64
+}
+
+func (r *objectReaderAt) ReadAt(p []byte, offset int64) (int, error) {
+	if offset >= r.size {
+		return 0, io.EOF
+	}
+
+	read := 0
+	for read < len(p) && offset+int64(read) < r.size {
+		position := offset + int64(read)
+		if position < r.windowOffset || position >= r.windowOffset+int64(len(r.window)) {
+			if err := r.fill(position, len(p)-read); err != nil {
+				return read, err
+			}
+		}
+		read += copy(p[read:], r.window[position-r.windowOffset:])
+	}
+
+	if read < len(p) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+// Reads the range starting at the offset into the window, at least length
+// bytes or up to the end of the object.
+func (r *objectReaderAt) fill(offset int64, length int) error {
+	size := int64(zipReadWindow)
+	if int64(length) > size {
+		size = int64(length)
+	}
+	if offset+size > r.size {
+		size = r.size - offset
+	}
+
+	object, err := r.client.GetObjectWithContext(r.ctx, &s3.GetObjectInput{
+		Bucket: aws.String(r.bucket),
+		Key:    aws.String(r.key),
+		Range:  aws.String(fmt.Sprintf("bytes=%d-%d", offset, offset+size-1)),
+	})
+	if err != nil {
+		return err
+	}
+	defer object.Body.Close()
+
+	window := make([]byte, size)
+	if _, err := io.ReadFull(object.Body, window); err != nil {
+		return err
+	}
+	r.window, r.windowOffset = window, offset
+	return nil
+}
@@ -0,0 +1,206 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"testing"
+
+	"go-cdk-workshop/internal/rules"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// fakeS3 serves the objects of a bucket to HeadObject and ranged GETs, and
+// counts the GETs.
+type fakeS3 struct {
+	s3iface.S3API
+	objects map[string][]byte
+	gets    int
+}
+
+func (f *fakeS3) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, options ...request.Option) (*s3.HeadObjectOutput, error) {
+	data, ok := f.objects[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, awserr.New("NotFound", "Not Found", nil)
+	}
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(data)))}, nil
+}
+
+func (f *fakeS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, options ...request.Option) (*s3.GetObjectOutput, error) {
+	f.gets++
+	data, ok := f.objects[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	if input.Range != nil {
+		var start, end int
+		if _, err := fmt.Sscanf(aws.StringValue(input.Range), "bytes=%d-%d", &start, &end); err != nil {
+			return nil, err
+		}
+		if start >= len(data) {
+			return nil, awserr.New("InvalidRange", "The requested range is not satisfiable", nil)
+		}
+		if end >= len(data) {
+			end = len(data) - 1
+		}
+		data = data[start : end+1]
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(bytes.NewReader(data)), ContentLength: aws.Int64(int64(len(data)))}, nil
+}
+
+// Returns a zip file of the files, keyed by their name.
+func zipOf(t *testing.T, files map[string]string) []byte {
+	var buffer bytes.Buffer
+	writer := zip.NewWriter(&buffer)
+	for name, content := range files {
+		file, err := writer.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		file.Write([]byte(content))
+	}
+	if err := writer.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buffer.Bytes()
+}
+
+func TestObjectReaderAt(t *testing.T) {
+	data := make([]byte, zipReadWindow+100)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+
+	tests := []struct {
+		name     string
+		reads    [][2]int64
+		wantN    int
+		wantEOF  bool
+		wantGets int
+	}{
+		{
+			name:     "sequential reads served by one range",
+			reads:    [][2]int64{{0, 10}, {10, 100}, {5000, 200}},
+			wantN:    200,
+			wantGets: 1,
+		},
+		{
+			name:     "read across the end of the window",
+			reads:    [][2]int64{{0, 10}, {zipReadWindow - 5, 10}},
+			wantN:    10,
+			wantGets: 2,
+		},
+		{
+			name:     "read past the end of the object",
+			reads:    [][2]int64{{zipReadWindow + 90, 20}},
+			wantN:    10,
+			wantEOF:  true,
+			wantGets: 1,
+		},
+		{
+			name:     "read after the end of the object",
+			reads:    [][2]int64{{zipReadWindow + 100, 10}},
+			wantEOF:  true,
+			wantGets: 0,
+		},
+		{
+			name:     "read longer than the window",
+			reads:    [][2]int64{{50, zipReadWindow + 10}},
+			wantN:    zipReadWindow + 10,
+			wantGets: 1,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &fakeS3{objects: map[string][]byte{"input/august.zip": data}}
+			reader := &objectReaderAt{ctx: context.Background(), client: client, bucket: "bucket", key: "input/august.zip", size: int64(len(data))}
+
+			var n int
+			var err error
+			for _, read := range test.reads {
+				p := make([]byte, read[1])
+				n, err = reader.ReadAt(p, read[0])
+				if n > 0 && !bytes.Equal(p[:n], data[read[0]:read[0]+int64(n)]) {
+					t.Errorf("ReadAt(%d, %d) read other bytes than the object's", read[0], read[1])
+				}
+			}
+			if n != test.wantN || (err == io.EOF) != test.wantEOF {
+				t.Errorf("ReadAt() = %d, %v, want %d, EOF %v", n, err, test.wantN, test.wantEOF)
+			}
+			if err != nil && err != io.EOF {
+				t.Errorf("ReadAt() error = %v", err)
+			}
+			if client.gets != test.wantGets {
+				t.Errorf("ReadAt() sent %d GETs, want %d", client.gets, test.wantGets)
+			}
+		})
+	}
+}
+
+func TestExpandRefused(t *testing.T) {
+	tooMany := map[string]string{}
+	for i := 0; i <= maxZipEntries; i++ {
+		tooMany[fmt.Sprintf("august-%d.csv", i)] = "a,b\n"
+	}
+
+	tests := []struct {
+		name  string
+		files map[string]string
+		rule  rules.Rule
+		want  string
+	}{
+		{
+			name:  "file over the maximum size of the rule",
+			files: map[string]string{"august.csv": "a,b\n1,2\n", "september.csv": "a,b\n"},
+			rule:  rules.Rule{Name: "default", MaxSizeBytes: 5},
+			want:  rules.TooLarge,
+		},
+		{
+			name:  "too many files",
+			files: tooMany,
+			rule:  rules.Rule{Name: "default"},
+			want:  rules.TooManyFiles,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &fakeS3{objects: map[string][]byte{"input/august.zip": zipOf(t, test.files)}}
+			got, err := expand(context.Background(), client, "bucket", "input/august.zip", &test.rule, "")
+			if err != nil {
+				t.Fatalf("expand() error = %v", err)
+			}
+			if got != test.want {
+				t.Errorf("expand() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
+
+func TestIsHidden(t *testing.T) {
+	tests := []struct {
+		name string
+		want bool
+	}{
+		{name: "august.csv"},
+		{name: "bank/august.csv"},
+		{name: ".DS_Store", want: true},
+		{name: "bank/.hidden.csv", want: true},
+		{name: "__MACOSX/bank/._august.csv", want: true},
+		{name: "bank/__MACOSX/august.csv", want: true},
+		{name: "bank.v2/august.csv"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := isHidden(test.name); got != test.want {
+				t.Errorf("isHidden(%q) = %v, want %v", test.name, got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"context"
+	"os"
+
+	"go-cdk-workshop/internal/ingestions"
+	"go-cdk-workshop/internal/logging"
+	"go-cdk-workshop/internal/objects"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// The metadata naming the upload of a file uploaded through the upload API,
+// signed into its upload URL.
+const uploadMetadata = "upload-id"
+
+// The metadata carrying the correlation id of the files extracted from a zip
+// file, the correlation id of the zip file.
+const correlationMetadata = "correlation-id"
+
+// Returns the correlation id of a file: the correlation id of the zip file it
+// was extracted from, the id of its upload, or the id of its upload event.
+func correlationOf(metadata map[string]*string, eventID string) string {
+	for _, name := range []string{correlationMetadata, uploadMetadata} {
+		if value := aws.StringValue(metadata[objects.MetadataKey(name)]); value != "" {
+			return value
+		}
+	}
+	return eventID
+}
+
+// Records why the file of an upload was not queued, once it was ignored or
+// rejected, so the status API does not report it as pending forever. The
+// error of moving the file is returned as is, and a failure to record is
+// only logged.
+func failUpload(ctx context.Context, mySession *session.Session, uploadID string, key string, message string, err error) error {
+	if err != nil || uploadID == "" {
+		return err
+	}
+	if err := ingestions.FailUpload(ctx, dynamodb.New(mySession), os.Getenv("INGESTIONS_TABLE"), uploadID, key, message); err != nil {
+		logging.Error("Error recording the failure of the upload", err)
+	}
+	return nil
+}
+
+// Links the uploads of the files to the ingestion loading them, a failure is
+// only logged.
+func linkUploads(ctx context.Context, dynamoSvc *dynamodb.DynamoDB, uploads []*upload, ingestionID string) {
+	for _, upload := range uploads {
+		if upload.uploadID == "" {
+			continue
+		}
+		if err := ingestions.LinkUpload(ctx, dynamoSvc, os.Getenv("INGESTIONS_TABLE"), upload.uploadID, ingestionID); err != nil {
+			logging.Error("Error linking the upload to its ingestion", err, "uploadId", upload.uploadID)
+		}
+	}
+}
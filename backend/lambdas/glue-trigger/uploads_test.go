@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+)
+
+func TestCorrelationOf(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata map[string]*string
+		want     string
+	}{
+		{
+			name:     "file extracted from an uploaded zip file",
+			metadata: map[string]*string{"Correlation-Id": aws.String("zip-upload"), "Upload-Id": aws.String("u1")},
+			want:     "zip-upload",
+		},
+		{
+			name:     "uploaded file",
+			metadata: map[string]*string{"Upload-Id": aws.String("u1"), "Schema": aws.String("transactions@v1")},
+			want:     "u1",
+		},
+		{
+			name:     "empty metadata",
+			metadata: map[string]*string{"Correlation-Id": aws.String(""), "Upload-Id": nil},
+			want:     "event-1",
+		},
+		{
+			name: "file without metadata",
+			want: "event-1",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := correlationOf(test.metadata, "event-1"); got != test.want {
+				t.Errorf("correlationOf() = %q, want %q", got, test.want)
+			}
+		})
+	}
+}
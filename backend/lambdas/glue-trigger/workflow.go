@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"go-cdk-workshop/internal/ingestions"
+	"go-cdk-workshop/internal/logging"
+	"go-cdk-workshop/internal/manifest"
+	"go-cdk-workshop/internal/metrics"
+	"go-cdk-workshop/internal/objects"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/sfn"
+	"github.com/aws/aws-sdk-go/service/sqs"
+)
+
+// The steps of the ingestion workflow run by this lambda.
+const (
+	actionValidate = "validate"
+	actionStart    = "start"
+	actionRecover  = "recover"
+)
+
+// The argument of the job run carrying its correlation id, logged by the job
+// and by the steps of the workflow.
+const correlationArgument = "--correlation_id"
+
+// WorkflowInput is the input of an execution of the ingestion workflow, the
+// state machine passes its fields to the steps.
+type WorkflowInput struct {
+	Bucket    string            `json:"bucket"`
+	Manifest  string            `json:"manifest"`
+	JobName   string            `json:"jobName"`
+	Arguments map[string]string `json:"arguments"`
+}
+
+// ValidateOutput is the result of the validate step.
+type ValidateOutput struct {
+	// The number of files of the manifest still to load.
+	Files int `json:"files"`
+}
+
+// StartOutput is the result of the start step, sent with its task token.
+type StartOutput struct {
+	JobRunID string `json:"jobRunId"`
+}
+
+// Writes the manifest of the files and starts an execution of the ingestion
+// workflow loading them. The execution is named after the manifest, so an
+// upload event delivered twice does not load its file twice nor rewrite its
+// manifest.
+func startWorkflow(ctx context.Context, s3Svc *s3.S3, sfnSvc *sfn.SFN, dynamoSvc *dynamodb.DynamoDB, uploads []*upload) (string, error) {
+	first := uploads[0]
+
+	// The same file may be in the batch twice, e.g. when the upload event was
+	// delivered twice, it is only loaded once.
+	files := []manifest.File{}
+	seen := map[string]bool{}
+	for _, upload := range uploads {
+		if !seen[upload.object.Key] {
+			seen[upload.object.Key] = true
+			files = append(files, upload.object)
+		}
+	}
+
+	runManifest := manifest.New(first.bucket, first.rule.Name, first.rule.Prefix, first.schema.Ref(), first.format, files)
+	logging.Set(logging.IngestionID, runManifest.ID)
+	logging.Set(logging.CorrelationID, runManifest.CorrelationID())
+	logging.Set(logging.Key, "")
+
+	// The manifest is only written when there is none yet: an upload event
+	// delivered again must not overwrite the manifest of the execution it
+	// started, which the validate step may have rewritten since.
+	_, err := s3Svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(runManifest.Bucket),
+		Key:    aws.String(runManifest.Key()),
+	})
+	switch {
+	case err == nil:
+		logging.Info("The manifest of the job run was already written", "manifest", runManifest.Key())
+	case objects.IsNotFound(err):
+		logging.Info("Writing the manifest of the job run", "manifest", runManifest.Key())
+		if err := manifest.Write(ctx, s3Svc, runManifest); err != nil {
+			logging.Error("Error writing the manifest", err)
+			return "", err
+		}
+	default:
+		logging.Error("Error getting the manifest", err)
+		return "", err
+	}
+
+	input, err := json.Marshal(WorkflowInput{
+		Bucket:   first.bucket,
+		Manifest: runManifest.Key(),
+		JobName:  first.rule.JobName,
+		Arguments: map[string]string{
+			"--s3_bucket":       first.bucket,
+			"--manifest":        runManifest.Key(),
+			"--format":          first.format,
+			"--schema":          first.schemaJSON,
+			"--source_prefix":   first.rule.Prefix,
+			"--table":           first.rule.TableName,
+			"--workers":         os.Getenv("WORKERS"),
+			correlationArgument: runManifest.CorrelationID(),
+		},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	logging.Info("Starting the ingestion workflow", "files", len(files))
+	execution, err := sfnSvc.StartExecutionWithContext(ctx, &sfn.StartExecutionInput{
+		StateMachineArn: aws.String(os.Getenv("STATE_MACHINE_ARN")),
+		Name:            aws.String(runManifest.ID),
+		Input:           aws.String(string(input)),
+	})
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) && awsErr.Code() == sfn.ErrCodeExecutionAlreadyExists {
+		logging.Info("The ingestion workflow was already started")
+		return runManifest.ID, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Record the ingestion as queued for the status API. The workflow has
+	// started, so a failure is only logged.
+	if err := ingestions.Queue(ctx, dynamoSvc, os.Getenv("INGESTIONS_TABLE"), queuedIngestion(runManifest, first.rule.JobName)); err != nil {
+		logging.Error("Error recording the ingestion", err)
+	}
+	linkUploads(ctx, dynamoSvc, uploads, runManifest.ID)
+
+	return aws.StringValue(execution.ExecutionArn), nil
+}
+
+// Returns the record of the ingestion of the files of a manifest, with each
+// file queued.
+func queuedIngestion(runManifest *manifest.Manifest, jobName string) *ingestions.Ingestion {
+	ingestion := &ingestions.Ingestion{
+		ID:       runManifest.ID,
+		Bucket:   runManifest.Bucket,
+		Manifest: runManifest.Key(),
+		Rule:     runManifest.Rule,
+		Schema:   runManifest.Schema,
+		Format:   runManifest.Format,
+		JobName:  jobName,
+		Keys:     runManifest.Keys(),
+		Files:    map[string]*ingestions.File{},
+	}
+	for _, file := range runManifest.Files {
+		ingestion.Files[file.Key] = &ingestions.File{Key: file.Key, Size: file.Size, State: ingestions.StateQueued}
+	}
+	return ingestion
+}
+
+// Checks the files of the manifest are still the ones uploaded, the files
+// moved or replaced since, e.g. by a workflow loading the same files, are
+// removed from the manifest so the job does not fail reading them.
+func validate(ctx context.Context, s3Svc *s3.S3, input WorkflowInput) (ValidateOutput, error) {
+	runManifest, err := manifest.Read(ctx, s3Svc, input.Bucket, input.Manifest)
+	if err != nil {
+		logging.Error("Error reading the manifest", err)
+		return ValidateOutput{}, err
+	}
+
+	files := []manifest.File{}
+	for _, file := range runManifest.Files {
+		head, err := s3Svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+			Bucket: aws.String(input.Bucket),
+			Key:    aws.String(file.Key),
+		})
+		if objects.IsNotFound(err) {
+			logging.Info("The file is no longer in the bucket", logging.Key, file.Key)
+			continue
+		}
+		if err != nil {
+			logging.Error("Error getting the file", err)
+			return ValidateOutput{}, err
+		}
+		if aws.StringValue(head.ETag) != file.ETag {
+			logging.Info("The file was replaced since it was uploaded, its own upload event loads it", logging.Key, file.Key)
+			continue
+		}
+		files = append(files, file)
+	}
+
+	if len(files) < len(runManifest.Files) && len(files) > 0 {
+		runManifest.Files = files
+		logging.Info("Writing the validated manifest", "manifest", input.Manifest)
+		if err := manifest.Write(ctx, s3Svc, runManifest); err != nil {
+			logging.Error("Error writing the manifest", err)
+			return ValidateOutput{}, err
+		}
+	}
+
+	return ValidateOutput{Files: len(files)}, nil
+}
+
+// Starts the job run loading the files of the manifest and completes the
+// start step with its id. The errors Glue may recover from are retried while
+// the lambda has time left, then the step is handed off to the delay queue,
+// so the files wait for the runs in progress without holding the lambda.
+func start(ctx context.Context, s3Svc *s3.S3, svc *glue.Glue, sfnSvc *sfn.SFN, sqsSvc *sqs.SQS, dynamoSvc *dynamodb.DynamoDB, event Event) error {
+	runManifest, err := manifest.Read(ctx, s3Svc, event.Bucket, event.Manifest)
+	if err != nil {
+		logging.Error("Error reading the manifest", err)
+		return err
+	}
+	if len(runManifest.Files) == 0 {
+		return failStart(ctx, sfnSvc, event.TaskToken, "JobRunNotStarted", fmt.Sprintf("the manifest %s has no files", event.Manifest))
+	}
+
+	// The first file of the manifest names the run in the Glue console.
+	arguments := map[string]*string{
+		"--s3_key": aws.String(runManifest.Files[0].Key),
+	}
+	for name, value := range event.Arguments {
+		arguments[name] = aws.String(value)
+	}
+
+	// Create a new Glue job
+	logging.Info("Starting a Glue job run", "jobName", event.JobName)
+	var glueJob *glue.StartJobRunOutput
+	err = withBackoff(ctx, func() error {
+		var err error
+		glueJob, err = svc.StartJobRunWithContext(ctx, &glue.StartJobRunInput{
+			JobName:   aws.String(event.JobName),
+			Arguments: arguments,
+		})
+		return err
+	})
+	switch {
+	case err == nil:
+	case !isRetryable(err):
+		logging.Error("Error starting Glue job", err)
+		return failStart(ctx, sfnSvc, event.TaskToken, "JobRunNotStarted", err.Error())
+	case event.Attempt+1 >= delayMaxAttempts:
+		logging.Error("Gave up starting the Glue job run", err)
+		return failStart(ctx, sfnSvc, event.TaskToken, "JobRunNotStarted", fmt.Sprintf("the job run could not be started after %d attempts: %s", delayMaxAttempts, err))
+	default:
+		return delayStart(ctx, sqsSvc, event)
+	}
+
+	logging.Set(logging.JobRunID, aws.StringValue(glueJob.JobRunId))
+	logging.Info("Started the Glue job run", "jobName", event.JobName)
+	metrics.Emit(runManifest.Prefix, metrics.Count(metrics.JobRunsStarted, 1))
+
+	// Record the ingestion as running, a failure is only logged.
+	if err := ingestions.Start(ctx, dynamoSvc, os.Getenv("INGESTIONS_TABLE"), runManifest.ID, event.JobName, aws.StringValue(glueJob.JobRunId)); err != nil {
+		logging.Error("Error recording the start of the ingestion", err)
+	}
+
+	// The run has started, so the step is not retried when it cannot be
+	// completed: its files would be loaded twice. The step then times out and
+	// the recover step carries on with the run recorded above.
+	output, _ := json.Marshal(StartOutput{JobRunID: aws.StringValue(glueJob.JobRunId)})
+	_, err = sfnSvc.SendTaskSuccessWithContext(ctx, &sfn.SendTaskSuccessInput{
+		TaskToken: aws.String(event.TaskToken),
+		Output:    aws.String(string(output)),
+	})
+	if err != nil {
+		logging.Error("Error completing the start step", err)
+	}
+	return nil
+}
+
+// Returns the job run recorded for the manifest when the start step timed
+// out, e.g. because it could not be completed once the run had started, so
+// the workflow waits for the run instead of failing the files it loads. It
+// fails when no run was recorded, the files are then failed.
+func recoverJobRun(ctx context.Context, dynamoSvc *dynamodb.DynamoDB, input WorkflowInput) (StartOutput, error) {
+	ingestion, err := ingestions.Get(ctx, dynamoSvc, os.Getenv("INGESTIONS_TABLE"), manifest.IDOf(input.Manifest))
+	if err != nil {
+		logging.Error("Error getting the ingestion", err)
+		return StartOutput{}, err
+	}
+	if ingestion == nil || ingestion.JobRunID == "" {
+		return StartOutput{}, fmt.Errorf("no job run was started for the manifest %s before the start step timed out", input.Manifest)
+	}
+
+	logging.Set(logging.JobRunID, ingestion.JobRunID)
+	logging.Info("Recovered the job run started for the manifest", "jobName", ingestion.JobName)
+	return StartOutput{JobRunID: ingestion.JobRunID}, nil
+}
+
+// Sets the context of the logs of a step of the ingestion workflow.
+func logWorkflow(input WorkflowInput) {
+	logging.Set(logging.IngestionID, manifest.IDOf(input.Manifest))
+	logging.Set(logging.CorrelationID, input.Arguments[correlationArgument])
+	logging.Set(logging.Bucket, input.Bucket)
+}
+
+// Fails the start step, the workflow then fails the files with the cause.
+func failStart(ctx context.Context, sfnSvc *sfn.SFN, taskToken string, name string, cause string) error {
+	_, err := sfnSvc.SendTaskFailureWithContext(ctx, &sfn.SendTaskFailureInput{
+		TaskToken: aws.String(taskToken),
+		Error:     aws.String(name),
+		Cause:     aws.String(cause),
+	})
+	if err != nil {
+		logging.Error("Error failing the start step", err)
+	}
+	return err
+}
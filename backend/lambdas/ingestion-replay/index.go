@@ -0,0 +1,375 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"go-cdk-workshop/internal/ledger"
+	"go-cdk-workshop/internal/logging"
+	"go-cdk-workshop/internal/objects"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+const (
+	// The folder the files are replayed from by default.
+	defaultPrefix = "archive/"
+
+	// The number of files replayed per request by default, and at most. The
+	// client calls again with the next token while there are more, so a
+	// request does not outlast the API timeout.
+	defaultLimit = 50
+	maxLimit     = 200
+
+	// Stop replaying files when less than this is left before the lambda
+	// times out, the client carries on with the next token.
+	deadlineMargin = 5 * time.Second
+
+	// The tag recording the replays of a file, on the archived file and its
+	// copy, and the tag recording where the copy comes from.
+	replayTag       = "replay-id"
+	replayedFromTag = "replayed-from"
+
+	// The tag naming the job run that loaded a file.
+	jobRunTag = "glue-job-run-id"
+)
+
+// Event handler, replays archived or failed files: each file of the
+// selection is copied back to the key it was uploaded to, so it goes through
+// the ingest queue and the ingestion workflow like a new upload.
+func HandleInfoEvent(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	ApiResponse := events.APIGatewayV2HTTPResponse{
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}
+
+	logging.StartRequest(ctx, event)
+	logging.Debug("Received event", "event", event)
+
+	request, err := parseRequest(event)
+	if err != nil {
+		ApiResponse.StatusCode = 400
+		body, _ := json.Marshal(&Body{Message: fmt.Sprintf("Error: %s", err)})
+		ApiResponse.Body = string(body)
+		return ApiResponse, nil
+	}
+	from, to, err := dateRange(request.From, request.To)
+	if err != nil {
+		ApiResponse.StatusCode = 400
+		body, _ := json.Marshal(&Body{Message: fmt.Sprintf("Error: %s", err)})
+		ApiResponse.Body = string(body)
+		return ApiResponse, nil
+	}
+
+	// Create a new S3 and DynamoDB client
+	logging.Debug("Creating a new S3 and DynamoDB client")
+	mySession := session.Must(session.NewSession())
+	s3Svc := s3.New(mySession)
+	dynamoSvc := dynamodb.New(mySession)
+
+	response, err := replay(ctx, s3Svc, dynamoSvc, request, from, to)
+	if err != nil {
+		logging.Error("Error listing the files", err)
+		ApiResponse.Body = fmt.Sprintf("Error listing the files: %s", err)
+		ApiResponse.StatusCode = 500
+		return ApiResponse, nil
+	}
+
+	// Return the response to the client
+	json, _ := json.Marshal(response)
+	ApiResponse.Body = string(json)
+	ApiResponse.StatusCode = 200
+	return ApiResponse, nil
+}
+
+// Returns the request in the body of the event with its defaults set.
+func parseRequest(event events.APIGatewayV2HTTPRequest) (Request, error) {
+	body := event.Body
+	if event.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			return Request{}, err
+		}
+		body = string(decoded)
+	}
+
+	request := Request{}
+	if strings.TrimSpace(body) != "" {
+		if err := json.Unmarshal([]byte(body), &request); err != nil {
+			return request, fmt.Errorf("invalid request: %w", err)
+		}
+	}
+
+	if request.Prefix == "" {
+		request.Prefix = defaultPrefix
+	}
+	if request.Pattern != "" {
+		if _, err := path.Match(request.Pattern, ""); err != nil {
+			return request, fmt.Errorf("invalid pattern %q: %w", request.Pattern, err)
+		}
+	}
+	if request.Limit <= 0 || request.Limit > maxLimit {
+		request.Limit = defaultLimit
+	}
+
+	// The same selection gets the same id, so a request sent again does not
+	// replay its files twice.
+	if request.ReplayID == "" {
+		hash := sha256.Sum256([]byte(strings.Join([]string{request.Prefix, request.Pattern, request.From, request.To}, "\n")))
+		request.ReplayID = hex.EncodeToString(hash[:])[:16]
+	}
+	request.ReplayID = objects.TagValue(request.ReplayID)
+	return request, nil
+}
+
+// Returns the times the files must have been archived between. A day covers
+// the whole day, a missing bound leaves the range open.
+func dateRange(from string, to string) (time.Time, time.Time, error) {
+	start, err := parseTime(from, false)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid from %q: %w", from, err)
+	}
+	end, err := parseTime(to, true)
+	if err != nil {
+		return time.Time{}, time.Time{}, fmt.Errorf("invalid to %q: %w", to, err)
+	}
+	return start, end, nil
+}
+
+// Parses a day or a time, a day ends at its last nanosecond when it is the
+// end of a range.
+func parseTime(value string, end bool) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if day, err := time.Parse("2006-01-02", value); err == nil {
+		if end {
+			return day.AddDate(0, 0, 1).Add(-time.Nanosecond), nil
+		}
+		return day, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// Lists the files of the selection and replays them, until the limit of the
+// request or the time of the lambda runs out.
+func replay(ctx context.Context, s3Svc s3iface.S3API, dynamoSvc dynamodbiface.DynamoDBAPI, request Request, from time.Time, to time.Time) (Response, error) {
+	bucket := os.Getenv("BUCKET_NAME")
+	response := Response{DryRun: request.DryRun, ReplayID: request.ReplayID, Files: []FileResult{}}
+	runs := map[string][]*ledger.Entry{}
+
+	input := &s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(request.Prefix),
+	}
+	if request.NextToken != "" {
+		input.StartAfter = aws.String(request.NextToken)
+	}
+
+	for {
+		page, err := s3Svc.ListObjectsV2WithContext(ctx, input)
+		if err != nil {
+			return response, err
+		}
+
+		for _, object := range page.Contents {
+			key := aws.StringValue(object.Key)
+			if !selected(request, key, aws.TimeValue(object.LastModified), from, to) {
+				continue
+			}
+
+			// Carry on with the next request when the limit or the time runs out.
+			deadline, ok := ctx.Deadline()
+			if len(response.Files) == request.Limit || (ok && time.Until(deadline) < deadlineMargin) {
+				return response, nil
+			}
+
+			result := replayFile(ctx, s3Svc, dynamoSvc, bucket, key, request, runs)
+			logging.Info("Replayed the file", "result", result)
+			response.Files = append(response.Files, result)
+			response.NextToken = key
+		}
+
+		if !aws.BoolValue(page.IsTruncated) {
+			response.NextToken = ""
+			return response, nil
+		}
+		input.ContinuationToken = page.NextContinuationToken
+	}
+}
+
+// Whether the file is one of the selection. The diagnostics written next to
+// the failed files are not replayed.
+func selected(request Request, key string, lastModified time.Time, from time.Time, to time.Time) bool {
+	if strings.HasSuffix(key, "/") || strings.HasSuffix(key, objects.DiagnosticsKey("")) {
+		return false
+	}
+	if request.Pattern != "" {
+		if match, _ := path.Match(request.Pattern, key); !match {
+			return false
+		}
+	}
+	if !from.IsZero() && lastModified.Before(from) {
+		return false
+	}
+	if !to.IsZero() && lastModified.After(to) {
+		return false
+	}
+	return true
+}
+
+// Copies a file back to the key it was uploaded to. A file already replayed
+// with the same id, or whose source key holds a file waiting to be loaded,
+// is skipped.
+func replayFile(ctx context.Context, s3Svc s3iface.S3API, dynamoSvc dynamodbiface.DynamoDBAPI, bucket string, key string, request Request, runs map[string][]*ledger.Entry) FileResult {
+	result := FileResult{Key: key, Status: StatusSkipped}
+
+	tagging, err := s3Svc.GetObjectTaggingWithContext(ctx, &s3.GetObjectTaggingInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return failed(result, err)
+	}
+	tags := map[string]string{}
+	for _, tag := range tagging.TagSet {
+		tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	if tags[replayTag] == request.ReplayID {
+		result.Message = "the file was already replayed"
+		return result
+	}
+
+	result.SourceKey, err = sourceKey(ctx, s3Svc, dynamoSvc, bucket, key, tags[jobRunTag], runs)
+	if err != nil {
+		return failed(result, err)
+	}
+	switch result.SourceKey {
+	case "":
+		result.Message = "the key the file was uploaded to is not known"
+		return result
+	case key:
+		result.Message = "the file is not archived"
+		return result
+	}
+
+	// Do not overwrite a file waiting to be loaded, e.g. a copy replayed by
+	// a previous request or a new upload.
+	_, err = s3Svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(result.SourceKey),
+	})
+	if err == nil {
+		result.Message = "a file is waiting to be loaded under the source key"
+		return result
+	}
+	if !objects.IsNotFound(err) {
+		return failed(result, err)
+	}
+
+	result.Status = StatusReplayed
+	if request.DryRun {
+		return result
+	}
+
+	// Copy the file without the tags of its previous run, the upload event
+	// of the copy starts its ingestion.
+	_, err = objects.Copy(ctx, s3Svc, objects.MoveInput{
+		Bucket:         bucket,
+		SourceKey:      key,
+		DestinationKey: result.SourceKey,
+		Tags: map[string]string{
+			replayTag:       request.ReplayID,
+			replayedFromTag: objects.TagValue(key),
+		},
+		ReplaceTags: true,
+	})
+	if err != nil {
+		return failed(result, err)
+	}
+
+	// Mark the file as replayed, it is skipped when the request is sent again.
+	dropped, err := objects.AddTags(ctx, s3Svc, bucket, key, map[string]string{replayTag: request.ReplayID})
+	if len(dropped) > 0 {
+		logging.Warn("Dropped the tags that did not fit on the file", "tags", dropped)
+	}
+	if err != nil {
+		logging.Error("Error tagging the replayed file", err)
+	}
+	return result
+}
+
+// Returns a failed result with the error.
+func failed(result FileResult, err error) FileResult {
+	logging.Error("Error replaying the file", err, logging.Key, result.Key)
+	result.Status = StatusFailed
+	result.Message = err.Error()
+	return result
+}
+
+// Returns the key a file was uploaded to: from the ledger entry of the job
+// run that archived it, or from the diagnostics written next to a failed
+// file. The entries of each job run are only read once per request.
+func sourceKey(ctx context.Context, s3Svc s3iface.S3API, dynamoSvc dynamodbiface.DynamoDBAPI, bucket string, key string, jobRunID string, runs map[string][]*ledger.Entry) (string, error) {
+	if jobRunID != "" {
+		entries, ok := runs[jobRunID]
+		if !ok {
+			var err error
+			entries, err = ledger.ListRun(ctx, dynamoSvc, os.Getenv("LEDGER_TABLE"), jobRunID)
+			if err != nil {
+				return "", err
+			}
+			runs[jobRunID] = entries
+		}
+		for _, entry := range entries {
+			if entry.ArchivedKey == key {
+				return entry.Key, nil
+			}
+		}
+	}
+
+	object, err := s3Svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(objects.DiagnosticsKey(key)),
+	})
+	if objects.IsNotFound(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer object.Body.Close()
+
+	content, err := io.ReadAll(object.Body)
+	if err != nil {
+		return "", err
+	}
+	diagnostics := struct {
+		SourceKey string `json:"sourceKey"`
+	}{}
+	if err := json.Unmarshal(content, &diagnostics); err != nil {
+		return "", err
+	}
+	return diagnostics.SourceKey, nil
+}
+
+func main() {
+	lambda.Start(HandleInfoEvent)
+}
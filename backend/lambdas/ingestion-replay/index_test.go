@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"encoding/base64"
+	"io"
+	"net/url"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"go-cdk-workshop/internal/ledger"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// fakeObject is a file of the fake bucket.
+type fakeObject struct {
+	content string
+	tags    map[string]string
+}
+
+// fakeBucket holds the files of the data bucket, listed in a single page.
+type fakeBucket struct {
+	s3iface.S3API
+	objects map[string]*fakeObject
+}
+
+func (b *fakeBucket) object(key *string) (*fakeObject, error) {
+	object, ok := b.objects[aws.StringValue(key)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	return object, nil
+}
+
+func (b *fakeBucket) ListObjectsV2WithContext(ctx aws.Context, input *s3.ListObjectsV2Input, options ...request.Option) (*s3.ListObjectsV2Output, error) {
+	keys := []string{}
+	for key := range b.objects {
+		if strings.HasPrefix(key, aws.StringValue(input.Prefix)) && key > aws.StringValue(input.StartAfter) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	output := &s3.ListObjectsV2Output{IsTruncated: aws.Bool(false)}
+	for _, key := range keys {
+		output.Contents = append(output.Contents, &s3.Object{
+			Key:          aws.String(key),
+			LastModified: aws.Time(time.Date(2026, 10, 18, 9, 30, 0, 0, time.UTC)),
+		})
+	}
+	return output, nil
+}
+
+func (b *fakeBucket) HeadObjectWithContext(ctx aws.Context, input *s3.HeadObjectInput, options ...request.Option) (*s3.HeadObjectOutput, error) {
+	object, err := b.object(input.Key)
+	if err != nil {
+		return nil, awserr.New("NotFound", "Not Found", nil)
+	}
+	return &s3.HeadObjectOutput{ContentLength: aws.Int64(int64(len(object.content)))}, nil
+}
+
+func (b *fakeBucket) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, options ...request.Option) (*s3.GetObjectOutput, error) {
+	object, err := b.object(input.Key)
+	if err != nil {
+		return nil, err
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(object.content))}, nil
+}
+
+func (b *fakeBucket) GetObjectTaggingWithContext(ctx aws.Context, input *s3.GetObjectTaggingInput, options ...request.Option) (*s3.GetObjectTaggingOutput, error) {
+	object, err := b.object(input.Key)
+	if err != nil {
+		return nil, err
+	}
+	output := &s3.GetObjectTaggingOutput{}
+	for key, value := range object.tags {
+		output.TagSet = append(output.TagSet, &s3.Tag{Key: aws.String(key), Value: aws.String(value)})
+	}
+	return output, nil
+}
+
+func (b *fakeBucket) PutObjectTaggingWithContext(ctx aws.Context, input *s3.PutObjectTaggingInput, options ...request.Option) (*s3.PutObjectTaggingOutput, error) {
+	object, err := b.object(input.Key)
+	if err != nil {
+		return nil, err
+	}
+	object.tags = map[string]string{}
+	for _, tag := range input.Tagging.TagSet {
+		object.tags[aws.StringValue(tag.Key)] = aws.StringValue(tag.Value)
+	}
+	return &s3.PutObjectTaggingOutput{}, nil
+}
+
+func (b *fakeBucket) CopyObjectWithContext(ctx aws.Context, input *s3.CopyObjectInput, options ...request.Option) (*s3.CopyObjectOutput, error) {
+	source, err := url.PathUnescape(aws.StringValue(input.CopySource))
+	if err != nil {
+		return nil, err
+	}
+	object, err := b.object(aws.String(strings.TrimPrefix(source, aws.StringValue(input.Bucket)+"/")))
+	if err != nil {
+		return nil, err
+	}
+	tags, err := url.ParseQuery(aws.StringValue(input.Tagging))
+	if err != nil {
+		return nil, err
+	}
+	copied := &fakeObject{content: object.content, tags: map[string]string{}}
+	for key := range tags {
+		copied.tags[key] = tags.Get(key)
+	}
+	b.objects[aws.StringValue(input.Key)] = copied
+	return &s3.CopyObjectOutput{CopyObjectResult: &s3.CopyObjectResult{}}, nil
+}
+
+// fakeLedger is a file ledger table returning the entries of a job run.
+type fakeLedger struct {
+	dynamodbiface.DynamoDBAPI
+	entries []ledger.Entry
+	queries int
+}
+
+func (f *fakeLedger) QueryPagesWithContext(ctx aws.Context, input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool, options ...request.Option) error {
+	f.queries++
+	page := &dynamodb.QueryOutput{}
+	for _, entry := range f.entries {
+		if entry.JobRunID != aws.StringValue(input.ExpressionAttributeValues[":run"].S) {
+			continue
+		}
+		item, err := dynamodbattribute.MarshalMap(entry)
+		if err != nil {
+			return err
+		}
+		page.Items = append(page.Items, item)
+	}
+	fn(page, true)
+	return nil
+}
+
+func TestParseRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		event   events.APIGatewayV2HTTPRequest
+		want    Request
+		wantErr bool
+	}{
+		{
+			name:  "empty body",
+			event: events.APIGatewayV2HTTPRequest{},
+			want:  Request{Prefix: defaultPrefix, Limit: defaultLimit, ReplayID: "7d41fadc86da821f"},
+		},
+		{
+			name:  "selection",
+			event: events.APIGatewayV2HTTPRequest{Body: `{"prefix": "failed/", "pattern": "failed/*.csv", "limit": 10, "replayId": "replay 1/2"}`},
+			want:  Request{Prefix: "failed/", Pattern: "failed/*.csv", Limit: 10, ReplayID: "replay 1/2"},
+		},
+		{
+			name:  "base64 body",
+			event: events.APIGatewayV2HTTPRequest{Body: base64.StdEncoding.EncodeToString([]byte(`{"dryRun": true, "replayId": "r1"}`)), IsBase64Encoded: true},
+			want:  Request{Prefix: defaultPrefix, DryRun: true, Limit: defaultLimit, ReplayID: "r1"},
+		},
+		{
+			name:  "limit over the maximum",
+			event: events.APIGatewayV2HTTPRequest{Body: `{"limit": 1000, "replayId": "r1"}`},
+			want:  Request{Prefix: defaultPrefix, Limit: defaultLimit, ReplayID: "r1"},
+		},
+		{
+			name:  "replay id with characters tags do not allow",
+			event: events.APIGatewayV2HTTPRequest{Body: `{"replayId": "replay #1"}`},
+			want:  Request{Prefix: defaultPrefix, Limit: defaultLimit, ReplayID: "replay  1"},
+		},
+		{
+			name:    "invalid JSON",
+			event:   events.APIGatewayV2HTTPRequest{Body: `{"prefix": `},
+			wantErr: true,
+		},
+		{
+			name:    "invalid pattern",
+			event:   events.APIGatewayV2HTTPRequest{Body: `{"pattern": "archive/[a-"}`},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseRequest(test.event)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseRequest() error = %v, want error %v", err, test.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseRequest() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseRequestReplayID(t *testing.T) {
+	august, _ := parseRequest(events.APIGatewayV2HTTPRequest{Body: `{"from": "2026-08-01", "to": "2026-08-31"}`})
+	again, _ := parseRequest(events.APIGatewayV2HTTPRequest{Body: `{"to": "2026-08-31", "from": "2026-08-01", "limit": 10}`})
+	september, _ := parseRequest(events.APIGatewayV2HTTPRequest{Body: `{"from": "2026-09-01", "to": "2026-09-30"}`})
+
+	if len(august.ReplayID) != 16 {
+		t.Errorf("parseRequest() replay id = %q, want 16 characters", august.ReplayID)
+	}
+	if august.ReplayID != again.ReplayID {
+		t.Errorf("parseRequest() replay ids = %q and %q for the same selection", august.ReplayID, again.ReplayID)
+	}
+	if august.ReplayID == september.ReplayID {
+		t.Errorf("parseRequest() replay id = %q for two selections", august.ReplayID)
+	}
+}
+
+func TestDateRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		from     string
+		to       string
+		wantFrom time.Time
+		wantTo   time.Time
+		wantErr  bool
+	}{
+		{
+			name: "open range",
+		},
+		{
+			name:     "days",
+			from:     "2026-10-01",
+			to:       "2026-10-18",
+			wantFrom: time.Date(2026, 10, 1, 0, 0, 0, 0, time.UTC),
+			wantTo:   time.Date(2026, 10, 18, 23, 59, 59, 999999999, time.UTC),
+		},
+		{
+			name:     "times",
+			from:     "2026-10-18T09:00:00Z",
+			to:       "2026-10-18T10:00:00Z",
+			wantFrom: time.Date(2026, 10, 18, 9, 0, 0, 0, time.UTC),
+			wantTo:   time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC),
+		},
+		{
+			name:    "invalid from",
+			from:    "18/10/2026",
+			wantErr: true,
+		},
+		{
+			name:    "invalid to",
+			to:      "2026-10-32",
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			from, to, err := dateRange(test.from, test.to)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("dateRange() error = %v, want error %v", err, test.wantErr)
+			}
+			if !from.Equal(test.wantFrom) || !to.Equal(test.wantTo) {
+				t.Errorf("dateRange() = %v, %v, want %v, %v", from, to, test.wantFrom, test.wantTo)
+			}
+		})
+	}
+}
+
+func TestSelected(t *testing.T) {
+	modified := time.Date(2026, 10, 18, 9, 30, 0, 0, time.UTC)
+	day := time.Date(2026, 10, 18, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name    string
+		request Request
+		key     string
+		from    time.Time
+		to      time.Time
+		want    bool
+	}{
+		{name: "any file", key: "archive/input/august.csv", want: true},
+		{name: "folder", key: "archive/input/"},
+		{name: "diagnostics", key: "failed/input/august.csv.error.json"},
+		{name: "matching pattern", request: Request{Pattern: "archive/*/august.csv"}, key: "archive/input/august.csv", want: true},
+		{name: "pattern of another folder", request: Request{Pattern: "archive/*.csv"}, key: "archive/input/august.csv"},
+		{name: "modified within the range", key: "archive/input/august.csv", from: day, to: day.Add(24 * time.Hour), want: true},
+		{name: "modified before the range", key: "archive/input/august.csv", from: day.Add(12 * time.Hour)},
+		{name: "modified after the range", key: "archive/input/august.csv", to: day.Add(time.Hour)},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := selected(test.request, test.key, modified, test.from, test.to); got != test.want {
+				t.Errorf("selected(%q) = %v, want %v", test.key, got, test.want)
+			}
+		})
+	}
+}
+
+func TestReplay(t *testing.T) {
+	t.Setenv("BUCKET_NAME", "bucket")
+	t.Setenv("LEDGER_TABLE", "ledger")
+
+	// Returns the files of the bucket: an archived file found through the
+	// ledger, a failed file found through its diagnostics, and files that
+	// are skipped.
+	bucket := func() *fakeBucket {
+		return &fakeBucket{objects: map[string]*fakeObject{
+			"archive/input/august.csv":                     {content: "a,b\n", tags: map[string]string{jobRunTag: "jr_1", "ingestion-rule": "default"}},
+			"archive/input/september.csv":                  {content: "a,b\n", tags: map[string]string{jobRunTag: "jr_1"}},
+			"archive/input/october.csv":                    {content: "a,b\n", tags: map[string]string{replayTag: "r1"}},
+			"archive/input/november.csv":                   {content: "a,b\n"},
+			"archive/failed/input/december.csv":            {content: "a,b\n"},
+			"archive/failed/input/december.csv.error.json": {content: `{"sourceKey": "input/december.csv"}`},
+			"input/september.csv":                          {content: "a,b,c\n"},
+		}}
+	}
+	entries := []ledger.Entry{
+		{Key: "input/august.csv", JobRunID: "jr_1", ArchivedKey: "archive/input/august.csv"},
+		{Key: "input/september.csv", JobRunID: "jr_1", ArchivedKey: "archive/input/september.csv"},
+	}
+
+	tests := []struct {
+		name          string
+		request       Request
+		want          []FileResult
+		wantNextToken string
+		wantCopies    []string
+	}{
+		{
+			name:    "every file",
+			request: Request{Prefix: "archive/", Limit: 50, ReplayID: "r1"},
+			want: []FileResult{
+				{Key: "archive/failed/input/december.csv", SourceKey: "input/december.csv", Status: StatusReplayed},
+				{Key: "archive/input/august.csv", SourceKey: "input/august.csv", Status: StatusReplayed},
+				{Key: "archive/input/november.csv", Status: StatusSkipped, Message: "the key the file was uploaded to is not known"},
+				{Key: "archive/input/october.csv", Status: StatusSkipped, Message: "the file was already replayed"},
+				{Key: "archive/input/september.csv", SourceKey: "input/september.csv", Status: StatusSkipped, Message: "a file is waiting to be loaded under the source key"},
+			},
+			wantCopies: []string{"input/august.csv", "input/december.csv"},
+		},
+		{
+			name:    "dry run",
+			request: Request{Prefix: "archive/input/", Pattern: "archive/input/a*", Limit: 50, ReplayID: "r1", DryRun: true},
+			want: []FileResult{
+				{Key: "archive/input/august.csv", SourceKey: "input/august.csv", Status: StatusReplayed},
+			},
+		},
+		{
+			name:    "limit reached",
+			request: Request{Prefix: "archive/", Limit: 1, ReplayID: "r1"},
+			want: []FileResult{
+				{Key: "archive/failed/input/december.csv", SourceKey: "input/december.csv", Status: StatusReplayed},
+			},
+			wantNextToken: "archive/failed/input/december.csv",
+			wantCopies:    []string{"input/december.csv"},
+		},
+		{
+			name:    "next request",
+			request: Request{Prefix: "archive/", Pattern: "archive/*/*", Limit: 1, ReplayID: "r1", NextToken: "archive/failed/input/december.csv"},
+			want: []FileResult{
+				{Key: "archive/input/august.csv", SourceKey: "input/august.csv", Status: StatusReplayed},
+			},
+			wantNextToken: "archive/input/august.csv",
+			wantCopies:    []string{"input/august.csv"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			s3Svc := bucket()
+			dynamoSvc := &fakeLedger{entries: entries}
+			got, err := replay(context.Background(), s3Svc, dynamoSvc, test.request, time.Time{}, time.Time{})
+			if err != nil {
+				t.Fatalf("replay() error = %v", err)
+			}
+			if !reflect.DeepEqual(got.Files, test.want) {
+				t.Errorf("replay() files = %+v, want %+v", got.Files, test.want)
+			}
+			if got.NextToken != test.wantNextToken {
+				t.Errorf("replay() next token = %q, want %q", got.NextToken, test.wantNextToken)
+			}
+			if dynamoSvc.queries > 1 {
+				t.Errorf("replay() read the entries of the job run %d times, want once", dynamoSvc.queries)
+			}
+
+			for _, key := range test.wantCopies {
+				copied, ok := s3Svc.objects[key]
+				if !ok {
+					t.Errorf("replay() did not copy %s", key)
+					continue
+				}
+				if copied.tags[replayTag] != "r1" || copied.tags[jobRunTag] != "" {
+					t.Errorf("replay() tagged the copy %s with %v", key, copied.tags)
+				}
+			}
+			for _, result := range got.Files {
+				replayed := s3Svc.objects[result.Key].tags[replayTag] == "r1"
+				if want := result.Status == StatusReplayed && !test.request.DryRun || result.Message == "the file was already replayed"; replayed != want {
+					t.Errorf("replay() tagged %s as replayed: %v, want %v", result.Key, replayed, want)
+				}
+			}
+		})
+	}
+}
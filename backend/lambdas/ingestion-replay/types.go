@@ -0,0 +1,58 @@
+package main
+
+// Request selects the archived or failed files to replay.
+type Request struct {
+	// The folder the files are listed from, e.g. archive/2026/10/. Defaults
+	// to archive/.
+	Prefix string `json:"prefix"`
+
+	// A pattern the keys of the files must match, e.g.
+	// archive/*/*/*/*/bank_*.csv, where * does not match the / of sub folders.
+	Pattern string `json:"pattern"`
+
+	// The days the files were archived or failed on, as 2006-01-02 or
+	// RFC 3339 times, both included.
+	From string `json:"from"`
+	To   string `json:"to"`
+
+	// Only reports the files that would be replayed.
+	DryRun bool `json:"dryRun"`
+
+	// The id of the replay, a file is only replayed once per id. Defaults to
+	// an id derived from the selection, so a request sent twice replays the
+	// files once.
+	ReplayID string `json:"replayId"`
+
+	// The number of files replayed per request, and where the previous
+	// request stopped.
+	Limit     int    `json:"limit"`
+	NextToken string `json:"nextToken"`
+}
+
+// Response lists the files of the selection, and where to carry on from
+// when there are more.
+type Response struct {
+	DryRun    bool         `json:"dryRun"`
+	ReplayID  string       `json:"replayId"`
+	Files     []FileResult `json:"files"`
+	NextToken string       `json:"nextToken,omitempty"`
+}
+
+// The outcomes of the files of a replay.
+const (
+	StatusReplayed = "REPLAYED"
+	StatusSkipped  = "SKIPPED"
+	StatusFailed   = "FAILED"
+)
+
+// FileResult is the outcome of a file of the selection.
+type FileResult struct {
+	Key       string `json:"key"`
+	SourceKey string `json:"sourceKey,omitempty"`
+	Status    string `json:"status"`
+	Message   string `json:"message,omitempty"`
+}
+
+type Body struct {
+	Message string `json:"message"`
+}
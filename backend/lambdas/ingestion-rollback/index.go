@@ -0,0 +1,361 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"go-cdk-workshop/internal/ledger"
+	"go-cdk-workshop/internal/logging"
+	"go-cdk-workshop/internal/objects"
+
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// The index of the loaded items by their file and job run.
+	sourceIndex = "sourceKey-jobRunId-index"
+
+	// The number of items per BatchWriteItem call, the maximum DynamoDB allows.
+	batchWriteSize = 25
+
+	// Stop removing items when less than this is left before the lambda times
+	// out, so the progress can still be recorded.
+	deadlineMargin = 30 * time.Second
+)
+
+// Event handler, rolls back the files loaded by a bad job run: it removes the
+// items they wrote and moves them back to the failed folder.
+func HandleInfoEvent(ctx context.Context, request Request) (Response, error) {
+	// Log the event
+	logging.Start(ctx)
+	logging.Set(logging.JobRunID, request.JobRunID)
+	logging.Set(logging.Key, request.Key)
+	logging.Debug("Received event", "event", request)
+
+	if request.Key == "" && request.JobRunID == "" {
+		return Response{}, fmt.Errorf("a key or a jobRunId is required")
+	}
+
+	// Create a new DynamoDB and S3 client to interact with AWS
+	logging.Debug("Creating a new DynamoDB and S3 client")
+	mySession := session.Must(session.NewSession())
+	dynamoSvc := dynamodb.New(mySession)
+	s3Svc := s3.New(mySession)
+
+	// Find the files to roll back in the ledger.
+	entries, err := findEntries(ctx, dynamoSvc, request)
+	if err != nil {
+		logging.Error("Error reading the ledger", err)
+		return Response{}, err
+	}
+	if len(entries) == 0 {
+		return Response{}, fmt.Errorf("no file loaded by the job run %q with the key %q in the ledger", request.JobRunID, request.Key)
+	}
+
+	response := Response{DryRun: request.DryRun, Complete: true, Files: []FileResult{}}
+	for _, entry := range entries {
+		logging.Set(logging.JobRunID, entry.JobRunID)
+		logging.Set(logging.Key, entry.Key)
+		result, complete, err := rollback(ctx, dynamoSvc, s3Svc, entry, request)
+		response.Files = append(response.Files, result)
+		if err != nil {
+			logging.Error("Error rolling back the file", err)
+			return response, err
+		}
+		if !complete {
+			logging.Info("No time left to roll back the other files, invoke the lambda again")
+			response.Complete = false
+			break
+		}
+	}
+
+	return response, nil
+}
+
+// Returns the ledger entries of the file, of the job run, or of the file of
+// the job run.
+func findEntries(ctx context.Context, dynamoSvc dynamodbiface.DynamoDBAPI, request Request) ([]*ledger.Entry, error) {
+	table := os.Getenv("LEDGER_TABLE")
+	switch {
+	case request.Key != "" && request.JobRunID != "":
+		entry, err := ledger.Get(ctx, dynamoSvc, table, request.Key, request.JobRunID)
+		if err != nil || entry == nil {
+			return nil, err
+		}
+		return []*ledger.Entry{entry}, nil
+	case request.Key != "":
+		return ledger.List(ctx, dynamoSvc, table, request.Key)
+	default:
+		return ledger.ListRun(ctx, dynamoSvc, table, request.JobRunID)
+	}
+}
+
+// Rolls back a file loaded by a job run: removes its items, then moves it
+// back to the failed folder and records the rollback in the ledger. It
+// reports whether it finished before the lambda ran out of time, the items
+// left are removed by the next invocation.
+func rollback(ctx context.Context, dynamoSvc *dynamodb.DynamoDB, s3Svc *s3.S3, entry *ledger.Entry, request Request) (FileResult, bool, error) {
+	result := FileResult{Key: entry.Key, JobRunID: entry.JobRunID, Table: entry.Table, ArchivedKey: entry.ArchivedKey}
+	if entry.Table == "" {
+		return result, true, fmt.Errorf("the ledger does not record the table of %s", entry.Key)
+	}
+
+	// Remove the items, or count them in a dry run.
+	logging.Info("Removing the items of the file", "table", entry.Table)
+	items, complete, err := removeItems(ctx, dynamoSvc, entry, request)
+	result.Items = items
+	if err != nil || !complete {
+		if !request.DryRun && items > 0 {
+			recordProgress(ctx, dynamoSvc, entry, items)
+		}
+		return result, complete, err
+	}
+
+	// The file is only moved back when it was archived, a file that did not
+	// reconcile is in the failed folder already.
+	result.FailedKey = failedKey(entry.ArchivedKey)
+	switch {
+	case entry.ArchivedKey == "":
+		result.Message = "the ledger does not record where the file was archived"
+	case result.FailedKey == "":
+		result.Message = "the file is not in the archive folder"
+	}
+	if request.DryRun {
+		return result, true, nil
+	}
+	if result.FailedKey != "" {
+		result.FailedKey, err = moveToFailed(ctx, s3Svc, entry, result, request)
+		if err != nil {
+			return result, true, err
+		}
+	}
+
+	// Record the rollback, the entry now points to the failed file.
+	now := time.Now().UTC()
+	entry.Status = ledger.StatusRolledBack
+	entry.RolledBackAt = &now
+	entry.RolledBackItems += items
+	if result.FailedKey != "" {
+		entry.ArchivedKey = result.FailedKey
+	}
+	if err := ledger.Put(ctx, dynamoSvc, os.Getenv("LEDGER_TABLE"), entry); err != nil {
+		logging.Error("Error recording the rollback in the ledger", err)
+		return result, true, err
+	}
+
+	logging.Info("Rolled back the file", "result", result)
+	return result, true, nil
+}
+
+// Deletes or soft-deletes the items the job run wrote for the file, found by
+// the index of their file and job run, and returns how many. The items are
+// only counted in a dry run.
+func removeItems(ctx context.Context, dynamoSvc *dynamodb.DynamoDB, entry *ledger.Entry, request Request) (int64, bool, error) {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(entry.Table),
+		IndexName:              aws.String(sourceIndex),
+		KeyConditionExpression: aws.String("#run = :run AND #key = :key"),
+		ProjectionExpression:   aws.String("#id, #accountNumber"),
+		ExpressionAttributeNames: map[string]*string{
+			"#run":           aws.String("jobRunId"),
+			"#key":           aws.String("sourceKey"),
+			"#id":            aws.String("id"),
+			"#accountNumber": aws.String("accountNumber"),
+		},
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":run": {S: aws.String(entry.JobRunID)},
+			":key": {S: aws.String(entry.Key)},
+		},
+	}
+	// The items soft-deleted by a previous attempt are skipped.
+	if request.SoftDelete {
+		input.FilterExpression = aws.String("attribute_not_exists(#deletedAt)")
+		input.ExpressionAttributeNames["#deletedAt"] = aws.String("deletedAt")
+	}
+
+	removed := int64(0)
+	for {
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < deadlineMargin {
+			return removed, false, nil
+		}
+
+		page, err := dynamoSvc.QueryWithContext(ctx, input)
+		if err != nil {
+			return removed, true, err
+		}
+
+		switch {
+		case request.DryRun:
+		case request.SoftDelete:
+			err = softDelete(ctx, dynamoSvc, entry.Table, page.Items)
+		default:
+			err = deleteItems(ctx, dynamoSvc, entry.Table, page.Items)
+		}
+		if err != nil {
+			return removed, true, err
+		}
+		removed += int64(len(page.Items))
+
+		if page.LastEvaluatedKey == nil {
+			return removed, true, nil
+		}
+		input.ExclusiveStartKey = page.LastEvaluatedKey
+	}
+}
+
+// Deletes the items by their keys, in batches. The items DynamoDB did not
+// process are sent again after a short wait.
+func deleteItems(ctx context.Context, dynamoSvc *dynamodb.DynamoDB, table string, keys []map[string]*dynamodb.AttributeValue) error {
+	for start := 0; start < len(keys); start += batchWriteSize {
+		end := start + batchWriteSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+
+		requests := []*dynamodb.WriteRequest{}
+		for _, key := range keys[start:end] {
+			requests = append(requests, &dynamodb.WriteRequest{DeleteRequest: &dynamodb.DeleteRequest{Key: key}})
+		}
+		for attempt := 0; len(requests) > 0; attempt++ {
+			if attempt == 5 {
+				return fmt.Errorf("%d items could not be deleted", len(requests))
+			}
+			time.Sleep(time.Duration(attempt) * 200 * time.Millisecond)
+
+			output, err := dynamoSvc.BatchWriteItemWithContext(ctx, &dynamodb.BatchWriteItemInput{
+				RequestItems: map[string][]*dynamodb.WriteRequest{table: requests},
+			})
+			if err != nil {
+				return err
+			}
+			requests = output.UnprocessedItems[table]
+		}
+	}
+	return nil
+}
+
+// Marks the items as deleted, keeping them in the table. An item deleted in
+// the meantime is not recreated.
+func softDelete(ctx context.Context, dynamoSvc *dynamodb.DynamoDB, table string, keys []map[string]*dynamodb.AttributeValue) error {
+	now := time.Now().UTC().Format(time.RFC3339)
+	for _, key := range keys {
+		_, err := dynamoSvc.UpdateItemWithContext(ctx, &dynamodb.UpdateItemInput{
+			TableName:                aws.String(table),
+			Key:                      key,
+			UpdateExpression:         aws.String("SET #deletedAt = :deletedAt"),
+			ConditionExpression:      aws.String("attribute_exists(#id)"),
+			ExpressionAttributeNames: map[string]*string{"#deletedAt": aws.String("deletedAt"), "#id": aws.String("id")},
+			ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+				":deletedAt": {S: aws.String(now)},
+			},
+		})
+		var awsErr awserr.Error
+		if errors.As(err, &awsErr) && awsErr.Code() == dynamodb.ErrCodeConditionalCheckFailedException {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Records the items removed so far, when the lambda ran out of time before
+// the file could be moved. A failure is only logged, the next invocation
+// records the rollback as a whole.
+func recordProgress(ctx context.Context, dynamoSvc *dynamodb.DynamoDB, entry *ledger.Entry, items int64) {
+	entry.RolledBackItems += items
+	if err := ledger.Put(ctx, dynamoSvc, os.Getenv("LEDGER_TABLE"), entry); err != nil {
+		logging.Error("Error recording the progress of the rollback", err)
+	}
+}
+
+// Returns the key of the failed folder matching an archived key, the archive
+// folder laid out by the key template swapped for the failed one. It returns
+// an empty key when the file is not in the archive folder.
+func failedKey(archivedKey string) string {
+	segments := strings.Split(archivedKey, "/")
+	for i, segment := range segments {
+		if segment == "archive" {
+			segments[i] = "failed"
+			return strings.Join(segments, "/")
+		}
+	}
+	return ""
+}
+
+// Moves the archived file back to the failed folder with a report of the
+// rollback next to it, and returns the key it was moved to. A file already
+// moved by a previous attempt is left where it is.
+func moveToFailed(ctx context.Context, s3Svc *s3.S3, entry *ledger.Entry, result FileResult, request Request) (string, error) {
+	source, err := s3Svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(entry.Bucket),
+		Key:    aws.String(entry.ArchivedKey),
+	})
+	if objects.IsNotFound(err) {
+		logging.Info("The file was already moved", "archivedKey", entry.ArchivedKey)
+		return result.FailedKey, nil
+	}
+	if err != nil {
+		return "", err
+	}
+
+	// Make sure the new key does not overwrite another file.
+	newKey, err := objects.AvailableKey(ctx, s3Svc, entry.Bucket, result.FailedKey, source)
+	if err != nil {
+		logging.Error("Error finding a free key for the file", err)
+		return "", err
+	}
+	result.FailedKey = newKey
+
+	// Write the report next to the failed file first, so a failed file never
+	// ends up without it.
+	body, err := json.MarshalIndent(map[string]interface{}{
+		"reason":     "ROLLED_BACK",
+		"softDelete": request.SoftDelete,
+		"rollback":   result,
+		"ledger":     entry,
+	}, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	_, err = s3Svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+		Bucket:      aws.String(entry.Bucket),
+		Key:         aws.String(objects.DiagnosticsKey(newKey)),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		logging.Error("Error writing the rollback report", err)
+		return "", err
+	}
+
+	logging.Info("Moving the file back to the failed folder", "archivedKey", entry.ArchivedKey)
+	_, err = objects.Move(ctx, s3Svc, objects.MoveInput{
+		Bucket:         entry.Bucket,
+		SourceKey:      entry.ArchivedKey,
+		DestinationKey: newKey,
+		Tags:           map[string]string{"rolled-back": "true"},
+	})
+	if err != nil {
+		logging.Error("Error moving the file back to the failed folder", err)
+		return "", err
+	}
+	return newKey, nil
+}
+
+func main() {
+	lambda.Start(HandleInfoEvent)
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"go-cdk-workshop/internal/ledger"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// fakeLedger is a file ledger table holding the entries, found by their key
+// and job run, by their key, or by their job run.
+type fakeLedger struct {
+	dynamodbiface.DynamoDBAPI
+	entries []ledger.Entry
+}
+
+func (f *fakeLedger) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, options ...request.Option) (*dynamodb.GetItemOutput, error) {
+	for _, entry := range f.entries {
+		if entry.Key == aws.StringValue(input.Key["key"].S) && entry.JobRunID == aws.StringValue(input.Key["jobRunId"].S) {
+			item, err := dynamodbattribute.MarshalMap(entry)
+			return &dynamodb.GetItemOutput{Item: item}, err
+		}
+	}
+	return &dynamodb.GetItemOutput{}, nil
+}
+
+func (f *fakeLedger) QueryPagesWithContext(ctx aws.Context, input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool, options ...request.Option) error {
+	page := &dynamodb.QueryOutput{}
+	for _, entry := range f.entries {
+		if value, ok := input.ExpressionAttributeValues[":key"]; ok && entry.Key != aws.StringValue(value.S) {
+			continue
+		}
+		if value, ok := input.ExpressionAttributeValues[":run"]; ok && entry.JobRunID != aws.StringValue(value.S) {
+			continue
+		}
+		item, err := dynamodbattribute.MarshalMap(entry)
+		if err != nil {
+			return err
+		}
+		page.Items = append(page.Items, item)
+	}
+	fn(page, true)
+	return nil
+}
+
+func TestFindEntries(t *testing.T) {
+	t.Setenv("LEDGER_TABLE", "ledger")
+	client := &fakeLedger{entries: []ledger.Entry{
+		{Key: "input/august.csv", JobRunID: "jr_1"},
+		{Key: "input/september.csv", JobRunID: "jr_1"},
+		{Key: "input/august.csv", JobRunID: "jr_2"},
+	}}
+
+	tests := []struct {
+		name    string
+		request Request
+		want    []string
+	}{
+		{
+			name:    "file of a job run",
+			request: Request{Key: "input/august.csv", JobRunID: "jr_2"},
+			want:    []string{"input/august.csv jr_2"},
+		},
+		{
+			name:    "file not loaded by the job run",
+			request: Request{Key: "input/september.csv", JobRunID: "jr_2"},
+			want:    []string{},
+		},
+		{
+			name:    "every load of a file",
+			request: Request{Key: "input/august.csv"},
+			want:    []string{"input/august.csv jr_1", "input/august.csv jr_2"},
+		},
+		{
+			name:    "every file of a job run",
+			request: Request{JobRunID: "jr_1"},
+			want:    []string{"input/august.csv jr_1", "input/september.csv jr_1"},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			entries, err := findEntries(context.Background(), client, test.request)
+			if err != nil {
+				t.Fatalf("findEntries() error = %v", err)
+			}
+			got := []string{}
+			for _, entry := range entries {
+				got = append(got, entry.Key+" "+entry.JobRunID)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("findEntries() = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestFailedKey(t *testing.T) {
+	tests := []struct {
+		archivedKey string
+		want        string
+	}{
+		{archivedKey: "archive/input/august.csv", want: "failed/input/august.csv"},
+		{archivedKey: "archive/2026/10/18/input/august.csv", want: "failed/2026/10/18/input/august.csv"},
+		{archivedKey: "bank/archive/input/august.csv", want: "bank/failed/input/august.csv"},
+		{archivedKey: "archive/input/archive/august.csv", want: "failed/input/archive/august.csv"},
+		{archivedKey: "archived/input/august.csv", want: ""},
+		{archivedKey: "failed/input/august.csv", want: ""},
+		{archivedKey: "", want: ""},
+	}
+	for _, test := range tests {
+		t.Run(test.archivedKey, func(t *testing.T) {
+			if got := failedKey(test.archivedKey); got != test.want {
+				t.Errorf("failedKey(%q) = %q, want %q", test.archivedKey, got, test.want)
+			}
+		})
+	}
+}
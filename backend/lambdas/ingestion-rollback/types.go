@@ -0,0 +1,45 @@
+package main
+
+// The request the lambda is invoked with, it names a file, a job run, or a
+// file of a job run.
+type Request struct {
+	// The key the file was uploaded to, e.g. input/bank_data.csv.
+	Key string `json:"key"`
+
+	// The id of the job run that loaded the files.
+	JobRunID string `json:"jobRunId"`
+
+	// Report what would be removed and moved, without changing anything.
+	DryRun bool `json:"dryRun"`
+
+	// Mark the items as deleted with a deletedAt attribute instead of
+	// deleting them, the API no longer returns them.
+	SoftDelete bool `json:"softDelete"`
+}
+
+type Response struct {
+	DryRun bool `json:"dryRun"`
+
+	// Whether every file was rolled back, the lambda is invoked again with
+	// the same request when it ran out of time.
+	Complete bool `json:"complete"`
+
+	Files []FileResult `json:"files"`
+}
+
+// FileResult describes the rollback of a file loaded by a job run.
+type FileResult struct {
+	Key      string `json:"key"`
+	JobRunID string `json:"jobRunId"`
+	Table    string `json:"table"`
+
+	// The items removed, or that would be removed in a dry run.
+	Items int64 `json:"items"`
+
+	// Where the file was archived, and where it is moved back to.
+	ArchivedKey string `json:"archivedKey,omitempty"`
+	FailedKey   string `json:"failedKey,omitempty"`
+
+	// Why the file was not moved, if it was not.
+	Message string `json:"message,omitempty"`
+}
@@ -0,0 +1,129 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+
+	"encoding/json"
+
+	"go-cdk-workshop/internal/ingestions"
+	"go-cdk-workshop/internal/logging"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+const (
+	maxPageSize = 100
+)
+
+// Event handler, this function returns the state of an ingestion or upload
+// given by the id path parameter, or lists the ingestions of a day.
+func HandleInfoEvent(ctx context.Context, request events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	ApiResponse := events.APIGatewayV2HTTPResponse{
+		Headers: map[string]string{
+			"Content-Type": "application/json",
+		},
+	}
+
+	logging.StartRequest(ctx, request)
+	logging.Debug("Received event", "event", request)
+
+	// Create a new DynamoDB client
+	logging.Debug("Creating a new DynamoDB client")
+	mySession := session.Must(session.NewSession())
+	svc := dynamodb.New(mySession)
+
+	var body interface{}
+	var err error
+	if id := request.PathParameters["id"]; id != "" {
+		var ingestion *ingestions.Ingestion
+		ingestion, err = ingestions.Get(ctx, svc, os.Getenv("TABLE_NAME"), id)
+		// The id of an upload returns the ingestion of its file once queued.
+		if err == nil && ingestion != nil && ingestion.IngestionID != "" {
+			var linked *ingestions.Ingestion
+			linked, err = ingestions.Get(ctx, svc, os.Getenv("TABLE_NAME"), ingestion.IngestionID)
+			if linked != nil {
+				ingestion = linked
+			}
+		}
+		if err == nil && ingestion == nil {
+			ApiResponse.StatusCode = 404
+			body, _ := json.Marshal(&Body{Message: fmt.Sprintf("Error: ingestion %s not found", id)})
+			ApiResponse.Body = string(body)
+			return ApiResponse, nil
+		}
+		if err == nil {
+			body = newIngestion(ingestion)
+		}
+	} else {
+		body, err = listIngestions(ctx, svc, request)
+	}
+
+	if err != nil {
+		logging.Error("Error querying DynamoDB", err)
+		ApiResponse.Body = fmt.Sprintf("Error querying DynamoDB: %s", err)
+		ApiResponse.StatusCode = 500
+		return ApiResponse, nil
+	}
+
+	// Return the response to the client
+	json, _ := json.Marshal(body)
+	ApiResponse.Body = string(json)
+	ApiResponse.StatusCode = 200
+	return ApiResponse, nil
+}
+
+// Returns a page of the ingestions of the day given by the date query
+// parameter, today by default, the latest first. The state and key
+// parameters only keep the ingestions in that state, or loading that file.
+func listIngestions(ctx context.Context, svc *dynamodb.DynamoDB, request events.APIGatewayV2HTTPRequest) (interface{}, error) {
+	day := request.QueryStringParameters["date"]
+	if day == "" {
+		day = time.Now().UTC().Format("2006-01-02")
+	}
+
+	// Set default page size
+	pageSize, _ := strconv.ParseInt(request.QueryStringParameters["pageSize"], 10, 64)
+	if pageSize <= 0 || pageSize > maxPageSize {
+		pageSize = maxPageSize
+	}
+
+	page, lastEvaluatedKey, err := ingestions.List(ctx, svc, os.Getenv("TABLE_NAME"), ingestions.ListInput{
+		Day:               day,
+		State:             request.QueryStringParameters["state"],
+		Key:               request.QueryStringParameters["key"],
+		Limit:             pageSize,
+		ExclusiveStartKey: parseBase64String(request.QueryStringParameters["paginationToken"]),
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	items := []Ingestion{}
+	for _, ingestion := range page {
+		items = append(items, newIngestion(ingestion))
+	}
+
+	// Converts the lastKeyEvaluated into a base64 encoded string
+	// This is used for pagination
+	paginationToken := ""
+	if lastEvaluatedKey != nil {
+		paginationToken = convertToBase64String(lastEvaluatedKey)
+	}
+
+	return &map[string]interface{}{
+		"items":           items,
+		"count":           len(items),
+		"paginationToken": paginationToken,
+	}, nil
+}
+
+func main() {
+	lambda.Start(HandleInfoEvent)
+}
@@ -0,0 +1,19 @@
+package main
+
+import "go-cdk-workshop/internal/ingestions"
+
+// Ingestion is the state of an ingestion as returned to the client, with its
+// files in the order of their keys.
+type Ingestion struct {
+	*ingestions.Ingestion
+	Files []*ingestions.File `json:"files"`
+}
+
+type Body struct {
+	Message string `json:"message"`
+}
+
+// Returns the ingestion as returned to the client.
+func newIngestion(ingestion *ingestions.Ingestion) Ingestion {
+	return Ingestion{Ingestion: ingestion, Files: ingestion.SortedFiles()}
+}
@@ -0,0 +1,35 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+
+	"go-cdk-workshop/internal/logging"
+
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// Converts a map of strings to a base64 encoded string
+func convertToBase64String(input map[string]*dynamodb.AttributeValue) string {
+	jsonString, err := json.Marshal(input)
+	if err != nil {
+		logging.Error("Error converting map to JSON string", err)
+		return ""
+	}
+	base64String := base64.StdEncoding.EncodeToString(jsonString)
+	logging.Debug("Base64 encoded string", "value", base64String)
+	return base64String
+}
+
+// Parses a base64 encoded string into a map of strings
+func parseBase64String(input string) map[string]*dynamodb.AttributeValue {
+	jsonString, err := base64.StdEncoding.DecodeString(input)
+	if err != nil {
+		logging.Error("Error decoding base64 string", err)
+		return nil
+	}
+	var output map[string]*dynamodb.AttributeValue
+	json.Unmarshal(jsonString, &output)
+	logging.Debug("Parsed base64 string", "value", output)
+	return output
+}
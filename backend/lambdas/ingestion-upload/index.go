@@ -0,0 +1,337 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"mime"
+	"os"
+	"path"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
+
+	"go-cdk-workshop/internal/ingestions"
+	"go-cdk-workshop/internal/logging"
+	"go-cdk-workshop/internal/rules"
+	"go-cdk-workshop/internal/schema"
+
+	"github.com/aws/aws-lambda-go/events"
+	"github.com/aws/aws-lambda-go/lambda"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+const (
+	// How long the upload URLs are valid for, longer for the files uploaded
+	// in parts.
+	uploadExpiry    = 15 * time.Minute
+	multipartExpiry = time.Hour
+
+	// The files over this size are uploaded in parts, of at least the part
+	// size and at most as many parts as S3 allows.
+	multipartThreshold = 100 * 1024 * 1024
+	minPartSize        = 64 * 1024 * 1024
+	maxParts           = 10000
+
+	// The largest file that can be uploaded, whatever its rule allows.
+	maxUploadSize = 100 * 1024 * 1024 * 1024
+
+	// The longest key S3 allows, in bytes.
+	maxKeyLength = 1024
+
+	// The metadata naming the upload of the file, and its schema.
+	uploadMetadata = "upload-id"
+	schemaMetadata = "schema"
+)
+
+// Event handler, this function returns the URL a file is uploaded to under
+// the prefix of its ingestion rule, along with the id of the upload the
+// status API follows its ingestion with.
+func HandleInfoEvent(ctx context.Context, event events.APIGatewayV2HTTPRequest) (events.APIGatewayV2HTTPResponse, error) {
+	logging.StartRequest(ctx, event)
+	logging.Debug("Received event", "event", event)
+
+	request, err := parseRequest(event)
+	if err != nil {
+		return errorResponse(400, err), nil
+	}
+
+	// The rules deciding which files are ingested.
+	var ingestionRules []rules.Rule
+	if err := json.Unmarshal([]byte(os.Getenv("INGESTION_RULES")), &ingestionRules); err != nil {
+		logging.Error("Error parsing the ingestion rules", err)
+		return errorResponse(500, err), nil
+	}
+
+	uploadID, err := newUploadID()
+	if err != nil {
+		return errorResponse(500, err), nil
+	}
+	// The id of the upload follows the file through its ingestion.
+	logging.Set(logging.CorrelationID, uploadID)
+
+	// Check the file against its rule before issuing the URL. The uploaded
+	// file is checked again by glue-trigger, e.g. when it is not the size
+	// announced.
+	rule, key, err := checkFile(ingestionRules, request, uploadID)
+	if err != nil {
+		logging.Warn("The file is not accepted", "error", err)
+		return errorResponse(400, err), nil
+	}
+
+	metadata := map[string]*string{uploadMetadata: aws.String(uploadID)}
+	if request.Schema != "" {
+		metadata[schemaMetadata] = aws.String(request.Schema)
+	}
+
+	// Create a new S3 and DynamoDB client
+	logging.Debug("Creating a new S3 and DynamoDB client")
+	mySession := session.Must(session.NewSession())
+	s3Svc := s3.New(mySession)
+	dynamoSvc := dynamodb.New(mySession)
+
+	response := Response{
+		ID:        uploadID,
+		StatusURL: "/ingestions/" + uploadID,
+		Bucket:    os.Getenv("BUCKET_NAME"),
+		Key:       key,
+	}
+	if request.Size > multipartThreshold {
+		err = presignMultipart(ctx, s3Svc, &response, request, metadata)
+	} else {
+		err = presignPut(s3Svc, &response, request, metadata)
+	}
+	if err != nil {
+		logging.Error("Error signing the upload URL", err)
+		return errorResponse(500, err), nil
+	}
+
+	// Record the upload, so its state can be followed before it is queued.
+	err = ingestions.CreateUpload(ctx, dynamoSvc, os.Getenv("INGESTIONS_TABLE"), &ingestions.Ingestion{
+		ID:        uploadID,
+		Bucket:    response.Bucket,
+		Rule:      rule.Name,
+		Schema:    request.Schema,
+		Keys:      []string{key},
+		Files:     map[string]*ingestions.File{key: {Key: key, Size: request.Size, State: ingestions.StatePending}},
+		ExpiresAt: &response.ExpiresAt,
+	})
+	if err != nil {
+		logging.Error("Error recording the upload", err)
+		return errorResponse(500, err), nil
+	}
+
+	logging.Info("Signed the upload URL", logging.Key, key, "multipart", response.Multipart != nil)
+
+	// Return the response to the client
+	body, _ := json.Marshal(response)
+	return events.APIGatewayV2HTTPResponse{
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(body),
+		StatusCode: 200,
+	}, nil
+}
+
+// Returns the request in the body of the event, with the content type of the
+// file guessed from its extension when not given.
+func parseRequest(event events.APIGatewayV2HTTPRequest) (Request, error) {
+	body := event.Body
+	if event.IsBase64Encoded {
+		decoded, err := base64.StdEncoding.DecodeString(body)
+		if err != nil {
+			return Request{}, err
+		}
+		body = string(decoded)
+	}
+
+	request := Request{}
+	if err := json.Unmarshal([]byte(body), &request); err != nil {
+		return request, fmt.Errorf("invalid request: %w", err)
+	}
+	if request.FileName == "" {
+		return request, fmt.Errorf("fileName is required")
+	}
+	if request.Size <= 0 {
+		return request, fmt.Errorf("size is required")
+	}
+	if request.Size > maxUploadSize {
+		return request, fmt.Errorf("the file is over %d bytes", int64(maxUploadSize))
+	}
+	if request.ContentType == "" {
+		request.ContentType = mime.TypeByExtension(path.Ext(request.FileName))
+	}
+	if request.ContentType == "" {
+		request.ContentType = "application/octet-stream"
+	}
+	if request.Schema != "" {
+		if _, err := schema.Lookup(request.Schema); err != nil {
+			return request, err
+		}
+	}
+	return request, nil
+}
+
+// Returns the rule of the file and the unique key it is uploaded to, or why
+// the rule does not accept it.
+func checkFile(ingestionRules []rules.Rule, request Request, uploadID string) (*rules.Rule, string, error) {
+	var rule *rules.Rule
+	if request.Rule == "" {
+		rule = rules.Match(ingestionRules, os.Getenv("S3_KEY_PREFIX"))
+	}
+	for i := range ingestionRules {
+		if request.Rule != "" && ingestionRules[i].Name == request.Rule {
+			rule = &ingestionRules[i]
+		}
+	}
+	if rule == nil {
+		return nil, "", fmt.Errorf("unknown ingestion rule %q", request.Rule)
+	}
+
+	key, err := uploadKey(rule.Prefix, request.FileName, uploadID)
+	if err != nil {
+		return nil, "", err
+	}
+
+	// The file must be handled by the rule, not by a rule of a sub folder.
+	if match := rules.Match(ingestionRules, key); match == nil || match.Name != rule.Name {
+		return nil, "", fmt.Errorf("the file %s is not handled by the %s ingestion rule", request.FileName, rule.Name)
+	}
+	reason := rule.Check(rules.Object{Key: key, Size: request.Size, ContentType: request.ContentType})
+	if reason != "" {
+		return nil, "", fmt.Errorf("the %s ingestion rule does not accept the file: %s", rule.Name, reason)
+	}
+	return rule, key, nil
+}
+
+// Returns the key the file is uploaded to: its path under the prefix of its
+// rule, with the id of the upload added before its extensions so two uploads
+// of the same file never overwrite each other. The route is called without
+// credentials, so the names that cannot make a valid key are refused here.
+func uploadKey(prefix string, fileName string, uploadID string) (string, error) {
+	name := strings.TrimPrefix(path.Clean("/"+fileName), "/")
+	if name == "" || name == "." || strings.HasSuffix(fileName, "/") || !utf8.ValidString(fileName) || strings.IndexFunc(fileName, unicode.IsControl) >= 0 {
+		return "", fmt.Errorf("invalid fileName %q", fileName)
+	}
+
+	dir, file := path.Split(name)
+	base, extension := file, ""
+	if index := strings.Index(file, "."); index > 0 {
+		base, extension = file[:index], file[index:]
+	}
+	key := fmt.Sprintf("%s%s%s-%s%s", prefix, dir, base, uploadID, extension)
+	if len(key) > maxKeyLength {
+		return "", fmt.Errorf("the fileName is too long, the key would be over %d bytes", maxKeyLength)
+	}
+	return key, nil
+}
+
+// Returns a new random upload id.
+func newUploadID() (string, error) {
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(id), nil
+}
+
+// Signs the URL the file is sent to in a single PUT. The size, content type
+// and metadata are signed, so the client must send the returned headers.
+func presignPut(s3Svc *s3.S3, response *Response, request Request, metadata map[string]*string) error {
+	req, _ := s3Svc.PutObjectRequest(&s3.PutObjectInput{
+		Bucket:        aws.String(response.Bucket),
+		Key:           aws.String(response.Key),
+		ContentType:   aws.String(request.ContentType),
+		ContentLength: aws.Int64(request.Size),
+		Metadata:      metadata,
+	})
+	url, headers, err := req.PresignRequest(uploadExpiry)
+	if err != nil {
+		return err
+	}
+
+	response.Method = "PUT"
+	response.URL = url
+	response.Headers = map[string]string{}
+	for name := range headers {
+		response.Headers[name] = headers.Get(name)
+	}
+	response.ExpiresAt = time.Now().UTC().Add(uploadExpiry)
+	return nil
+}
+
+// Starts the upload of a large file in parts and signs the URL of each part,
+// and the URLs completing or aborting the upload.
+func presignMultipart(ctx context.Context, s3Svc *s3.S3, response *Response, request Request, metadata map[string]*string) error {
+	upload, err := s3Svc.CreateMultipartUploadWithContext(ctx, &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(response.Bucket),
+		Key:         aws.String(response.Key),
+		ContentType: aws.String(request.ContentType),
+		Metadata:    metadata,
+	})
+	if err != nil {
+		return err
+	}
+
+	partSize := int64(minPartSize)
+	if request.Size/partSize >= maxParts {
+		partSize = request.Size/maxParts + 1
+	}
+	count := (request.Size + partSize - 1) / partSize
+
+	multipart := &Multipart{UploadID: aws.StringValue(upload.UploadId), PartSize: partSize, Parts: []Part{}}
+	for number := int64(1); number <= count; number++ {
+		req, _ := s3Svc.UploadPartRequest(&s3.UploadPartInput{
+			Bucket:     aws.String(response.Bucket),
+			Key:        aws.String(response.Key),
+			UploadId:   upload.UploadId,
+			PartNumber: aws.Int64(number),
+		})
+		url, err := req.Presign(multipartExpiry)
+		if err != nil {
+			return err
+		}
+		multipart.Parts = append(multipart.Parts, Part{PartNumber: number, URL: url})
+	}
+
+	completeReq, _ := s3Svc.CompleteMultipartUploadRequest(&s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String(response.Bucket),
+		Key:      aws.String(response.Key),
+		UploadId: upload.UploadId,
+	})
+	if multipart.CompleteURL, err = completeReq.Presign(multipartExpiry); err != nil {
+		return err
+	}
+	abortReq, _ := s3Svc.AbortMultipartUploadRequest(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(response.Bucket),
+		Key:      aws.String(response.Key),
+		UploadId: upload.UploadId,
+	})
+	if multipart.AbortURL, err = abortReq.Presign(multipartExpiry); err != nil {
+		return err
+	}
+
+	response.Multipart = multipart
+	response.ExpiresAt = time.Now().UTC().Add(multipartExpiry)
+	return nil
+}
+
+// Returns an error response with the message of the error.
+func errorResponse(statusCode int, err error) events.APIGatewayV2HTTPResponse {
+	body, _ := json.Marshal(&Body{Message: fmt.Sprintf("Error: %s", err)})
+	return events.APIGatewayV2HTTPResponse{
+		Headers:    map[string]string{"Content-Type": "application/json"},
+		Body:       string(body),
+		StatusCode: statusCode,
+	}
+}
+
+func main() {
+	lambda.Start(HandleInfoEvent)
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"encoding/base64"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go-cdk-workshop/internal/rules"
+
+	"github.com/aws/aws-lambda-go/events"
+)
+
+func TestParseRequest(t *testing.T) {
+	tests := []struct {
+		name    string
+		event   events.APIGatewayV2HTTPRequest
+		want    Request
+		wantErr bool
+	}{
+		{
+			name:  "file with its content type",
+			event: events.APIGatewayV2HTTPRequest{Body: `{"fileName": "august.csv", "contentType": "text/csv", "size": 100, "rule": "bank"}`},
+			want:  Request{FileName: "august.csv", ContentType: "text/csv", Size: 100, Rule: "bank"},
+		},
+		{
+			name:  "content type guessed from the extension",
+			event: events.APIGatewayV2HTTPRequest{Body: `{"fileName": "august.json", "size": 100}`},
+			want:  Request{FileName: "august.json", ContentType: "application/json", Size: 100},
+		},
+		{
+			name:  "unknown extension",
+			event: events.APIGatewayV2HTTPRequest{Body: `{"fileName": "august.unknown-extension", "size": 100}`},
+			want:  Request{FileName: "august.unknown-extension", ContentType: "application/octet-stream", Size: 100},
+		},
+		{
+			name:  "base64 body with a schema",
+			event: events.APIGatewayV2HTTPRequest{Body: base64.StdEncoding.EncodeToString([]byte(`{"fileName": "august.csv", "contentType": "text/csv", "size": 1, "schema": "transactions@v1"}`)), IsBase64Encoded: true},
+			want:  Request{FileName: "august.csv", ContentType: "text/csv", Size: 1, Schema: "transactions@v1"},
+		},
+		{
+			name:    "unknown schema",
+			event:   events.APIGatewayV2HTTPRequest{Body: `{"fileName": "august.csv", "size": 1, "schema": "transactions@v99"}`},
+			wantErr: true,
+		},
+		{
+			name:    "no file name",
+			event:   events.APIGatewayV2HTTPRequest{Body: `{"size": 100}`},
+			wantErr: true,
+		},
+		{
+			name:    "no size",
+			event:   events.APIGatewayV2HTTPRequest{Body: `{"fileName": "august.csv"}`},
+			wantErr: true,
+		},
+		{
+			name:    "file too large",
+			event:   events.APIGatewayV2HTTPRequest{Body: `{"fileName": "august.csv", "size": 107374182401}`},
+			wantErr: true,
+		},
+		{
+			name:    "invalid JSON",
+			event:   events.APIGatewayV2HTTPRequest{Body: `{"fileName": `},
+			wantErr: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := parseRequest(test.event)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("parseRequest() error = %v, want error %v", err, test.wantErr)
+			}
+			if err == nil && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("parseRequest() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestUploadKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		fileName string
+		want     string
+		wantErr  bool
+	}{
+		{name: "file name", fileName: "bank_data.csv", want: "input/bank_data-u1.csv"},
+		{name: "path with extensions", fileName: "bank-a/bank_data.csv.gz", want: "input/bank-a/bank_data-u1.csv.gz"},
+		{name: "no extension", fileName: "bank_data", want: "input/bank_data-u1"},
+		{name: "hidden file", fileName: ".bank_data", want: "input/.bank_data-u1"},
+		{name: "path out of the prefix", fileName: "../../bank/./bank_data.csv", want: "input/bank/bank_data-u1.csv"},
+		{name: "absolute path", fileName: "/bank_data.csv", want: "input/bank_data-u1.csv"},
+		{name: "empty", fileName: "", wantErr: true},
+		{name: "root", fileName: "/", wantErr: true},
+		{name: "folder", fileName: "bank-a/", wantErr: true},
+		{name: "control character", fileName: "bank\n_data.csv", wantErr: true},
+		{name: "invalid UTF-8", fileName: "bank\xff.csv", wantErr: true},
+		{name: "key too long", fileName: strings.Repeat("a", maxKeyLength) + ".csv", wantErr: true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := uploadKey("input/", test.fileName, "u1")
+			if (err != nil) != test.wantErr {
+				t.Fatalf("uploadKey(%q) error = %v, want error %v", test.fileName, err, test.wantErr)
+			}
+			if got != test.want {
+				t.Errorf("uploadKey(%q) = %q, want %q", test.fileName, got, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckFile(t *testing.T) {
+	t.Setenv("S3_KEY_PREFIX", "input/")
+	ingestionRules := []rules.Rule{
+		{Name: "default", Prefix: "input/", Extensions: []string{".csv"}},
+		{Name: "bank", Prefix: "input/bank/", MaxSizeBytes: 100},
+	}
+
+	tests := []struct {
+		name     string
+		request  Request
+		wantRule string
+		wantKey  string
+		wantErr  string
+	}{
+		{
+			name:     "rule of the default prefix",
+			request:  Request{FileName: "august.csv", Size: 10},
+			wantRule: "default",
+			wantKey:  "input/august-u1.csv",
+		},
+		{
+			name:     "named rule",
+			request:  Request{FileName: "august.json", Size: 10, Rule: "bank"},
+			wantRule: "bank",
+			wantKey:  "input/bank/august-u1.json",
+		},
+		{
+			name:    "unknown rule",
+			request: Request{FileName: "august.csv", Size: 10, Rule: "card"},
+			wantErr: `unknown ingestion rule "card"`,
+		},
+		{
+			name:    "file of the folder of another rule",
+			request: Request{FileName: "bank/august.csv", Size: 10},
+			wantErr: "not handled by the default ingestion rule",
+		},
+		{
+			name:    "extension refused",
+			request: Request{FileName: "august.json", Size: 10},
+			wantErr: rules.ExtensionNotAllowed,
+		},
+		{
+			name:    "file too large",
+			request: Request{FileName: "august.csv", Size: 200, Rule: "bank"},
+			wantErr: rules.TooLarge,
+		},
+		{
+			name:    "invalid file name",
+			request: Request{FileName: "bank/", Size: 10},
+			wantErr: "invalid fileName",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			rule, key, err := checkFile(ingestionRules, test.request, "u1")
+			if test.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), test.wantErr) {
+					t.Fatalf("checkFile() error = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("checkFile() error = %v", err)
+			}
+			if rule.Name != test.wantRule || key != test.wantKey {
+				t.Errorf("checkFile() = %s, %q, want %s, %q", rule.Name, key, test.wantRule, test.wantKey)
+			}
+		})
+	}
+}
@@ -0,0 +1,64 @@
+package main
+
+import "time"
+
+// Request describes the file to upload.
+type Request struct {
+	// The name of the file, e.g. bank_data.csv, or its path under the prefix
+	// of its rule, e.g. bank-a/bank_data.csv.
+	FileName string `json:"fileName"`
+
+	// The content type and size of the file in bytes, the file is checked
+	// against its rule with them.
+	ContentType string `json:"contentType"`
+	Size        int64  `json:"size"`
+
+	// The ingestion rule the file is uploaded under, the rule of the default
+	// prefix when empty, and the schema of the file, the schema of the rule
+	// when empty.
+	Rule   string `json:"rule"`
+	Schema string `json:"schema"`
+}
+
+// Response is where and how to upload the file, and the id to follow its
+// ingestion with.
+type Response struct {
+	// The id of the upload, GET /ingestions/{id} returns the state of the
+	// ingestion of the file.
+	ID        string `json:"id"`
+	StatusURL string `json:"statusUrl"`
+
+	Bucket    string    `json:"bucket"`
+	Key       string    `json:"key"`
+	ExpiresAt time.Time `json:"expiresAt"`
+
+	// The URL the file is sent to, and the headers to send with it, for the
+	// files uploaded in a single request.
+	Method  string            `json:"method,omitempty"`
+	URL     string            `json:"url,omitempty"`
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// The parts of a large file, uploaded in any order, and the URLs to
+	// complete or abort the upload, for the files uploaded in parts.
+	Multipart *Multipart `json:"multipart,omitempty"`
+}
+
+// Multipart describes the upload of a file in parts. The ETags of the parts
+// are posted to CompleteURL as the CompleteMultipartUpload XML of S3.
+type Multipart struct {
+	UploadID    string `json:"uploadId"`
+	PartSize    int64  `json:"partSize"`
+	Parts       []Part `json:"parts"`
+	CompleteURL string `json:"completeUrl"`
+	AbortURL    string `json:"abortUrl"`
+}
+
+// Part is a part of a file uploaded in parts.
+type Part struct {
+	PartNumber int64  `json:"partNumber"`
+	URL        string `json:"url"`
+}
+
+type Body struct {
+	Message string `json:"message"`
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"go-cdk-workshop/internal/ledger"
+	"go-cdk-workshop/internal/objects"
+	"go-cdk-workshop/internal/schema"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/glue"
+)
+
+// Diagnostics describe why a Glue job run failed, they are written as JSON
+// next to the failed file so operators can triage it without opening the
+// Glue console.
+type Diagnostics struct {
+	JobName         string            `json:"jobName"`
+	JobRunID        string            `json:"jobRunId"`
+	State           string            `json:"state"`
+	ErrorMessage    string            `json:"errorMessage"`
+	Attempt         int64             `json:"attempt"`
+	StartedOn       *time.Time        `json:"startedOn,omitempty"`
+	CompletedOn     *time.Time        `json:"completedOn,omitempty"`
+	ExecutionTime   int64             `json:"executionTimeSeconds"`
+	Schema          string            `json:"schema,omitempty"`
+	GlueVersion     string            `json:"glueVersion,omitempty"`
+	WorkerType      string            `json:"workerType,omitempty"`
+	NumberOfWorkers int64             `json:"numberOfWorkers,omitempty"`
+	LogGroupName    string            `json:"logGroupName,omitempty"`
+	Arguments       map[string]string `json:"arguments"`
+	SourceBucket    string            `json:"sourceBucket"`
+	SourceKey       string            `json:"sourceKey"`
+	SourceArchive   string            `json:"sourceArchive,omitempty"`
+	Manifest        string            `json:"manifest,omitempty"`
+	FailedKey       string            `json:"failedKey"`
+	Stats           *Stats            `json:"stats,omitempty"`
+
+	// The report of the reconciliation of the file, see the file ledger.
+	Reconciliation *ledger.Entry `json:"reconciliation,omitempty"`
+}
+
+// Builds the diagnostics of a job run from the run returned by GetJobRun.
+func newDiagnostics(run *glue.JobRun, sourceBucket string, sourceKey string, failedKey string, stats *Stats) Diagnostics {
+	arguments := map[string]string{}
+	for name, value := range run.Arguments {
+		arguments[name] = aws.StringValue(value)
+	}
+
+	// The reference of the schema the file was loaded with, e.g.
+	// transactions@v1, which is shorter to read than the schema itself.
+	schemaRef := ""
+	var runSchema schema.Schema
+	if err := json.Unmarshal([]byte(arguments["--schema"]), &runSchema); err == nil && runSchema.Name != "" {
+		schemaRef = runSchema.Ref()
+		arguments["--schema"] = schemaRef
+	}
+
+	return Diagnostics{
+		JobName:         aws.StringValue(run.JobName),
+		JobRunID:        aws.StringValue(run.Id),
+		State:           aws.StringValue(run.JobRunState),
+		ErrorMessage:    aws.StringValue(run.ErrorMessage),
+		Attempt:         aws.Int64Value(run.Attempt),
+		StartedOn:       run.StartedOn,
+		CompletedOn:     run.CompletedOn,
+		ExecutionTime:   aws.Int64Value(run.ExecutionTime),
+		Schema:          schemaRef,
+		GlueVersion:     aws.StringValue(run.GlueVersion),
+		WorkerType:      aws.StringValue(run.WorkerType),
+		NumberOfWorkers: aws.Int64Value(run.NumberOfWorkers),
+		LogGroupName:    aws.StringValue(run.LogGroupName),
+		Arguments:       arguments,
+		SourceBucket:    sourceBucket,
+		SourceKey:       sourceKey,
+		FailedKey:       failedKey,
+		Stats:           stats,
+	}
+}
+
+// Returns the diagnostics as indented JSON.
+func (d Diagnostics) JSON() ([]byte, error) {
+	return json.MarshalIndent(d, "", "  ")
+}
+
+// Returns the tags describing the job run, added to the moved file.
+func (d Diagnostics) Tags() map[string]string {
+	tags := map[string]string{
+		"glue-job-run-id": objects.TagValue(d.JobRunID),
+		"glue-job-state":  objects.TagValue(d.State),
+	}
+	if d.ErrorMessage != "" {
+		tags["glue-error"] = objects.TagValue(d.ErrorMessage)
+	}
+	if d.Schema != "" {
+		tags["schema"] = objects.TagValue(d.Schema)
+	}
+	if d.Stats != nil {
+		tags["accepted-rows"] = strconv.FormatInt(d.Stats.AcceptedRows, 10)
+		tags["rejected-rows"] = strconv.FormatInt(d.Stats.RejectedRows, 10)
+	}
+	return tags
+}
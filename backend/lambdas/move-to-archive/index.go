@@ -1,19 +1,54 @@
 package main
 
 import (
+	"bytes"
+	"context"
 	"fmt"
-	"log"
-	"strings"
+	"os"
+	"time"
+
+	"go-cdk-workshop/internal/ledger"
+	"go-cdk-workshop/internal/logging"
+	"go-cdk-workshop/internal/manifest"
+	"go-cdk-workshop/internal/notify"
+	"go-cdk-workshop/internal/objects"
 
 	"github.com/aws/aws-lambda-go/lambda"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
 	"github.com/aws/aws-sdk-go/service/glue"
 	"github.com/aws/aws-sdk-go/service/s3"
 )
 
 type Request struct {
+	// The Glue Job State Change event of the runs started before the
+	// ingestion workflow, replayed by the redrive lambda.
 	Detail GlueJobStateChangeEventDetail `json:"detail"`
+
+	// The step of the ingestion workflow, "reconcile", "archive" or "notify",
+	// along with the input of the execution.
+	Action   string `json:"action"`
+	Bucket   string `json:"bucket"`
+	Manifest string `json:"manifest"`
+	JobName  string `json:"jobName"`
+	JobRunID string `json:"jobRunId"`
+
+	// The arguments of the job run, the reconcile step reads the table and
+	// schema of the files from them.
+	Arguments map[string]string `json:"arguments"`
+
+	// The outcome of the ingestion decided by the previous steps, the state
+	// of the job run by default.
+	State        string `json:"state"`
+	ErrorMessage string `json:"errorMessage"`
+
+	// The events of the files moved by the archive step, sent by the notify step.
+	Events []notify.Event `json:"events"`
+
+	// Whether the archive step sends the events itself, when it is replayed
+	// from the dead-letter queue.
+	Notify bool `json:"notify"`
 }
 
 type GlueJobStateChangeEventDetail struct {
@@ -23,69 +58,308 @@ type GlueJobStateChangeEventDetail struct {
 }
 
 type Response struct {
-	S3Key    string `json:"s3Key"`
-	S3Bucket string `json:"s3Bucket"`
+	S3Key    string         `json:"s3Key"`
+	S3Bucket string         `json:"s3Bucket"`
+	S3Keys   []string       `json:"s3Keys"`
+	Manifest string         `json:"manifest,omitempty"`
+	Events   []notify.Event `json:"events"`
 }
 
-// Event handler, this function handles requests from clients
-func HandleInfoEvent(request Request) (Response, error) {
+// Event handler, this function handles the steps of the ingestion workflow
+// that move and report on the files once their job run finished.
+func HandleInfoEvent(ctx context.Context, request Request) (interface{}, error) {
 	// Log the event
-	log.Println("Received event: ", fmt.Sprintf("%+v", request))
+	logging.Start(ctx)
+	logging.Debug("Received event", "event", request)
 
 	// Create a new Glue and S3 client to interact with AWS
-	log.Println("Creating a new Glue client...")
+	logging.Debug("Creating a new Glue client")
 	mySession := session.Must(session.NewSession())
 	glueSvc := glue.New(mySession)
 	s3Svc := s3.New(mySession)
+	dynamoSvc := dynamodb.New(mySession)
 
-	// Get the Glue job status so we can check if it succeeded to determine
-	// if we should move the file to the archive bucket or the failed bucket
-	log.Println("Getting the Glue job status: ", request.Detail.JobName)
-	glueJob, err := glueSvc.GetJobRun(&glue.GetJobRunInput{
-		JobName: aws.String(request.Detail.JobName),
-		RunId:   aws.String(request.Detail.JobRunID),
-	})
+	switch request.Action {
+	case actionReconcile:
+		logWorkflow(request)
+		return reconcile(ctx, s3Svc, dynamoSvc, request)
+	case actionNotify:
+		return Response{Events: request.Events}, notifyAll(ctx, mySession, request.Events)
+	case actionArchive:
+	case "":
+		// The Glue event is archived and notified in one go, as before the workflow.
+		request.JobName = request.Detail.JobName
+		request.JobRunID = request.Detail.JobRunID
+		request.State = request.Detail.State
+		request.Notify = true
+	default:
+		return nil, fmt.Errorf("unknown workflow step: %s", request.Action)
+	}
 
+	logWorkflow(request)
+	response, err := archiveRun(ctx, glueSvc, s3Svc, dynamoSvc, request)
 	if err != nil {
-		log.Println("Error getting Glue job status: ", err)
-		return Response{}, err
+		return response, err
+	}
+	if request.Notify {
+		if err := notifyAll(ctx, mySession, response.Events); err != nil {
+			logging.Error("Error sending the ingestion notifications", err)
+		}
+	}
+	return response, nil
+}
+
+// Moves the files of a job run to the archive or failed folder, and returns
+// the events describing how their ingestion went.
+func archiveRun(ctx context.Context, glueSvc *glue.Glue, s3Svc *s3.S3, dynamoSvc *dynamodb.DynamoDB, request Request) (Response, error) {
+	// Get the Glue job status so we can check if it succeeded to determine
+	// if we should move the file to the archive bucket or the failed bucket.
+	// There is no run when the workflow failed before starting it.
+	run := &glue.JobRun{JobName: aws.String(request.JobName), Arguments: map[string]*string{}}
+	if request.JobRunID != "" {
+		logging.Info("Getting the Glue job status", "jobName", request.JobName)
+		glueJob, err := glueSvc.GetJobRunWithContext(ctx, &glue.GetJobRunInput{
+			JobName: aws.String(request.JobName),
+			RunId:   aws.String(request.JobRunID),
+		})
+
+		if err != nil {
+			logging.Error("Error getting Glue job status", err)
+			return Response{}, err
+		}
+		run = glueJob.JobRun
+	}
+	if correlationID := aws.StringValue(run.Arguments[correlationArgument]); correlationID != "" {
+		logging.Set(logging.CorrelationID, correlationID)
+	}
+
+	// The outcome decided by the workflow wins over the state of the run,
+	// e.g. a run that succeeded without loading every row.
+	state := request.State
+	if state == "" {
+		state = aws.StringValue(run.JobRunState)
+	}
+	run.JobRunState = aws.String(state)
+	if message := failureMessage(request.ErrorMessage); message != "" {
+		run.ErrorMessage = aws.String(message)
+	}
+
+	// Gets the files processed by the Glue job so we can know what objects to
+	// copy: the files of its manifest, or the file of the runs started before
+	// the uploads were coalesced.
+	logging.Info("Getting the files processed by the Glue job", "jobName", request.JobName)
+	s3Bucket := request.Bucket
+	if s3Bucket == "" {
+		s3Bucket = aws.StringValue(run.Arguments["--s3_bucket"])
 	}
+	manifestKey := request.Manifest
+	if manifestKey == "" {
+		manifestKey = aws.StringValue(run.Arguments["--manifest"])
+	}
+	// The prefix of the ingestion rule the files were accepted by, the runs
+	// started before there were rules used S3_KEY_PREFIX.
+	prefix := os.Getenv("S3_KEY_PREFIX")
+	if sourcePrefix, ok := run.Arguments["--source_prefix"]; ok {
+		prefix = aws.StringValue(sourcePrefix)
+	}
+	keys := []string{aws.StringValue(run.Arguments["--s3_key"])}
+	var runManifest *manifest.Manifest
+	if manifestKey != "" {
+		var err error
+		runManifest, err = manifest.Read(ctx, s3Svc, s3Bucket, manifestKey)
+		if err != nil {
+			logging.Error("Error reading the manifest of the job run", err)
+			return Response{}, err
+		}
+		keys, prefix = runManifest.Keys(), runManifest.Prefix
+		logging.Set(logging.IngestionID, runManifest.ID)
+	}
+	if len(keys) == 0 || keys[0] == "" {
+		return Response{}, fmt.Errorf("the job run has no files to archive")
+	}
+
+	// Get how many rows of the files were loaded and rejected.
+	var stats *Stats
+	if request.JobRunID != "" {
+		var err error
+		stats, err = readStats(ctx, s3Svc, s3Bucket, os.Getenv("STATS_PREFIX"), request.JobRunID)
+		if err != nil {
+			logging.Error("Error getting the row counts of the job run", err)
+			return Response{}, err
+		}
+	}
+
+	// Move each file on its own, a file that cannot be moved does not hold
+	// back the others. The step fails once they were all tried so it is
+	// retried, the files already moved are then skipped.
+	response := Response{S3Key: keys[0], S3Bucket: s3Bucket, S3Keys: keys, Manifest: manifestKey, Events: []notify.Event{}}
+	failed := 0
+	defer logFile(runManifest, "")
+	for _, key := range keys {
+		logFile(runManifest, key)
 
-	// Gets the file processed by the Glue job so we can know what object to copy.
-	log.Println("Getting the file processed by the Glue job: ", request.Detail.JobName)
-	s3key := glueJob.JobRun.Arguments["--s3_key"]
-	s3Bucket := glueJob.JobRun.Arguments["--s3_bucket"]
+		// A file reconciled on its own is archived or failed by its ledger
+		// entry, whatever the outcome of the other files of the run.
+		fileRun, entry, err := reconciledRun(ctx, dynamoSvc, run, key)
+		if err != nil {
+			logging.Error("Error reading the ledger entry of the file", err)
+			failed++
+			continue
+		}
+
+		event, err := archive(ctx, s3Svc, fileRun, s3Bucket, key, prefix, manifestKey, stats.forFile(key, len(keys)), entry)
+		if err != nil {
+			logging.Error("Error archiving the file", err)
+			failed++
+			continue
+		}
+		if event == nil {
+			continue
+		}
+		response.Events = append(response.Events, *event)
+		emitMetrics(prefix, event)
+
+		// Record where the file went, so a rollback can move it back. The
+		// file has been moved already, so a failure is only logged.
+		if entry != nil {
+			if err := ledger.SetArchivedKey(ctx, dynamoSvc, os.Getenv("LEDGER_TABLE"), key, entry.JobRunID, event.DestinationKey); err != nil {
+				logging.Error("Error recording the archived key in the ledger", err)
+			}
+		}
+		recordFile(ctx, dynamoSvc, manifestKey, event)
+	}
+	if failed > 0 {
+		return response, fmt.Errorf("%d of the %d files of the job run could not be archived", failed, len(keys))
+	}
+	recordOutcome(ctx, dynamoSvc, manifestKey)
+
+	return response, nil
+}
+
+// Moves a file loaded by the job run to the archive or failed folder, and
+// returns the event describing how its ingestion went. It returns nil when
+// the file was already moved.
+func archive(ctx context.Context, s3Svc *s3.S3, run *glue.JobRun, s3Bucket string, s3key string, prefix string, manifestKey string, stats *Stats, entry *ledger.Entry) (*notify.Event, error) {
+	// Make sure the file is still there, it was moved already when the event
+	// is retried after another file of the run could not be moved.
+	source, err := s3Svc.HeadObjectWithContext(ctx, &s3.HeadObjectInput{
+		Bucket: aws.String(s3Bucket),
+		Key:    aws.String(s3key),
+	})
+	if objects.IsNotFound(err) {
+		logging.Info("The file was already moved")
+		return nil, nil
+	}
+	if err != nil {
+		logging.Error("Error getting the file", err)
+		return nil, err
+	}
 
 	// Move the file to the proper folder so the client can know if the file was
 	// processed successfully or not
+	failed := aws.StringValue(run.JobRunState) != glue.JobRunStateSucceeded
 	folder := "archive"
-	if request.Detail.State == "FAILED" {
+	if failed {
 		folder = "failed"
 	}
 
-	// The new file key with the new folder.
-	newS3Key := fmt.Sprintf("%s/%s", folder, strings.Join(strings.Split(*s3key, "/")[1:], "/"))
+	// The new file key with the new folder, laid out by the date and id of the
+	// job run so files uploaded twice under the same name are kept apart.
+	keyTemplate := os.Getenv("ARCHIVE_KEY_TEMPLATE")
+	if keyTemplate == "" {
+		keyTemplate = objects.DefaultKeyTemplate
+	}
+	runDate := time.Now()
+	if run.StartedOn != nil {
+		runDate = *run.StartedOn
+	}
+	newS3Key, err := objects.RenderKey(keyTemplate, folder, prefix, s3key, aws.StringValue(run.Id), runDate)
+	if err != nil {
+		logging.Error("Error rendering the new file key", err)
+		return nil, err
+	}
 
-	log.Println(fmt.Sprintf("Moving the file to the %s subfolder: ", folder), *s3key)
-	_, err = s3Svc.CopyObject(&s3.CopyObjectInput{
-		Bucket:     s3Bucket,
-		CopySource: aws.String(fmt.Sprintf("%s/%s", *s3Bucket, *s3key)),
-		Key:        aws.String(newS3Key),
+	// Make sure the new key does not overwrite another file.
+	newS3Key, err = objects.AvailableKey(ctx, s3Svc, s3Bucket, newS3Key, source)
+	if err != nil {
+		logging.Error("Error finding a free key for the file", err)
+		return nil, err
+	}
+
+	// Describe the job run so operators can tell why a file failed without
+	// opening the Glue console.
+	diagnostics := newDiagnostics(run, s3Bucket, s3key, newS3Key, stats)
+	diagnostics.Manifest = manifestKey
+	diagnostics.Reconciliation = entry
+
+	// The zip file the file was extracted from, if any.
+	diagnostics.SourceArchive = aws.StringValue(source.Metadata[objects.MetadataKey(objects.SourceArchiveMetadata)])
+
+	// Write the diagnostics next to the failed file first, so a failed file
+	// never ends up without them.
+	if failed {
+		logging.Info("Writing the diagnostics of the failed job run", "diagnosticsKey", objects.DiagnosticsKey(newS3Key))
+		body, err := diagnostics.JSON()
+		if err != nil {
+			logging.Error("Error formatting the diagnostics", err)
+			return nil, err
+		}
+
+		_, err = s3Svc.PutObjectWithContext(ctx, &s3.PutObjectInput{
+			Bucket:      aws.String(s3Bucket),
+			Key:         aws.String(objects.DiagnosticsKey(newS3Key)),
+			Body:        bytes.NewReader(body),
+			ContentType: aws.String("application/json"),
+		})
+
+		if err != nil {
+			logging.Error("Error writing the diagnostics", err)
+			return nil, err
+		}
+	}
+
+	// Move the file with its metadata and tags, along with the tags describing
+	// the job run. The original is only deleted once the copy is verified, and
+	// a failed delete fails the lambda so the event is retried.
+	logging.Info("Moving the file", "folder", folder)
+	moved, err := objects.Move(ctx, s3Svc, objects.MoveInput{
+		Bucket:         s3Bucket,
+		SourceKey:      s3key,
+		DestinationKey: newS3Key,
+		Tags:           diagnostics.Tags(),
 	})
+	if len(moved.DroppedTags) > 0 {
+		logging.Warn("Dropped the tags that did not fit on the moved file", "tags", moved.DroppedTags)
+	}
 
 	if err != nil {
-		log.Println("Error moving the file to the archive subfolder: ", err)
-		return Response{}, err
+		logging.Error("Error moving the file", err, "folder", folder)
+		return nil, err
 	}
+	logging.Info("Moved the file", "destinationKey", newS3Key, "size", moved.Size, "multipart", moved.Multipart)
 
-	// Delete the file from the original folder
-	log.Println("Deleting the file from the original folder: ", request.Detail.JobName)
-	_, err = s3Svc.DeleteObject(&s3.DeleteObjectInput{
-		Bucket: s3Bucket,
-		Key:    s3key,
-	})
+	// Describe how the ingestion went for the notify step.
+	event := notify.Event{
+		Type:           notify.IngestionSucceeded,
+		Time:           time.Now().UTC(),
+		JobName:        diagnostics.JobName,
+		JobRunID:       diagnostics.JobRunID,
+		State:          diagnostics.State,
+		Bucket:         s3Bucket,
+		Key:            s3key,
+		DestinationKey: newS3Key,
+		SourceArchive:  diagnostics.SourceArchive,
+	}
+	if stats != nil {
+		event.Rows = &notify.Rows{Accepted: stats.AcceptedRows, Rejected: stats.RejectedRows, RejectedPath: stats.RejectedPath}
+	}
+	if failed {
+		event.Type = notify.IngestionFailed
+		event.ErrorMessage = diagnostics.ErrorMessage
+		event.DiagnosticsKey = objects.DiagnosticsKey(newS3Key)
+	}
 
-	return Response{S3Key: *s3key, S3Bucket: *s3Bucket}, nil
+	return &event, nil
 }
 
 func main() {
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+
+	"go-cdk-workshop/internal/objects"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// Stats are the row counts of a job run, written by the Glue job to
+// STATS_PREFIX once it has validated the rows of the file.
+type Stats struct {
+	AcceptedRows  int64            `json:"acceptedRows"`
+	RejectedRows  int64            `json:"rejectedRows"`
+	RejectReasons map[string]int64 `json:"rejectReasons,omitempty"`
+	RejectedPath  string           `json:"rejectedPath,omitempty"`
+
+	// The columns of the files that are not in their schema, and were not loaded.
+	UnexpectedColumns []string `json:"unexpectedColumns,omitempty"`
+
+	// The row counts of each file of the run, keyed by the key of the file.
+	Files map[string]FileStats `json:"files,omitempty"`
+}
+
+// FileStats are the row counts of a file of a job run, and the checksums of
+// its accepted rows the file is reconciled with.
+type FileStats struct {
+	SourceRows   int64 `json:"sourceRows"`
+	AcceptedRows int64 `json:"acceptedRows"`
+	RejectedRows int64 `json:"rejectedRows"`
+
+	// The sum of the ids of the accepted rows, and of their amounts in cents
+	// when the schema has an amount column.
+	IDChecksum     int64  `json:"idChecksum"`
+	AmountChecksum *int64 `json:"amountChecksum,omitempty"`
+}
+
+// Returns the row counts of a file of the run. A run loading several files
+// counts the rows of each of them, a run loading a single file counts its
+// rows as a whole. The rejected rows of every file stay under RejectedPath,
+// with the key of their file.
+func (s *Stats) forFile(key string, files int) *Stats {
+	if s == nil || files == 1 {
+		return s
+	}
+	counts, ok := s.Files[key]
+	if !ok {
+		return nil
+	}
+	stats := *s
+	stats.AcceptedRows, stats.RejectedRows = counts.AcceptedRows, counts.RejectedRows
+	stats.RejectReasons = nil
+	if counts.RejectedRows == 0 {
+		stats.RejectedPath = ""
+	}
+	stats.Files = nil
+	return &stats
+}
+
+// Reads the row counts of a job run. It returns nil when the job did not
+// write them, e.g. when it failed before validating the rows.
+func readStats(ctx context.Context, s3Svc s3iface.S3API, bucket string, prefix string, runID string) (*Stats, error) {
+	object, err := s3Svc.GetObjectWithContext(ctx, &s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(prefix + runID + ".json"),
+	})
+	if objects.IsNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer object.Body.Close()
+
+	body, err := io.ReadAll(object.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	stats := &Stats{}
+	if err := json.Unmarshal(body, stats); err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestStatsForFile(t *testing.T) {
+	run := &Stats{
+		AcceptedRows:  7,
+		RejectedRows:  2,
+		RejectReasons: map[string]int64{"INVALID_AMOUNT": 2},
+		RejectedPath:  "s3://bucket/rejected/run/",
+		Files: map[string]FileStats{
+			"input/august.csv":    {SourceRows: 5, AcceptedRows: 3, RejectedRows: 2, IDChecksum: 6},
+			"input/september.csv": {SourceRows: 4, AcceptedRows: 4, IDChecksum: 10},
+		},
+	}
+
+	tests := []struct {
+		name  string
+		stats *Stats
+		key   string
+		files int
+		want  *Stats
+	}{
+		{
+			name:  "no counts",
+			key:   "input/august.csv",
+			files: 2,
+		},
+		{
+			name:  "single file run",
+			stats: run,
+			key:   "input/august.csv",
+			files: 1,
+			want:  run,
+		},
+		{
+			name:  "file with rejected rows",
+			stats: run,
+			key:   "input/august.csv",
+			files: 2,
+			want:  &Stats{AcceptedRows: 3, RejectedRows: 2, RejectedPath: "s3://bucket/rejected/run/"},
+		},
+		{
+			name:  "file without rejected rows",
+			stats: run,
+			key:   "input/september.csv",
+			files: 2,
+			want:  &Stats{AcceptedRows: 4},
+		},
+		{
+			name:  "file not counted",
+			stats: run,
+			key:   "input/october.csv",
+			files: 2,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := test.stats.forFile(test.key, test.files); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("forFile() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
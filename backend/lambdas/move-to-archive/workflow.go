@@ -0,0 +1,353 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"go-cdk-workshop/internal/ingestions"
+	"go-cdk-workshop/internal/ledger"
+	"go-cdk-workshop/internal/logging"
+	"go-cdk-workshop/internal/manifest"
+	"go-cdk-workshop/internal/metrics"
+	"go-cdk-workshop/internal/notify"
+	"go-cdk-workshop/internal/schema"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// The steps of the ingestion workflow run by this lambda.
+const (
+	actionReconcile = "reconcile"
+	actionArchive   = "archive"
+	actionNotify    = "notify"
+)
+
+// The argument of the job run carrying its correlation id, see glue-trigger.
+const correlationArgument = "--correlation_id"
+
+const (
+	// The index of the loaded items by their file and job run.
+	sourceIndex = "sourceKey-jobRunId-index"
+
+	// How many times a file short of items is checked, and how long apart.
+	reconcileAttempts   = 3
+	reconcileRetryDelay = 5 * time.Second
+)
+
+// ReconcileOutput is the outcome of a job run that succeeded, it is failed
+// when a file was not loaded as a whole. Only the files that do not reconcile
+// are moved to the failed folder, see the file ledger.
+type ReconcileOutput struct {
+	State   string `json:"state"`
+	Message string `json:"message"`
+}
+
+// Reconciles each file of the job run: the rows read from the file with the
+// rows the job accepted and rejected, and the accepted rows with the items
+// found in the table, by their number, ids and amounts. The outcome of each
+// file is recorded in the file ledger.
+func reconcile(ctx context.Context, s3Svc s3iface.S3API, dynamoSvc dynamodbiface.DynamoDBAPI, request Request) (ReconcileOutput, error) {
+	stats, err := readStats(ctx, s3Svc, request.Bucket, os.Getenv("STATS_PREFIX"), request.JobRunID)
+	if err != nil {
+		logging.Error("Error getting the row counts of the job run", err)
+		return ReconcileOutput{}, err
+	}
+	if stats == nil {
+		return reconciled(fmt.Sprintf("the job run %s did not record its row counts", request.JobRunID)), nil
+	}
+
+	runManifest, err := manifest.Read(ctx, s3Svc, request.Bucket, request.Manifest)
+	if err != nil {
+		logging.Error("Error reading the manifest of the job run", err)
+		return ReconcileOutput{}, err
+	}
+	missing := []string{}
+	for _, key := range runManifest.Keys() {
+		if _, ok := stats.Files[key]; !ok {
+			missing = append(missing, key)
+		}
+	}
+	if len(missing) > 0 {
+		return reconciled(fmt.Sprintf("the job run %s did not load %s", request.JobRunID, strings.Join(missing, ", "))), nil
+	}
+
+	// The column summed to check the amounts, if the schema has one.
+	var runSchema schema.Schema
+	if err := json.Unmarshal([]byte(request.Arguments["--schema"]), &runSchema); err != nil {
+		logging.Error("Error parsing the schema of the job run", err)
+		return ReconcileOutput{}, err
+	}
+
+	mismatched := []string{}
+	for _, key := range runManifest.Keys() {
+		logFile(runManifest, key)
+		entry, err := reconcileFile(ctx, dynamoSvc, request, runSchema.Amount, key, stats.Files[key])
+		if err != nil {
+			logging.Error("Error reconciling the file", err)
+			return ReconcileOutput{}, err
+		}
+		if err := ledger.Put(ctx, dynamoSvc, os.Getenv("LEDGER_TABLE"), entry); err != nil {
+			logging.Error("Error recording the file in the ledger", err)
+			return ReconcileOutput{}, err
+		}
+		if !entry.Reconciled() {
+			logging.Warn("The file does not reconcile", "mismatches", entry.Mismatches)
+			mismatched = append(mismatched, fmt.Sprintf("%s (%s)", key, strings.Join(entry.Mismatches, ", ")))
+		}
+	}
+	logFile(runManifest, "")
+	if len(mismatched) > 0 {
+		return reconciled(fmt.Sprintf("the job run %s did not load %d of its %d files as a whole: %s", request.JobRunID, len(mismatched), len(runManifest.Files), strings.Join(mismatched, "; "))), nil
+	}
+
+	logging.Info("Reconciled the job run", "acceptedRows", stats.AcceptedRows, "rejectedRows", stats.RejectedRows)
+	return reconciled(""), nil
+}
+
+// Reconciles a file with the items the job run wrote for it. The index of the
+// items is updated shortly after they are written, so a file short of items
+// is checked again a few times before it is reported.
+func reconcileFile(ctx context.Context, dynamoSvc dynamodbiface.DynamoDBAPI, request Request, amountColumn string, key string, counts FileStats) (*ledger.Entry, error) {
+	entry := &ledger.Entry{
+		Key:                    key,
+		JobRunID:               request.JobRunID,
+		Bucket:                 request.Bucket,
+		Manifest:               request.Manifest,
+		Table:                  request.Arguments["--table"],
+		SourceRows:             counts.SourceRows,
+		AcceptedRows:           counts.AcceptedRows,
+		RejectedRows:           counts.RejectedRows,
+		ExpectedIDChecksum:     counts.IDChecksum,
+		ExpectedAmountChecksum: counts.AmountChecksum,
+	}
+	if entry.ExpectedAmountChecksum == nil {
+		amountColumn = ""
+	}
+
+	for attempt := 1; ; attempt++ {
+		loaded, err := sumItems(ctx, dynamoSvc, request.Arguments["--table"], request.JobRunID, key, amountColumn)
+		if err != nil {
+			return nil, err
+		}
+		entry.LoadedItems, entry.LoadedIDChecksum = loaded.items, loaded.ids
+		if amountColumn != "" {
+			entry.LoadedAmountChecksum = aws.Int64(loaded.amounts)
+		}
+		entry.Reconcile()
+
+		if entry.Reconciled() || entry.LoadedItems >= entry.AcceptedRows || attempt == reconcileAttempts {
+			return entry, nil
+		}
+		logging.Info("Fewer items than accepted rows, checking the file again", logging.Key, key)
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(reconcileRetryDelay):
+		}
+	}
+}
+
+// The number, the sum of the ids and the sum of the amounts in cents of the
+// items a job run wrote for a file.
+type itemSums struct {
+	items   int64
+	ids     int64
+	amounts int64
+}
+
+// Sums the items a job run wrote to the table for a file, found by the index
+// of their file and job run.
+func sumItems(ctx context.Context, dynamoSvc dynamodbiface.DynamoDBAPI, table string, jobRunID string, key string, amountColumn string) (itemSums, error) {
+	names := map[string]*string{"#id": aws.String("id"), "#run": aws.String("jobRunId"), "#key": aws.String("sourceKey")}
+	projection := "#id"
+	if amountColumn != "" {
+		names["#amount"] = aws.String(amountColumn)
+		projection += ", #amount"
+	}
+
+	sums := itemSums{}
+	var parseErr error
+	err := dynamoSvc.QueryPagesWithContext(ctx, &dynamodb.QueryInput{
+		TableName:                aws.String(table),
+		IndexName:                aws.String(sourceIndex),
+		KeyConditionExpression:   aws.String("#run = :run AND #key = :key"),
+		ProjectionExpression:     aws.String(projection),
+		ExpressionAttributeNames: names,
+		ExpressionAttributeValues: map[string]*dynamodb.AttributeValue{
+			":run": {S: aws.String(jobRunID)},
+			":key": {S: aws.String(key)},
+		},
+	}, func(page *dynamodb.QueryOutput, lastPage bool) bool {
+		for _, item := range page.Items {
+			id, err := strconv.ParseInt(aws.StringValue(item["id"].N), 10, 64)
+			if err != nil {
+				parseErr = fmt.Errorf("invalid id of an item of %s: %w", key, err)
+				return false
+			}
+			sums.items++
+			sums.ids += id
+
+			if value, ok := item[amountColumn]; ok && value.N != nil {
+				amount, err := strconv.ParseFloat(aws.StringValue(value.N), 64)
+				if err != nil {
+					parseErr = fmt.Errorf("invalid amount of an item of %s: %w", key, err)
+					return false
+				}
+				sums.amounts += int64(math.Round(amount * 100))
+			}
+		}
+		return true
+	})
+	if err == nil {
+		err = parseErr
+	}
+	return sums, err
+}
+
+// Returns the outcome of the reconciliation, failed when there is a message.
+func reconciled(message string) ReconcileOutput {
+	if message == "" {
+		return ReconcileOutput{State: glue.JobRunStateSucceeded, Message: ""}
+	}
+	logging.Warn("The job run does not reconcile", "reason", message)
+	return ReconcileOutput{State: glue.JobRunStateFailed, Message: message}
+}
+
+// Returns the job run as seen by a file the reconcile step recorded in the
+// file ledger: succeeded when the file reconciles, failed with its mismatches
+// otherwise. The run is returned as is when the file was not reconciled.
+func reconciledRun(ctx context.Context, dynamoSvc dynamodbiface.DynamoDBAPI, run *glue.JobRun, key string) (*glue.JobRun, *ledger.Entry, error) {
+	table := os.Getenv("LEDGER_TABLE")
+	if table == "" || aws.StringValue(run.Id) == "" {
+		return run, nil, nil
+	}
+	entry, err := ledger.Get(ctx, dynamoSvc, table, key, aws.StringValue(run.Id))
+	if err != nil || entry == nil {
+		return run, nil, err
+	}
+
+	fileRun := *run
+	fileRun.JobRunState = aws.String(glue.JobRunStateSucceeded)
+	fileRun.ErrorMessage = nil
+	if !entry.Reconciled() {
+		fileRun.JobRunState = aws.String(glue.JobRunStateFailed)
+		fileRun.ErrorMessage = aws.String("the file does not reconcile: " + strings.Join(entry.Mismatches, ", "))
+	}
+	return &fileRun, entry, nil
+}
+
+// Returns the message of the failure passed by the workflow. A step that
+// failed passes the cause of its error, which is the error of the lambda as
+// JSON, the message is then taken out of it.
+func failureMessage(cause string) string {
+	var lambdaError struct {
+		ErrorMessage string `json:"errorMessage"`
+	}
+	if err := json.Unmarshal([]byte(cause), &lambdaError); err == nil && lambdaError.ErrorMessage != "" {
+		return lambdaError.ErrorMessage
+	}
+	return cause
+}
+
+// Lets the operators know how the ingestion of the files went. The files have
+// been moved already, so a failed notification is logged rather than retried.
+func notifyAll(ctx context.Context, mySession *session.Session, events []notify.Event) error {
+	notifier, err := notify.FromEnv(mySession)
+	if err != nil {
+		return err
+	}
+
+	for _, event := range events {
+		logging.Info("Sending the ingestion notification", "type", event.Type)
+		if err := notifier.Notify(ctx, event); err != nil {
+			logging.Error("Error sending the ingestion notification", err)
+		}
+	}
+	return nil
+}
+
+// Records the outcome of a file for the status API. The file has been moved
+// already, so a failure is only logged. The runs started before the
+// manifests were not recorded.
+func recordFile(ctx context.Context, dynamoSvc *dynamodb.DynamoDB, manifestKey string, event *notify.Event) {
+	if manifestKey == "" {
+		return
+	}
+
+	file := &ingestions.File{
+		Key:            event.Key,
+		State:          ingestions.StateLoaded,
+		DestinationKey: event.DestinationKey,
+		ErrorMessage:   event.ErrorMessage,
+		DiagnosticsKey: event.DiagnosticsKey,
+		FinishedAt:     &event.Time,
+	}
+	if event.Type == notify.IngestionFailed {
+		file.State = ingestions.StateFailed
+	}
+	if event.Rows != nil {
+		file.AcceptedRows = aws.Int64(event.Rows.Accepted)
+		file.RejectedRows = aws.Int64(event.Rows.Rejected)
+	}
+	if err := ingestions.SetFile(ctx, dynamoSvc, os.Getenv("INGESTIONS_TABLE"), manifest.IDOf(manifestKey), file); err != nil {
+		logging.Error("Error recording the outcome of the file", err)
+	}
+}
+
+// Sets the context of the logs of a step of the ingestion workflow.
+func logWorkflow(request Request) {
+	logging.Set(logging.IngestionID, manifest.IDOf(request.Manifest))
+	logging.Set(logging.CorrelationID, request.Arguments[correlationArgument])
+	logging.Set(logging.JobRunID, request.JobRunID)
+	logging.Set(logging.Bucket, request.Bucket)
+}
+
+// Sets the file of the manifest the logs are about, and its correlation id.
+// An empty key goes back to the job run as a whole.
+func logFile(runManifest *manifest.Manifest, key string) {
+	logging.Set(logging.Key, key)
+	if runManifest == nil {
+		return
+	}
+	if key == "" {
+		logging.Set(logging.CorrelationID, runManifest.CorrelationID())
+		return
+	}
+	logging.Set(logging.CorrelationID, runManifest.CorrelationIDOf(key))
+}
+
+// Emits the metrics of a file moved by the archive step: where it was moved,
+// and how many of its rows were loaded and rejected.
+func emitMetrics(prefix string, event *notify.Event) {
+	moved := metrics.Count(metrics.FilesArchived, 1)
+	if event.Type == notify.IngestionFailed {
+		moved = metrics.Count(metrics.FilesFailed, 1)
+	}
+	values := []metrics.Metric{moved}
+	if event.Rows != nil {
+		values = append(values, metrics.Count(metrics.RowsLoaded, event.Rows.Accepted), metrics.Count(metrics.RowsRejected, event.Rows.Rejected))
+	}
+	metrics.Emit(prefix, values...)
+}
+
+// Records the outcome of the ingestion once all its files are archived, a
+// failure is only logged.
+func recordOutcome(ctx context.Context, dynamoSvc *dynamodb.DynamoDB, manifestKey string) {
+	if manifestKey == "" {
+		return
+	}
+	if err := ingestions.Finish(ctx, dynamoSvc, os.Getenv("INGESTIONS_TABLE"), manifest.IDOf(manifestKey)); err != nil {
+		logging.Error("Error recording the outcome of the ingestion", err)
+	}
+}
@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+
+	"go-cdk-workshop/internal/ledger"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbattribute"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/glue"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+// fakeS3 serves the row counts and manifests of the job runs.
+type fakeS3 struct {
+	s3iface.S3API
+	objects map[string]string
+}
+
+func (f *fakeS3) GetObjectWithContext(ctx aws.Context, input *s3.GetObjectInput, options ...request.Option) (*s3.GetObjectOutput, error) {
+	content, ok := f.objects[aws.StringValue(input.Key)]
+	if !ok {
+		return nil, awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil)
+	}
+	return &s3.GetObjectOutput{Body: io.NopCloser(strings.NewReader(content))}, nil
+}
+
+// fakeDynamo holds the items loaded for each file, returned a page per item
+// by the index of their file, and the entries of the file ledger.
+type fakeDynamo struct {
+	dynamodbiface.DynamoDBAPI
+	items  map[string][]map[string]*dynamodb.AttributeValue
+	ledger map[string]map[string]*dynamodb.AttributeValue
+}
+
+func (f *fakeDynamo) QueryPagesWithContext(ctx aws.Context, input *dynamodb.QueryInput, fn func(*dynamodb.QueryOutput, bool) bool, options ...request.Option) error {
+	items := f.items[aws.StringValue(input.ExpressionAttributeValues[":key"].S)]
+	for i, item := range items {
+		if !fn(&dynamodb.QueryOutput{Items: []map[string]*dynamodb.AttributeValue{item}}, i == len(items)-1) {
+			break
+		}
+	}
+	return nil
+}
+
+func (f *fakeDynamo) PutItemWithContext(ctx aws.Context, input *dynamodb.PutItemInput, options ...request.Option) (*dynamodb.PutItemOutput, error) {
+	f.ledger[aws.StringValue(input.Item["key"].S)+" "+aws.StringValue(input.Item["jobRunId"].S)] = input.Item
+	return &dynamodb.PutItemOutput{}, nil
+}
+
+func (f *fakeDynamo) GetItemWithContext(ctx aws.Context, input *dynamodb.GetItemInput, options ...request.Option) (*dynamodb.GetItemOutput, error) {
+	return &dynamodb.GetItemOutput{Item: f.ledger[aws.StringValue(input.Key["key"].S)+" "+aws.StringValue(input.Key["jobRunId"].S)]}, nil
+}
+
+// Returns a loaded item with its id, and its amount when there is one.
+func itemOf(id string, amount string) map[string]*dynamodb.AttributeValue {
+	item := map[string]*dynamodb.AttributeValue{"id": {N: aws.String(id)}}
+	if amount != "" {
+		item["transactionAmount"] = &dynamodb.AttributeValue{N: aws.String(amount)}
+	}
+	return item
+}
+
+func TestSumItems(t *testing.T) {
+	tests := []struct {
+		name         string
+		items        []map[string]*dynamodb.AttributeValue
+		amountColumn string
+		want         itemSums
+		wantErr      bool
+	}{
+		{
+			name:         "ids and amounts",
+			items:        []map[string]*dynamodb.AttributeValue{itemOf("1", "19.99"), itemOf("2", "0.1"), itemOf("4", "-5")},
+			amountColumn: "transactionAmount",
+			want:         itemSums{items: 3, ids: 7, amounts: 1509},
+		},
+		{
+			name:         "item without an amount",
+			items:        []map[string]*dynamodb.AttributeValue{itemOf("1", "19.99"), itemOf("2", "")},
+			amountColumn: "transactionAmount",
+			want:         itemSums{items: 2, ids: 3, amounts: 1999},
+		},
+		{
+			name:  "schema without an amount column",
+			items: []map[string]*dynamodb.AttributeValue{itemOf("1", "19.99"), itemOf("2", "0.1")},
+			want:  itemSums{items: 2, ids: 3},
+		},
+		{
+			name:         "no items",
+			amountColumn: "transactionAmount",
+		},
+		{
+			name:    "invalid id",
+			items:   []map[string]*dynamodb.AttributeValue{itemOf("1", ""), itemOf("1.5", "")},
+			wantErr: true,
+		},
+		{
+			name:         "invalid amount",
+			items:        []map[string]*dynamodb.AttributeValue{itemOf("1", "ten")},
+			amountColumn: "transactionAmount",
+			wantErr:      true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			client := &fakeDynamo{items: map[string][]map[string]*dynamodb.AttributeValue{"input/august.csv": test.items}}
+			got, err := sumItems(context.Background(), client, "transactions", "jr_1", "input/august.csv", test.amountColumn)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("sumItems() error = %v, want error %v", err, test.wantErr)
+			}
+			if err == nil && got != test.want {
+				t.Errorf("sumItems() = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestReconcile(t *testing.T) {
+	t.Setenv("STATS_PREFIX", "stats/")
+	t.Setenv("LEDGER_TABLE", "ledger")
+
+	runManifest := `{"id": "m1", "files": [{"key": "input/august.csv"}, {"key": "input/september.csv"}]}`
+	stats := `{"acceptedRows": 3, "rejectedRows": 1, "files": {
+		"input/august.csv": {"sourceRows": 3, "acceptedRows": 2, "rejectedRows": 1, "idChecksum": 3, "amountChecksum": 1500},
+		"input/september.csv": {"sourceRows": 1, "acceptedRows": 1, "idChecksum": 7, "amountChecksum": 250}}}`
+	loaded := map[string][]map[string]*dynamodb.AttributeValue{
+		"input/august.csv":    {itemOf("1", "10"), itemOf("2", "5")},
+		"input/september.csv": {itemOf("7", "2.5")},
+	}
+
+	tests := []struct {
+		name       string
+		objects    map[string]string
+		items      map[string][]map[string]*dynamodb.AttributeValue
+		want       ReconcileOutput
+		wantLedger map[string]string
+	}{
+		{
+			name:       "every file loaded as a whole",
+			objects:    map[string]string{"stats/jr_1.json": stats, "manifests/m1.json": runManifest},
+			items:      loaded,
+			want:       ReconcileOutput{State: glue.JobRunStateSucceeded},
+			wantLedger: map[string]string{"input/august.csv": ledger.StatusReconciled, "input/september.csv": ledger.StatusReconciled},
+		},
+		{
+			name:    "item of another file",
+			objects: map[string]string{"stats/jr_1.json": stats, "manifests/m1.json": runManifest},
+			items: map[string][]map[string]*dynamodb.AttributeValue{
+				"input/august.csv":    {itemOf("1", "10"), itemOf("5", "5")},
+				"input/september.csv": loaded["input/september.csv"],
+			},
+			want: ReconcileOutput{
+				State:   glue.JobRunStateFailed,
+				Message: "the job run jr_1 did not load 1 of its 2 files as a whole: input/august.csv (id checksum 3, 6 loaded)",
+			},
+			wantLedger: map[string]string{"input/august.csv": ledger.StatusMismatched, "input/september.csv": ledger.StatusReconciled},
+		},
+		{
+			name:    "no row counts",
+			objects: map[string]string{"manifests/m1.json": runManifest},
+			want: ReconcileOutput{
+				State:   glue.JobRunStateFailed,
+				Message: "the job run jr_1 did not record its row counts",
+			},
+			wantLedger: map[string]string{},
+		},
+		{
+			name: "file not counted",
+			objects: map[string]string{
+				"stats/jr_1.json":   `{"files": {"input/august.csv": {"sourceRows": 1, "acceptedRows": 1, "idChecksum": 1}}}`,
+				"manifests/m1.json": runManifest,
+			},
+			want: ReconcileOutput{
+				State:   glue.JobRunStateFailed,
+				Message: "the job run jr_1 did not load input/september.csv",
+			},
+			wantLedger: map[string]string{},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dynamo := &fakeDynamo{items: test.items, ledger: map[string]map[string]*dynamodb.AttributeValue{}}
+			request := Request{
+				Bucket:   "bucket",
+				Manifest: "manifests/m1.json",
+				JobRunID: "jr_1",
+				Arguments: map[string]string{
+					"--table":  "transactions",
+					"--schema": `{"name": "transactions", "version": 1, "columns": [], "amount": "transactionAmount"}`,
+				},
+			}
+
+			got, err := reconcile(context.Background(), &fakeS3{objects: test.objects}, dynamo, request)
+			if err != nil {
+				t.Fatalf("reconcile() error = %v", err)
+			}
+			if got != test.want {
+				t.Errorf("reconcile() = %+v, want %+v", got, test.want)
+			}
+
+			statuses := map[string]string{}
+			for _, item := range dynamo.ledger {
+				statuses[aws.StringValue(item["key"].S)] = aws.StringValue(item["status"].S)
+			}
+			if !reflect.DeepEqual(statuses, test.wantLedger) {
+				t.Errorf("reconcile() recorded %v, want %v", statuses, test.wantLedger)
+			}
+		})
+	}
+}
+
+func TestReconciledRun(t *testing.T) {
+	reconciledEntry, err := dynamodbattribute.MarshalMap(ledger.Entry{Key: "input/august.csv", JobRunID: "jr_1", Status: ledger.StatusReconciled})
+	if err != nil {
+		t.Fatal(err)
+	}
+	mismatchedEntry, err := dynamodbattribute.MarshalMap(ledger.Entry{
+		Key:        "input/september.csv",
+		JobRunID:   "jr_1",
+		Status:     ledger.StatusMismatched,
+		Mismatches: []string{"2 rows accepted, 1 items loaded", "id checksum 3, 1 loaded"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dynamo := &fakeDynamo{ledger: map[string]map[string]*dynamodb.AttributeValue{
+		"input/august.csv jr_1":    reconciledEntry,
+		"input/september.csv jr_1": mismatchedEntry,
+	}}
+	run := &glue.JobRun{Id: aws.String("jr_1"), JobRunState: aws.String(glue.JobRunStateSucceeded)}
+
+	tests := []struct {
+		name        string
+		table       string
+		run         *glue.JobRun
+		key         string
+		wantState   string
+		wantMessage string
+		wantEntry   bool
+	}{
+		{
+			name:      "file reconciled",
+			table:     "ledger",
+			run:       run,
+			key:       "input/august.csv",
+			wantState: glue.JobRunStateSucceeded,
+			wantEntry: true,
+		},
+		{
+			name:        "file not reconciled",
+			table:       "ledger",
+			run:         run,
+			key:         "input/september.csv",
+			wantState:   glue.JobRunStateFailed,
+			wantMessage: "the file does not reconcile: 2 rows accepted, 1 items loaded, id checksum 3, 1 loaded",
+			wantEntry:   true,
+		},
+		{
+			name:        "file not in the ledger",
+			table:       "ledger",
+			run:         &glue.JobRun{Id: aws.String("jr_1"), JobRunState: aws.String(glue.JobRunStateFailed), ErrorMessage: aws.String("Out of memory")},
+			key:         "input/october.csv",
+			wantState:   glue.JobRunStateFailed,
+			wantMessage: "Out of memory",
+		},
+		{
+			name:      "no ledger",
+			run:       run,
+			key:       "input/september.csv",
+			wantState: glue.JobRunStateSucceeded,
+		},
+		{
+			name:      "run without an id",
+			table:     "ledger",
+			run:       &glue.JobRun{JobRunState: aws.String(glue.JobRunStateSucceeded)},
+			key:       "input/september.csv",
+			wantState: glue.JobRunStateSucceeded,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			t.Setenv("LEDGER_TABLE", test.table)
+			got, entry, err := reconciledRun(context.Background(), dynamo, test.run, test.key)
+			if err != nil {
+				t.Fatalf("reconciledRun() error = %v", err)
+			}
+			if state := aws.StringValue(got.JobRunState); state != test.wantState {
+				t.Errorf("reconciledRun() state = %q, want %q", state, test.wantState)
+			}
+			if message := aws.StringValue(got.ErrorMessage); message != test.wantMessage {
+				t.Errorf("reconciledRun() message = %q, want %q", message, test.wantMessage)
+			}
+			if (entry != nil) != test.wantEntry {
+				t.Errorf("reconciledRun() entry = %+v, want an entry %v", entry, test.wantEntry)
+			}
+		})
+	}
+}
+
+func TestFailureMessage(t *testing.T) {
+	tests := []struct {
+		name  string
+		cause string
+		want  string
+	}{
+		{
+			name:  "error of a lambda",
+			cause: `{"errorMessage":"the manifest cannot be read","errorType":"errorString"}`,
+			want:  "the manifest cannot be read",
+		},
+		{
+			name:  "JSON without a message",
+			cause: `{"errorType":"Lambda.Unknown"}`,
+			want:  `{"errorType":"Lambda.Unknown"}`,
+		},
+		{
+			name:  "plain text",
+			cause: "The Glue job run failed",
+			want:  "The Glue job run failed",
+		},
+		{
+			name: "empty cause",
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if got := failureMessage(test.cause); got != test.want {
+				t.Errorf("failureMessage(%q) = %q, want %q", test.cause, got, test.want)
+			}
+		})
+	}
+}
@@ -10,8 +10,9 @@
 # Copyright 2023 Kyle Lierer. All Rights Reserved.
 #
 
-# Gets the stack name from the CLI
+# Gets the stack name and the optional stage (dev, staging or prod) from the CLI
 STACK_NAME=$1
+STAGE=${2:-dev}
 
 # Defines a few colors for use in the script
 RED='\033[0;31m'
@@ -22,7 +23,7 @@ NC='\033[0m'
 # If no stack name is provided, exit
 if [ -z "$STACK_NAME" ]; then
     echo -e "${RED}No stack name provided!${NC}"
-    echo -e "${RED}Usage: ./deploy.sh <stack-name>${NC}"
+    echo -e "${RED}Usage: ./deploy.sh <stack-name> [stage]${NC}"
     exit 1
 fi
 
@@ -36,7 +37,7 @@ fi
 # Deploy the CDK stack to the AWS account/region
 echo -e "${BLUE}Deploying the CDK workshop stack...${NC}"
 cd backend
-cdk deploy -c name=$STACK_NAME --outputs-file ./outputs.json
+cdk deploy -c name=$STACK_NAME -c stage=$STAGE --outputs-file ./outputs.json
 
 if [ $? -ne 0 ]; then
     echo -e "${RED}CDK stack deployment failed!${NC}"
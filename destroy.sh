@@ -8,8 +8,9 @@
 # Copyright 2023 Kyle Lierer. All Rights Reserved.
 #
 
-# Gets the stack name from the CLI
+# Gets the stack name and the optional stage (dev, staging or prod) from the CLI
 STACK_NAME=$1
+STAGE=${2:-dev}
 
 # Defines a few colors for use in the script
 RED='\033[0;31m'
@@ -20,5 +21,5 @@ NC='\033[0m'
 # Deploy the CDK stack to the AWS account/region
 echo -e "${BLUE}Destroying the CDK workshop stack...${NC}"
 cd backend
-cdk destroy -c name=$STACK_NAME
+cdk destroy -c name=$STACK_NAME -c stage=$STAGE
 echo -e "${GREEN}CDK stack destroy!${NC}"
\ No newline at end of file
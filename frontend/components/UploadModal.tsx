@@ -0,0 +1,71 @@
+import { AttachmentIcon } from '@chakra-ui/icons';
+import { Button, FormControl, FormHelperText, FormLabel, Heading, Input, Modal, ModalBody, ModalCloseButton, ModalContent, ModalFooter, ModalHeader, ModalOverlay, Stack, Tag, Text, useDisclosure } from "@chakra-ui/react";
+import { useEffect, useState } from 'react';
+import { Ingestion } from '../types/types';
+import { getIngestion, uploadFile } from "../utilities/ingestion";
+
+// The states an ingestion does not leave.
+const finalStates = ['LOADED', 'PARTIALLY_LOADED', 'FAILED', 'SKIPPED'];
+
+export default function UploadModal() {
+    const { isOpen, onOpen, onClose } = useDisclosure()
+    const [file, setFile] = useState<File | null>(null)
+    const [uploading, setUploading] = useState(false)
+    const [uploadId, setUploadId] = useState('')
+    const [ingestion, setIngestion] = useState<Ingestion | null>(null)
+    const [error, setError] = useState('')
+
+    const handleUploadClick = () => {
+        setUploading(true)
+        setUploadId('')
+        setIngestion(null)
+        setError('')
+        uploadFile(file!)
+            .then((upload) => setUploadId(upload.id))
+            .catch((error) => setError(error.response?.data?.message ?? error.message))
+            .finally(() => setUploading(false))
+    }
+
+    // Follow the ingestion of the uploaded file until it is loaded or failed.
+    useEffect(() => {
+        if (!uploadId || (ingestion && finalStates.includes(ingestion.state))) {
+            return
+        }
+        const timer = setTimeout(() => getIngestion(uploadId, setIngestion), 5000)
+        return () => clearTimeout(timer)
+    }, [uploadId, ingestion])
+
+    return (
+        <>
+            <Button size='sm' colorScheme={'gray'} leftIcon={<AttachmentIcon />} marginRight={2} onClick={onOpen}>Upload File</Button>
+
+            <Modal onClose={onClose} size={'xl'} isOpen={isOpen}>
+                <ModalOverlay />
+                <ModalContent>
+                    <ModalHeader>
+                        <Heading size="lg">Upload File</Heading>
+                    </ModalHeader>
+                    <ModalCloseButton />
+                    <ModalBody>
+                        <Stack spacing={3}>
+                            <FormControl>
+                                <FormLabel>File</FormLabel>
+                                <Input type='file' paddingTop={1} onChange={(e) => setFile(e.target.files?.[0] ?? null)} />
+                                <FormHelperText>The file is loaded by the ingestion rule of input/.</FormHelperText>
+                            </FormControl>
+                            {uploadId && (
+                                <Text>Ingestion {uploadId}: <Tag>{ingestion?.state ?? 'PENDING'}</Tag></Text>
+                            )}
+                            {ingestion?.errorMessage && <Text color='red.500'>{ingestion.errorMessage}</Text>}
+                            {error && <Text color='red.500'>{error}</Text>}
+                        </Stack>
+                    </ModalBody>
+                    <ModalFooter>
+                        <Button colorScheme='blue' marginRight={3} isDisabled={!file} isLoading={uploading} onClick={handleUploadClick}>Upload</Button>
+                        <Button onClick={onClose}>Close</Button>
+                    </ModalFooter>
+                </ModalContent>
+            </Modal>
+        </>
+    )
+}
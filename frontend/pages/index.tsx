@@ -2,6 +2,7 @@ import { Button, Container, Fade, Flex, Heading, Select, Spinner, Table, TableCo
 import { useEffect, useState } from 'react'
 import FilterModal from '../components/FilterModal';
 import TransactionRow from '../components/TransactionModal';
+import UploadModal from '../components/UploadModal';
 import { Transaction, TransactionQueryResponse } from '../types/types'
 import { getTransactions } from '../utilities/transaction';
 
@@ -32,6 +33,7 @@ export default function Home() {
     <Container paddingTop={10} maxW="container.xl">
       <Heading as="h1" size="xl" marginBottom={10}>Bank Transactions</Heading>
       <Flex alignItems="center" justify={"right"}>
+        <UploadModal />
         <FilterModal filter={filter} onFilterChange={setFilter} />
       </Flex>
       <Flex alignItems="center" justify={"space-between"} marginBottom={5}>
@@ -29,4 +29,71 @@ export type Transaction = {
     cardPresent: string;
     isFraud: string;
     countryCode: string;
-};
\ No newline at end of file
+};
+export type IngestionState = 'PENDING' | 'QUEUED' | 'RUNNING' | 'LOADED' | 'PARTIALLY_LOADED' | 'FAILED' | 'SKIPPED';
+
+export type IngestionQueryResponse = {
+    items: Ingestion[];
+    count: number;
+    paginationToken: string;
+  }
+
+export type Ingestion = {
+    id: string;
+    bucket: string;
+    manifest: string;
+    rule?: string;
+    schema?: string;
+    format?: string;
+    state: IngestionState;
+    jobName?: string;
+    jobRunId?: string;
+    keys: string[];
+    files: IngestionFile[];
+    acceptedRows: number;
+    rejectedRows: number;
+    errorMessage?: string;
+    day: string;
+    createdAt: string;
+    startedAt?: string;
+    finishedAt?: string;
+    updatedAt: string;
+};
+
+export type IngestionFile = {
+    key: string;
+    size: number;
+    state: IngestionState;
+    destinationKey?: string;
+    acceptedRows?: number;
+    rejectedRows?: number;
+    errorMessage?: string;
+    diagnosticsKey?: string;
+    finishedAt?: string;
+};
+
+export type UploadRequest = {
+    fileName: string;
+    contentType?: string;
+    size: number;
+    rule?: string;
+    schema?: string;
+};
+
+export type UploadResponse = {
+    id: string;
+    statusUrl: string;
+    bucket: string;
+    key: string;
+    expiresAt: string;
+    method?: string;
+    url?: string;
+    headers?: { [name: string]: string };
+    multipart?: {
+        uploadId: string;
+        partSize: number;
+        parts: { partNumber: number; url: string }[];
+        completeUrl: string;
+        abortUrl: string;
+    };
+};
@@ -0,0 +1,67 @@
+import axios from 'axios';
+import { Ingestion, IngestionQueryResponse, UploadRequest, UploadResponse } from '../types/types';
+
+function getIngestions(filter: { [key: string]: any }, callback: (ingestions: IngestionQueryResponse) => void) {
+    axios.get(`${process.env.API_ENDPOINT}/ingestions`, { params: filter })
+        .then(response => {
+            callback(response.data);
+        });
+}
+
+function getIngestion(id: string, callback: (ingestion: Ingestion) => void) {
+    axios.get(`${process.env.API_ENDPOINT}/ingestions/${id}`)
+        .then(response => {
+            callback(response.data);
+        });
+}
+
+function createUpload(upload: UploadRequest) {
+    return axios.post<UploadResponse>(`${process.env.API_ENDPOINT}/uploads`, upload)
+        .then(response => response.data);
+}
+
+// Sends a file to the URL of a single part upload, with the signed headers.
+// The browser sets the content length itself.
+function putFile(upload: UploadResponse, file: File) {
+    const headers = { ...upload.headers };
+    delete headers['content-length'];
+    return axios.put(upload.url!, file, { headers });
+}
+
+// Sends the parts of a large file to their URLs, then completes the upload
+// with the ETags of the parts. The upload is aborted when a part fails, so
+// its parts are not kept until the bucket cleans them up.
+async function putParts(upload: UploadResponse, file: File) {
+    const multipart = upload.multipart!;
+    try {
+        const etags: string[] = [];
+        for (const part of multipart.parts) {
+            const start = (part.partNumber - 1) * multipart.partSize;
+            const response = await axios.put(part.url, file.slice(start, start + multipart.partSize));
+            etags.push(response.headers['etag']);
+        }
+        const parts = multipart.parts.map((part, i) =>
+            `<Part><PartNumber>${part.partNumber}</PartNumber><ETag>${etags[i]}</ETag></Part>`
+        );
+        await axios.post(multipart.completeUrl, `<CompleteMultipartUpload>${parts.join('')}</CompleteMultipartUpload>`, {
+            headers: { 'content-type': 'application/xml' },
+        });
+    } catch (error) {
+        await axios.delete(multipart.abortUrl).catch(() => undefined);
+        throw error;
+    }
+}
+
+// Uploads a file through the upload route, in parts when it is large, and
+// returns the upload whose id the ingestion is followed with.
+async function uploadFile(file: File, rule?: string) {
+    const upload = await createUpload({ fileName: file.name, contentType: file.type || undefined, size: file.size, rule });
+    if (upload.multipart) {
+        await putParts(upload, file);
+    } else {
+        await putFile(upload, file);
+    }
+    return upload;
+}
+
+export { getIngestions, getIngestion, createUpload, putFile, putParts, uploadFile };